@@ -1,11 +1,18 @@
 package gokonfi
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // Declaration of all built-in functions. Whatever we add here
@@ -13,22 +20,331 @@ import (
 //
 // Keep sorted alphabetically.
 var builtinFunctions = []*NativeFuncVal{
+	{Name: "abs", Arity: 1, F: builtinAbs},
+	{Name: "all", Arity: 2, F: builtinAll},
+	{Name: "any", Arity: 2, F: builtinAny},
+	{Name: "assert_type", Arity: 2, F: builtinAssertType},
+	{Name: "between", Arity: 3, F: builtinBetween},
+	{Name: "ceil", Arity: 1, F: builtinCeil},
+	{Name: "center", Arity: -1, F: builtinCenter},
+	{Name: "chars", Arity: 1, F: builtinChars},
+	{Name: "chr", Arity: 1, F: builtinChr},
+	{Name: "clamp", Arity: 3, F: builtinClamp},
+	{Name: "coalesce", Arity: -1, F: builtinCoalesce},
+	{Name: "concat", Arity: -1, F: builtinConcat},
 	{Name: "cond", Arity: 3, F: builtinCond},
 	{Name: "contains", Arity: 2, F: builtinContains},
+	{Name: "count", Arity: 2, F: builtinCount},
+	{Name: "deep_get", Arity: 3, F: builtinDeepGet},
+	{Name: "deep_set", Arity: 3, F: builtinDeepSet},
+	{Name: "default", Arity: 2, F: builtinDefault},
+	{Name: "drop", Arity: 2, F: builtinDrop},
+	{Name: "endswith", Arity: 2, F: builtinEndswith},
+	{Name: "entries", Arity: 1, F: builtinEntries},
 	{Name: "error", Arity: 1, F: builtinError},
 	{Name: "flatmap", Arity: 2, F: builtinFlatmap},
+	{Name: "flatten_paths", Arity: 1, F: builtinFlattenPaths},
+	{Name: "floor", Arity: 1, F: builtinFloor},
 	{Name: "fold", Arity: -1, F: builtinFold},
+	{Name: "fold_right", Arity: -1, F: builtinFoldRight},
 	{Name: "format", Arity: -1, F: builtinFormat},
+	{Name: "format_time", Arity: 2, F: builtinFormatTime},
+	{Name: "from_json", Arity: 1, F: builtinFromJson},
+	{Name: "get", Arity: 3, F: builtinGet},
+	{Name: "getenv", Arity: -1, F: builtinGetenv},
+	{Name: "has", Arity: 2, F: builtinHas},
+	{Name: "indexof", Arity: 2, F: builtinIndexof},
+	{Name: "is_type", Arity: 2, F: builtinIsType},
 	{Name: "isnil", Arity: 1, F: builtinIsnil},
+	{Name: "iterate", Arity: 3, F: builtinIterate},
+	{Name: "join", Arity: 2, F: builtinJoin},
 	{Name: "len", Arity: 1, F: builtinLen},
+	{Name: "lines", Arity: 1, F: builtinLines},
+	{Name: "ljust", Arity: -1, F: builtinLjust},
+	{Name: "lower", Arity: 1, F: builtinLower},
 	{Name: "lptime", Arity: 1, F: builtinLenientParseTime},
-	{Name: "load", Arity: 1, F: builtinLoad},
+	{Name: "load", Arity: -1, F: builtinLoad},
+	{Name: "map_keys", Arity: 2, F: builtinMapKeys},
+	{Name: "map_values", Arity: 2, F: builtinMapValues},
+	{Name: "max", Arity: -1, F: builtinMax},
+	{Name: "merge", Arity: -1, F: builtinMerge},
+	{Name: "min", Arity: -1, F: builtinMin},
 	{Name: "mkrec", Arity: -1, F: builtinMkrec},
+	{Name: "normalize_unit", Arity: 1, F: builtinNormalizeUnit},
+	{Name: "now", Arity: 0, F: builtinNow},
+	{Name: "ord", Arity: 1, F: builtinOrd},
+	{Name: "parse_double", Arity: 1, F: builtinParseDouble},
+	{Name: "parse_int", Arity: -1, F: builtinParseInt},
+	{Name: "partition", Arity: 2, F: builtinPartition},
 	{Name: "pcall", Arity: -1, F: builtinPcall},
+	{Name: "pow", Arity: 2, F: builtinPow},
+	{Name: "pretty", Arity: 1, F: builtinPretty},
 	{Name: "regexp_extract", Arity: -1, F: builtinRegexpExtract},
+	{Name: "regexp_find_all", Arity: 2, F: builtinRegexpFindAll},
+	{Name: "regexp_match", Arity: 2, F: builtinRegexpMatch},
+	{Name: "repeat", Arity: 2, F: builtinRepeat},
+	{Name: "replace", Arity: 3, F: builtinReplace},
+	{Name: "rjust", Arity: -1, F: builtinRjust},
+	{Name: "round", Arity: 1, F: builtinRound},
+	{Name: "select", Arity: 2, F: builtinSelect},
+	{Name: "slice", Arity: 3, F: builtinSlice},
+	{Name: "split", Arity: 2, F: builtinSplit},
+	{Name: "sqrt", Arity: 1, F: builtinSqrt},
+	{Name: "startswith", Arity: 2, F: builtinStartswith},
 	{Name: "str", Arity: 1, F: builtinStr},
 	{Name: "substr", Arity: 3, F: builtinSubstr},
+	{Name: "sum", Arity: 1, F: builtinSum},
+	{Name: "take", Arity: 2, F: builtinTake},
+	{Name: "time_diff", Arity: 2, F: builtinTimeDiff},
+	{Name: "to_json", Arity: 1, F: builtinToJson},
+	{Name: "trim", Arity: -1, F: builtinTrim},
+	{Name: "trimspace", Arity: 1, F: builtinTrimspace},
+	{Name: "try", Arity: 2, F: builtinTry},
 	{Name: "typeof", Arity: 1, F: builtinTypeof},
+	{Name: "unique", Arity: 1, F: builtinUnique},
+	{Name: "unlines", Arity: 1, F: builtinUnlines},
+	{Name: "upper", Arity: 1, F: builtinUpper},
+	{Name: "without", Arity: -1, F: builtinWithout},
+	{Name: "zip", Arity: 2, F: builtinZip},
+	{Name: "zip_with", Arity: 3, F: builtinZipWith},
+}
+
+// abs(x number) number
+func builtinAbs(args []Val, ctx *Ctx) (Val, error) {
+	switch x := args[0].(type) {
+	case IntVal:
+		if x < 0 {
+			return -x, nil
+		}
+		return x, nil
+	case DoubleVal:
+		return DoubleVal(math.Abs(float64(x))), nil
+	case UnitVal:
+		return UnitVal{V: math.Abs(x.V), F: x.F, T: x.T}, nil
+	}
+	return nil, fmt.Errorf("abs: invalid type: %s", args[0].Typ().Id)
+}
+
+// Reports whether pred is true for all elements of xs. Stops at the first element
+// for which pred is false.
+// all(pred func('a)bool, xs []'a) bool
+func builtinAll(args []Val, ctx *Ctx) (Val, error) {
+	pred, xs, err := predAndList("all", args)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range xs.Elements {
+		b, err := pred.Call([]Val{x}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("all: call failed: %w", err)
+		}
+		if !b.Bool() {
+			return BoolVal(false), nil
+		}
+	}
+	return BoolVal(true), nil
+}
+
+// Reports whether pred is true for any element of xs. Stops at the first element
+// for which pred is true.
+// any(pred func('a)bool, xs []'a) bool
+func builtinAny(args []Val, ctx *Ctx) (Val, error) {
+	pred, xs, err := predAndList("any", args)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range xs.Elements {
+		b, err := pred.Call([]Val{x}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("any: call failed: %w", err)
+		}
+		if b.Bool() {
+			return BoolVal(true), nil
+		}
+	}
+	return BoolVal(false), nil
+}
+
+// predAndList returns the predicate and list arguments of the builtin fname.
+func predAndList(fname string, args []Val) (CallableVal, ListVal, error) {
+	pred, ok := args[0].(CallableVal)
+	if !ok {
+		return nil, ListVal{}, fmt.Errorf("%s: 1st argument must be a callable, got %s", fname, args[0].Typ().Id)
+	}
+	xs, ok := args[1].(ListVal)
+	if !ok {
+		return nil, ListVal{}, fmt.Errorf("%s: 2nd argument must be a list, got %s", fname, args[1].Typ().Id)
+	}
+	return pred, xs, nil
+}
+
+// Returns x if it has the given type. Otherwise, raises an error.
+// assert_type(x any, typ string) any
+func builtinAssertType(args []Val, ctx *Ctx) (Val, error) {
+	t, err := typeNameArg("assert_type", args[1], ctx)
+	if err != nil {
+		return nil, err
+	}
+	if args[0].Typ() != t {
+		return nil, fmt.Errorf("assert_type: expected value of type %s, got %s", t.Id, args[0].Typ().Id)
+	}
+	return args[0], nil
+}
+
+// typeNameArg returns the type named by the argument arg of builtin function fname.
+// Names of unit multiples (e.g. "minutes") denote their unit type.
+// It returns an error if arg is not a string or not the name of a known type.
+func typeNameArg(fname string, arg Val, ctx *Ctx) (*Typ, error) {
+	s, ok := arg.(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("%s: 2nd argument must be a string, got %s", fname, arg.Typ().Id)
+	}
+	t := ctx.LookupType(string(s))
+	if t == nil {
+		return nil, fmt.Errorf("%s: unknown type %s", fname, s)
+	}
+	return t, nil
+}
+
+// Returns true if lo <= x <= hi. All arguments must be ints, doubles,
+// or units of the same type.
+// between(x 'a, lo 'a, hi 'a) bool
+func builtinBetween(args []Val, ctx *Ctx) (Val, error) {
+	lo, hi, err := numBounds("between", args)
+	if err != nil {
+		return nil, err
+	}
+	return BoolVal(lo >= 0 && hi <= 0), nil
+}
+
+// ceil(x number) int
+func builtinCeil(args []Val, ctx *Ctx) (Val, error) {
+	return roundToInt("ceil", args[0], math.Ceil)
+}
+
+// center(s string, width int [, fill string]) string
+func builtinCenter(args []Val, ctx *Ctx) (Val, error) {
+	return justify("center", args, func(pad, width int) (int, int) {
+		// Same formula as Python's str.center: if pad is odd, the extra fill
+		// character goes to the left iff width is odd.
+		left := pad/2 + (pad & width & 1)
+		return left, pad - left
+	})
+}
+
+// Returns the characters (runes) of s as a list of strings.
+// chars(s string) []string
+func builtinChars(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("chars: argument must be a string, got %s", args[0].Typ().Id)
+	}
+	result := []Val{}
+	for _, r := range string(s) {
+		result = append(result, StringVal(r))
+	}
+	return ListVal{Elements: result}, nil
+}
+
+// Returns the single-character string for the Unicode code point n.
+// chr(n int) string
+func builtinChr(args []Val, ctx *Ctx) (Val, error) {
+	n, ok := args[0].(IntVal)
+	if !ok {
+		return nil, fmt.Errorf("chr: argument must be an int, got %s", args[0].Typ().Id)
+	}
+	if n < 0 || n > utf8.MaxRune || !utf8.ValidRune(rune(n)) {
+		return nil, fmt.Errorf("chr: invalid code point %d", n)
+	}
+	return StringVal(rune(n)), nil
+}
+
+// Returns x constrained to the interval [lo, hi]. All arguments must be
+// ints, doubles, or units of the same type.
+// clamp(x 'a, lo 'a, hi 'a) 'a
+func builtinClamp(args []Val, ctx *Ctx) (Val, error) {
+	lo, hi, err := numBounds("clamp", args)
+	if err != nil {
+		return nil, err
+	}
+	if lo < 0 {
+		return args[1], nil
+	} else if hi > 0 {
+		return args[2], nil
+	}
+	return args[0], nil
+}
+
+// numBounds compares args[0] to the lower and upper bounds args[1] and args[2].
+func numBounds(name string, args []Val) (lo int, hi int, err error) {
+	if c, err := numCompare(args[1], args[2]); err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", name, err)
+	} else if c > 0 {
+		return 0, 0, fmt.Errorf("%s: lower bound %s is greater than upper bound %s", name, args[1], args[2])
+	}
+	if lo, err = numCompare(args[0], args[1]); err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if hi, err = numCompare(args[0], args[2]); err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return lo, hi, nil
+}
+
+// numCompare returns -1, 0, or 1 if x is less than, equal to, or greater than y.
+// x and y must both be ints, doubles, or units of the same type.
+func numCompare(x, y Val) (int, error) {
+	switch u := x.(type) {
+	case IntVal:
+		if v, ok := y.(IntVal); ok {
+			if u < v {
+				return -1, nil
+			} else if u > v {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case DoubleVal:
+		if v, ok := y.(DoubleVal); ok {
+			if u < v {
+				return -1, nil
+			} else if u > v {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case UnitVal:
+		if v, ok := y.(UnitVal); ok && u.T == v.T {
+			return unitCompare(u, v), nil
+		}
+	}
+	return 0, fmt.Errorf("incompatible types %s and %s", x.Typ().Id, y.Typ().Id)
+}
+
+// Returns the first argument that is not nil, or nil if all arguments are nil.
+// All arguments are evaluated before the call, so coalesce does not short-circuit.
+// coalesce(x any, ...) any
+func builtinCoalesce(args []Val, ctx *Ctx) (Val, error) {
+	for _, arg := range args {
+		if _, ok := arg.(NilVal); !ok {
+			return arg, nil
+		}
+	}
+	return NilVal{}, nil
+}
+
+// Returns the concatenation of all given lists.
+// concat(xs []any, ...) []any
+func builtinConcat(args []Val, ctx *Ctx) (Val, error) {
+	result := []Val{}
+	for i, arg := range args {
+		xs, ok := arg.(ListVal)
+		if !ok {
+			return nil, fmt.Errorf("concat: argument #%d must be a list, got %s", i+1, arg.Typ().Id)
+		}
+		result = append(result, xs.Elements...)
+	}
+	return ListVal{Elements: result}, nil
 }
 
 // cond(b any, x any, y any) any
@@ -51,6 +367,176 @@ func builtinContains(args []Val, ctx *Ctx) (Val, error) {
 	return nil, fmt.Errorf("contains: invalid argument types: (%T, %T)", args[0], args[1])
 }
 
+// Returns the number of elements of xs for which pred is true.
+// count(pred func('a)bool, xs []'a) int
+func builtinCount(args []Val, ctx *Ctx) (Val, error) {
+	pred, xs, err := predAndList("count", args)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, x := range xs.Elements {
+		b, err := pred.Call([]Val{x}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("count: call failed: %w", err)
+		}
+		if b.Bool() {
+			n++
+		}
+	}
+	return IntVal(n), nil
+}
+
+// Returns the value at the dotted path (e.g. "a.b.c") of the record r,
+// or def if any segment of the path is missing.
+// deep_get(r rec, path string, def any) any
+func builtinDeepGet(args []Val, ctx *Ctx) (Val, error) {
+	r, _, path, err := recAndPath("deep_get", args)
+	if err != nil {
+		return nil, err
+	}
+	var v Val = r
+	for _, f := range strings.Split(path, ".") {
+		x, _, ok := asRec(v)
+		if !ok {
+			return args[2], nil
+		}
+		if v, ok = x.Fields[f]; !ok {
+			return args[2], nil
+		}
+	}
+	return v, nil
+}
+
+// Returns a copy of the record r in which the value at the dotted path
+// (e.g. "a.b.c") is set to v. Missing intermediate records are created.
+// Typed records along the path keep their type and must remain valid.
+// deep_set(r rec, path string, v any) rec
+func builtinDeepSet(args []Val, ctx *Ctx) (Val, error) {
+	r, t, path, err := recAndPath("deep_set", args)
+	if err != nil {
+		return nil, err
+	}
+	return deepSet(r, t, strings.Split(path, "."), args[2], path, ctx)
+}
+
+// recAndPath returns the (possibly typed) record and the path given as the
+// first two arguments of builtin function fname.
+func recAndPath(fname string, args []Val) (*RecVal, *Typ, string, error) {
+	r, t, ok := asRec(args[0])
+	if !ok {
+		return nil, nil, "", fmt.Errorf("%s: 1st argument must be a record, got %s", fname, args[0].Typ().Id)
+	}
+	path, ok := args[1].(StringVal)
+	if !ok {
+		return nil, nil, "", fmt.Errorf("%s: 2nd argument must be a string, got %s", fname, args[1].Typ().Id)
+	}
+	return r, t, string(path), nil
+}
+
+// deepSet returns a copy of r with the value at the given path segments set to v.
+// If t is not nil, the copy is a typed record of type t.
+func deepSet(r *RecVal, t *Typ, segments []string, v Val, path string, ctx *Ctx) (Val, error) {
+	f := segments[0]
+	if len(segments) > 1 {
+		inner, it := NewRec(), (*Typ)(nil)
+		if x, found := r.Fields[f]; found {
+			var ok bool
+			if inner, it, ok = asRec(x); !ok {
+				return nil, fmt.Errorf("deep_set: path %s: field %s must be a record, got %s", path, f, x.Typ().Id)
+			}
+		}
+		nv, err := deepSet(inner, it, segments[1:], v, path, ctx)
+		if err != nil {
+			return nil, err
+		}
+		v = nv
+	}
+	result := NewRec()
+	for _, g := range r.FieldNames() {
+		if g == f {
+			// The annotation of the old value does not apply to the new one.
+			result.setField(f, v, nil)
+		} else {
+			result.setField(g, r.Fields[g], r.FieldAnnotations[g])
+		}
+	}
+	if _, ok := r.Fields[f]; !ok {
+		result.setField(f, v, nil)
+	}
+	tv, err := wrapMergedRec(result, t, nil, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("deep_set: path %s: %w", path, err)
+	}
+	return tv, nil
+}
+
+// Returns x if it is not nil, else fallback. Like coalesce, both arguments
+// are evaluated before the call.
+// default(x any, fallback any) any
+func builtinDefault(args []Val, ctx *Ctx) (Val, error) {
+	return builtinCoalesce(args, ctx)
+}
+
+// Returns all but the first n elements of xs, or an empty list if xs has fewer than n elements.
+// drop(n int, xs []any) []any
+func builtinDrop(args []Val, ctx *Ctx) (Val, error) {
+	n, xs, err := countAndList("drop", args)
+	if err != nil {
+		return nil, err
+	}
+	return ListVal{Elements: xs[n:]}, nil
+}
+
+// countAndList validates the (n int, xs list) arguments of take and drop.
+// The returned n is clamped to the length of xs.
+func countAndList(name string, args []Val) (int, []Val, error) {
+	n, ok := args[0].(IntVal)
+	if !ok {
+		return 0, nil, fmt.Errorf("%s: 1st argument must be an int, got %s", name, args[0].Typ().Id)
+	}
+	if n < 0 {
+		return 0, nil, fmt.Errorf("%s: 1st argument must not be negative, got %d", name, n)
+	}
+	xs, ok := args[1].(ListVal)
+	if !ok {
+		return 0, nil, fmt.Errorf("%s: 2nd argument must be a list, got %s", name, args[1].Typ().Id)
+	}
+	if int64(n) > int64(len(xs.Elements)) {
+		return len(xs.Elements), xs.Elements, nil
+	}
+	return int(n), xs.Elements, nil
+}
+
+// endswith(s string, suffix string) bool
+func builtinEndswith(args []Val, ctx *Ctx) (Val, error) {
+	ss, err := stringArgs("endswith", args)
+	if err != nil {
+		return nil, err
+	}
+	return BoolVal(strings.HasSuffix(ss[0], ss[1])), nil
+}
+
+// Returns the fields of r as a list of [name, value] pairs, sorted by name.
+// The result can be passed to mkrec to rebuild the record.
+// entries(r rec) [][string, any]
+func builtinEntries(args []Val, ctx *Ctx) (Val, error) {
+	r, _, ok := asRec(args[0])
+	if !ok {
+		return nil, fmt.Errorf("entries: argument must be a record, got %s", args[0].Typ().Id)
+	}
+	names := make([]string, 0, len(r.Fields))
+	for name := range r.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]Val, len(names))
+	for i, name := range names {
+		result[i] = ListVal{Elements: []Val{StringVal(name), r.Fields[name]}}
+	}
+	return ListVal{Elements: result}, nil
+}
+
 // error(s string) error
 func builtinError(args []Val, ctx *Ctx) (Val, error) {
 	return nil, &ValError{V: args[0]}
@@ -63,8 +549,140 @@ func pcallResult(value Val, err bool) Val {
 	})
 }
 
+// pcallError returns the result of a failed pcall. In addition to the
+// fields of pcallResult, it has a message field describing the error.
+func pcallError(value Val, msg string) Val {
+	return NewRecWithFields(map[string]Val{
+		"value":   value,
+		"err":     BoolVal(true),
+		"message": StringVal(msg),
+	})
+}
+
+// Converts u to the largest multiple of its unit type in which it is a whole number,
+// e.g. 120::minutes to 2::hours. If no such multiple exists, u is returned unchanged.
+// normalize_unit(u unit) unit
+func builtinNormalizeUnit(args []Val, ctx *Ctx) (Val, error) {
+	u, ok := args[0].(UnitVal)
+	if !ok {
+		return nil, fmt.Errorf("normalize_unit: argument must be a unit value, got %s", args[0].Typ().Id)
+	}
+	if u.V == 0 {
+		return u, nil
+	}
+	mults := make([]float64, 0, len(u.T.UnitMults))
+	for _, f := range u.T.UnitMults {
+		mults = append(mults, f)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(mults)))
+	for _, f := range mults {
+		w := u.WithF(f)
+		if w.V == math.Trunc(w.V) {
+			return w, nil
+		}
+	}
+	return u, nil
+}
+
+// Returns the current time, as reported by the context's clock (see Ctx.SetClock).
+// now() time
+func builtinNow(args []Val, ctx *Ctx) (Val, error) {
+	return TypedVal{V: timeRec(ctx.global.now()), T: builtinTypeTime}, nil
+}
+
+// Returns the Unicode code point of the first character of s.
+// ord(s string) int
+func builtinOrd(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("ord: argument must be a string, got %s", args[0].Typ().Id)
+	}
+	if len(s) == 0 {
+		return nil, fmt.Errorf("ord: argument must not be empty")
+	}
+	r, _ := utf8.DecodeRuneInString(string(s))
+	if r == utf8.RuneError {
+		return nil, fmt.Errorf("ord: invalid UTF-8 encoding in %q", s)
+	}
+	return IntVal(r), nil
+}
+
+// Parses s as a floating point number. Use pcall or try to handle malformed input.
+// parse_double(s string) double
+func builtinParseDouble(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("parse_double: argument must be a string, got %s", args[0].Typ().Id)
+	}
+	d, err := strconv.ParseFloat(string(s), 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return nil, fmt.Errorf("parse_double: value out of range: %q", s)
+	} else if err != nil {
+		return nil, fmt.Errorf("parse_double: invalid double: %q", s)
+	}
+	return DoubleVal(d), nil
+}
+
+// Parses s as an integer in the given base, which defaults to 10. If base is 0,
+// it is derived from the prefix of s: 0x for hex, 0o or 0 for octal, 0b for binary.
+// Use pcall or try to handle malformed input.
+// parse_int(s string [, base int]) int
+func builtinParseInt(args []Val, ctx *Ctx) (Val, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, fmt.Errorf("parse_int: invalid number of arguments: %d", len(args))
+	}
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("parse_int: 1st argument must be a string, got %s", args[0].Typ().Id)
+	}
+	base := IntVal(10)
+	if len(args) == 2 {
+		base, ok = args[1].(IntVal)
+		if !ok {
+			return nil, fmt.Errorf("parse_int: 2nd argument must be an int, got %s", args[1].Typ().Id)
+		}
+		if base != 0 && (base < 2 || base > 36) {
+			return nil, fmt.Errorf("parse_int: base must be 0 or between 2 and 36, got %d", base)
+		}
+	}
+	i, err := strconv.ParseInt(string(s), int(base), 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return nil, fmt.Errorf("parse_int: value out of range: %q", s)
+	} else if err != nil {
+		return nil, fmt.Errorf("parse_int: invalid int for base %d: %q", base, s)
+	}
+	return IntVal(i), nil
+}
+
+// Returns a two-element list of the elements of xs for which pred is true
+// and of those for which it is false. Both lists preserve the order of xs.
+// partition(pred func('a)bool, xs []'a) [][]'a
+func builtinPartition(args []Val, ctx *Ctx) (Val, error) {
+	pred, xs, err := predAndList("partition", args)
+	if err != nil {
+		return nil, err
+	}
+	yes, no := []Val{}, []Val{}
+	for _, x := range xs.Elements {
+		b, err := pred.Call([]Val{x}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("partition: call failed: %w", err)
+		}
+		if b.Bool() {
+			yes = append(yes, x)
+		} else {
+			no = append(no, x)
+		}
+	}
+	return ListVal{Elements: []Val{ListVal{Elements: yes}, ListVal{Elements: no}}}, nil
+}
+
 // From Lua: call f with optional args. Pass through the return value
 // if f does not raise an error. Otherwise, return the error.
+// The result is a record {value, err} on success. On failure, it is a
+// record {value, err, message}, where value is the value passed to error()
+// or, for all other errors, the error message. Canceled evaluations
+// (see EvalWithContext) are not caught.
 // pcall(f func, [arg any]*) any
 func builtinPcall(args []Val, ctx *Ctx) (Val, error) {
 	if len(args) == 0 {
@@ -76,14 +694,24 @@ func builtinPcall(args []Val, ctx *Ctx) (Val, error) {
 	}
 	v, err := f.Call(args[1:], ctx)
 	if err != nil {
+		if ctx.global.canceled() != nil {
+			// Canceled evaluations cannot be caught.
+			return nil, err
+		}
 		var valErr *ValError
 		// Try to unwrap ValueError.
 		// Note that errors may be chained, our Eval routine does not pass ValueErrors through unchanged.
 		if errors.As(err, &valErr) {
-			return pcallResult(valErr.V, true), nil
-
+			msg := valErr.V.String()
+			if s, ok := valErr.V.(StringVal); ok {
+				msg = string(s)
+			}
+			return pcallError(valErr.V, msg), nil
 		}
-		return nil, err
+		// All other errors, e.g. division by zero or invalid arguments
+		// to builtin functions, can be caught as well.
+		msg := rootErrorMessage(err)
+		return pcallError(StringVal(msg), msg), nil
 	}
 	return pcallResult(v, false), nil
 }
@@ -115,6 +743,56 @@ func builtinFlatmap(args []Val, ctx *Ctx) (Val, error) {
 	return ListVal{Elements: result}, nil
 }
 
+// Returns a record that maps the dotted path of each leaf value in r to that value.
+// Nested (possibly typed) records and lists are traversed recursively, list elements
+// are identified by their index (e.g. "items.0.name"). Empty records and lists are
+// leaf values. It is an error if two leaf values have the same path, e.g. the
+// field "a.b" and the field b of the nested record a.
+// flatten_paths(r rec) rec
+func builtinFlattenPaths(args []Val, ctx *Ctx) (Val, error) {
+	r, _, ok := asRec(args[0])
+	if !ok {
+		return nil, fmt.Errorf("flatten_paths: argument must be a record, got %s", args[0].Typ().Id)
+	}
+	result := NewRec()
+	for _, f := range r.FieldNames() {
+		if err := flattenPaths(f, r.Fields[f], result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// flattenPaths adds all leaf values of v to result, prefixing their paths with path.
+func flattenPaths(path string, v Val, result *RecVal) error {
+	if r, _, ok := asRec(v); ok && len(r.Fields) > 0 {
+		for _, f := range r.FieldNames() {
+			if err := flattenPaths(path+"."+f, r.Fields[f], result); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if l, ok := v.(ListVal); ok && len(l.Elements) > 0 {
+		for i, e := range l.Elements {
+			if err := flattenPaths(path+"."+strconv.Itoa(i), e, result); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, dup := result.Fields[path]; dup {
+		return fmt.Errorf("flatten_paths: duplicate path %s", path)
+	}
+	result.setField(path, v, nil)
+	return nil
+}
+
+// floor(x number) int
+func builtinFloor(args []Val, ctx *Ctx) (Val, error) {
+	return roundToInt("floor", args[0], math.Floor)
+}
+
 // Three argument fold:
 // fold(f func('a, 'b)'a, accu 'a, xs []'b ) 'a
 func builtinFold(args []Val, ctx *Ctx) (Val, error) {
@@ -169,27 +847,349 @@ func builtinFold1(args []Val, ctx *Ctx) (Val, error) {
 	return accu, nil
 }
 
-// format(fmt string, args ...any) string
-func builtinFormat(args []Val, ctx *Ctx) (Val, error) {
-	if len(args) == 0 {
-		return StringVal(""), nil
+// Three argument right fold:
+// fold_right(f func('b, 'a)'a, accu 'a, xs []'b ) 'a
+func builtinFoldRight(args []Val, ctx *Ctx) (Val, error) {
+	if len(args) != 3 && len(args) != 2 {
+		return nil, fmt.Errorf("fold_right: invalid number of arguments: %d", len(args))
 	}
-	if len(args) == 1 {
-		return args[1], nil
+	if len(args) == 2 {
+		return builtinFoldRight1(args, ctx)
 	}
-	format, ok := args[0].(StringVal)
+	f, ok := args[0].(CallableVal)
 	if !ok {
-		return nil, fmt.Errorf("format: first argument must be a format string, got %T", args[0])
+		return nil, fmt.Errorf("fold_right: 1st argument must be a callable, got %T", args[0])
 	}
-	formatArgs := make([]any, len(args[1:]))
-	for i, arg := range args[1:] {
-		formatArgs[i] = arg
+	xs, ok := args[2].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("fold_right: 3rd argument must be a list, got %T", args[2])
 	}
-	s := fmt.Sprintf(string(format), formatArgs...)
-	return StringVal(s), nil
+	accu := args[1]
+	for i := len(xs.Elements) - 1; i >= 0; i-- {
+		y, err := f.Call([]Val{xs.Elements[i], accu}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("fold_right: call failed: %w", err)
+		}
+		accu = y
+	}
+	return accu, nil
 }
 
-// isnil(x any) bool
+// Two-argument right fold:
+// fold_right(f func('b, 'b)'b, xs []'b ) 'b
+func builtinFoldRight1(args []Val, ctx *Ctx) (Val, error) {
+	// We expect the right number of arguments here, since this function is not exposed.
+	f, ok := args[0].(CallableVal)
+	if !ok {
+		return nil, fmt.Errorf("fold_right: 1st argument must be a callable, got %T", args[0])
+	}
+	xs, ok := args[1].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("fold_right: 2nd argument must be a list, got %T", args[1])
+	}
+	if len(xs.Elements) == 0 {
+		return NilVal{}, nil
+	}
+	n := len(xs.Elements)
+	accu := xs.Elements[n-1]
+	for i := n - 2; i >= 0; i-- {
+		y, err := f.Call([]Val{xs.Elements[i], accu}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("fold_right: call failed: %w", err)
+		}
+		accu = y
+	}
+	return accu, nil
+}
+
+// format(fmt string, args ...any) string
+func builtinFormat(args []Val, ctx *Ctx) (Val, error) {
+	if len(args) == 0 {
+		return StringVal(""), nil
+	}
+	format, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("format: first argument must be a format string, got %T", args[0])
+	}
+	if len(args) == 1 {
+		return format, nil
+	}
+	formatArgs := make([]any, len(args[1:]))
+	for i, arg := range args[1:] {
+		formatArgs[i] = formatArg(arg)
+	}
+	s := fmt.Sprintf(string(format), formatArgs...)
+	return StringVal(s), nil
+}
+
+// formatArg unwraps v to its underlying Go value, so that it can be
+// used with the verbs of fmt.Sprintf (e.g. %d for IntVal).
+// Other values (including nil) are passed on as is
+// and get formatted using their String method.
+func formatArg(v Val) any {
+	switch x := v.(type) {
+	case IntVal:
+		return int64(x)
+	case DoubleVal:
+		return float64(x)
+	case UnitVal:
+		return x.V
+	case StringVal:
+		return string(x)
+	case BoolVal:
+		return bool(x)
+	}
+	return v
+}
+
+// stringArgs checks that all args are strings and returns them as Go strings.
+func stringArgs(name string, args []Val) ([]string, error) {
+	ss := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(StringVal)
+		if !ok {
+			return nil, fmt.Errorf("%s: argument #%d must be a string, got %s", name, i+1, arg.Typ().Id)
+		}
+		ss[i] = string(s)
+	}
+	return ss, nil
+}
+
+// justify implements the Python-style string padding builtins ljust, rjust, and center.
+// The width is measured in runes, not bytes. The optional fill argument must be a single
+// character and defaults to a space. If s is already at least width runes long,
+// it is returned unchanged. split determines how many of the pad fill characters
+// go to the left and right of s, respectively.
+func justify(name string, args []Val, split func(pad, width int) (left, right int)) (Val, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, fmt.Errorf("%s: invalid number of arguments: %d", name, len(args))
+	}
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("%s: 1st argument must be a string, got %s", name, args[0].Typ().Id)
+	}
+	width, ok := args[1].(IntVal)
+	if !ok {
+		return nil, fmt.Errorf("%s: 2nd argument must be an int, got %s", name, args[1].Typ().Id)
+	}
+	fill := " "
+	if len(args) == 3 {
+		f, ok := args[2].(StringVal)
+		if !ok || utf8.RuneCountInString(string(f)) != 1 {
+			return nil, fmt.Errorf("%s: 3rd argument must be a single character string, got %s", name, args[2])
+		}
+		fill = string(f)
+	}
+	pad := int(width) - utf8.RuneCountInString(string(s))
+	if pad <= 0 {
+		return s, nil
+	}
+	left, right := split(pad, int(width))
+	return StringVal(strings.Repeat(fill, left) + string(s) + strings.Repeat(fill, right)), nil
+}
+
+// Returns the result of applying f to v n times, i.e. f(f(...f(v))).
+// Returns v if n is 0.
+// iterate(f func('a)'a, n int, v 'a) 'a
+func builtinIterate(args []Val, ctx *Ctx) (Val, error) {
+	f, ok := args[0].(CallableVal)
+	if !ok {
+		return nil, fmt.Errorf("iterate: 1st argument must be a callable, got %s", args[0].Typ().Id)
+	}
+	n, ok := args[1].(IntVal)
+	if !ok {
+		return nil, fmt.Errorf("iterate: 2nd argument must be an int, got %s", args[1].Typ().Id)
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("iterate: 2nd argument must not be negative, got %d", n)
+	}
+	v := args[2]
+	for i := IntVal(0); i < n; i++ {
+		y, err := f.Call([]Val{v}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("iterate: call failed: %w", err)
+		}
+		v = y
+	}
+	return v, nil
+}
+
+// join(sep string, xs []string) string
+func builtinJoin(args []Val, ctx *Ctx) (Val, error) {
+	sep, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("join: 1st argument must be a string, got %s", args[0].Typ().Id)
+	}
+	xs, ok := args[1].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("join: 2nd argument must be a list, got %s", args[1].Typ().Id)
+	}
+	ss := make([]string, len(xs.Elements))
+	for i, x := range xs.Elements {
+		s, ok := x.(StringVal)
+		if !ok {
+			return nil, fmt.Errorf("join: list element at index %d must be a string, got %s", i, x.Typ().Id)
+		}
+		ss[i] = string(s)
+	}
+	return StringVal(strings.Join(ss, string(sep))), nil
+}
+
+// Formats the time t using a Go reference time layout, e.g. '2006-01-02 15:04 -07:00'.
+// format_time(t time, layout string) string
+func builtinFormatTime(args []Val, ctx *Ctx) (Val, error) {
+	t, ok := args[0].(TypedVal)
+	if !ok || t.T != builtinTypeTime {
+		return nil, fmt.Errorf("format_time: 1st argument must be a time, got %s", args[0].Typ().Id)
+	}
+	layout, ok := args[1].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("format_time: 2nd argument must be a string, got %s", args[1].Typ().Id)
+	}
+	return StringVal(goTime(t.V.(*RecVal)).Format(string(layout))), nil
+}
+
+// Parses the JSON string s. Integral numbers that fit into an int
+// are returned as ints, all other numbers as doubles.
+// from_json(s string) any
+func builtinFromJson(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("from_json: argument must be a string, got %s", args[0].Typ().Id)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(s)))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("from_json: invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("from_json: invalid JSON: unexpected data after top-level value")
+	}
+	return fromJsonValue(v)
+}
+
+// fromJsonValue converts a value decoded by encoding/json (using UseNumber) to a Val.
+func fromJsonValue(v any) (Val, error) {
+	switch x := v.(type) {
+	case nil:
+		return NilVal{}, nil
+	case bool:
+		return BoolVal(x), nil
+	case string:
+		return StringVal(x), nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return IntVal(i), nil
+		}
+		d, err := x.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("from_json: invalid number: %s", x)
+		}
+		return DoubleVal(d), nil
+	case []any:
+		elems := make([]Val, len(x))
+		for i, e := range x {
+			val, err := fromJsonValue(e)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = val
+		}
+		return ListVal{Elements: elems}, nil
+	case map[string]any:
+		// The order of JSON object keys is lost by encoding/json, so order fields by name.
+		r := NewRec()
+		for _, k := range sortedKeys(x) {
+			val, err := fromJsonValue(x[k])
+			if err != nil {
+				return nil, err
+			}
+			r.setField(k, val, nil)
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("from_json: unexpected JSON value of type %T", v)
+}
+
+// Returns the value of field name of the record r, or def if r has no such field.
+// get(r rec, name string, def any) any
+func builtinGet(args []Val, ctx *Ctx) (Val, error) {
+	r, name, err := recAndFieldName("get", args)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := r.Fields[name]; ok {
+		return v, nil
+	}
+	return args[2], nil
+}
+
+// Returns the value of the environment variable name. If the variable is not set,
+// returns def if specified, or nil otherwise.
+// getenv(name string [, def string]) string
+func builtinGetenv(args []Val, ctx *Ctx) (Val, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, fmt.Errorf("getenv: invalid number of arguments: %d", len(args))
+	}
+	ss, err := stringArgs("getenv", args)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := os.LookupEnv(ss[0]); ok {
+		return StringVal(v), nil
+	}
+	if len(args) == 2 {
+		return args[1], nil
+	}
+	return NilVal{}, nil
+}
+
+// Reports whether the record r has a field named name.
+// has(r rec, name string) bool
+func builtinHas(args []Val, ctx *Ctx) (Val, error) {
+	r, name, err := recAndFieldName("has", args)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := r.Fields[name]
+	return BoolVal(ok), nil
+}
+
+// recAndFieldName validates the (r rec, name string) arguments of has and get.
+func recAndFieldName(fname string, args []Val) (*RecVal, string, error) {
+	r, ok := args[0].(*RecVal)
+	if !ok {
+		return nil, "", fmt.Errorf("%s: 1st argument must be a record, got %s", fname, args[0].Typ().Id)
+	}
+	name, ok := args[1].(StringVal)
+	if !ok {
+		return nil, "", fmt.Errorf("%s: 2nd argument must be a string, got %s", fname, args[1].Typ().Id)
+	}
+	return r, string(name), nil
+}
+
+// Returns the byte index of the first occurrence of sub in s, or -1 if sub is not present in s.
+// indexof(s string, sub string) int
+func builtinIndexof(args []Val, ctx *Ctx) (Val, error) {
+	ss, err := stringArgs("indexof", args)
+	if err != nil {
+		return nil, err
+	}
+	return IntVal(strings.Index(ss[0], ss[1])), nil
+}
+
+// Reports whether x has the given type.
+// is_type(x any, typ string) bool
+func builtinIsType(args []Val, ctx *Ctx) (Val, error) {
+	t, err := typeNameArg("is_type", args[1], ctx)
+	if err != nil {
+		return nil, err
+	}
+	return BoolVal(args[0].Typ() == t), nil
+}
+
+// isnil(x any) bool
 func builtinIsnil(args []Val, ctx *Ctx) (Val, error) {
 	_, ok := args[0].(NilVal)
 	return BoolVal(ok), nil
@@ -208,6 +1208,16 @@ func builtinLen(args []Val, ctx *Ctx) (Val, error) {
 	return nil, fmt.Errorf("len: invalid type: %T", args[0])
 }
 
+// Returns s with all Unicode letters mapped to their lower case.
+// lower(s string) string
+func builtinLower(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("lower: argument must be a string, got %s", args[0].Typ().Id)
+	}
+	return StringVal(strings.ToLower(string(s))), nil
+}
+
 func builtinLenientParseTime(args []Val, _ *Ctx) (Val, error) {
 	s, ok := args[0].(StringVal)
 	if !ok {
@@ -222,39 +1232,227 @@ func builtinLenientParseTime(args []Val, _ *Ctx) (Val, error) {
 	}
 	for _, l := range layouts {
 		if tm, err := time.Parse(l, string(s)); err == nil {
-			r := NewRec()
-			r.setField("year", IntVal(tm.Year()), nil)
-			r.setField("month", IntVal(tm.Month()), nil)
-			r.setField("day", IntVal(tm.Day()), nil)
-			r.setField("hour", IntVal(tm.Hour()), nil)
-			r.setField("minute", IntVal(tm.Minute()), nil)
-			r.setField("second", IntVal(tm.Second()), nil)
-			r.setField("nanosecond", IntVal(tm.Nanosecond()), nil)
-			_, offset := tm.Zone()
-			r.setField("offset", IntVal(offset), nil)
-			return r, nil
+			return timeRec(tm), nil
 		}
 	}
 	return nil, fmt.Errorf("could not parse time %q", s)
 }
 
+// Splits s into its lines. Line breaks may be "\n" or "\r\n".
+// A trailing line break does not produce an empty last line.
+// lines(s string) []string
+func builtinLines(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("lines: argument must be a string, got %s", args[0].Typ().Id)
+	}
+	if s == "" {
+		return ListVal{Elements: []Val{}}, nil
+	}
+	t := strings.ReplaceAll(string(s), "\r\n", "\n")
+	parts := strings.Split(strings.TrimSuffix(t, "\n"), "\n")
+	result := make([]Val, len(parts))
+	for i, p := range parts {
+		result[i] = StringVal(p)
+	}
+	return ListVal{Elements: result}, nil
+}
+
+// Pads s on the right to the given width.
+// ljust(s string, width int [, fill string]) string
+func builtinLjust(args []Val, ctx *Ctx) (Val, error) {
+	return justify("ljust", args, func(pad, _ int) (int, int) {
+		return 0, pad
+	})
+}
+
+// Returns a record with the fields of r renamed to f(name).
+// It is an error if f returns the same name for different fields.
+// map_keys(f func(string)string, r rec) rec
+func builtinMapKeys(args []Val, ctx *Ctx) (Val, error) {
+	f, ok := args[0].(CallableVal)
+	if !ok {
+		return nil, fmt.Errorf("map_keys: 1st argument must be a callable, got %s", args[0].Typ().Id)
+	}
+	r, ok := args[1].(*RecVal)
+	if !ok {
+		return nil, fmt.Errorf("map_keys: 2nd argument must be a record, got %s", args[1].Typ().Id)
+	}
+	result := NewRec()
+	for _, name := range r.FieldNames() {
+		k, err := f.Call([]Val{StringVal(name)}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("map_keys: call failed: %w", err)
+		}
+		s, ok := k.(StringVal)
+		if !ok {
+			return nil, fmt.Errorf("map_keys: function must return a string, got %s for field %s", k.Typ().Id, name)
+		}
+		if _, dup := result.Fields[string(s)]; dup {
+			return nil, fmt.Errorf("map_keys: duplicate field name %s for field %s", s, name)
+		}
+		result.setField(string(s), r.Fields[name], r.FieldAnnotations[name])
+	}
+	return result, nil
+}
+
+// Returns a record with the same fields as r and values f(value).
+// Type annotations of r's fields are not preserved.
+// map_values(f func('a)'b, r rec) rec
+func builtinMapValues(args []Val, ctx *Ctx) (Val, error) {
+	f, ok := args[0].(CallableVal)
+	if !ok {
+		return nil, fmt.Errorf("map_values: 1st argument must be a callable, got %s", args[0].Typ().Id)
+	}
+	r, ok := args[1].(*RecVal)
+	if !ok {
+		return nil, fmt.Errorf("map_values: 2nd argument must be a record, got %s", args[1].Typ().Id)
+	}
+	result := NewRec()
+	for _, name := range r.FieldNames() {
+		v, err := f.Call([]Val{r.Fields[name]}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("map_values: call failed: %w", err)
+		}
+		result.setField(name, v, nil)
+	}
+	return result, nil
+}
+
+// max(xs []'a) 'a
+// max(x 'a, y 'a, ...) 'a
+func builtinMax(args []Val, ctx *Ctx) (Val, error) {
+	return extremum("max", args, greaterThan)
+}
+
+// Merges records from left to right, like the @ operator does.
+// The 2-argument version with a list of records as its first argument
+// accepts an options record. If its concat_lists field is true, lists in
+// common fields are concatenated instead of being replaced.
+// merge(x rec, y rec, ...) rec
+// merge(xs []rec, opts rec) rec
+func builtinMerge(args []Val, ctx *Ctx) (Val, error) {
+	var opts mergeOptions
+	if len(args) > 0 {
+		if xs, ok := args[0].(ListVal); ok {
+			if len(args) != 2 {
+				return nil, fmt.Errorf("merge: list version expects 2 arguments, got %d", len(args))
+			}
+			o, ok := args[1].(*RecVal)
+			if !ok {
+				return nil, fmt.Errorf("merge: 2nd argument must be a record, got %s", args[1].Typ().Id)
+			}
+			for f, v := range o.Fields {
+				switch f {
+				case "concat_lists":
+					b, ok := v.(BoolVal)
+					if !ok {
+						return nil, fmt.Errorf("merge: option concat_lists must be a bool, got %s", v.Typ().Id)
+					}
+					opts.concatLists = bool(b)
+				default:
+					return nil, fmt.Errorf("merge: unknown option %s", f)
+				}
+			}
+			args = xs.Elements
+		}
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("merge: expected at least one record")
+	}
+	for i, x := range args {
+		if _, _, ok := asRec(x); !ok {
+			return nil, fmt.Errorf("merge: argument #%d must be a record, got %s", i+1, x.Typ().Id)
+		}
+	}
+	result := args[0]
+	for _, x := range args[1:] {
+		r, err := mergeValuesWith(result, x, opts, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("merge: %w", err)
+		}
+		result = r
+	}
+	return result, nil
+}
+
+// min(xs []'a) 'a
+// min(x 'a, y 'a, ...) 'a
+func builtinMin(args []Val, ctx *Ctx) (Val, error) {
+	return extremum("min", args, lessThan)
+}
+
+// extremum returns the element x of args for which better(x, y) holds
+// for all other elements y. If args has a single element, it must be a list
+// and the extremum of its elements is returned. Elements are compared using
+// the same comparison functions as the binary operators, so all values
+// must be of the same (comparable) type.
+func extremum(name string, args []Val, better func(x, y Val) (Val, error)) (Val, error) {
+	xs := args
+	if len(args) == 1 {
+		l, ok := args[0].(ListVal)
+		if !ok {
+			return nil, fmt.Errorf("%s: 1-argument version expects a list argument, got %s", name, args[0].Typ().Id)
+		}
+		xs = l.Elements
+	}
+	if len(xs) == 0 {
+		return nil, fmt.Errorf("%s: empty sequence", name)
+	}
+	r := xs[0]
+	for _, x := range xs[1:] {
+		b, err := better(x, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if b.Bool() {
+			r = x
+		}
+	}
+	return r, nil
+}
+
 // builtinLoad loads a module (file) and stores it in the context.
-// It returns the module body as a Val.
-// load(name string) any
+// It returns the module as a record of its pub declarations and its body.
+// If a list of names is given, the record only contains those fields,
+// and it is an error if any of them does not exist.
+// load(name string [, names []string]) record
 func builtinLoad(args []Val, ctx *Ctx) (Val, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, fmt.Errorf("load: expected 1 or 2 arguments, got %d", len(args))
+	}
 	name, ok := args[0].(StringVal)
 	if !ok {
 		return nil, fmt.Errorf("load: expected string argument got: %s", args[0])
 	}
+	var names []string
+	if len(args) == 2 {
+		xs, ok := args[1].(ListVal)
+		if !ok {
+			return nil, fmt.Errorf("load: 2nd argument must be a list, got %s", args[1].Typ().Id)
+		}
+		for _, x := range xs.Elements {
+			n, ok := x.(StringVal)
+			if !ok {
+				return nil, fmt.Errorf("load: 2nd argument must be a list of strings, got element of type %s", x.Typ().Id)
+			}
+			names = append(names, string(n))
+		}
+	}
 	lmod, err := LoadModule(string(name), ctx.dropLocals())
 	if err != nil {
 		return nil, err
 	}
-	return lmod.AsRec(), nil
+	if len(args) == 1 {
+		return lmod.AsRec(), nil
+	}
+	return lmod.asRecSubset(names)
 }
 
 // The constructor for records. Useful to generate dynamic records
 // whose field names are only known at runtime.
+// The 1-argument version accepts a flat list of alternating field names and values,
+// or a list of [name, value] pairs as returned by entries.
 // mkrec(f string, fv any [, f string, fv any]*) record
 func builtinMkrec(args []Val, ctx *Ctx) (Val, error) {
 	if len(args) == 1 {
@@ -262,11 +1460,32 @@ func builtinMkrec(args []Val, ctx *Ctx) (Val, error) {
 		if !ok {
 			return nil, fmt.Errorf("mkrec: 1-argument version expects a list argument, got %s", args[0].Typ().Id)
 		}
+		if len(lv.Elements) > 0 {
+			if _, isPair := lv.Elements[0].(ListVal); isPair {
+				return recFromPairs(lv.Elements)
+			}
+		}
 		return recFromList(lv.Elements)
 	}
 	return recFromList(args)
 }
 
+func recFromPairs(xs []Val) (*RecVal, error) {
+	r := NewRec()
+	for i, x := range xs {
+		p, ok := x.(ListVal)
+		if !ok || len(p.Elements) != 2 {
+			return nil, fmt.Errorf("mkrec: expected [field name, field value] pair at list index %d", i)
+		}
+		f, ok := p.Elements[0].(StringVal)
+		if !ok {
+			return nil, fmt.Errorf("mkrec: expected string as field name at list index %d, got %s", i, p.Elements[0].Typ().Id)
+		}
+		r.setField(string(f), p.Elements[1], nil)
+	}
+	return r, nil
+}
+
 func recFromList(xs []Val) (*RecVal, error) {
 	// Expect list of pairs of field name and field value.
 	if len(xs)%2 != 0 {
@@ -283,6 +1502,115 @@ func recFromList(xs []Val) (*RecVal, error) {
 	return r, nil
 }
 
+// pow(base number, exp number) double
+func builtinPow(args []Val, ctx *Ctx) (Val, error) {
+	base, err := floatArg("pow", args[0])
+	if err != nil {
+		return nil, err
+	}
+	exp, err := floatArg("pow", args[1])
+	if err != nil {
+		return nil, err
+	}
+	return DoubleVal(math.Pow(base, exp)), nil
+}
+
+// floatArg returns the value of the numeric (int or double) argument x as a float64.
+func floatArg(name string, x Val) (float64, error) {
+	switch v := x.(type) {
+	case IntVal:
+		return float64(v), nil
+	case DoubleVal:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("%s: argument must be a number, got %s", name, x.Typ().Id)
+}
+
+// Maximum number of entries in regexpCache. The cache is cleared when it is full,
+// to bound its memory usage for dynamically generated patterns.
+const maxRegexpCacheSize = 1000
+
+// Cache of compiled regular expressions, keyed by their pattern.
+var regexpCache = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+// compileRegexp is like regexp.Compile, but returns cached results for
+// previously compiled patterns.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCache.Lock()
+	defer regexpCache.Unlock()
+	if re, ok := regexpCache.m[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(regexpCache.m) >= maxRegexpCacheSize {
+		regexpCache.m = make(map[string]*regexp.Regexp)
+	}
+	regexpCache.m[pattern] = re
+	return re, nil
+}
+
+// Returns an indented, multi-line rendering of v, e.g. for use in error messages.
+// Unlike str, record fields are written in declaration order.
+// pretty(v any) string
+func builtinPretty(args []Val, ctx *Ctx) (Val, error) {
+	var sb strings.Builder
+	writePretty(&sb, args[0], "")
+	return StringVal(sb.String()), nil
+}
+
+// writePretty writes the pretty rendering of v to sb. Nested lines
+// are indented by indent plus two spaces per nesting level.
+func writePretty(sb *strings.Builder, v Val, indent string) {
+	const step = "  "
+	switch x := v.(type) {
+	case *RecVal:
+		if len(x.Fields) == 0 {
+			sb.WriteString("{}")
+			return
+		}
+		sb.WriteString("{\n")
+		for _, f := range x.FieldNames() {
+			sb.WriteString(indent + step)
+			if isIdentifier(f) {
+				sb.WriteString(f)
+			} else {
+				sb.WriteString(strconv.Quote(f))
+			}
+			sb.WriteString(": ")
+			writePretty(sb, x.Fields[f], indent+step)
+			sb.WriteString("\n")
+		}
+		sb.WriteString(indent + "}")
+	case ListVal:
+		if len(x.Elements) == 0 {
+			sb.WriteString("[]")
+			return
+		}
+		sb.WriteString("[\n")
+		for i, e := range x.Elements {
+			sb.WriteString(indent + step)
+			writePretty(sb, e, indent+step)
+			if i < len(x.Elements)-1 {
+				sb.WriteString(",")
+			}
+			sb.WriteString("\n")
+		}
+		sb.WriteString(indent + "]")
+	case TypedVal:
+		sb.WriteString(x.T.Id + "(")
+		writePretty(sb, x.V, indent)
+		sb.WriteString(")")
+	default:
+		writeVal(sb, v)
+	}
+}
+
 // regexp_extract(s string, regexp string [, group_index int]) string
 func builtinRegexpExtract(args []Val, ctx *Ctx) (Val, error) {
 	if len(args) != 3 && len(args) != 2 {
@@ -307,7 +1635,7 @@ func builtinRegexpExtract(args []Val, ctx *Ctx) (Val, error) {
 			group_index = int(gi)
 		}
 	}
-	re, err := regexp.Compile(string(regexpStr))
+	re, err := compileRegexp(string(regexpStr))
 	if err != nil {
 		return nil, fmt.Errorf("regexp_extract: %w", err)
 	}
@@ -324,8 +1652,203 @@ func builtinRegexpExtract(args []Val, ctx *Ctx) (Val, error) {
 	return StringVal(r), nil
 }
 
+// Returns all successive, non-overlapping matches of regexp in s.
+// regexp_find_all(s string, regexp string) []string
+func builtinRegexpFindAll(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("regexp_find_all: 1st argument must be a string, got %s", args[0].Typ().Id)
+	}
+	regexpStr, ok := args[1].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("regexp_find_all: 2nd argument must be a string, got %s", args[1].Typ().Id)
+	}
+	re, err := compileRegexp(string(regexpStr))
+	if err != nil {
+		return nil, fmt.Errorf("regexp_find_all: %w", err)
+	}
+	matches := re.FindAllString(string(s), -1)
+	res := make([]Val, len(matches))
+	for i, m := range matches {
+		res[i] = StringVal(m)
+	}
+	return ListVal{Elements: res}, nil
+}
+
+// Reports whether s contains any match of regexp.
+// regexp_match(s string, regexp string) bool
+func builtinRegexpMatch(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("regexp_match: 1st argument must be a string, got %s", args[0].Typ().Id)
+	}
+	regexpStr, ok := args[1].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("regexp_match: 2nd argument must be a string, got %s", args[1].Typ().Id)
+	}
+	re, err := compileRegexp(string(regexpStr))
+	if err != nil {
+		return nil, fmt.Errorf("regexp_match: %w", err)
+	}
+	return BoolVal(re.MatchString(string(s))), nil
+}
+
+// Maximum length of lists created by repeat. Larger lists would exhaust
+// memory or exceed the maximum slice length.
+const maxRepeatLen = 10_000_000
+
+// Returns a list containing x n times.
+// repeat(x 'a, n int) []'a
+func builtinRepeat(args []Val, ctx *Ctx) (Val, error) {
+	n, ok := args[1].(IntVal)
+	if !ok {
+		return nil, fmt.Errorf("repeat: 2nd argument must be an int, got %s", args[1].Typ().Id)
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("repeat: 2nd argument must not be negative, got %d", n)
+	}
+	if n > maxRepeatLen {
+		return nil, fmt.Errorf("repeat: 2nd argument must not exceed %d, got %d", maxRepeatLen, n)
+	}
+	result := make([]Val, n)
+	for i := range result {
+		result[i] = args[0]
+	}
+	return ListVal{Elements: result}, nil
+}
+
+// Replaces all occurrences of old in s by new.
+// replace(s string, old string, new string) string
+func builtinReplace(args []Val, ctx *Ctx) (Val, error) {
+	ss, err := stringArgs("replace", args)
+	if err != nil {
+		return nil, err
+	}
+	return StringVal(strings.ReplaceAll(ss[0], ss[1], ss[2])), nil
+}
+
+// Pads s on the left to the given width.
+// rjust(s string, width int [, fill string]) string
+func builtinRjust(args []Val, ctx *Ctx) (Val, error) {
+	return justify("rjust", args, func(pad, _ int) (int, int) {
+		return pad, 0
+	})
+}
+
+// Rounds x to the nearest integer, rounding half away from zero.
+// round(x number) int
+func builtinRound(args []Val, ctx *Ctx) (Val, error) {
+	return roundToInt("round", args[0], math.Round)
+}
+
+// roundToInt applies the rounding function r to x and returns the result as an IntVal.
+func roundToInt(name string, x Val, r func(float64) float64) (Val, error) {
+	switch v := x.(type) {
+	case IntVal:
+		return v, nil
+	case DoubleVal:
+		f := r(float64(v))
+		if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, fmt.Errorf("%s: result out of int range: %v", name, f)
+		}
+		return IntVal(f), nil
+	}
+	return nil, fmt.Errorf("%s: argument must be a number, got %s", name, x.Typ().Id)
+}
+
+// Returns a new record containing only the fields of r for which pred(name, value) is true.
+// Type annotations of the selected fields are preserved.
+// select(r rec, pred func(string, any)bool) rec
+func builtinSelect(args []Val, ctx *Ctx) (Val, error) {
+	r, ok := args[0].(*RecVal)
+	if !ok {
+		return nil, fmt.Errorf("select: 1st argument must be a record, got %s", args[0].Typ().Id)
+	}
+	pred, ok := args[1].(CallableVal)
+	if !ok {
+		return nil, fmt.Errorf("select: 2nd argument must be a callable, got %s", args[1].Typ().Id)
+	}
+	result := NewRec()
+	for _, f := range r.FieldNames() {
+		v := r.Fields[f]
+		keep, err := pred.Call([]Val{StringVal(f), v}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("select: call failed: %w", err)
+		}
+		if keep.Bool() {
+			result.setField(f, v, r.FieldAnnotations[f])
+		}
+	}
+	return result, nil
+}
+
+// Returns the elements of xs from index lo (inclusive) to hi (exclusive).
+// Like substr, it is an error if the indices are out of range.
+// slice(xs []any, lo int, hi int) []any
+func builtinSlice(args []Val, ctx *Ctx) (Val, error) {
+	xs, ok := args[0].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("slice: 1st argument must be a list, got %s", args[0].Typ().Id)
+	}
+	lo, ok := args[1].(IntVal)
+	if !ok {
+		return nil, fmt.Errorf("slice: 2nd argument must be an int, got %s", args[1].Typ().Id)
+	}
+	hi, ok := args[2].(IntVal)
+	if !ok {
+		return nil, fmt.Errorf("slice: 3rd argument must be an int, got %s", args[2].Typ().Id)
+	}
+	if lo < 0 || lo > hi || int64(hi) > int64(len(xs.Elements)) {
+		return nil, fmt.Errorf("slice: invalid lo(%d)/hi(%d) arguments for list of length %d",
+			lo, hi, len(xs.Elements))
+	}
+	return ListVal{Elements: xs.Elements[lo:hi]}, nil
+}
+
+// split(s string, sep string) []string
+func builtinSplit(args []Val, ctx *Ctx) (Val, error) {
+	ss, err := stringArgs("split", args)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(ss[0], ss[1])
+	result := make([]Val, len(parts))
+	for i, p := range parts {
+		result[i] = StringVal(p)
+	}
+	return ListVal{Elements: result}, nil
+}
+
+// sqrt(x number) double
+func builtinSqrt(args []Val, ctx *Ctx) (Val, error) {
+	x, err := floatArg("sqrt", args[0])
+	if err != nil {
+		return nil, err
+	}
+	if x < 0 {
+		return nil, fmt.Errorf("sqrt: argument must not be negative, got %v", x)
+	}
+	return DoubleVal(math.Sqrt(x)), nil
+}
+
+// startswith(s string, prefix string) bool
+func builtinStartswith(args []Val, ctx *Ctx) (Val, error) {
+	ss, err := stringArgs("startswith", args)
+	if err != nil {
+		return nil, err
+	}
+	return BoolVal(strings.HasPrefix(ss[0], ss[1])), nil
+}
+
 // str(x any) string
 func builtinStr(args []Val, ctx *Ctx) (Val, error) {
+	if v, ok := args[0].(TypedVal); ok {
+		s, err := v.format(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("str: %w", err)
+		}
+		return StringVal(s), nil
+	}
 	return StringVal(args[0].String()), nil
 }
 
@@ -350,7 +1873,265 @@ func builtinSubstr(args []Val, ctx *Ctx) (Val, error) {
 	return nil, fmt.Errorf("substr: invalid type: %T", args[0])
 }
 
+// Sums up all elements of xs. The sum of an empty list is 0.
+// sum(xs []number) number
+func builtinSum(args []Val, ctx *Ctx) (Val, error) {
+	xs, ok := args[0].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("sum: argument must be a list, got %s", args[0].Typ().Id)
+	}
+	if len(xs.Elements) == 0 {
+		return IntVal(0), nil
+	}
+	accu := xs.Elements[0]
+	for _, x := range xs.Elements[1:] {
+		y, err := plus(accu, x)
+		if err != nil {
+			return nil, fmt.Errorf("sum: %w", err)
+		}
+		accu = y
+	}
+	switch accu.(type) {
+	case IntVal, DoubleVal, UnitVal:
+		return accu, nil
+	}
+	return nil, fmt.Errorf("sum: invalid element type: %s", accu.Typ().Id)
+}
+
+// Returns the first n elements of xs, or all of xs if it has fewer than n elements.
+// take(n int, xs []any) []any
+func builtinTake(args []Val, ctx *Ctx) (Val, error) {
+	n, xs, err := countAndList("take", args)
+	if err != nil {
+		return nil, err
+	}
+	return ListVal{Elements: xs[:n]}, nil
+}
+
+// Returns the duration a - b between the times a and b, in seconds.
+// The result is negative if a is before b.
+// time_diff(a time, b time) duration
+func builtinTimeDiff(args []Val, ctx *Ctx) (Val, error) {
+	var ts [2]time.Time
+	for i, arg := range args {
+		t, ok := arg.(TypedVal)
+		if !ok || t.T != builtinTypeTime {
+			return nil, fmt.Errorf("time_diff: argument #%d must be a time, got %s", i+1, arg.Typ().Id)
+		}
+		ts[i] = goTime(t.V.(*RecVal))
+	}
+	// Don't use time.Time.Sub: its time.Duration result saturates at about ±292 years.
+	secs := float64(ts[0].Unix()-ts[1].Unix()) + float64(ts[0].Nanosecond()-ts[1].Nanosecond())/1e9
+	return UnitVal{V: secs, F: builtinTypeDuration.UnitMults["seconds"], T: builtinTypeDuration}, nil
+}
+
+// Returns the JSON encoding of x.
+// to_json(x any) string
+func builtinToJson(args []Val, ctx *Ctx) (Val, error) {
+	s, err := EncodeAsJson(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("to_json: %w", err)
+	}
+	return StringVal(s), nil
+}
+
+// Removes all leading and trailing characters contained in cutset from s.
+// If cutset is not specified, removes leading and trailing whitespace.
+// trim(s string [, cutset string]) string
+func builtinTrim(args []Val, ctx *Ctx) (Val, error) {
+	if len(args) == 1 {
+		return builtinTrimspace(args, ctx)
+	}
+	if len(args) != 2 {
+		return nil, fmt.Errorf("trim: invalid number of arguments: %d", len(args))
+	}
+	ss, err := stringArgs("trim", args)
+	if err != nil {
+		return nil, err
+	}
+	return StringVal(strings.Trim(ss[0], ss[1])), nil
+}
+
+// Removes all leading and trailing whitespace from s.
+// trimspace(s string) string
+func builtinTrimspace(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("trimspace: argument must be a string, got %s", args[0].Typ().Id)
+	}
+	return StringVal(strings.TrimSpace(string(s))), nil
+}
+
+// Calls the zero-argument function f and returns its result.
+// If f raises any error, def is returned instead. Canceled evaluations
+// (see EvalWithContext) are not caught.
+// try(f func, def any) any
+func builtinTry(args []Val, ctx *Ctx) (Val, error) {
+	f, ok := args[0].(CallableVal)
+	if !ok {
+		return nil, fmt.Errorf("try: 1st argument must be a callable, got %s", args[0].Typ().Id)
+	}
+	// Don't hide calls that fail because f requires arguments.
+	switch g := f.(type) {
+	case *NativeFuncVal:
+		if g.Arity > 0 {
+			return nil, fmt.Errorf("try: 1st argument must be callable without arguments, %s requires %d", g.Name, g.Arity)
+		}
+	case *FuncExprVal:
+		if ps := g.F.Params; len(ps) > 0 && ps[0].Default == nil && !ps[0].Variadic {
+			return nil, fmt.Errorf("try: 1st argument must be callable without arguments, %s requires parameter %s", g, ps[0].Name)
+		}
+	}
+	v, err := f.Call(nil, ctx)
+	if err != nil {
+		if ctx.global.canceled() != nil {
+			return nil, err
+		}
+		return args[1], nil
+	}
+	return v, nil
+}
+
 // typeof(x any) string
 func builtinTypeof(args []Val, ctx *Ctx) (Val, error) {
 	return StringVal(args[0].Typ().Id), nil
 }
+
+// Removes duplicates from xs, keeping the first occurrence of each element.
+// Only lists of scalar values are supported.
+// unique(xs []any) []any
+func builtinUnique(args []Val, ctx *Ctx) (Val, error) {
+	xs, ok := args[0].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("unique: argument must be a list, got %s", args[0].Typ().Id)
+	}
+	seen := make(map[Val]bool)
+	result := []Val{}
+	for i, x := range xs.Elements {
+		switch x.(type) {
+		case IntVal, DoubleVal, UnitVal, StringVal, BoolVal, NilVal:
+			// For scalars, == on Val is equivalent to Equal.
+			if !seen[x] {
+				seen[x] = true
+				result = append(result, x)
+			}
+		default:
+			return nil, fmt.Errorf("unique: list element at index %d must be a scalar, got %s", i, x.Typ().Id)
+		}
+	}
+	return ListVal{Elements: result}, nil
+}
+
+// Joins the strings in xs with "\n". This is the inverse of lines
+// for strings without a trailing line break.
+// unlines(xs []string) string
+func builtinUnlines(args []Val, ctx *Ctx) (Val, error) {
+	xs, ok := args[0].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("unlines: argument must be a list, got %s", args[0].Typ().Id)
+	}
+	ss := make([]string, len(xs.Elements))
+	for i, x := range xs.Elements {
+		s, ok := x.(StringVal)
+		if !ok {
+			return nil, fmt.Errorf("unlines: list element at index %d must be a string, got %s", i, x.Typ().Id)
+		}
+		ss[i] = string(s)
+	}
+	return StringVal(strings.Join(ss, "\n")), nil
+}
+
+// Returns s with all Unicode letters mapped to their upper case.
+// upper(s string) string
+func builtinUpper(args []Val, ctx *Ctx) (Val, error) {
+	s, ok := args[0].(StringVal)
+	if !ok {
+		return nil, fmt.Errorf("upper: argument must be a string, got %s", args[0].Typ().Id)
+	}
+	return StringVal(strings.ToUpper(string(s))), nil
+}
+
+// Returns a copy of r without the fields of the given names.
+// Names of fields that r does not have are ignored.
+// A copy of a typed record keeps its type and must remain valid.
+// without(r rec, name string, ...) rec
+func builtinWithout(args []Val, ctx *Ctx) (Val, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("without: expected at least one argument")
+	}
+	r, t, ok := asRec(args[0])
+	if !ok {
+		return nil, fmt.Errorf("without: 1st argument must be a record, got %s", args[0].Typ().Id)
+	}
+	drop := make(map[string]bool)
+	for i, arg := range args[1:] {
+		s, ok := arg.(StringVal)
+		if !ok {
+			return nil, fmt.Errorf("without: argument #%d must be a string, got %s", i+2, arg.Typ().Id)
+		}
+		drop[string(s)] = true
+	}
+	result := NewRec()
+	for _, f := range r.FieldNames() {
+		if !drop[f] {
+			result.setField(f, r.Fields[f], r.FieldAnnotations[f])
+		}
+	}
+	v, err := wrapMergedRec(result, t, nil, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("without: %w", err)
+	}
+	return v, nil
+}
+
+// Pairs the elements of xs and ys. The result has the length of the shorter list.
+// zip(xs []'a, ys []'b) [][]any
+func builtinZip(args []Val, ctx *Ctx) (Val, error) {
+	xs, ok := args[0].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("zip: 1st argument must be a list, got %s", args[0].Typ().Id)
+	}
+	ys, ok := args[1].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("zip: 2nd argument must be a list, got %s", args[1].Typ().Id)
+	}
+	n := len(xs.Elements)
+	if len(ys.Elements) < n {
+		n = len(ys.Elements)
+	}
+	result := make([]Val, n)
+	for i := 0; i < n; i++ {
+		result[i] = ListVal{Elements: []Val{xs.Elements[i], ys.Elements[i]}}
+	}
+	return ListVal{Elements: result}, nil
+}
+
+// Applies f pairwise to the elements of xs and ys. The result has the length of the shorter list.
+// zip_with(f func('a, 'b)'c, xs []'a, ys []'b) []'c
+func builtinZipWith(args []Val, ctx *Ctx) (Val, error) {
+	f, ok := args[0].(CallableVal)
+	if !ok {
+		return nil, fmt.Errorf("zip_with: 1st argument must be a callable, got %s", args[0].Typ().Id)
+	}
+	xs, ok := args[1].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("zip_with: 2nd argument must be a list, got %s", args[1].Typ().Id)
+	}
+	ys, ok := args[2].(ListVal)
+	if !ok {
+		return nil, fmt.Errorf("zip_with: 3rd argument must be a list, got %s", args[2].Typ().Id)
+	}
+	n := len(xs.Elements)
+	if len(ys.Elements) < n {
+		n = len(ys.Elements)
+	}
+	result := make([]Val, n)
+	for i := 0; i < n; i++ {
+		z, err := f.Call([]Val{xs.Elements[i], ys.Elements[i]}, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("zip_with: call failed: %w", err)
+		}
+		result[i] = z
+	}
+	return ListVal{Elements: result}, nil
+}
@@ -1,10 +1,16 @@
 package gokonfi
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestFormatSingleArg(t *testing.T) {
@@ -37,6 +43,58 @@ func TestFormatSingleArg(t *testing.T) {
 	}
 }
 
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "format('%05.2f', 3.14159)", want: StringVal("03.14")},
+		{input: "format('%d apples', 3)", want: StringVal("3 apples")},
+		{input: "format('%s and %s', 'this', 'that')", want: StringVal("this and that")},
+		{input: "format('%q', 'quoted')", want: StringVal(`"quoted"`)},
+		{input: "format('%x', 255)", want: StringVal("ff")},
+		{input: "format('%.1f min', (90::seconds)::minutes)", want: StringVal("1.5 min")},
+		{input: "format('%v', [1])", want: StringVal("[1]")},
+		{input: "format('no args')", want: StringVal("no args")},
+		{input: "format('100%')", want: StringVal("100%")},
+		{input: "format()", want: StringVal("")},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	tests := []string{
+		"format(1)",
+		"format(nil, 1)",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
 func TestIsnil(t *testing.T) {
 	tests := []struct {
 		input Val
@@ -185,6 +243,243 @@ func TestRegexpExtractError(t *testing.T) {
 
 }
 
+func TestCompileRegexpCache(t *testing.T) {
+	re1, err := compileRegexp("a+")
+	if err != nil {
+		t.Fatalf("compileRegexp failed: %s", err)
+	}
+	re2, err := compileRegexp("b+")
+	if err != nil {
+		t.Fatalf("compileRegexp failed: %s", err)
+	}
+	if re1 == re2 {
+		t.Fatalf("Got the same regexp for different patterns")
+	}
+	if re, _ := compileRegexp("a+"); re != re1 {
+		t.Errorf("Want cached regexp for a+, got a new one")
+	}
+	// Cached regexps must still yield the right results.
+	for _, test := range []struct{ re, want string }{
+		{re: "a+", want: "aa"},
+		{re: "b+", want: "bbb"},
+		{re: "a+", want: "aa"},
+	} {
+		got, err := builtinRegexpExtract([]Val{StringVal("xaabbb"), StringVal(test.re)}, nil)
+		if err != nil {
+			t.Fatalf("Error calling regexp_extract: %s", err)
+		}
+		if got != StringVal(test.want) {
+			t.Errorf("regexp_extract(%q): want %q, got %v", test.re, test.want, got)
+		}
+	}
+	// Compile errors are not cached.
+	for i := 0; i < 2; i++ {
+		if _, err := compileRegexp("(a"); err == nil {
+			t.Errorf("Wanted error for invalid pattern")
+		}
+	}
+}
+
+var regexpBenchArgs = []Val{StringVal("https://www2.example.com/path/to"), StringVal("^https?://([^/]*)/.*"), IntVal(1)}
+
+func BenchmarkRegexpExtract(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := builtinRegexpExtract(regexpBenchArgs, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Baseline for BenchmarkRegexpExtract: compiles the regexp on each call.
+func BenchmarkRegexpExtractUncached(b *testing.B) {
+	s := string(regexpBenchArgs[0].(StringVal))
+	for i := 0; i < b.N; i++ {
+		re, err := regexp.Compile(string(regexpBenchArgs[1].(StringVal)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		re.FindStringSubmatch(s)
+	}
+}
+
+func TestRegexpMatchFindAll(t *testing.T) {
+	strs := func(ss ...string) ListVal {
+		xs := make([]Val, len(ss))
+		for i, s := range ss {
+			xs[i] = StringVal(s)
+		}
+		return ListVal{Elements: xs}
+	}
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "regexp_match('konfi-1.2', `[0-9]+\\.[0-9]+`)", want: BoolVal(true)},
+		{input: "regexp_match('konfi-12', `[0-9]+\\.[0-9]+`)", want: BoolVal(false)},
+		{input: "regexp_match('konfi', '^k')", want: BoolVal(true)},
+		{input: "regexp_match('konfi', '^onfi$')", want: BoolVal(false)},
+		{input: "regexp_match('', '')", want: BoolVal(true)},
+		{input: "regexp_find_all('a1 b22 c333', '[0-9]+')", want: strs("1", "22", "333")},
+		{input: "regexp_find_all('aaa', 'a')", want: strs("a", "a", "a")},
+		{input: "regexp_find_all('abc', 'x')", want: strs()},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRegexpMatchFindAllError(t *testing.T) {
+	tests := []string{
+		"regexp_match('a', '(a')",
+		"regexp_match(1, 'a')",
+		"regexp_match('a', nil)",
+		"regexp_match('a')",
+		"regexp_find_all('a', '+')",
+		"regexp_find_all([], 'a')",
+		"regexp_find_all('a', 1)",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestTry(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "try(func () { 1 + 1 }, 0)", want: IntVal(2)},
+		{input: "try(func () { error('boom') }, 'default')", want: StringVal("default")},
+		{input: "try(func () { substr('abc', 0, 10) }, '')", want: StringVal("")},
+		{input: "try(func () { 1 / 0 }, -1)", want: IntVal(-1)},
+		{input: "try(func () { nil }, 1)", want: NilVal{}},
+		{input: "try(func (x: 3) { x }, 0)", want: IntVal(3)},
+		{input: "{let x: {a: 1} y: try(func () { x.b }, x.a)}.y", want: IntVal(1)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTryError(t *testing.T) {
+	tests := []string{
+		"try(1, 2)",
+		"try(func () { 1 })",
+		"try(func (x) { x }, 0)",
+		"try(len, 0)",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // Evaluated and compared to the result of input.
+	}{
+		{input: "merge({a: 1})", want: "{a: 1}"},
+		{input: "merge({a: 1}, {b: 2})", want: "{a: 1} @ {b: 2}"},
+		{input: "merge({a: 1 b: 1}, {b: 2 c: 2}, {c: 3 d: 3})", want: "{a: 1 b: 2 c: 3 d: 3}"},
+		{input: "merge({a: {x: 1}}, {a: {y: 2}}, {a: {z: 3}})", want: "{a: {x: 1 y: 2 z: 3}}"},
+		{input: "merge({xs: [1]}, {xs: [2]})", want: "{xs: [2]}"},
+		{input: "merge([{a: 1}, {b: 2}, {a: 3}], {})", want: "{a: 3 b: 2}"},
+		{input: "merge([{xs: [1]}, {xs: [2, 3]}], {concat_lists: false})", want: "{xs: [2, 3]}"},
+		{input: "merge([{xs: [1]}, {xs: [2, 3]}, {xs: []}], {concat_lists: true})", want: "{xs: [1, 2, 3]}"},
+		{input: "merge([{a: {xs: ['a']} b: [1]}, {a: {xs: ['b']} b: 2}], {concat_lists: true})", want: "{a: {xs: ['a', 'b']} b: 2}"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			w, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse expected expression: %s", err)
+			}
+			want, err := Eval(w, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate expected expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestMergeError(t *testing.T) {
+	tests := []string{
+		"merge()",
+		"merge({a: 1}, 2)",
+		"merge(1, {a: 1})",
+		"merge([{a: 1}])",
+		"merge([{a: 1}, 1], {})",
+		"merge([{a: 1}], {unknown: true})",
+		"merge([{a: 1}], {concat_lists: 1})",
+		"merge([{a: 1}], [])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
 func TestTypeof(t *testing.T) {
 	tests := []struct {
 		input Val
@@ -207,3 +502,2274 @@ func TestTypeof(t *testing.T) {
 		})
 	}
 }
+
+func TestIsTypeAssertType(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "is_type(1, 'int')", want: BoolVal(true)},
+		{input: "is_type(1, 'double')", want: BoolVal(false)},
+		{input: "is_type('a', 'string')", want: BoolVal(true)},
+		{input: "is_type(nil, 'nil')", want: BoolVal(true)},
+		{input: "is_type({}, 'rec')", want: BoolVal(true)},
+		{input: "is_type([], 'list')", want: BoolVal(true)},
+		{input: "is_type(len, 'builtin')", want: BoolVal(true)},
+		{input: "is_type(func () { 1 }, 'func')", want: BoolVal(true)},
+		{input: "is_type(3::minutes, 'duration')", want: BoolVal(true)},
+		{input: "is_type(3::minutes, 'int')", want: BoolVal(false)},
+		{input: "is_type(5::minutes, 'minutes')", want: BoolVal(true)},
+		{input: "is_type(5::hours, 'minutes')", want: BoolVal(true)},
+		{input: "is_type(5::percent, 'minutes')", want: BoolVal(false)},
+		{input: "is_type(80::port, 'port')", want: BoolVal(true)},
+		{input: "assert_type(1, 'int')", want: IntVal(1)},
+		{input: "assert_type('a', 'string')", want: StringVal("a")},
+		{input: "assert_type(2::hours, 'duration') == 2::hours", want: BoolVal(true)},
+		{input: "assert_type(5::minutes, 'minutes') == 5::minutes", want: BoolVal(true)},
+		{input: "pcall(assert_type, 1, 'string').err", want: BoolVal(true)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIsTypeAssertTypeError(t *testing.T) {
+	tests := []string{
+		"assert_type(1, 'string')",
+		"assert_type(1::seconds, 'int')",
+		"assert_type(1, 'nosuchtype')",
+		"is_type(1, 'nosuchtype')",
+		"is_type(1, 2)",
+		"is_type(1)",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestIsTypeUserType(t *testing.T) {
+	input := `
+		pub unit bytes { multiples: { kb: 1024 } }
+		pub type Server { host: string }
+		[is_type(1::kb, 'bytes'), is_type({host: 'a'}::Server, 'Server'), is_type({host: 'a'}, 'Server')]`
+	m, err := evalSelfContainedModule(input, GlobalCtx())
+	if err != nil {
+		t.Fatalf("failed to load module: %s", err)
+	}
+	want := ListVal{Elements: []Val{BoolVal(true), BoolVal(true), BoolVal(false)}}
+	if diff := cmp.Diff(want, m.body); diff != "" {
+		t.Errorf("Value mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestZipWith(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{name: "plus", input: "zip_with(func(x, y) { x + y }, [1, 2, 3], [10, 20, 30])",
+			want: ListVal{[]Val{IntVal(11), IntVal(22), IntVal(33)}}},
+		{name: "shorter-xs", input: "zip_with(func(x, y) { x * y }, [2], [3, 4])",
+			want: ListVal{[]Val{IntVal(6)}}},
+		{name: "shorter-ys", input: "zip_with(func(x, y) { x * y }, [2, 3], [4])",
+			want: ListVal{[]Val{IntVal(8)}}},
+		{name: "empty", input: "zip_with(func(x, y) { x }, [], [1])", want: ListVal{[]Val{}}},
+		{name: "both-empty", input: "zip_with(func(x, y) { x }, [], [])", want: ListVal{[]Val{}}},
+		{name: "doubles", input: "zip_with(func(x, y) { x - y }, [1.5, 2.5], [0.5, 1.0])",
+			want: ListVal{[]Val{DoubleVal(1), DoubleVal(1.5)}}},
+		{name: "builtin", input: "zip_with(max, [1, 5], [3, 2])",
+			want: ListVal{[]Val{IntVal(3), IntVal(5)}}},
+		{name: "records", input: "zip_with(func(n, p) { {name: n port: p} }, ['a'], [80])",
+			want: ListVal{[]Val{NewRecWithFields(map[string]Val{"name": StringVal("a"), "port": IntVal(80)})}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestZipWithError(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "not-callable", input: "zip_with(1, [1], [2])"},
+		{name: "xs-not-list", input: "zip_with(func(x, y) { x }, 1, [2])"},
+		{name: "ys-not-list", input: "zip_with(func(x, y) { x }, [1], 'a')"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestJustify(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "ljust('ab', 5)", want: StringVal("ab   ")},
+		{input: "rjust('ab', 5)", want: StringVal("   ab")},
+		// Odd padding is distributed like in Python's str.center.
+		{input: "center('ab', 5)", want: StringVal("  ab ")},
+		{input: "center('abc', 6)", want: StringVal(" abc  ")},
+		{input: "center('ab', 6, '*')", want: StringVal("**ab**")},
+		{input: "rjust('7', 3, '0')", want: StringVal("007")},
+		// Width is measured in runes, not bytes.
+		{input: "ljust('über', 5, '.')", want: StringVal("über.")},
+		{input: "rjust('x', 3, 'ü')", want: StringVal("üüx")},
+		// Strings longer than width are returned unchanged.
+		{input: "ljust('abc', 2)", want: StringVal("abc")},
+		{input: "center('abc', -1)", want: StringVal("abc")},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestJustifyError(t *testing.T) {
+	tests := []string{
+		"ljust('a')",
+		"ljust(1, 2)",
+		"rjust('a', '2')",
+		"center('a', 3, '')",
+		"center('a', 3, 'xy')",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestNumericBuiltins(t *testing.T) {
+	seconds := func(x float64) UnitVal {
+		return UnitVal{V: x, F: builtinTypeDuration.UnitMults["seconds"], T: builtinTypeDuration}
+	}
+	minutes := func(x float64) UnitVal {
+		return UnitVal{V: x, F: builtinTypeDuration.UnitMults["minutes"], T: builtinTypeDuration}
+	}
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "min([3, 1, 2])", want: IntVal(1)},
+		{input: "max([3, 1, 2])", want: IntVal(3)},
+		{input: "min(3, 1, 2)", want: IntVal(1)},
+		{input: "max(3, 4)", want: IntVal(4)},
+		{input: "min([7])", want: IntVal(7)},
+		{input: "min([1.5, -2.5])", want: DoubleVal(-2.5)},
+		{input: "max(1.5, -2.5)", want: DoubleVal(1.5)},
+		{input: "max([1::minutes, 90::seconds, 10::seconds])", want: seconds(90)},
+		{input: "min(1::minutes, 90::seconds)", want: minutes(1)},
+		{input: "sum([1, 2, 3])", want: IntVal(6)},
+		{input: "sum([0.5, 0.25])", want: DoubleVal(0.75)},
+		{input: "sum([])", want: IntVal(0)},
+		{input: "sum([1::minutes, 30::seconds])", want: seconds(90)},
+		{input: "abs(-3)", want: IntVal(3)},
+		{input: "abs(3)", want: IntVal(3)},
+		{input: "abs(-0.5)", want: DoubleVal(0.5)},
+		{input: "abs(-2::minutes)", want: minutes(2)},
+	}
+	opts := cmpopts.IgnoreInterfaces(struct{ CallableVal }{})
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got, opts); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNumericBuiltinsError(t *testing.T) {
+	tests := []string{
+		"min([])",
+		"max()",
+		"min(1)",
+		"max([1, 'a'])",
+		"min(1, 2.0)",
+		"sum(['a', 'b'])",
+		"sum([1, 2.0])",
+		"sum(1)",
+		"abs('a')",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{
+			name:  "by-name",
+			input: "select({a: 1 b: 2 c: 3}, func(k, v) { k != 'b' })",
+			want:  NewRecWithFields(map[string]Val{"a": IntVal(1), "c": IntVal(3)}),
+		},
+		{
+			name:  "by-value",
+			input: "select({a: 1 b: 2 c: 3}, func(k, v) { v > 1 })",
+			want:  NewRecWithFields(map[string]Val{"b": IntVal(2), "c": IntVal(3)}),
+		},
+		{
+			name:  "by-name-and-value",
+			input: "select({a: 1 b: 2 c: 3}, func(k, v) { k == 'a' || v == 3 })",
+			want:  NewRecWithFields(map[string]Val{"a": IntVal(1), "c": IntVal(3)}),
+		},
+		{
+			name:  "none",
+			input: "select({a: 1}, func(k, v) { false })",
+			want:  NewRec(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSelectPreservesAnnotations(t *testing.T) {
+	e, err := parse("select({x::int: 1 y::string: 'a'}, func(k, v) { k == 'x' })")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	got, err := Eval(e, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	r := got.(*RecVal)
+	if len(r.Fields) != 1 {
+		t.Fatalf("Want 1 field, got %d", len(r.Fields))
+	}
+	if a := r.FieldAnnotations["x"]; a == nil || a.T != builtinTypeInt {
+		t.Errorf("Want int annotation for field x, got %v", a)
+	}
+}
+
+func TestCountAnyAll(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "count(func (x) { x > 1 }, [1, 2, 3])", want: IntVal(2)},
+		{input: "count(func (x) { x > 1 }, [])", want: IntVal(0)},
+		{input: "any(func (x) { x > 1 }, [1, 2, 3])", want: BoolVal(true)},
+		{input: "any(func (x) { x > 3 }, [1, 2, 3])", want: BoolVal(false)},
+		{input: "all(func (x) { x > 0 }, [1, 2, 3])", want: BoolVal(true)},
+		{input: "all(func (x) { x > 1 }, [1, 2, 3])", want: BoolVal(false)},
+		// Empty lists.
+		{input: "any(func (x) { true }, [])", want: BoolVal(false)},
+		{input: "all(func (x) { false }, [])", want: BoolVal(true)},
+		// Predicate results are converted to bool.
+		{input: "count(func (x) { x }, [0, 1, '', 'a', nil])", want: IntVal(2)},
+		{input: "all(isnil, [nil, nil])", want: BoolVal(true)},
+		// any and all short-circuit: the predicate is not called after the result is known.
+		{input: "any(func (x) { if x == 1 then true else error('boom') }, [1, 2])", want: BoolVal(true)},
+		{input: "all(func (x) { if x == 1 then false else error('boom') }, [1, 2])", want: BoolVal(false)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCountAnyAllError(t *testing.T) {
+	tests := []string{
+		"count(1, [1])",
+		"count(func (x) { x }, 1)",
+		"any(func (x) { x }, {a: 1})",
+		"all('a', [])",
+		"count(func (x) { error('boom') }, [1])",
+		"any(func (x) { if x == 2 then true else error('boom') }, [1, 2])",
+		"all(func (x, y) { true }, [1])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestPretty(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "pretty(1)", want: "1"},
+		{input: "pretty('a')", want: `"a"`},
+		{input: "pretty(nil)", want: "nil"},
+		{input: "pretty(90::seconds)", want: "90::seconds"},
+		{input: "pretty({})", want: "{}"},
+		{input: "pretty([])", want: "[]"},
+		{input: "pretty([1, 2])", want: "[\n  1,\n  2\n]"},
+		{
+			// Fields are written in declaration order.
+			input: "pretty({name: 'job' timeout: 5::minutes retry: {count: 3 delays: [1::seconds, 10::seconds]} tags: []})",
+			want: `{
+  name: "job"
+  timeout: 5::minutes
+  retry: {
+    count: 3
+    delays: [
+      1::seconds,
+      10::seconds
+    ]
+  }
+  tags: []
+}`,
+		},
+		{input: "pretty({f: len})", want: "{\n  f: <builtin len>\n}"},
+		{input: "pretty([{a: 1}])", want: "[\n  {\n    a: 1\n  }\n]"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(StringVal(test.want), got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPartition(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{
+			input: "partition(func (x) { x % 2 == 0 }, [1, 2, 3, 4, 5])",
+			want:  ListVal{[]Val{ListVal{[]Val{IntVal(2), IntVal(4)}}, ListVal{[]Val{IntVal(1), IntVal(3), IntVal(5)}}}},
+		},
+		{
+			input: "partition(func (s) { len(s) > 1 }, ['ccc', 'a', 'bb', 'd'])",
+			want:  ListVal{[]Val{ListVal{[]Val{StringVal("ccc"), StringVal("bb")}}, ListVal{[]Val{StringVal("a"), StringVal("d")}}}},
+		},
+		{
+			input: "partition(func (x) { true }, [1, 2])",
+			want:  ListVal{[]Val{ListVal{[]Val{IntVal(1), IntVal(2)}}, ListVal{[]Val{}}}},
+		},
+		{
+			input: "partition(func (x) { true }, [])",
+			want:  ListVal{[]Val{ListVal{[]Val{}}, ListVal{[]Val{}}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPartitionError(t *testing.T) {
+	tests := []string{
+		"partition(1, [1])",
+		"partition(func (x) { x }, 'abc')",
+		"partition(func (x) { x + 'a' }, [1])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestDeepGetDeepSet(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "deep_get({a: {b: {c: 1}}}, 'a.b.c', 0)", want: "1"},
+		{input: "deep_get({a: {b: {c: 1}}}, 'a.b', 0)", want: "{c: 1}"},
+		{input: "deep_get({a: 1}, 'a', 0)", want: "1"},
+		// Missing segments yield the default.
+		{input: "deep_get({a: {b: {c: 1}}}, 'a.x.c', 0)", want: "0"},
+		{input: "deep_get({a: {b: {c: 1}}}, 'a.b.c.d', 'def')", want: "'def'"},
+		{input: "deep_get({}, 'a', nil)", want: "nil"},
+		{input: "deep_get({a: [1]}, 'a.0', -1)", want: "-1"},
+		{input: "deep_set({a: {b: {c: 1}}}, 'a.b.c', 2)", want: "{a: {b: {c: 2}}}"},
+		{input: "deep_set({a: 1}, 'a', 'x')", want: "{a: 'x'}"},
+		{input: "deep_set({}, 'a.b.c', 1)", want: "{a: {b: {c: 1}}}"},
+		{input: "deep_set({a: {x: 0}}, 'a.b.c', 1)", want: "{a: {x: 0 b: {c: 1}}}"},
+		{input: "deep_set({a: {b: 1} z: 2}, 'a.b', {c: 3})", want: "{a: {b: {c: 3}} z: 2}"},
+		// The original record is not modified.
+		{input: "{let r: {a: {b: 1}} x: deep_set(r, 'a.b', 2) y: r}.y", want: "{a: {b: 1}}"},
+		{input: "deep_get(deep_set({}, 'a.b', 7), 'a.b', 0)", want: "7"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			w, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse expected expression: %s", err)
+			}
+			want, err := Eval(w, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate expected expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestDeepSetPreservesOrder(t *testing.T) {
+	e, err := parse("deep_set({c: 1 a: 2 b: 3}, 'a', 0)")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	got, err := Eval(e, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	if diff := cmp.Diff([]string{"c", "a", "b"}, got.(*RecVal).FieldNames()); diff != "" {
+		t.Errorf("Field names differ (-want +got): %s", diff)
+	}
+}
+
+func TestDeepGetDeepSetTyped(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string // Expression that evaluates to the expected value.
+		wantErr bool
+	}{
+		{name: "get", input: "deep_get({a: {b: 1}::Inner}::Outer, 'a.b', 0)", want: "1"},
+		{name: "set", input: "deep_set({a: {b: 1}::Inner}::Outer, 'a.b', 2)", want: "{a: {b: 2}::Inner}::Outer"},
+		{name: "setUntypedOuter", input: "deep_set({a: {b: 1}::Inner}, 'a.b', 2)", want: "{a: {b: 2}::Inner}"},
+		{name: "setNewField", input: "deep_set({a: {b: 1}::Inner}, 'a.c', 2)", want: "{a: {b: 1 c: 2}::Inner}"},
+		{name: "setInvalid", input: "deep_set({a: {b: 1}::Inner}::Outer, 'a.b', 'x')", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decls := "pub type Inner { b: int } pub type Outer { a: Inner } "
+			if test.wantErr {
+				m, err := evalSelfContainedModule(decls+test.input, GlobalCtx())
+				if err == nil {
+					t.Errorf("Wanted error, got %v", m.body)
+				}
+				return
+			}
+			// Evaluate both expressions in the same module, so they share their types.
+			input := fmt.Sprintf("%s{got: %s want: %s}", decls, test.input, test.want)
+			m, err := evalSelfContainedModule(input, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			r := m.body.(*RecVal)
+			if got, want := r.Fields["got"], r.Fields["want"]; !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestDeepGetDeepSetError(t *testing.T) {
+	tests := []string{
+		"deep_get(1, 'a', 0)",
+		"deep_get({}, 1, 0)",
+		"deep_set(1, 'a', 0)",
+		"deep_set({}, 1, 0)",
+		// Intermediate values must be records.
+		"deep_set({a: 1}, 'a.b', 0)",
+		"deep_set({a: {b: [1]}}, 'a.b.c', 0)",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestClampBetween(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "clamp(5, 0, 10)", want: "5"},
+		{input: "clamp(-1, 0, 10)", want: "0"},
+		{input: "clamp(11, 0, 10)", want: "10"},
+		{input: "clamp(0, 0, 0)", want: "0"},
+		{input: "clamp(0.5, 1.0, 2.0)", want: "1.0"},
+		{input: "clamp(90::seconds, 1::minutes, 2::minutes)", want: "90::seconds"},
+		{input: "clamp(3::hours, 1::minutes, 2::minutes)", want: "2::minutes"},
+		{input: "clamp(1::seconds, 1::minutes, 2::minutes)", want: "1::minutes"},
+		{input: "between(5, 0, 10)", want: "true"},
+		{input: "between(0, 0, 10)", want: "true"},
+		{input: "between(10, 0, 10)", want: "true"},
+		{input: "between(-1, 0, 10)", want: "false"},
+		{input: "between(11, 0, 10)", want: "false"},
+		{input: "between(2.5, 1.0, 2.0)", want: "false"},
+		{input: "between(90::seconds, 1::minutes, 2::minutes)", want: "true"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			we, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse want expression: %s", err)
+			}
+			want, err := Eval(we, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate want expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestClampBetweenError(t *testing.T) {
+	tests := []string{
+		"clamp(1, 0.0, 2.0)",
+		"clamp(1, 0, 2.0)",
+		"clamp(1::seconds, 0::percent, 2::percent)",
+		"clamp('a', 'b', 'c')",
+		"clamp(1, 2, 0)",
+		"between(1, 0, 'x')",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "coalesce()", want: NilVal{}},
+		{input: "coalesce(nil)", want: NilVal{}},
+		{input: "coalesce(nil, nil, nil)", want: NilVal{}},
+		{input: "coalesce(1)", want: IntVal(1)},
+		{input: "coalesce(nil, 'a', 'b')", want: StringVal("a")},
+		{input: "coalesce(nil, nil, false)", want: BoolVal(false)},
+		{input: "coalesce(getenv('KONFI_TEST_UNSET'), [])", want: ListVal{Elements: []Val{}}},
+		{input: "default(nil, 2)", want: IntVal(2)},
+		{input: "default(1, 2)", want: IntVal(1)},
+		{input: "default('', 'x')", want: StringVal("")},
+		{input: "default(nil, nil)", want: NilVal{}},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestConcat(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "concat()", want: ListVal{Elements: []Val{}}},
+		{input: "concat([])", want: ListVal{Elements: []Val{}}},
+		{input: "concat([1, 'a'])", want: ListVal{Elements: []Val{IntVal(1), StringVal("a")}}},
+		{input: "concat([1], [], [2, 3], [[4]])",
+			want: ListVal{Elements: []Val{IntVal(1), IntVal(2), IntVal(3), ListVal{Elements: []Val{IntVal(4)}}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestConcatCopies(t *testing.T) {
+	xs := ListVal{Elements: []Val{IntVal(1), IntVal(2)}}
+	got, err := builtinConcat([]Val{xs}, GlobalCtx())
+	if err != nil {
+		t.Fatalf("concat failed: %s", err)
+	}
+	got.(ListVal).Elements[0] = IntVal(7)
+	if xs.Elements[0] != IntVal(1) {
+		t.Errorf("concat modified its argument: %v", xs)
+	}
+}
+
+func TestConcatError(t *testing.T) {
+	tests := []string{
+		"concat(1)",
+		"concat([1], 'a')",
+		"concat([1], {})",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestNow(t *testing.T) {
+	clock := func() time.Time {
+		return time.Date(2024, 2, 28, 23, 30, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		input string
+		want  string // Expression that evaluates to the expected value.
+	}{
+		{input: `now()`, want: `'2024-02-28T23:30:00Z'::time`},
+		{input: `now().year`, want: `2024`},
+		{input: `typeof(now())`, want: `'time'`},
+		{input: `now() + 1::hours`, want: `'2024-02-29T00:30:00Z'::time`},
+		{input: `now() + 1::days + 1::days`, want: `'2024-03-01T23:30:00Z'::time`},
+		{input: `2::seconds + now()`, want: `'2024-02-28T23:30:02Z'::time`},
+		{input: `now() - 90::minutes`, want: `'2024-02-28T22:00:00Z'::time`},
+		{input: `now() + 1.5::millis`, want: `'2024-02-28T23:30:00.0015Z'::time`},
+		{input: `'2024-01-01 12:00:00 +0200'::time + 1::hours`, want: `'2024-01-01 13:00:00 +0200'::time`},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			ctx := GlobalCtx()
+			ctx.SetClock(clock)
+			got, err := Eval(e, ctx)
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			we, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse want expression: %s", err)
+			}
+			want, err := Eval(we, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate want expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestNowDefaultClock(t *testing.T) {
+	e, err := parse("now()")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	before := time.Now().Truncate(time.Second)
+	v, err := Eval(e, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	after := time.Now()
+	tv, ok := v.(TypedVal)
+	if !ok || tv.T != builtinTypeTime {
+		t.Fatalf("Want time value, got %v", v)
+	}
+	if got := goTime(tv.V.(*RecVal)); got.Before(before) || got.After(after) {
+		t.Errorf("Want time between %v and %v, got %v", before, after, got)
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: `format_time('2023-01-02T03:04:05Z'::time, '2006-01-02')`, want: "2023-01-02"},
+		{input: `format_time('2023-01-02T03:04:05Z'::time, 'Jan 2, 2006 at 3:04pm (MST)')`, want: "Jan 2, 2023 at 3:04am (UTC)"},
+		{input: `format_time('2023-07-14 18:30:00 +0200'::time, '02.01.2006 15:04 -07:00')`, want: "14.07.2023 18:30 +02:00"},
+		{input: `format_time('2023-07-14 18:30:00 -0530'::time, 'Mon 15:04:05 MST')`, want: "Fri 18:30:00 -0530"},
+		{input: `format_time('2023-07-14T18:30:00.25+01:00'::time, '15:04:05.000Z07:00')`, want: "18:30:00.250+01:00"},
+		{input: `format_time('2023-07-14T18:30:00Z'::time, 'plain text')`, want: "plain text"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if got != StringVal(test.want) {
+				t.Errorf("Want %q, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestFormatTimeError(t *testing.T) {
+	tests := []string{
+		"format_time('2023-01-02', '2006')",
+		"format_time(80::port, '2006')",
+		"format_time('2023-01-02'::time, 2006)",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestTimeDiff(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // Expression that evaluates to the expected value.
+	}{
+		{input: `time_diff('2023-01-02T04:00:00Z'::time, '2023-01-02T03:00:00Z'::time)`, want: `3600::seconds`},
+		{input: `time_diff('2023-01-02T03:00:00Z'::time, '2023-01-02T04:00:00Z'::time)`, want: `-3600::seconds`},
+		{input: `time_diff('2023-01-02'::time, '2023-01-02'::time)`, want: `0::seconds`},
+		// Same wall clock time in different timezones.
+		{input: `time_diff('2023-01-02 12:00:00 +0100'::time, '2023-01-02 12:00:00 +0200'::time)`, want: `3600::seconds`},
+		// Across midnight and a change of offset: 23:30 UTC is 01:30 the next day at +0200.
+		{input: `time_diff('2023-01-03 01:45:00 +0200'::time, '2023-01-02T23:30:00Z'::time)`, want: `900::seconds`},
+		{input: `time_diff('2023-01-02T03:00:00.5Z'::time, '2023-01-02T03:00:00Z'::time)`, want: `0.5::seconds`},
+		{input: `time_diff('2024-03-01'::time, '2024-02-28'::time)::days`, want: `2::days`},
+		// 400 Gregorian years have 146097 days, more than time.Duration can represent.
+		{input: `time_diff('2400-01-01'::time, '2000-01-01'::time)`, want: `12622780800::seconds`},
+		{input: `time_diff('1600-01-01T00:00:00.25Z'::time, '2000-01-01T00:00:00.5Z'::time)`, want: `-12622780800.25::seconds`},
+		{input: `'2023-01-02'::time + time_diff('2023-01-05'::time, '2023-01-02'::time)`, want: `'2023-01-05'::time`},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			we, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse want expression: %s", err)
+			}
+			want, err := Eval(we, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate want expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestTimeDiffError(t *testing.T) {
+	tests := []string{
+		"time_diff('2023-01-02'::time, '2023-01-02')",
+		"time_diff(1::hours, '2023-01-02'::time)",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestTimeArithmeticError(t *testing.T) {
+	tests := []string{
+		"now() + 1",
+		"now() + 1::percent",
+		"now() + now()",
+		"1::hours - now()",
+		"80::port + 1::hours",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestParseIntDouble(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // Expression that evaluates to the expected value.
+	}{
+		{input: `parse_int('42')`, want: `42`},
+		{input: `parse_int('-17', 10)`, want: `-17`},
+		{input: `parse_int('ff', 16)`, want: `255`},
+		{input: `parse_int('0x1F', 0)`, want: `31`},
+		{input: `parse_int('0b101', 0)`, want: `5`},
+		{input: `parse_int('0o17', 0)`, want: `15`},
+		{input: `parse_int('1_000', 0)`, want: `1000`},
+		{input: `parse_int('z', 36)`, want: `35`},
+		{input: `parse_double('3.5')`, want: `3.5`},
+		{input: `parse_double('-1e3')`, want: `-1000.0`},
+		{input: `parse_double('2')`, want: `2.0`},
+		// Malformed input can be handled with pcall or try.
+		{input: `pcall(parse_int, 'x').err`, want: `true`},
+		{input: `pcall(parse_int, '12', 8).value`, want: `10`},
+		{input: `try(func () { parse_double('one') }, 0.0)`, want: `0.0`},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			we, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse want expression: %s", err)
+			}
+			want, err := Eval(we, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate want expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestParseIntDoubleError(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{input: `parse_int('')`, wantErr: `parse_int: invalid int for base 10: ""`},
+		{input: `parse_int('12a')`, wantErr: `parse_int: invalid int for base 10: "12a"`},
+		{input: `parse_int('ff', 10)`, wantErr: `parse_int: invalid int for base 10: "ff"`},
+		{input: `parse_int('0x1F')`, wantErr: `parse_int: invalid int for base 10: "0x1F"`},
+		{input: `parse_int('99999999999999999999')`, wantErr: `parse_int: value out of range`},
+		{input: `parse_int('1', 1)`, wantErr: `parse_int: base must be 0 or between 2 and 36, got 1`},
+		{input: `parse_int('1', 37)`, wantErr: `parse_int: base must be 0 or between 2 and 36, got 37`},
+		{input: `parse_int(1)`, wantErr: `parse_int: 1st argument must be a string, got int`},
+		{input: `parse_int('1', '10')`, wantErr: `parse_int: 2nd argument must be an int, got string`},
+		{input: `parse_int('1', 10, 1)`, wantErr: `parse_int: invalid number of arguments: 3`},
+		{input: `parse_double('1.2.3')`, wantErr: `parse_double: invalid double: "1.2.3"`},
+		{input: `parse_double('1e400')`, wantErr: `parse_double: value out of range`},
+		{input: `parse_double(1.0)`, wantErr: `parse_double: argument must be a string, got double`},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("Wanted error, got %v", got)
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestIterateRepeat(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // Expression that evaluates to the expected value.
+	}{
+		{input: `iterate(func (x) { x * x }, 4, 2)`, want: `65536`},
+		{input: `iterate(func (x) { x + 1 }, 0, 'v')`, want: `'v'`},
+		{input: `iterate(func (xs) { concat(xs, [len(xs)]) }, 3, [])`, want: `[0, 1, 2]`},
+		{input: `repeat('a', 3)`, want: `['a', 'a', 'a']`},
+		{input: `repeat([1], 2)`, want: `[[1], [1]]`},
+		{input: `repeat(1, 0)`, want: `[]`},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			we, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse want expression: %s", err)
+			}
+			want, err := Eval(we, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate want expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestIterateRepeatError(t *testing.T) {
+	tests := []string{
+		"iterate(1, 1, 1)",
+		"iterate(func (x) { x }, -1, 1)",
+		"iterate(func (x) { x }, 'a', 1)",
+		"iterate(func (x) { x + 1 }, 2, 'a')",
+		"repeat(1, -1)",
+		"repeat(0, 1000000000000000)",
+		"repeat(0, 10000001)",
+		"repeat(1, 2.0)",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestLinesUnlines(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // Expression that evaluates to the expected value.
+	}{
+		{input: `lines('')`, want: `[]`},
+		{input: `lines('a')`, want: `['a']`},
+		{input: `lines('a\nb')`, want: `['a', 'b']`},
+		// A trailing line break does not produce an empty last line.
+		{input: `lines('a\nb\n')`, want: `['a', 'b']`},
+		{input: `lines('\n')`, want: `['']`},
+		{input: `lines('a\n\nb\n\n')`, want: `['a', '', 'b', '']`},
+		// CRLF line breaks are normalized.
+		{input: `lines('a\r\nb\r\n')`, want: `['a', 'b']`},
+		{input: `lines('a\r\nb\nc')`, want: `['a', 'b', 'c']`},
+		{input: `lines('a\rb')`, want: `['a\rb']`},
+		{input: `unlines([])`, want: `''`},
+		{input: `unlines(['a'])`, want: `'a'`},
+		{input: `unlines(['a', '', 'b'])`, want: `'a\n\nb'`},
+		// Round trips.
+		{input: `unlines(lines('a\nb\nc'))`, want: `'a\nb\nc'`},
+		{input: `unlines(lines('a\r\nb\r\n'))`, want: `'a\nb'`},
+		{input: `lines(unlines(['x', '', 'y']))`, want: `['x', '', 'y']`},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			w, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse expected expression: %s", err)
+			}
+			want, err := Eval(w, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate expected expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestLinesUnlinesError(t *testing.T) {
+	tests := []string{
+		"lines(1)",
+		"lines(['a'])",
+		"unlines('a')",
+		"unlines(['a', 1])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestEntries(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // Expression that evaluates to the expected value.
+	}{
+		{input: "entries({})", want: "[]"},
+		{input: "entries({b: 2 a: 'x' c: [1]})", want: "[['a', 'x'], ['b', 2], ['c', [1]]]"},
+		{input: "entries({a: {b: 1}})", want: "[['a', {b: 1}]]"},
+		// Entries can be processed like any other list.
+		{input: "flatmap(func (e) { [fold(func (k, v) { k }, e)] }, entries({y: 1 x: 2}))", want: "['x', 'y']"},
+		{input: "sum(flatmap(func (e) { [fold(func (k, v) { v }, e)] }, entries({a: 1 b: 2 c: 3})))", want: "6"},
+		// mkrec is the inverse of entries.
+		{input: "mkrec(entries({a: 1 b: {c: 'x'}}))", want: "{a: 1 b: {c: 'x'}}"},
+		{input: "mkrec(entries({}))", want: "{}"},
+		{input: "mkrec(flatmap(func (e) { e }, entries({a: 1 b: {c: 'x'}})))", want: "{a: 1 b: {c: 'x'}}"},
+		{input: "mkrec([['a', [1, 2]], ['b', nil]])", want: "{a: [1, 2] b: nil}"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			w, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse expected expression: %s", err)
+			}
+			want, err := Eval(w, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate expected expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestEntriesError(t *testing.T) {
+	tests := []string{
+		"entries([1, 2])",
+		"entries('a')",
+		"entries()",
+		"mkrec([['a', 1], 'b'])",
+		"mkrec([['a', 1], ['b']])",
+		"mkrec([[1, 'a']])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestFlattenPaths(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "flatten_paths({})", want: NewRec()},
+		{input: "flatten_paths({a: 1 b: 'x'})", want: NewRecWithFields(map[string]Val{"a": IntVal(1), "b": StringVal("x")})},
+		{
+			input: "flatten_paths({db: {host: 'h' port: 5432} debug: false})",
+			want: NewRecWithFields(map[string]Val{
+				"db.host": StringVal("h"),
+				"db.port": IntVal(5432),
+				"debug":   BoolVal(false),
+			}),
+		},
+		{
+			input: "flatten_paths({items: [{name: 'a'}, {name: 'b' tags: ['x', nil]}]})",
+			want: NewRecWithFields(map[string]Val{
+				"items.0.name":   StringVal("a"),
+				"items.1.name":   StringVal("b"),
+				"items.1.tags.0": StringVal("x"),
+				"items.1.tags.1": NilVal{},
+			}),
+		},
+		// Empty records and lists are leaves.
+		{
+			input: "flatten_paths({a: {} b: [] c: [[]]})",
+			want: NewRecWithFields(map[string]Val{
+				"a":   NewRec(),
+				"b":   ListVal{[]Val{}},
+				"c.0": ListVal{[]Val{}},
+			}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+// Typed records are traversed like untyped ones.
+func TestFlattenPathsTyped(t *testing.T) {
+	const input = `pub type Server { host: string port: int }
+		pub type App { server: Server }
+		flatten_paths({server: {host: 'h' port: 80}::Server}::App)`
+	m, err := evalSelfContainedModule(input, GlobalCtx())
+	if err != nil {
+		t.Fatalf("failed to load module: %s", err)
+	}
+	want := NewRecWithFields(map[string]Val{
+		"server.host": StringVal("h"),
+		"server.port": IntVal(80),
+	})
+	if !m.body.Equal(want) {
+		t.Errorf("Want %v, got %v", want, m.body)
+	}
+}
+
+// Paths are ordered like the fields of the input record.
+func TestFlattenPathsOrder(t *testing.T) {
+	e, err := parse("flatten_paths({z: {y: 1 x: [2, 3]} a: 4})")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	got, err := Eval(e, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	want := []string{"z.y", "z.x.0", "z.x.1", "a"}
+	if diff := cmp.Diff(want, got.(*RecVal).FieldNames()); diff != "" {
+		t.Errorf("Field names differ (-want +got): %s", diff)
+	}
+}
+
+func TestFlattenPathsError(t *testing.T) {
+	tests := []string{
+		"flatten_paths([1])",
+		"flatten_paths(1)",
+		"flatten_paths()",
+		// Colliding paths.
+		"flatten_paths(mkrec('a.b', 1, 'a', {b: 2}))",
+		"flatten_paths(mkrec('a', {b: 2}, 'a.b', 1))",
+		"flatten_paths(mkrec('a', [1], 'a.0', 2))",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestFoldRight(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		// Left and right folds differ for non-associative functions.
+		{input: "fold(func (acc, x) { acc - x }, 0, [1, 2, 3])", want: IntVal(-6)},
+		{input: "fold_right(func (x, acc) { x - acc }, 0, [1, 2, 3])", want: IntVal(2)},
+		{input: "fold(func (x, y) { x - y }, [1, 2, 3])", want: IntVal(-4)},
+		{input: "fold_right(func (x, y) { x - y }, [1, 2, 3])", want: IntVal(2)},
+		{input: "fold_right(func (x, acc) { [x, acc] }, nil, [1, 2])",
+			want: ListVal{[]Val{IntVal(1), ListVal{[]Val{IntVal(2), NilVal{}}}}}},
+		{input: "fold_right(func (x, acc) { acc + x }, '', ['a', 'b', 'c'])", want: StringVal("cba")},
+		{input: "fold_right(func (x, acc) { acc }, 0, [])", want: IntVal(0)},
+		{input: "fold_right(func (x, y) { x }, [])", want: NilVal{}},
+		{input: "fold_right(func (x, y) { x }, [7])", want: IntVal(7)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestFoldRightError(t *testing.T) {
+	tests := []string{
+		"fold_right(func (x, y) { x })",
+		"fold_right(1, [1])",
+		"fold_right(func (x, y) { x }, 1)",
+		"fold_right(func (x, y) { x }, 0, 1)",
+		"fold_right(func (x, y) { x }, 0, [1], 2)",
+		"fold_right(func (x, y) { x + y }, 0, [1, 'a'])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestMapValuesMapKeys(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "map_values(func (x) { x * 2 }, {a: 1 b: 2})", want: NewRecWithFields(map[string]Val{"a": IntVal(2), "b": IntVal(4)})},
+		{input: "map_values(func (x) { x }, {})", want: NewRec()},
+		{input: "map_values(str, {a: 1 b: true})", want: NewRecWithFields(map[string]Val{"a": StringVal("1"), "b": StringVal("true")})},
+		{input: "map_keys(func (k) { 'x_' + k }, {a: 1 b: 2})", want: NewRecWithFields(map[string]Val{"x_a": IntVal(1), "x_b": IntVal(2)})},
+		{input: "map_keys(func (k) { k }, {})", want: NewRec()},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestMapValuesMapKeysPreserveOrder(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{input: "map_values(func (x) { -x }, {c: 1 a: 2 b: 3})", want: []string{"c", "a", "b"}},
+		{input: "map_keys(func (k) { k + k }, {c: 1 a: 2 b: 3})", want: []string{"cc", "aa", "bb"}},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got.(*RecVal).FieldNames()); diff != "" {
+				t.Errorf("Field names differ (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestMapValuesMapKeysError(t *testing.T) {
+	tests := []string{
+		"map_values(1, {a: 1})",
+		"map_values(func (x) { x }, [1])",
+		"map_values(func (x) { x + 'a' }, {a: 1})",
+		"map_keys(1, {a: 1})",
+		"map_keys(func (k) { k }, [1])",
+		"map_keys(func (k) { 1 }, {a: 1})",
+		// Duplicate keys.
+		"map_keys(func (k) { 'x' }, {a: 1 b: 2})",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestWithout(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "without({a: 1 b: 2 c: 3}, 'a', 'b')", want: NewRecWithFields(map[string]Val{"c": IntVal(3)})},
+		{input: "without({a: 1}, 'x')", want: NewRecWithFields(map[string]Val{"a": IntVal(1)})},
+		{input: "without({a: 1})", want: NewRecWithFields(map[string]Val{"a": IntVal(1)})},
+		{input: "without({a: 1}, 'a')", want: NewRec()},
+		// The original record is not modified.
+		{input: "{let r: {a: 1 b: 2} x: without(r, 'a') y: r}.y", want: NewRecWithFields(map[string]Val{"a": IntVal(1), "b": IntVal(2)})},
+		{input: "without({a: 1 tmp: 2} @ {b: 3}, 'tmp')", want: NewRecWithFields(map[string]Val{"a": IntVal(1), "b": IntVal(3)})},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestWithoutEntriesTyped(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string // Expression that evaluates to the expected value.
+		wantErr bool
+	}{
+		{name: "without", input: "without({host: 'h' port: 80 tmp: 1}::Server, 'tmp')", want: "{host: 'h' port: 80}::Server"},
+		{name: "withoutMissingField", input: "without({host: 'h' port: 80}::Server, 'port')", wantErr: true},
+		{name: "entries", input: "entries({host: 'h' port: 80}::Server)", want: "[['host', 'h'], ['port', 80]]"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decls := "pub type Server { host: string port: int } "
+			if test.wantErr {
+				m, err := evalSelfContainedModule(decls+test.input, GlobalCtx())
+				if err == nil {
+					t.Errorf("Wanted error, got %v", m.body)
+				}
+				return
+			}
+			// Evaluate both expressions in the same module, so they share their types.
+			input := fmt.Sprintf("%s{got: %s want: %s}", decls, test.input, test.want)
+			m, err := evalSelfContainedModule(input, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			r := m.body.(*RecVal)
+			if got, want := r.Fields["got"], r.Fields["want"]; !got.Equal(want) {
+				t.Errorf("Want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestWithoutDoesNotModifyArg(t *testing.T) {
+	r := NewRecWithFields(map[string]Val{"a": IntVal(1), "b": IntVal(2)})
+	got, err := builtinWithout([]Val{r, StringVal("a")}, nil)
+	if err != nil {
+		t.Fatalf("Error calling without: %s", err)
+	}
+	if n := len(got.(*RecVal).Fields); n != 1 {
+		t.Errorf("Want 1 field in result, got %d", n)
+	}
+	if n := len(r.Fields); n != 2 {
+		t.Errorf("Want 2 fields in original record, got %d", n)
+	}
+}
+
+func TestWithoutError(t *testing.T) {
+	tests := []string{
+		"without()",
+		"without(1, 'a')",
+		"without({a: 1}, 1)",
+		"without({a: 1}, ['a'])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestStringBuiltins(t *testing.T) {
+	strs := func(ss ...string) ListVal {
+		xs := make([]Val, len(ss))
+		for i, s := range ss {
+			xs[i] = StringVal(s)
+		}
+		return ListVal{Elements: xs}
+	}
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "split('a-b-c', '-')", want: strs("a", "b", "c")},
+		{input: "split('abc', '')", want: strs("a", "b", "c")},
+		{input: "split('', ',')", want: strs("")},
+		{input: "split('a,', ',')", want: strs("a", "")},
+		{input: "join('-', ['a', 'b', 'c'])", want: StringVal("a-b-c")},
+		{input: "join(', ', [])", want: StringVal("")},
+		{input: "join('-', split('a-b-c', '-')) == 'a-b-c'", want: BoolVal(true)},
+		{input: "split(join(':', ['x', 'y']), ':')", want: strs("x", "y")},
+		{input: "replace('a.b.c', '.', '/')", want: StringVal("a/b/c")},
+		{input: "replace('aaa', 'a', 'bb')", want: StringVal("bbbbbb")},
+		{input: "replace('abc', 'x', 'y')", want: StringVal("abc")},
+		{input: "trim('  a b \\t\\n')", want: StringVal("a b")},
+		{input: "trim('--a-b--', '-')", want: StringVal("a-b")},
+		{input: "trimspace(' x ')", want: StringVal("x")},
+		{input: "upper('abc')", want: StringVal("ABC")},
+		{input: "upper('ü')", want: StringVal("Ü")},
+		{input: "lower('AbC')", want: StringVal("abc")},
+		{input: "lower('ÄÖÜ')", want: StringVal("äöü")},
+		{input: "startswith('konfi', 'kon')", want: BoolVal(true)},
+		{input: "startswith('konfi', 'fi')", want: BoolVal(false)},
+		{input: "startswith('konfi', '')", want: BoolVal(true)},
+		{input: "endswith('konfi', 'fi')", want: BoolVal(true)},
+		{input: "endswith('konfi', 'kon')", want: BoolVal(false)},
+		{input: "indexof('konfi', 'nf')", want: IntVal(2)},
+		{input: "indexof('konfi', 'x')", want: IntVal(-1)},
+		{input: "indexof('äb', 'b')", want: IntVal(2)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStringBuiltinsError(t *testing.T) {
+	tests := []string{
+		"split(1, ',')",
+		"join('-', ['a', 1])",
+		"join('-', 'abc')",
+		"join(1, ['a'])",
+		"replace('a', 'b', 3)",
+		"trim(1)",
+		"trim('a', 'b', 'c')",
+		"trimspace(nil)",
+		"upper(1)",
+		"lower([])",
+		"startswith('a', 1)",
+		"endswith(nil, 'a')",
+		"indexof('a', {})",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestListSlicing(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "take(2, [1, 2, 3])", want: ListVal{Elements: []Val{IntVal(1), IntVal(2)}}},
+		{input: "take(0, [1, 2, 3])", want: ListVal{Elements: []Val{}}},
+		{input: "take(5, [1, 2, 3])", want: ListVal{Elements: []Val{IntVal(1), IntVal(2), IntVal(3)}}},
+		{input: "take(1, [])", want: ListVal{Elements: []Val{}}},
+		{input: "drop(2, [1, 2, 3])", want: ListVal{Elements: []Val{IntVal(3)}}},
+		{input: "drop(0, [1, 2])", want: ListVal{Elements: []Val{IntVal(1), IntVal(2)}}},
+		{input: "drop(5, [1, 2, 3])", want: ListVal{Elements: []Val{}}},
+		{input: "slice([1, 2, 3, 4], 1, 3)", want: ListVal{Elements: []Val{IntVal(2), IntVal(3)}}},
+		{input: "slice([1, 2, 3], 0, 3)", want: ListVal{Elements: []Val{IntVal(1), IntVal(2), IntVal(3)}}},
+		{input: "slice([1, 2, 3], 2, 2)", want: ListVal{Elements: []Val{}}},
+		{input: "take(2, [1, 2, 3]) == slice([1, 2, 3], 0, 2)", want: BoolVal(true)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListSlicingError(t *testing.T) {
+	tests := []string{
+		"take(-1, [1])",
+		"drop(-1, [1])",
+		"take('a', [1])",
+		"drop(1, 'abc')",
+		"slice([1, 2], -1, 1)",
+		"slice([1, 2], 2, 1)",
+		"slice([1, 2], 0, 3)",
+		"slice('ab', 0, 1)",
+		"slice([1], 0, 'a')",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestUnique(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "unique([1, 2, 1, 3, 2])", want: ListVal{Elements: []Val{IntVal(1), IntVal(2), IntVal(3)}}},
+		{input: "unique([1, 2, 1, 3, 2]) == [1, 2, 3]", want: BoolVal(true)},
+		{input: "unique([])", want: ListVal{Elements: []Val{}}},
+		{input: "unique(['b', 'a', 'b'])", want: ListVal{Elements: []Val{StringVal("b"), StringVal("a")}}},
+		{input: "unique([1, 1.0, '1', true, true, nil, nil])", want: ListVal{Elements: []Val{IntVal(1), DoubleVal(1), StringVal("1"), BoolVal(true), NilVal{}}}},
+		{input: "len(unique([1::minutes, 60::seconds, 1::minutes]))", want: IntVal(2)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUniqueError(t *testing.T) {
+	tests := []string{
+		"unique('abc')",
+		"unique([{a: 1}, {a: 1}])",
+		"unique([1, [2]])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestNormalizeUnit(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "normalize_unit(120::minutes)", want: "2::hours"},
+		{input: "normalize_unit(48::hours)", want: "2::days"},
+		{input: "normalize_unit(90::minutes)", want: "90::minutes"},
+		{input: "normalize_unit(1.5::hours)", want: "90::minutes"},
+		{input: "normalize_unit(7::minutes)", want: "7::minutes"},
+		{input: "normalize_unit(-3600::seconds)", want: "-1::hours"},
+		{input: "normalize_unit(0::seconds)", want: "0::seconds"},
+		{input: "normalize_unit(2000::millis)", want: "2::seconds"},
+		{input: "normalize_unit(0.5::nanos)", want: "0.5::nanos"},
+		{input: "normalize_unit(100::percent)", want: "1::fraction"},
+		{input: "normalize_unit(1::hours + 30::minutes)", want: "90::minutes"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if got.String() != test.want {
+				t.Errorf("Got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeUnitError(t *testing.T) {
+	tests := []string{
+		"normalize_unit(3)",
+		"normalize_unit('2::hours')",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestZip(t *testing.T) {
+	pair := func(x, y Val) Val {
+		return ListVal{Elements: []Val{x, y}}
+	}
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "zip([1, 2], ['a', 'b'])", want: ListVal{Elements: []Val{pair(IntVal(1), StringVal("a")), pair(IntVal(2), StringVal("b"))}}},
+		{input: "zip([1, 2, 3], ['a'])", want: ListVal{Elements: []Val{pair(IntVal(1), StringVal("a"))}}},
+		{input: "zip([1], [true, false])", want: ListVal{Elements: []Val{pair(IntVal(1), BoolVal(true))}}},
+		{input: "zip([], [1, 2])", want: ListVal{Elements: []Val{}}},
+		{input: "zip([1, 2], [3, 4]) == [[1, 3], [2, 4]]", want: BoolVal(true)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestZipError(t *testing.T) {
+	tests := []string{
+		"zip(1, [2])",
+		"zip([1], 'a')",
+		"zip([1])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestMathBuiltins(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "floor(2.7)", want: IntVal(2)},
+		{input: "floor(-2.5)", want: IntVal(-3)},
+		{input: "floor(3)", want: IntVal(3)},
+		{input: "ceil(2.1)", want: IntVal(3)},
+		{input: "ceil(-2.5)", want: IntVal(-2)},
+		{input: "ceil(3)", want: IntVal(3)},
+		{input: "round(2.5)", want: IntVal(3)},
+		{input: "round(2.4)", want: IntVal(2)},
+		{input: "round(-2.5)", want: IntVal(-3)},
+		{input: "round(7)", want: IntVal(7)},
+		{input: "sqrt(16)", want: DoubleVal(4)},
+		{input: "sqrt(2.25)", want: DoubleVal(1.5)},
+		{input: "sqrt(0)", want: DoubleVal(0)},
+		{input: "pow(2, 10)", want: DoubleVal(1024)},
+		{input: "pow(2, 10) == 1024.0", want: BoolVal(true)},
+		{input: "pow(4, 0.5)", want: DoubleVal(2)},
+		{input: "pow(2, -1)", want: DoubleVal(0.5)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMathBuiltinsError(t *testing.T) {
+	tests := []string{
+		"floor('1.5')",
+		"ceil(nil)",
+		"round(1e300)",
+		"sqrt(-1)",
+		"sqrt(-0.5)",
+		"sqrt('4')",
+		"pow(2)",
+		"pow(2, '3')",
+		"pow(1::seconds, 2)",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestSqrtNegativeIsEvalError(t *testing.T) {
+	e, err := parse("sqrt(-4)")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	_, err = Eval(e, GlobalCtx())
+	var evalErr *EvalError
+	if !errors.As(err, &evalErr) {
+		t.Errorf("Wanted EvalError, got %T: %v", err, err)
+	}
+}
+
+func TestGetenv(t *testing.T) {
+	t.Setenv("KONFI_TEST_SET", "value")
+	t.Setenv("KONFI_TEST_EMPTY", "")
+	os.Unsetenv("KONFI_TEST_UNSET")
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "getenv('KONFI_TEST_SET')", want: StringVal("value")},
+		{input: "getenv('KONFI_TEST_SET', 'default')", want: StringVal("value")},
+		{input: "getenv('KONFI_TEST_EMPTY')", want: StringVal("")},
+		{input: "getenv('KONFI_TEST_EMPTY', 'default')", want: StringVal("")},
+		{input: "getenv('KONFI_TEST_UNSET', 'default')", want: StringVal("default")},
+		{input: "getenv('KONFI_TEST_UNSET')", want: NilVal{}},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetenvError(t *testing.T) {
+	tests := []string{
+		"getenv()",
+		"getenv(1)",
+		"getenv('HOME', 1)",
+		"getenv('HOME', 'a', 'b')",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestJsonBuiltins(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: `to_json({b: [1, 2.5, 'x'] a: nil c: true})`, want: StringVal(`{"b":[1,2.5,"x"],"a":null,"c":true}`)},
+		{input: `to_json('<>')`, want: StringVal(`"<>"`)},
+		{input: `from_json('{"a": 1, "b": [true, null, "s"]}')`, want: NewRecWithFields(map[string]Val{
+			"a": IntVal(1),
+			"b": ListVal{Elements: []Val{BoolVal(true), NilVal{}, StringVal("s")}},
+		})},
+		{input: `from_json('1')`, want: IntVal(1)},
+		{input: `from_json('-1.5')`, want: DoubleVal(-1.5)},
+		{input: `from_json('1e3')`, want: DoubleVal(1000)},
+		{input: `from_json('9223372036854775807')`, want: IntVal(9223372036854775807)},
+		{input: `from_json('9223372036854775808')`, want: DoubleVal(9223372036854775808)},
+		{input: `from_json('[]')`, want: ListVal{Elements: []Val{}}},
+		{input: `from_json(' "x" ')`, want: StringVal("x")},
+		// Round trips.
+		{input: `from_json(to_json({a: {b: [1, 'c']}})) == {a: {b: [1, 'c']}}`, want: BoolVal(true)},
+		{input: `from_json(to_json([1.5, nil, false])) == [1.5, nil, false]`, want: BoolVal(true)},
+		{input: `to_json(from_json('{"z":[1,{"y":2}]}'))`, want: StringVal(`{"z":[1,{"y":2}]}`)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestJsonBuiltinsError(t *testing.T) {
+	tests := []string{
+		`from_json('{"a": }')`,
+		`from_json('[1, 2')`,
+		`from_json('')`,
+		`from_json('1 2')`,
+		`from_json(1)`,
+		`to_json(len)`,
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestHasGet(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "has({a: 1}, 'a')", want: BoolVal(true)},
+		{input: "has({a: 1}, 'b')", want: BoolVal(false)},
+		{input: "has({}, '')", want: BoolVal(false)},
+		{input: "has({a: nil}, 'a')", want: BoolVal(true)},
+		{input: "has({let a: 1 b: a}, 'a')", want: BoolVal(false)},
+		{input: "get({a: 1}, 'a', 0)", want: IntVal(1)},
+		{input: "get({a: 1}, 'b', 0)", want: IntVal(0)},
+		{input: "get({a: nil}, 'a', 0)", want: NilVal{}},
+		{input: "get({}, 'x', 'default')", want: StringVal("default")},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHasGetError(t *testing.T) {
+	tests := []string{
+		"has([1], 'a')",
+		"has({a: 1}, 1)",
+		"get('abc', 'a', 0)",
+		"get({a: 1}, nil, 0)",
+		"get({a: 1}, 'a')",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestCharBuiltins(t *testing.T) {
+	strs := func(ss ...string) ListVal {
+		xs := make([]Val, len(ss))
+		for i, s := range ss {
+			xs[i] = StringVal(s)
+		}
+		return ListVal{Elements: xs}
+	}
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "chars('abc')", want: strs("a", "b", "c")},
+		{input: "chars('äö€😀')", want: strs("ä", "ö", "€", "😀")},
+		{input: "chars('')", want: strs()},
+		{input: "ord('a')", want: IntVal(97)},
+		{input: "ord('abc')", want: IntVal(97)},
+		{input: "ord('ü')", want: IntVal(252)},
+		{input: "ord('😀')", want: IntVal(0x1F600)},
+		{input: "chr(97)", want: StringVal("a")},
+		{input: "chr(8364)", want: StringVal("€")},
+		{input: "chr(ord('😀'))", want: StringVal("😀")},
+		{input: "len(chars('äö'))", want: IntVal(2)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCharBuiltinsError(t *testing.T) {
+	tests := []string{
+		"chars(1)",
+		"ord('')",
+		"ord(97)",
+		"chr(-1)",
+		"chr(1114112)",
+		"chr(55296)", // Surrogate half (0xD800).
+		"chr('a')",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestStrUsesEncode(t *testing.T) {
+	ctx := GlobalCtx()
+	money := &Typ{Id: "money"}
+	money.Convert = &NativeFuncVal{
+		Name: "money.Convert",
+		F: func(args []Val, ctx *Ctx) (Val, error) {
+			return TypedVal{V: args[1], T: money}, nil
+		},
+		Arity: 2,
+	}
+	money.Encode = &NativeFuncVal{
+		Name: "money.Encode",
+		F: func(args []Val, ctx *Ctx) (Val, error) {
+			d, err := convertType(args[0].(TypedVal).V, "double", ctx, 0)
+			if err != nil {
+				return nil, err
+			}
+			return StringVal(fmt.Sprintf("$%.2f", float64(d.(DoubleVal)))), nil
+		},
+		Arity: 1,
+	}
+	ctx.defineType(money)
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "str(3::money)", want: StringVal("$3.00")},
+		{input: `"cost: ${12.5::money}"`, want: StringVal("cost: $12.50")},
+		// Types without an Encode function fall back to their default representation.
+		{input: "str(80::port)", want: StringVal("port(80)")},
+		{input: `"${'2023-01-02T03:04:05Z'::time}"`, want: StringVal("2023-01-02T03:04:05Z")},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, ctx)
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -1,55 +1,390 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dnswlt/gokonfi"
 )
 
-var (
-	printResult  bool
-	outputFormat string
-)
+// Name of the module read from stdin, as used in error messages.
+const stdinModuleName = "<stdin>"
+
+// setFlags collects the values of repeated -set key=value flags.
+type setFlags []string
 
-func init() {
-	flag.StringVar(&outputFormat, "format", "yaml", "output format (supported: yaml, json)")
-	flag.BoolVar(&printResult, "p", true, "print result to stdout")
+func (s *setFlags) String() string {
+	return strings.Join(*s, ",")
 }
 
-func run() error {
-	flag.Parse()
-	if len(flag.Args()) != 1 {
-		return fmt.Errorf("expected one input file, got %d", len(flag.Args()))
+func (s *setFlags) Set(v string) error {
+	if k, _, found := strings.Cut(v, "="); !found || k == "" {
+		return fmt.Errorf("expected key=value, got %q", v)
 	}
-	filename := flag.Arg(0)
-	ctx := gokonfi.GlobalCtx()
-	mod, err := gokonfi.LoadModule(filename, ctx)
+	*s = append(*s, v)
+	return nil
+}
+
+// parseSetValue converts the value of a -set flag to an int, double, bool,
+// or string value, in that order of preference.
+func parseSetValue(s string) gokonfi.Val {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return gokonfi.IntVal(i)
+	}
+	// Don't treat strings like "inf" or "nan" as doubles.
+	if d, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(d, 0) && !math.IsNaN(d) {
+		return gokonfi.DoubleVal(d)
+	}
+	if s == "true" || s == "false" {
+		return gokonfi.BoolVal(s == "true")
+	}
+	return gokonfi.StringVal(s)
+}
+
+// run executes the konfi command with the given command-line arguments
+// (excluding the program name), writing results to stdout and diagnostics to stderr.
+// If no input file or "-" is given, the module is read from stdin.
+// If several input files are given, their results are merged from left to right.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		printResult  bool
+		outputFormat string
+		indent       int
+		compact      bool
+		unitEncoding string
+		color        string
+		profileTop   int
+		selectPath   string
+		sets         setFlags
+		checkOnly    bool
+		emitSchema   bool
+		comments     bool
+		strict       bool
+		determ       bool
+	)
+	flags := flag.NewFlagSet("konfi", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&outputFormat, "format", "yaml", "output format (supported: yaml, json, toml, env)")
+	flags.BoolVar(&printResult, "p", true, "print result to stdout")
+	flags.IntVar(&indent, "indent", 0, "number of spaces per indentation level (0: use the output format's default)")
+	flags.BoolVar(&compact, "compact", false, "output JSON on a single line (only supported for -format=json)")
+	flags.StringVar(&color, "color", "auto", "colorize error messages (supported: auto, always, never)")
+	flags.IntVar(&profileTop, "profile", 0, "print the given number of most time-consuming functions and fields to stderr (0: no profiling)")
+	flags.StringVar(&unitEncoding, "units", "value", "output encoding of unit values (supported: value, string, base)")
+	flags.StringVar(&selectPath, "path", "", "only output the value at the given dotted path (e.g. a.b.c) of the result")
+	flags.Var(&sets, "set", "define a top-level variable as key=value (can be repeated)")
+	flags.BoolVar(&checkOnly, "check", false, "only evaluate the given input files and report errors, don't print results")
+	flags.BoolVar(&comments, "comments", false, "output leading comments of record fields as YAML comments (only supported for -format=yaml)")
+	flags.BoolVar(&strict, "strict", false, "report let bindings that are never referenced as errors")
+	flags.BoolVar(&determ, "deterministic", false, "sort record fields by name and fix now() to $SOURCE_DATE_EPOCH (default: the Unix epoch)")
+	flags.BoolVar(&emitSchema, "emit-schema", false, "print a JSON Schema of the input file's result instead of the result itself")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var errFormat gokonfi.ErrorFormat
+	switch color {
+	case "auto":
+		f, ok := stderr.(*os.File)
+		errFormat.Color = ok && isTerminal(f) && os.Getenv("NO_COLOR") == ""
+	case "always":
+		errFormat.Color = true
+	case "never":
+		errFormat.Color = false
+	default:
+		return fmt.Errorf("invalid value for -color: %s", color)
+	}
+	var units gokonfi.UnitEncoding
+	switch unitEncoding {
+	case "value":
+		units = gokonfi.UnitEncodingValue
+	case "string":
+		units = gokonfi.UnitEncodingString
+	case "base":
+		units = gokonfi.UnitEncodingBase
+	default:
+		return fmt.Errorf("unknown unit encoding: %s", unitEncoding)
+	}
+	if comments && outputFormat != "yaml" {
+		return fmt.Errorf("-comments is not supported for output format %s", outputFormat)
+	}
+	var clock func() time.Time
+	if determ {
+		t, err := sourceDateEpoch()
+		if err != nil {
+			return err
+		}
+		clock = func() time.Time { return t }
+	}
+	newCtx := func() *gokonfi.Ctx {
+		ctx := gokonfi.GlobalCtx()
+		if clock != nil {
+			ctx.SetClock(clock)
+		}
+		if comments {
+			ctx.EnableComments()
+		}
+		if strict {
+			ctx.EnableStrict()
+		}
+		for _, kv := range sets {
+			k, v, _ := strings.Cut(kv, "=")
+			ctx.Store(k, parseSetValue(v))
+		}
+		return ctx
+	}
+	if checkOnly {
+		return checkFiles(flags.Args(), stdin, stderr, newCtx, errFormat)
+	}
+	if emitSchema {
+		if compact && indent > 0 {
+			return fmt.Errorf("-compact and -indent cannot be used together")
+		}
+		return writeSchema(flags.Args(), stdin, stdout, newCtx(), errFormat, indent, compact, units)
+	}
+	ctx := newCtx()
+	var profile *gokonfi.Profile
+	if profileTop > 0 {
+		profile = ctx.EnableProfiling()
+	}
+	result, err := loadMerged(flags.Args(), stdin, ctx)
 	if err != nil {
-		return gokonfi.FormattedError(err, ctx)
+		return gokonfi.FormattedErrorWith(err, ctx, errFormat)
+	}
+	if profile != nil {
+		if err := profile.WriteTop(stderr, profileTop); err != nil {
+			return err
+		}
+	}
+	if indent < 0 {
+		return fmt.Errorf("invalid indentation: %d", indent)
+	}
+	if compact && outputFormat != "json" {
+		return fmt.Errorf("-compact is not supported for output format %s", outputFormat)
+	}
+	if compact && indent > 0 {
+		return fmt.Errorf("-compact and -indent cannot be used together")
+	}
+	if selectPath != "" {
+		result, err = resolvePath(result, selectPath)
+		if err != nil {
+			return err
+		}
 	}
 	switch outputFormat {
 	case "json":
-		js, err := gokonfi.EncodeAsJsonIndent(mod.Body())
+		opts := gokonfi.JsonOptions{Indent: "  ", Units: units, SortKeys: determ}
+		switch {
+		case compact:
+			opts.Indent = ""
+		case indent > 0:
+			opts.Indent = strings.Repeat(" ", indent)
+		}
+		js, err := gokonfi.EncodeAsJsonWith(result, opts)
 		if err != nil {
 			return err
 		}
-		fmt.Println(js)
+		fmt.Fprintln(stdout, js)
 	case "yaml":
-		yml, err := gokonfi.EncodeAsYaml(mod.Body())
+		yml, err := gokonfi.EncodeAsYamlWith(result, gokonfi.YamlOptions{Indent: indent, Units: units, SortKeys: determ})
 		if err != nil {
 			return err
 		}
-		fmt.Print(yml) // yml always ends in a newline.
+		fmt.Fprint(stdout, yml) // yml always ends in a newline.
+	case "toml":
+		tml, err := gokonfi.EncodeAsTomlWith(result, gokonfi.TomlOptions{Units: units, SortKeys: determ})
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(stdout, tml)
+	case "env":
+		env, err := gokonfi.EncodeAsEnvWith(result, gokonfi.EnvOptions{Units: units, SortKeys: determ})
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(stdout, env)
 	default:
 		return fmt.Errorf("unknown output format: %s", outputFormat)
 	}
 	return nil
 }
 
+// sourceDateEpoch returns the time given in seconds since the Unix epoch by the
+// SOURCE_DATE_EPOCH environment variable, or the Unix epoch itself if it is unset.
+func sourceDateEpoch() (time.Time, error) {
+	s := os.Getenv("SOURCE_DATE_EPOCH")
+	if s == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid value for SOURCE_DATE_EPOCH: %s", s)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// checkFiles evaluates each of the given files in a new context obtained from newCtx
+// and writes all errors to stderr. If no files are given, the module is read from stdin.
+// It returns an error if evaluation of any file failed.
+func checkFiles(files []string, stdin io.Reader, stderr io.Writer, newCtx func() *gokonfi.Ctx, errFormat gokonfi.ErrorFormat) error {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	failed := 0
+	for _, f := range files {
+		ctx := newCtx()
+		if _, err := loadBody(f, stdin, ctx); err != nil {
+			fmt.Fprintln(stderr, gokonfi.FormattedErrorWith(err, ctx, errFormat))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("check failed for %d of %d files", failed, len(files))
+	}
+	return nil
+}
+
+// writeSchema writes a JSON Schema of the module in the given file to stdout.
+// The module is read from stdin if no file is given. Unit values are described
+// as they are encoded with the given unit encoding.
+func writeSchema(files []string, stdin io.Reader, stdout io.Writer, ctx *gokonfi.Ctx, errFormat gokonfi.ErrorFormat, indent int, compact bool, units gokonfi.UnitEncoding) error {
+	if len(files) > 1 {
+		return fmt.Errorf("-emit-schema supports only a single input file, got %d", len(files))
+	}
+	filename := "-"
+	if len(files) == 1 {
+		filename = files[0]
+	}
+	mod, err := loadModule(filename, stdin, ctx)
+	if err != nil {
+		return gokonfi.FormattedErrorWith(err, ctx, errFormat)
+	}
+	schema, err := mod.SchemaWith(gokonfi.SchemaOptions{Units: units})
+	if err != nil {
+		return err
+	}
+	var js []byte
+	switch {
+	case compact:
+		js, err = json.Marshal(schema)
+	case indent > 0:
+		js, err = json.MarshalIndent(schema, "", strings.Repeat(" ", indent))
+	default:
+		js, err = json.MarshalIndent(schema, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, string(js))
+	return nil
+}
+
+// loadMerged loads the modules from the given files and merges their bodies from
+// left to right, so that later files override earlier ones. If no files are given,
+// the module is read from stdin.
+func loadMerged(files []string, stdin io.Reader, ctx *gokonfi.Ctx) (gokonfi.Val, error) {
+	switch len(files) {
+	case 0:
+		return loadBody("-", stdin, ctx)
+	case 1:
+		// A single module's body need not be a record.
+		return loadBody(files[0], stdin, ctx)
+	}
+	var result gokonfi.Val
+	for i, f := range files {
+		body, err := loadBody(f, stdin, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := asRecord(body); !ok {
+			return nil, fmt.Errorf("cannot merge %s: module body must be a record, got %s", f, body.Typ().Id)
+		}
+		if i == 0 {
+			result = body
+			continue
+		}
+		result, err = gokonfi.MergeValues(result, body, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot merge %s: %w", f, err)
+		}
+	}
+	return result, nil
+}
+
+// loadBody loads the module from the given file, or from stdin if filename is empty or "-",
+// and returns its body.
+func loadBody(filename string, stdin io.Reader, ctx *gokonfi.Ctx) (gokonfi.Val, error) {
+	mod, err := loadModule(filename, stdin, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mod.Body(), nil
+}
+
+// module is the part of a loaded module's API used by the konfi command.
+type module interface {
+	Body() gokonfi.Val
+	SchemaWith(opts gokonfi.SchemaOptions) (any, error)
+}
+
+// loadModule loads the module from the given file, or from stdin if filename is empty or "-".
+func loadModule(filename string, stdin io.Reader, ctx *gokonfi.Ctx) (module, error) {
+	if filename == "" || filename == "-" {
+		mod, err := gokonfi.LoadModuleReader(stdinModuleName, stdin, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return mod, nil
+	}
+	mod, err := gokonfi.LoadModule(filename, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mod, nil
+}
+
+// asRecord returns the record of v if v is a record or a typed record.
+func asRecord(v gokonfi.Val) (*gokonfi.RecVal, bool) {
+	if tv, ok := v.(gokonfi.TypedVal); ok {
+		v = tv.V
+	}
+	r, ok := v.(*gokonfi.RecVal)
+	return r, ok
+}
+
+// resolvePath returns the value at the given dotted path (e.g. "a.b.c") of v.
+func resolvePath(v gokonfi.Val, path string) (gokonfi.Val, error) {
+	for _, f := range strings.Split(path, ".") {
+		r, ok := asRecord(v)
+		if !ok {
+			return nil, fmt.Errorf("path %s: cannot select field %q of %s value", path, f, v.Typ().Id)
+		}
+		fv, ok := r.Fields[f]
+		if !ok {
+			return nil, fmt.Errorf("path %s: no field %q", path, f)
+		}
+		v = fv
+	}
+	return v, nil
+}
+
+// isTerminal reports whether f is a character device, such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
 func main() {
-	if err := run(); err != nil {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
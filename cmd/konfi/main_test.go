@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dnswlt/gokonfi"
+)
+
+// writeModule writes a konfi module with the given contents to a temp directory
+// and returns its path.
+func writeModule(t *testing.T, name, contents string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatalf("cannot write module: %s", err)
+	}
+	return p
+}
+
+func TestRunPath(t *testing.T) {
+	mod := writeModule(t, "app.konfi", `pub type Server { host: string port: int } pub type App { server: Server } {
+		server: {host: 'localhost' port: 8080}
+		name: 'app'
+		typed: {server: {host: 'example.com' port: 443}::Server}::App
+	}`)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "server", want: "{\"host\":\"localhost\",\"port\":8080}"},
+		{path: "server.port", want: "8080"},
+		{path: "name", want: "\"app\""},
+		{path: "typed.server", want: "{\"host\":\"example.com\",\"port\":443}"},
+		{path: "typed.server.host", want: "\"example.com\""},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if err := run([]string{"-format=json", "-indent=0", "-path", test.path, mod}, nil, &stdout, &stderr); err != nil {
+				t.Fatalf("run failed: %s", err)
+			}
+			got := strings.Join(strings.Fields(stdout.String()), "")
+			if got != test.want {
+				t.Errorf("Got: %s, want: %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunPathError(t *testing.T) {
+	mod := writeModule(t, "app.konfi", `{server: {host: 'localhost'}}`)
+	tests := []struct {
+		path    string
+		wantErr string
+	}{
+		{path: "client", wantErr: `no field "client"`},
+		{path: "server.port", wantErr: `no field "port"`},
+		{path: "server.host.name", wantErr: `cannot select field "name" of string value`},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := run([]string{"-path", test.path, mod}, nil, &stdout, &stderr)
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	for _, args := range [][]string{{"-format=json"}, {"-format=json", "-"}} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			stdin := strings.NewReader(`let x: 2 {y: x * 3}`)
+			if err := run(args, stdin, &stdout, &stderr); err != nil {
+				t.Fatalf("run failed: %s", err)
+			}
+			got := strings.Join(strings.Fields(stdout.String()), "")
+			if want := `{"y":6}`; got != want {
+				t.Errorf("Got: %s, want: %s", got, want)
+			}
+		})
+	}
+}
+
+func TestRunStdinError(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	stdin := strings.NewReader("{\n  x: y\n}")
+	err := run([]string{"-color=never"}, stdin, &stdout, &stderr)
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if want := "<stdin>:2:"; !strings.Contains(err.Error(), want) {
+		t.Errorf("wanted error containing %q, got %q", want, err)
+	}
+}
+
+func TestParseSetValue(t *testing.T) {
+	tests := []struct {
+		input string
+		want  gokonfi.Val
+	}{
+		{input: "3", want: gokonfi.IntVal(3)},
+		{input: "-10", want: gokonfi.IntVal(-10)},
+		{input: "1.5", want: gokonfi.DoubleVal(1.5)},
+		{input: "1e3", want: gokonfi.DoubleVal(1000)},
+		{input: "true", want: gokonfi.BoolVal(true)},
+		{input: "false", want: gokonfi.BoolVal(false)},
+		{input: "prod", want: gokonfi.StringVal("prod")},
+		{input: "inf", want: gokonfi.StringVal("inf")},
+		{input: "True", want: gokonfi.StringVal("True")},
+		{input: "", want: gokonfi.StringVal("")},
+		{input: "a=b", want: gokonfi.StringVal("a=b")},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			if got := parseSetValue(test.input); got != test.want {
+				t.Errorf("Got: %v (%T), want: %v (%T)", got, got, test.want, test.want)
+			}
+		})
+	}
+}
+
+func TestRunSet(t *testing.T) {
+	mod := writeModule(t, "app.konfi", `{count: replicas * 2 stage: env verbose: debug}`)
+	var stdout, stderr bytes.Buffer
+	args := []string{"-format=json", "-set", "replicas=3", "-set", "env=prod", "-set", "debug=false", mod}
+	if err := run(args, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	got := strings.Join(strings.Fields(stdout.String()), "")
+	if want := `{"count":6,"stage":"prod","verbose":false}`; got != want {
+		t.Errorf("Got: %s, want: %s", got, want)
+	}
+}
+
+func TestRunSetError(t *testing.T) {
+	for _, set := range []string{"replicas", "=3"} {
+		t.Run(set, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if err := run([]string{"-set", set, "-"}, strings.NewReader("1"), &stdout, &stderr); err == nil {
+				t.Errorf("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	valid1 := writeModule(t, "valid1.konfi", `{x: 1}`)
+	valid2 := writeModule(t, "valid2.konfi", `let y: 2 {x: y}`)
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-check", valid1, valid2}, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	if stdout.Len() != 0 || stderr.Len() != 0 {
+		t.Errorf("expected no output, got stdout: %q, stderr: %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestRunCheckError(t *testing.T) {
+	valid := writeModule(t, "valid.konfi", `{x: 1}`)
+	invalid := writeModule(t, "invalid.konfi", `{x: 1 + 'a'}`)
+	var stdout, stderr bytes.Buffer
+	err := run([]string{"-check", "-color=never", valid, invalid}, nil, &stdout, &stderr)
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if want := "1 of 2 files"; !strings.Contains(err.Error(), want) {
+		t.Errorf("wanted error containing %q, got %q", want, err)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("expected no output, got %q", stdout.String())
+	}
+	if want := "invalid.konfi:1:"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("wanted stderr containing %q, got %q", want, stderr.String())
+	}
+	if strings.Contains(stderr.String(), "/valid.konfi:") {
+		t.Errorf("unexpected error for valid file: %q", stderr.String())
+	}
+}
+
+func TestRunMerge(t *testing.T) {
+	base := writeModule(t, "base.konfi", `{name: 'app' replicas: 1 db: {host: 'localhost' port: 5432}}`)
+	prod := writeModule(t, "prod.konfi", `{replicas: 3 db: {host: 'db.prod'}}`)
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-format=json", base, prod}, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	got := strings.Join(strings.Fields(stdout.String()), "")
+	if want := `{"name":"app","replicas":3,"db":{"host":"db.prod","port":5432}}`; got != want {
+		t.Errorf("Got: %s, want: %s", got, want)
+	}
+}
+
+func TestRunMergeTyped(t *testing.T) {
+	base := writeModule(t, "base.konfi", `pub type App { name: string replicas: int } {name: 'app' replicas: 1}::App`)
+	prod := writeModule(t, "prod.konfi", `{replicas: 3}`)
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-format=json", base, prod}, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	got := strings.Join(strings.Fields(stdout.String()), "")
+	if want := `{"name":"app","replicas":3}`; got != want {
+		t.Errorf("Got: %s, want: %s", got, want)
+	}
+}
+
+func TestRunMergeError(t *testing.T) {
+	base := writeModule(t, "base.konfi", `{x: 1}`)
+	list := writeModule(t, "list.konfi", `[1, 2]`)
+	var stdout, stderr bytes.Buffer
+	err := run([]string{base, list}, nil, &stdout, &stderr)
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if want := "module body must be a record, got list"; !strings.Contains(err.Error(), want) {
+		t.Errorf("wanted error containing %q, got %q", want, err)
+	}
+}
+
+func TestRunIndentCompact(t *testing.T) {
+	const input = `{a: {b: [1]}}`
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-format=json"}, want: "{\n  \"a\": {\n    \"b\": [\n      1\n    ]\n  }\n}\n"},
+		{args: []string{"-format=json", "-indent=4"}, want: "{\n    \"a\": {\n        \"b\": [\n            1\n        ]\n    }\n}\n"},
+		{args: []string{"-format=json", "-compact"}, want: "{\"a\":{\"b\":[1]}}\n"},
+		{args: []string{"-format=json", "-compact", "-indent=0"}, want: "{\"a\":{\"b\":[1]}}\n"},
+		{args: []string{"-format=yaml"}, want: "a:\n    b:\n        - 1\n"},
+		{args: []string{"-format=yaml", "-indent=2"}, want: "a:\n  b:\n    - 1\n"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if err := run(test.args, strings.NewReader(input), &stdout, &stderr); err != nil {
+				t.Fatalf("run failed: %s", err)
+			}
+			if got := stdout.String(); got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunIndentCompactError(t *testing.T) {
+	tests := [][]string{
+		{"-format=json", "-indent=-1"},
+		{"-format=json", "-compact", "-indent=2"},
+		{"-format=yaml", "-compact"},
+		{"-format=toml", "-compact"},
+	}
+	for _, args := range tests {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if err := run(args, strings.NewReader("{a: 1}"), &stdout, &stderr); err == nil {
+				t.Errorf("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestRunEmitSchema(t *testing.T) {
+	const input = `pub type Server { host: string } {server::Server: {host: 'h'}::Server name::string?: nil}`
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-emit-schema", "-compact"}, strings.NewReader(input), &stdout, &stderr); err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	want := `{"$defs":{"Server":{"properties":{"host":{"type":"string"}},"required":["host"],"type":"object"}},` +
+		`"$schema":"https://json-schema.org/draft/2020-12/schema",` +
+		`"properties":{"name":{"anyOf":[{"type":"string"},{"type":"null"}]},"server":{"$ref":"#/$defs/Server"}},` +
+		`"required":["server"],"type":"object"}` + "\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRunEmitSchemaUnits(t *testing.T) {
+	const input = `{timeout: 10::seconds}`
+	tests := []struct {
+		units string
+		want  string
+	}{
+		{units: "value", want: `"timeout":{"type":"number"}`},
+		{units: "string", want: `"timeout":{"type":"string"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.units, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if err := run([]string{"-emit-schema", "-compact", "-units", test.units}, strings.NewReader(input), &stdout, &stderr); err != nil {
+				t.Fatalf("run failed: %s", err)
+			}
+			if got := stdout.String(); !strings.Contains(got, test.want) {
+				t.Errorf("Got:\n%s\nwant schema containing:\n%s", got, test.want)
+			}
+		})
+	}
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-emit-schema", "-units", "nosuchencoding"}, strings.NewReader(input), &stdout, &stderr); err == nil {
+		t.Errorf("expected error for unknown unit encoding, got none")
+	}
+}
+
+func TestRunEmitSchemaError(t *testing.T) {
+	tests := []struct {
+		args  []string
+		input string
+	}{
+		{args: []string{"-emit-schema", "a.konfi", "b.konfi"}, input: "{}"},
+		{args: []string{"-emit-schema", "-compact", "-indent=2"}, input: "{}"},
+		{args: []string{"-emit-schema"}, input: "{f: func (x) { x }}"},
+		{args: []string{"-emit-schema"}, input: "{a: }"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if err := run(test.args, strings.NewReader(test.input), &stdout, &stderr); err == nil {
+				t.Errorf("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestRunComments(t *testing.T) {
+	const input = "{\n  // The answer.\n  a: 42\n}"
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"-comments"}, want: "# The answer.\na: 42\n"},
+		{args: []string{}, want: "a: 42\n"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if err := run(test.args, strings.NewReader(input), &stdout, &stderr); err != nil {
+				t.Fatalf("run failed: %s", err)
+			}
+			if got := stdout.String(); got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunCommentsError(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-comments", "-format=json"}, strings.NewReader("{a: 1}"), &stdout, &stderr); err == nil {
+		t.Errorf("expected error, got none")
+	}
+}
+
+func TestRunStrict(t *testing.T) {
+	const input = "{let unused: 1 a: 2}"
+	var stdout, stderr bytes.Buffer
+	if err := run(nil, strings.NewReader(input), &stdout, &stderr); err != nil {
+		t.Fatalf("run failed without -strict: %s", err)
+	}
+	if err := run([]string{"-strict"}, strings.NewReader(input), &stdout, &stderr); err == nil {
+		t.Errorf("expected error with -strict, got none")
+	}
+	if err := run([]string{"-strict", "-check"}, strings.NewReader(input), &stdout, &stderr); err == nil {
+		t.Errorf("expected error with -strict -check, got none")
+	}
+}
+
+func TestRunDeterministic(t *testing.T) {
+	const input = "{z: 1 a: {x: 2 b: 3} t: format_time(now(), '2006-01-02')}"
+	tests := []struct {
+		args  []string
+		epoch string
+		want  string
+	}{
+		{args: []string{"-deterministic", "-format=json", "-compact"}, want: `{"a":{"b":3,"x":2},"t":"1970-01-01","z":1}` + "\n"},
+		{args: []string{"-deterministic", "-format=json", "-compact"}, epoch: "1700000000", want: `{"a":{"b":3,"x":2},"t":"2023-11-14","z":1}` + "\n"},
+		{args: []string{"-deterministic", "-format=yaml"}, want: "a:\n    b: 3\n    x: 2\nt: \"1970-01-01\"\nz: 1\n"},
+		{args: []string{"-deterministic", "-format=toml"}, want: "t = \"1970-01-01\"\nz = 1\n\n[a]\nb = 3\nx = 2\n"},
+		{args: []string{"-deterministic", "-format=env"}, want: "A_B=3\nA_X=2\nT=1970-01-01\nZ=1\n"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " ")+" "+test.epoch, func(t *testing.T) {
+			t.Setenv("SOURCE_DATE_EPOCH", test.epoch)
+			var stdout, stderr bytes.Buffer
+			if err := run(test.args, strings.NewReader(input), &stdout, &stderr); err != nil {
+				t.Fatalf("run failed: %s", err)
+			}
+			if got := stdout.String(); got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunDeterministicError(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-deterministic"}, strings.NewReader("{a: 1}"), &stdout, &stderr); err == nil {
+		t.Errorf("expected error, got none")
+	}
+}
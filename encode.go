@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -12,9 +13,52 @@ import (
 
 // YAML encoding.
 
+// YamlOptions control the output of EncodeAsYamlWith.
+type YamlOptions struct {
+	// Indent is the number of spaces per indentation level.
+	// If 0, the default indentation of 4 spaces is used.
+	Indent int
+	// Units determines how unit values are encoded.
+	Units UnitEncoding
+	// SortKeys specifies whether record fields are sorted by name.
+	// If false, fields are encoded in declaration order.
+	SortKeys bool
+}
+
 func EncodeAsYaml(v Val) (string, error) {
-	bs, err := yaml.Marshal(v)
-	return string(bs), err
+	return EncodeAsYamlWith(v, YamlOptions{})
+}
+
+// EncodeAsYamlIndent encodes the given Val as YAML, indenting nested
+// values by the given number of spaces.
+func EncodeAsYamlIndent(v Val, indent int) (string, error) {
+	if indent <= 0 {
+		return "", fmt.Errorf("invalid YAML indentation: %d", indent)
+	}
+	return EncodeAsYamlWith(v, YamlOptions{Indent: indent})
+}
+
+// EncodeAsYamlWith encodes the given Val as YAML, as specified by opts.
+func EncodeAsYamlWith(v Val, opts YamlOptions) (string, error) {
+	if opts.Indent < 0 {
+		return "", fmt.Errorf("invalid YAML indentation: %d", opts.Indent)
+	}
+	n, err := yamlNode(v, &opts)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	enc := yaml.NewEncoder(&sb)
+	if opts.Indent > 0 {
+		enc.SetIndent(opts.Indent)
+	}
+	if err := enc.Encode(n); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
 }
 
 func (x DoubleVal) MarshalYAML() (interface{}, error) {
@@ -26,7 +70,51 @@ func (x DoubleVal) MarshalYAML() (interface{}, error) {
 }
 
 func (r *RecVal) MarshalYAML() (interface{}, error) {
-	return r.Fields, nil
+	// Use a yaml.Node to preserve the order of fields.
+	return yamlNode(r, &YamlOptions{})
+}
+
+// yamlNode returns the YAML node representing v. Records and lists are converted
+// to nodes directly, because yaml.Node.Encode drops the comments of nested nodes.
+func yamlNode(v Val, opts *YamlOptions) (*yaml.Node, error) {
+	v, err := encodedVal(v, opts.Units)
+	if err != nil {
+		return nil, err
+	}
+	switch x := v.(type) {
+	case *RecVal:
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, f := range fieldNames(x, opts.SortKeys) {
+			k := &yaml.Node{}
+			if err := k.Encode(f); err != nil {
+				return nil, err
+			}
+			if a := x.FieldAnnotations[f]; a != nil {
+				k.HeadComment = a.Comment
+			}
+			fv, err := yamlNode(x.Fields[f], opts)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, k, fv)
+		}
+		return n, nil
+	case ListVal:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, e := range x.Elements {
+			en, err := yamlNode(e, opts)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, en)
+		}
+		return n, nil
+	}
+	n := &yaml.Node{}
+	if err := n.Encode(v); err != nil {
+		return nil, err
+	}
+	return n, nil
 }
 
 func (xs ListVal) MarshalYAML() (interface{}, error) {
@@ -34,19 +122,50 @@ func (xs ListVal) MarshalYAML() (interface{}, error) {
 }
 
 func (x UnitVal) MarshalYAML() (interface{}, error) {
-	v := float64(x.V)
-	if math.Trunc(v) == v {
-		return int64(v), nil
-	}
-	return v, nil
+	return x.encode(UnitEncodingValue)
 }
 
 func (x TypedVal) MarshalYAML() (interface{}, error) {
+	return encodedVal(x, UnitEncodingValue)
+}
+
+// encode returns the representation of x in the given unit encoding. For
+// UnitEncodingValue, the Encode function of x's type is used, if it has one.
+func (x UnitVal) encode(units UnitEncoding) (Val, error) {
+	switch units {
+	case UnitEncodingString:
+		return StringVal(x.String()), nil
+	case UnitEncodingBase:
+		return DoubleVal(x.V * x.F), nil
+	}
 	if x.T.Encode != nil {
 		return x.T.Encode.Call([]Val{x}, nil)
 	}
-	// Types that don't define an Encode function are simply unwrapped.
-	return x.V, nil
+	return DoubleVal(x.V), nil
+}
+
+// fieldNames returns the field names of r in declaration order, or sorted by name if sorted is true.
+func fieldNames(r *RecVal, sorted bool) []string {
+	if sorted {
+		return sortedKeys(r.Fields)
+	}
+	return r.FieldNames()
+}
+
+// encodedVal returns the value that v is encoded as,
+// i.e. it unwraps units and typed values using their Encode functions.
+// Types that don't define an Encode function are simply unwrapped.
+func encodedVal(v Val, units UnitEncoding) (Val, error) {
+	switch x := v.(type) {
+	case UnitVal:
+		return x.encode(units)
+	case TypedVal:
+		if x.T.Encode != nil {
+			return x.T.Encode.Call([]Val{x}, nil)
+		}
+		return encodedVal(x.V, units)
+	}
+	return v, nil
 }
 
 func (f *FuncExprVal) MarshalYAML() (interface{}, error) {
@@ -59,73 +178,569 @@ func (f *NativeFuncVal) MarshalYAML() (interface{}, error) {
 
 // JSON encoding.
 
+// The MarshalJSON methods let encoding/json encode Vals. They delegate to
+// encodeJson, so that values are encoded the same way as by EncodeAsJson.
+// Note that json.Marshal HTML-escapes their output; use a json.Encoder with
+// SetEscapeHTML(false) to avoid that.
+
 func (r *RecVal) MarshalJSON() ([]byte, error) {
-	// json.Marshal will always HTML-encode < > &, so we use this "workaround" :(
-	// Creating a new encoder for each (nested) record is probably not very fast.
+	return marshalJson(r)
+}
+
+func (xs ListVal) MarshalJSON() ([]byte, error) {
+	return marshalJson(xs)
+}
+
+func (x UnitVal) MarshalJSON() ([]byte, error) {
+	return marshalJson(x)
+}
+
+func (x TypedVal) MarshalJSON() ([]byte, error) {
+	return marshalJson(x)
+}
+
+func (r NilVal) MarshalJSON() ([]byte, error) {
+	return marshalJson(r)
+}
+
+func marshalJson(v Val) ([]byte, error) {
 	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
-	enc.SetEscapeHTML(false)
-	if err := enc.Encode(r.Fields); err != nil {
+	if err := encodeJson(&buf, v, &JsonOptions{}); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-func (xs ListVal) MarshalJSON() ([]byte, error) {
-	// json.Marshal will always HTML-encode < > &, so we use this "workaround" :(
-	// Creating a new encoder for each (nested) record is probably not very fast.
+// JsonOptions control the output of EncodeAsJsonWith.
+type JsonOptions struct {
+	// Indent is the string used for each indentation level.
+	// If empty, the output is compact (without newlines).
+	Indent string
+	// EscapeHTML specifies whether < > & are escaped in strings.
+	EscapeHTML bool
+	// SortKeys specifies whether record fields are sorted by name.
+	// If false, fields are encoded in declaration order.
+	SortKeys bool
+	// Units determines how unit values are encoded.
+	Units UnitEncoding
+}
+
+// EncodeAsJson encodes the given Val as a compact JSON value (without newlines).
+func EncodeAsJson(v Val) (string, error) {
+	return EncodeAsJsonWith(v, JsonOptions{})
+}
+
+// EncodeAsJsonIndent encodes the given Val as an indented, multi-line JSON value.
+func EncodeAsJsonIndent(v Val) (string, error) {
+	return EncodeAsJsonWith(v, JsonOptions{Indent: "  "})
+}
+
+// EncodeAsJsonIndentWidth encodes the given Val as an indented, multi-line JSON value,
+// indenting nested values by the given number of spaces.
+func EncodeAsJsonIndentWidth(v Val, indent int) (string, error) {
+	if indent <= 0 {
+		return "", fmt.Errorf("invalid JSON indentation: %d", indent)
+	}
+	return EncodeAsJsonWith(v, JsonOptions{Indent: strings.Repeat(" ", indent)})
+}
+
+// EncodeAsJsonWith encodes the given Val as JSON, as specified by opts.
+func EncodeAsJsonWith(v Val, opts JsonOptions) (string, error) {
 	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
-	enc.SetEscapeHTML(false)
-	if err := enc.Encode(xs.Elements); err != nil {
-		return nil, err
+	if err := encodeJson(&buf, v, &opts); err != nil {
+		return "", err
 	}
-	return buf.Bytes(), nil
+	if opts.Indent == "" {
+		return buf.String(), nil
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", opts.Indent); err != nil {
+		return "", err
+	}
+	return out.String(), nil
 }
 
-func (t UnitVal) MarshalJSON() ([]byte, error) {
-	// json.Marshal will always HTML-encode < > &, so we use this "workaround" :(
-	// Creating a new encoder for each (nested) record is probably not very fast.
-	return json.Marshal(t.V)
+func encodeJson(buf *bytes.Buffer, v Val, opts *JsonOptions) error {
+	v, err := encodedVal(v, opts.Units)
+	if err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case *RecVal:
+		buf.WriteByte('{')
+		for i, f := range fieldNames(x, opts.SortKeys) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJsonScalar(buf, f, opts); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := encodeJson(buf, x.Fields[f], opts); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case ListVal:
+		buf.WriteByte('[')
+		for i, e := range x.Elements {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJson(buf, e, opts); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case NilVal:
+		buf.WriteString("null")
+	case IntVal, DoubleVal, BoolVal, StringVal:
+		return encodeJsonScalar(buf, x, opts)
+	default:
+		return fmt.Errorf("cannot encode %s in JSON", v.Typ().Id)
+	}
+	return nil
 }
 
-func (x TypedVal) MarshalJSON() ([]byte, error) {
-	if x.T.Encode != nil {
-		v, err := x.T.Encode.Call([]Val{x}, nil)
-		if err != nil {
-			return nil, err
+func encodeJsonScalar(buf *bytes.Buffer, v any, opts *JsonOptions) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(opts.EscapeHTML)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	// Encode always appends a newline.
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+// TOML encoding.
+
+// EncodeAsToml encodes the given Val as a TOML document. Since a TOML document
+// is a table, v must be a record. Records nested in records are encoded as tables,
+// lists of records as arrays of tables. Fields with nil values cannot be
+// represented in TOML and result in an error.
+func EncodeAsToml(v Val) (string, error) {
+	return EncodeAsTomlWith(v, TomlOptions{})
+}
+
+// TomlOptions control the output of EncodeAsTomlWith.
+type TomlOptions struct {
+	// Units determines how unit values are encoded.
+	Units UnitEncoding
+	// SortKeys specifies whether record fields are sorted by name.
+	// If false, fields are encoded in declaration order.
+	SortKeys bool
+}
+
+// EncodeAsTomlWith encodes the given Val as a TOML document, as specified by opts.
+func EncodeAsTomlWith(v Val, opts TomlOptions) (string, error) {
+	r, ok := v.(*RecVal)
+	if !ok {
+		return "", fmt.Errorf("cannot encode %s as TOML document, must be a record", v.Typ().Id)
+	}
+	var sb strings.Builder
+	if err := encodeTomlTable(&sb, nil, r, &opts); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// isTomlTableArray reports whether xs must be encoded as an array of tables.
+func isTomlTableArray(xs ListVal) bool {
+	if len(xs.Elements) == 0 {
+		return false
+	}
+	for _, x := range xs.Elements {
+		if _, ok := x.(*RecVal); !ok {
+			return false
 		}
-		return json.Marshal(v)
 	}
-	// Types that don't define an Encode function are simply unwrapped.
-	return json.Marshal(x.V)
+	return true
 }
 
-func (r NilVal) MarshalJSON() ([]byte, error) {
-	return json.Marshal(nil)
+func encodeTomlTable(sb *strings.Builder, path []string, r *RecVal, opts *TomlOptions) error {
+	type subTable struct {
+		name string
+		v    Val
+	}
+	var subTables []subTable
+	// Key/value pairs must precede all sub-tables.
+	for _, f := range fieldNames(r, opts.SortKeys) {
+		v, err := encodedVal(r.Fields[f], opts.Units)
+		if err != nil {
+			return err
+		}
+		switch x := v.(type) {
+		case *RecVal:
+			subTables = append(subTables, subTable{f, x})
+			continue
+		case ListVal:
+			if isTomlTableArray(x) {
+				subTables = append(subTables, subTable{f, x})
+				continue
+			}
+		}
+		sb.WriteString(tomlKey(f))
+		sb.WriteString(" = ")
+		if err := encodeTomlInline(sb, v, opts); err != nil {
+			return fmt.Errorf("field %s: %w", strings.Join(append(path, f), "."), err)
+		}
+		sb.WriteString("\n")
+	}
+	for _, t := range subTables {
+		p := append(append([]string(nil), path...), t.name)
+		header := make([]string, len(p))
+		for i, k := range p {
+			header[i] = tomlKey(k)
+		}
+		switch x := t.v.(type) {
+		case *RecVal:
+			if sb.Len() > 0 {
+				sb.WriteString("\n")
+			}
+			fmt.Fprintf(sb, "[%s]\n", strings.Join(header, "."))
+			if err := encodeTomlTable(sb, p, x, opts); err != nil {
+				return err
+			}
+		case ListVal:
+			for _, e := range x.Elements {
+				if sb.Len() > 0 {
+					sb.WriteString("\n")
+				}
+				fmt.Fprintf(sb, "[[%s]]\n", strings.Join(header, "."))
+				if err := encodeTomlTable(sb, p, e.(*RecVal), opts); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
 }
 
-// EncodeAsJson encodes the given Val as a compact JSON value (without newlines).
-func EncodeAsJson(v Val) (string, error) {
-	return encodeAsJsonIndent(v, "", "")
+// encodeTomlInline encodes v as a TOML value that fits on a single line.
+func encodeTomlInline(sb *strings.Builder, v Val, opts *TomlOptions) error {
+	v, err := encodedVal(v, opts.Units)
+	if err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case IntVal:
+		sb.WriteString(x.String())
+	case DoubleVal:
+		f := float64(x)
+		switch {
+		case math.IsNaN(f):
+			sb.WriteString("nan")
+		case math.IsInf(f, 1):
+			sb.WriteString("inf")
+		case math.IsInf(f, -1):
+			sb.WriteString("-inf")
+		case math.Trunc(f) == f && math.Abs(f) < 1e15:
+			// Like in JSON and YAML, integral doubles are encoded as integers.
+			sb.WriteString(strconv.FormatInt(int64(f), 10))
+		default:
+			s := strconv.FormatFloat(f, 'g', -1, 64)
+			if !strings.ContainsAny(s, ".eE") {
+				s += ".0"
+			}
+			sb.WriteString(s)
+		}
+	case BoolVal:
+		sb.WriteString(x.String())
+	case StringVal:
+		sb.WriteString(tomlQuote(string(x)))
+	case ListVal:
+		sb.WriteString("[")
+		for i, e := range x.Elements {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			if err := encodeTomlInline(sb, e, opts); err != nil {
+				return err
+			}
+		}
+		sb.WriteString("]")
+	case *RecVal:
+		sb.WriteString("{")
+		for i, f := range fieldNames(x, opts.SortKeys) {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			sb.WriteString(" ")
+			sb.WriteString(tomlKey(f))
+			sb.WriteString(" = ")
+			if err := encodeTomlInline(sb, x.Fields[f], opts); err != nil {
+				return err
+			}
+		}
+		if len(x.Fields) > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString("}")
+	case NilVal:
+		return fmt.Errorf("cannot encode nil in TOML")
+	default:
+		return fmt.Errorf("cannot encode %s in TOML", v.Typ().Id)
+	}
+	return nil
 }
 
-// EncodeAsJsonIndent encodes the given Val as an indented, multi-line JSON value.
-func EncodeAsJsonIndent(v Val) (string, error) {
-	return encodeAsJsonIndent(v, "", "  ")
+// tomlKey returns k as a bare key if possible, otherwise as a quoted key.
+func tomlKey(k string) string {
+	if k == "" {
+		return `""`
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return tomlQuote(k)
+		}
+	}
+	return k
 }
 
-func encodeAsJsonIndent(v Val, prefix, indent string) (string, error) {
+// tomlQuote returns s as a TOML basic string.
+func tomlQuote(s string) string {
 	var sb strings.Builder
-	enc := json.NewEncoder(&sb)
-	enc.SetEscapeHTML(false)
-	doIndent := len(prefix) > 0 || len(indent) > 0
-	if doIndent {
-		enc.SetIndent(prefix, indent)
+	sb.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&sb, `\u%04X`, c)
+			} else {
+				sb.WriteRune(c)
+			}
+		}
 	}
-	if err := enc.Encode(v); err != nil {
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// Dotenv encoding.
+
+// EncodeAsEnv encodes the given record as KEY=value lines, as used in .env files.
+// Nested field names are joined with "_" and upper-cased, e.g. db.host becomes DB_HOST.
+// All leaves must be scalars; lists and functions result in an error.
+func EncodeAsEnv(v Val) (string, error) {
+	return EncodeAsEnvWith(v, EnvOptions{})
+}
+
+// EnvOptions control the output of EncodeAsEnvWith.
+type EnvOptions struct {
+	// Units determines how unit values are encoded.
+	Units UnitEncoding
+	// SortKeys specifies whether record fields are sorted by name.
+	// If false, fields are encoded in declaration order.
+	SortKeys bool
+}
+
+// EncodeAsEnvWith encodes the given record as KEY=value lines, as specified by opts.
+func EncodeAsEnvWith(v Val, opts EnvOptions) (string, error) {
+	r, ok := v.(*RecVal)
+	if !ok {
+		return "", fmt.Errorf("cannot encode %s as env, must be a record", v.Typ().Id)
+	}
+	var sb strings.Builder
+	if err := encodeEnvRec(&sb, "", r, &opts); err != nil {
 		return "", err
 	}
-	s := sb.String()
-	return strings.TrimRight(s, "\n"), nil
+	return sb.String(), nil
+}
+
+func encodeEnvRec(sb *strings.Builder, prefix string, r *RecVal, opts *EnvOptions) error {
+	for _, f := range fieldNames(r, opts.SortKeys) {
+		key := prefix + envKey(f)
+		v, err := encodedVal(r.Fields[f], opts.Units)
+		if err != nil {
+			return err
+		}
+		var s string
+		switch x := v.(type) {
+		case *RecVal:
+			if err := encodeEnvRec(sb, key+"_", x, opts); err != nil {
+				return err
+			}
+			continue
+		case NilVal:
+			s = ""
+		case IntVal, BoolVal:
+			s = x.String()
+		case DoubleVal:
+			bs, err := json.Marshal(float64(x))
+			if err != nil {
+				return fmt.Errorf("cannot encode field %s as env: %w", key, err)
+			}
+			s = string(bs)
+		case StringVal:
+			s = string(x)
+		default:
+			return fmt.Errorf("cannot encode field %s of type %s as env", key, v.Typ().Id)
+		}
+		fmt.Fprintf(sb, "%s=%s\n", key, envQuote(s))
+	}
+	return nil
+}
+
+// envKey upper-cases k and replaces all characters that are not
+// valid in environment variable names by "_".
+func envKey(k string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z':
+			return c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+			return c
+		}
+		return '_'
+	}, k)
+}
+
+// envQuote single-quotes s shell-style if it contains any characters
+// other than letters, digits, and a few safe punctuation characters.
+func envQuote(s string) string {
+	safe := true
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_-.,:/@+=%", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Go value conversion.
+
+// ToGo converts v to a native Go value: records become map[string]any,
+// lists become []any, and scalars become int64, float64, string, bool, or nil.
+// Units are converted to their float64 value and typed values are unwrapped.
+// Since Go maps are unordered, the field order of records is not preserved.
+// Functions cannot be converted and result in an error.
+func ToGo(v Val) (any, error) {
+	switch x := v.(type) {
+	case *RecVal:
+		m := make(map[string]any, len(x.Fields))
+		for _, f := range x.FieldNames() {
+			y, err := ToGo(x.Fields[f])
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", f, err)
+			}
+			m[f] = y
+		}
+		return m, nil
+	case ListVal:
+		xs := make([]any, len(x.Elements))
+		for i, e := range x.Elements {
+			y, err := ToGo(e)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			xs[i] = y
+		}
+		return xs, nil
+	case IntVal:
+		return int64(x), nil
+	case DoubleVal:
+		return float64(x), nil
+	case UnitVal:
+		return x.V, nil
+	case StringVal:
+		return string(x), nil
+	case BoolVal:
+		return bool(x), nil
+	case NilVal:
+		return nil, nil
+	case TypedVal:
+		return ToGo(x.V)
+	}
+	return nil, fmt.Errorf("cannot convert %s to a Go value", v.Typ().Id)
+}
+
+// FromGo converts the native Go value x to a Val. It supports map[string]any,
+// []any, nil, and the scalar types bool, string, and all int and float types.
+// Unsigned ints larger than math.MaxInt64 result in an error.
+// Since Go maps are unordered, record fields are ordered by name.
+// Values that already are a Val are returned as is.
+func FromGo(x any) (Val, error) {
+	switch y := x.(type) {
+	case nil:
+		return NilVal{}, nil
+	case Val:
+		return y, nil
+	case bool:
+		return BoolVal(y), nil
+	case string:
+		return StringVal(y), nil
+	case int:
+		return IntVal(y), nil
+	case int8:
+		return IntVal(y), nil
+	case int16:
+		return IntVal(y), nil
+	case int32:
+		return IntVal(y), nil
+	case int64:
+		return IntVal(y), nil
+	case uint8:
+		return IntVal(y), nil
+	case uint16:
+		return IntVal(y), nil
+	case uint32:
+		return IntVal(y), nil
+	case uint:
+		return uintVal(uint64(y))
+	case uint64:
+		return uintVal(y)
+	case uintptr:
+		return uintVal(uint64(y))
+	case float32:
+		return DoubleVal(y), nil
+	case float64:
+		return DoubleVal(y), nil
+	case []any:
+		elems := make([]Val, len(y))
+		for i, e := range y {
+			v, err := FromGo(e)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			elems[i] = v
+		}
+		return ListVal{Elements: elems}, nil
+	case map[string]any:
+		r := NewRec()
+		for _, k := range sortedKeys(y) {
+			v, err := FromGo(y[k])
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", k, err)
+			}
+			r.setField(k, v, nil)
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("cannot convert Go value of type %T", x)
+}
+
+// uintVal returns u as an IntVal, or an error if u is out of range.
+func uintVal(u uint64) (Val, error) {
+	if u > math.MaxInt64 {
+		return nil, fmt.Errorf("cannot convert Go value %d: out of range for int", u)
+	}
+	return IntVal(u), nil
 }
@@ -1,8 +1,14 @@
 package gokonfi
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestEncodeAsJson(t *testing.T) {
@@ -12,7 +18,11 @@ func TestEncodeAsJson(t *testing.T) {
 	}{
 		{input: "1 + 3", want: "4"},
 		{input: "{x: 1}", want: "{\"x\":1}"},
-		{input: "{x: 1 y: 'a' z: false w: 1e6}", want: `{"w":1000000,"x":1,"y":"a","z":false}`},
+		{input: "{x: 1 y: 'a' z: false w: 1e6}", want: `{"x":1,"y":"a","z":false,"w":1000000}`},
+		// Fields are encoded in declaration order.
+		{input: "{b: 1 a: 2}", want: `{"b":1,"a":2}`},
+		{input: "{b: 1 a: 2} @ {c: 3 a: 4}", want: `{"b":1,"a":4,"c":3}`},
+		{input: "{z: {y: 1 x: 2} a: {}}", want: `{"z":{"y":1,"x":2},"a":{}}`},
 		{input: "{x: {y: {z: 0}}}", want: `{"x":{"y":{"z":0}}}`},
 		{input: "{x: nil}", want: `{"x":null}`},
 		{input: "{let f(x): x + '.exe' y: f('konfi')}", want: `{"y":"konfi.exe"}`},
@@ -42,3 +52,767 @@ func TestEncodeAsJson(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshalJSONMatchesEncodeAsJson(t *testing.T) {
+	inputs := []string{
+		"{a: '<b>' t: {x: 'a&b'}::T d: 7::minutes p: 80::percent l: [nil, 1.5, 'x>y'] n: nil}",
+		"'2023-01-02T03:04:05Z'::time",
+		"[{z: 1 a: 2}]",
+	}
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			ctx := GlobalCtx()
+			ctx.defineType(NewRecordType("T", map[string]*Typ{"x": builtinTypeString}))
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, ctx)
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			want, err := EncodeAsJson(v)
+			if err != nil {
+				t.Fatalf("Could not encode value: %s", err)
+			}
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(v); err != nil {
+				t.Fatalf("Could not marshal value: %s", err)
+			}
+			if got := strings.TrimSuffix(buf.String(), "\n"); got != want {
+				t.Errorf("Got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestEncodeIndent(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func(Val, int) (string, error)
+		indent int
+		want   string
+	}{
+		{name: "json2", encode: EncodeAsJsonIndentWidth, indent: 2, want: "{\n  \"x\": {\n    \"z\": [\n      1\n    ]\n  }\n}"},
+		{name: "json4", encode: EncodeAsJsonIndentWidth, indent: 4, want: "{\n    \"x\": {\n        \"z\": [\n            1\n        ]\n    }\n}"},
+		{name: "yaml2", encode: EncodeAsYamlIndent, indent: 2, want: "x:\n  z:\n    - 1\n"},
+		{name: "yaml4", encode: EncodeAsYamlIndent, indent: 4, want: "x:\n    z:\n        - 1\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse("{x: {z: [1]}}")
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			got, err := test.encode(v, test.indent)
+			if err != nil {
+				t.Fatalf("Could not encode value: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeUnitRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		encoding UnitEncoding
+		json     string
+		yaml     string
+	}{
+		{
+			name:     "time",
+			input:    `"2023-01-02T03:04:05.5+01:00"::time`,
+			encoding: UnitEncodingValue,
+			json:     `"2023-01-02T03:04:05.5+01:00"`,
+			yaml:     "\"2023-01-02T03:04:05.5+01:00\"\n",
+		},
+		{
+			name:     "durationValue",
+			input:    `7::minutes`,
+			encoding: UnitEncodingValue,
+			json:     `7`,
+			yaml:     "7\n",
+		},
+		{
+			name:     "durationString",
+			input:    `7::minutes`,
+			encoding: UnitEncodingString,
+			json:     `"7::minutes"`,
+			yaml:     "7::minutes\n",
+		},
+		{
+			name:     "percentValue",
+			input:    `80::percent`,
+			encoding: UnitEncodingValue,
+			json:     `80`,
+			yaml:     "80\n",
+		},
+		{
+			name:     "percentBase",
+			input:    `80::percent`,
+			encoding: UnitEncodingBase,
+			json:     `0.8`,
+			yaml:     "0.8\n",
+		},
+		{
+			name:     "percentString",
+			input:    `80::percent`,
+			encoding: UnitEncodingString,
+			json:     `"80::percent"`,
+			yaml:     "80::percent\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			ctx := GlobalCtx()
+			v, err := Eval(e, ctx)
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			gotJson, err := EncodeAsJsonWith(v, JsonOptions{Units: test.encoding})
+			if err != nil {
+				t.Fatalf("Could not encode value as JSON: %s", err)
+			}
+			if gotJson != test.json {
+				t.Errorf("Got JSON: %s, want: %s", gotJson, test.json)
+			}
+			gotYaml, err := EncodeAsYamlWith(v, YamlOptions{Units: test.encoding})
+			if err != nil {
+				t.Fatalf("Could not encode value as YAML: %s", err)
+			}
+			if gotYaml != test.yaml {
+				t.Errorf("Got YAML: %q, want: %q", gotYaml, test.yaml)
+			}
+			// Converting the encoded value back must yield the original value.
+			// Plain numbers lose their unit multiple, so they cannot be converted back.
+			typ := v.Typ().Id
+			if u, ok := v.(UnitVal); ok {
+				if test.encoding != UnitEncodingString {
+					return
+				}
+				typ = u.TypeId()
+			}
+			e, err = parse(gotJson + "::" + typ)
+			if err != nil {
+				t.Fatalf("Could not parse encoded value: %s", err)
+			}
+			back, err := Eval(e, ctx)
+			if err != nil {
+				t.Fatalf("Could not convert encoded value: %s", err)
+			}
+			if back.String() != v.String() {
+				t.Errorf("Round trip failed: got %s, want %s", back, v)
+			}
+		})
+	}
+}
+
+func TestEncodeUnitsOption(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		encode func(Val) (string, error)
+		want   string
+	}{
+		{
+			name:   "jsonString",
+			input:  "{d: 90::seconds r: {p: 80::percent} xs: [1::hours]}",
+			encode: func(v Val) (string, error) { return EncodeAsJsonWith(v, JsonOptions{Units: UnitEncodingString}) },
+			want:   `{"d":"90::seconds","r":{"p":"80::percent"},"xs":["1::hours"]}`,
+		},
+		{
+			name:   "yamlBase",
+			input:  "{d: 90::seconds r: {p: 80::percent} xs: [1::hours]}",
+			encode: func(v Val) (string, error) { return EncodeAsYamlWith(v, YamlOptions{Units: UnitEncodingBase}) },
+			want:   "d: 90000000000\nr:\n    p: 0.8\nxs:\n    - 3600000000000\n",
+		},
+		{
+			name:   "tomlString",
+			input:  "{d: 90::seconds r: {p: 80::percent} xs: [1::hours]}",
+			encode: func(v Val) (string, error) { return EncodeAsTomlWith(v, TomlOptions{Units: UnitEncodingString}) },
+			want:   "d = \"90::seconds\"\nxs = [\"1::hours\"]\n\n[r]\np = \"80::percent\"\n",
+		},
+		{
+			name:   "envBase",
+			input:  "{d: 90::seconds r: {p: 80::percent}}",
+			encode: func(v Val) (string, error) { return EncodeAsEnvWith(v, EnvOptions{Units: UnitEncodingBase}) },
+			want:   "D=90000000000\nR_P=0.8\n",
+		},
+		{
+			name:   "default",
+			input:  "{d: 90::seconds r: {p: 80::percent} xs: [1::hours]}",
+			encode: EncodeAsJson,
+			want:   `{"d":90,"r":{"p":80},"xs":[1]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			got, err := test.encode(v)
+			if err != nil {
+				t.Fatalf("Could not encode value: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeDeterministic(t *testing.T) {
+	// Fields are stored in a map, but encoders must output them in a stable order.
+	input := "{z: 1 a: {y: 2 b: 3 m: [{q: 1 c: 2}]} k: 'v' c: 4::minutes}"
+	encoders := map[string]func(Val) (string, error){
+		"json": EncodeAsJson,
+		"yaml": EncodeAsYaml,
+	}
+	for name, encode := range encoders {
+		t.Run(name, func(t *testing.T) {
+			var first string
+			for i := 0; i < 20; i++ {
+				e, err := parse(input)
+				if err != nil {
+					t.Fatalf("Could not parse expression: %s", err)
+				}
+				v, err := Eval(e, GlobalCtx())
+				if err != nil {
+					t.Fatalf("Could not evaluate expression: %s", err)
+				}
+				got, err := encode(v)
+				if err != nil {
+					t.Fatalf("Could not encode value: %s", err)
+				}
+				if i == 0 {
+					first = got
+				} else if got != first {
+					t.Fatalf("Output differs between runs:\n%s\nvs.\n%s", first, got)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeSortKeys(t *testing.T) {
+	input := "{z: 1 a: {x: 2 b: 3} k: 'v'}"
+	tests := []struct {
+		name   string
+		encode func(Val, bool) (string, error)
+		want   string
+	}{
+		{"json", func(v Val, sortKeys bool) (string, error) {
+			return EncodeAsJsonWith(v, JsonOptions{SortKeys: sortKeys})
+		}, `{"a":{"b":3,"x":2},"k":"v","z":1}`},
+		{"yaml", func(v Val, sortKeys bool) (string, error) {
+			return EncodeAsYamlWith(v, YamlOptions{SortKeys: sortKeys})
+		}, "a:\n    b: 3\n    x: 2\nk: v\nz: 1\n"},
+		{"toml", func(v Val, sortKeys bool) (string, error) {
+			return EncodeAsTomlWith(v, TomlOptions{SortKeys: sortKeys})
+		}, "k = \"v\"\nz = 1\n\n[a]\nb = 3\nx = 2\n"},
+		{"env", func(v Val, sortKeys bool) (string, error) {
+			return EncodeAsEnvWith(v, EnvOptions{SortKeys: sortKeys})
+		}, "A_B=3\nA_X=2\nK=v\nZ=1\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			got, err := test.encode(v, true)
+			if err != nil {
+				t.Fatalf("Could not encode value: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+			unsorted, err := test.encode(v, false)
+			if err != nil {
+				t.Fatalf("Could not encode value: %s", err)
+			}
+			if unsorted == test.want {
+				t.Errorf("Expected declaration order without SortKeys, got:\n%s", unsorted)
+			}
+		})
+	}
+}
+
+func TestEncodeAsYamlComments(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{
+			input: "{\n  // The host.\n  // Second line.\n  host: 'h' // trailing\n  port: 80\n}",
+			want:  "# The host.\n# Second line.\nhost: h\nport: 80\n",
+		},
+		{
+			input: "{\n  // Nested.\n  db: {\n    // Inner.\n    x::int: 1\n  }\n  // List.\n  l: [{\n    // Element.\n    a: 1\n  }]\n  e: []\n}",
+			want:  "# Nested.\ndb:\n    # Inner.\n    x: 1\n# List.\nl:\n    - # Element.\n      a: 1\ne: []\n",
+		},
+		{
+			// Comments of the rhs of a merge take precedence.
+			input: "{\n  // x\n  a::int: 1\n  // x\n  b: 2\n} @ {\n  // y\n  a: 3\n  b: 4\n}",
+			want:  "# y\na: 3\n# x\nb: 4\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			ctx := GlobalCtx()
+			ctx.EnableComments()
+			v, err := EvalStringCtx(test.input, ctx)
+			if err != nil {
+				t.Fatalf("Could not evaluate module: %s", err)
+			}
+			got, err := EncodeAsYaml(v)
+			if err != nil {
+				t.Fatalf("Could not encode value as YAML: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeAsYamlNoComments(t *testing.T) {
+	v, err := EvalString("{\n  // The host.\n  host: 'h'\n}")
+	if err != nil {
+		t.Fatalf("Could not evaluate module: %s", err)
+	}
+	got, err := EncodeAsYaml(v)
+	if err != nil {
+		t.Fatalf("Could not encode value as YAML: %s", err)
+	}
+	if want := "host: h\n"; got != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEncodeAsYamlFieldOrder(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "{b: 1 a: 2}", want: "b: 1\na: 2\n"},
+		{input: "{z: {w: 1 x: [{d: 1 c: 2}]} a: 'v'}", want: "z:\n    w: 1\n    x:\n        - d: 1\n          c: 2\na: v\n"},
+		{input: "{b: 1 a: 2} @ {c: 3 a: 4}", want: "b: 1\na: 4\nc: 3\n"},
+		{input: "{x: {}}", want: "x: {}\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			got, err := EncodeAsYaml(v)
+			if err != nil {
+				t.Fatalf("Could not encode value as YAML: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeAsToml(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "{b: 1 a: 'x'}", want: "b = 1\na = \"x\"\n"},
+		{input: "{x: 1.5 z: true w: 1e6 v: 7::minutes}", want: "x = 1.5\nz = true\nw = 1000000\nv = 7\n"},
+		{input: "{x: [1, 'a', [true]]}", want: "x = [1, \"a\", [true]]\n"},
+		{input: "{x: [{a: 1}, 2]}", want: "x = [{ a = 1 }, 2]\n"},
+		{input: "{k: \"q\\\"\\n\"}", want: "k = \"q\\\"\\n\"\n"},
+		{input: "{s: {p: 1 q: {r: 2}} t: 3}", want: "t = 3\n\n[s]\np = 1\n\n[s.q]\nr = 2\n"},
+		{input: "{srv: [{n: 'a'}, {n: 'b'}]}", want: "[[srv]]\nn = \"a\"\n\n[[srv]]\nn = \"b\"\n"},
+		{input: "{x: {}}", want: "[x]\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			got, err := EncodeAsToml(v)
+			if err != nil {
+				t.Fatalf("Could not encode value as TOML: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeAsTomlError(t *testing.T) {
+	tests := []string{
+		"1",
+		"[{x: 1}]",
+		"{x: nil}",
+		"{f: func(x) {x}}",
+		"{r: {x: [nil]}}",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			if got, err := EncodeAsToml(v); err == nil {
+				t.Errorf("Expected error, got %q", got)
+			}
+		})
+	}
+}
+
+func TestEncodeAsEnv(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "{port: 80 debug: false}", want: "PORT=80\nDEBUG=false\n"},
+		{input: "{db: {host: 'localhost' port: 5432} name: 'app'}", want: "DB_HOST=localhost\nDB_PORT=5432\nNAME=app\n"},
+		{input: "{a: {b: {c: 1.5}}}", want: "A_B_C=1.5\n"},
+		{input: "{timeout: 7::minutes x: nil}", want: "TIMEOUT=7\nX=\n"},
+		{input: "{msg: 'hello world'}", want: "MSG='hello world'\n"},
+		{input: "{msg: \"it's\"}", want: "MSG='it'\\''s'\n"},
+		{input: "{url: 'http://example.com:8080/x'}", want: "URL=http://example.com:8080/x\n"},
+		{input: "{s: ''}", want: "S=\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			got, err := EncodeAsEnv(v)
+			if err != nil {
+				t.Fatalf("Could not encode value as env: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeAsEnvError(t *testing.T) {
+	tests := []string{
+		"1",
+		"{x: [1, 2]}",
+		"{x: {f: func(x) {x}}}",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			if got, err := EncodeAsEnv(v); err == nil {
+				t.Errorf("Expected error, got %q", got)
+			}
+		})
+	}
+}
+
+func TestEncodeAsJsonWith(t *testing.T) {
+	tests := []struct {
+		input string
+		opts  JsonOptions
+		want  string
+	}{
+		{input: "{b: {c: [1]} a: 2}", opts: JsonOptions{Indent: "    "}, want: "{\n    \"b\": {\n        \"c\": [\n            1\n        ]\n    },\n    \"a\": 2\n}"},
+		{input: "{b: {}}", opts: JsonOptions{Indent: "\t"}, want: "{\n\t\"b\": {}\n}"},
+		{input: "{x: '<a&b>'}", opts: JsonOptions{}, want: `{"x":"<a&b>"}`},
+		{input: "{x: '<a&b>'}", opts: JsonOptions{EscapeHTML: true}, want: `{"x":"\u003ca\u0026b\u003e"}`},
+		{input: "{x: '<>'}", opts: JsonOptions{Indent: "  ", EscapeHTML: true}, want: "{\n  \"x\": \"\\u003c\\u003e\"\n}"},
+		{input: "{b: 1 a: {d: 2 c: 3}}", opts: JsonOptions{SortKeys: true}, want: `{"a":{"c":3,"d":2},"b":1}`},
+		{input: "{b: 1 a: {d: 2 c: 3}}", opts: JsonOptions{}, want: `{"b":1,"a":{"d":2,"c":3}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			got, err := EncodeAsJsonWith(v, test.opts)
+			if err != nil {
+				t.Fatalf("Could not encode value as JSON: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestToGo(t *testing.T) {
+	tests := []struct {
+		input string
+		want  any
+	}{
+		{input: "1", want: int64(1)},
+		{input: "1.5", want: 1.5},
+		{input: "'a'", want: "a"},
+		{input: "true", want: true},
+		{input: "nil", want: nil},
+		{input: "7::minutes", want: 7.0},
+		{input: "[]", want: []any{}},
+		{input: "{}", want: map[string]any{}},
+		{
+			input: "{a: 1 b: [1, 'x', nil, {c: true}] d: {e: {f: 2.5}} g: 3::hours}",
+			want: map[string]any{
+				"a": int64(1),
+				"b": []any{int64(1), "x", nil, map[string]any{"c": true}},
+				"d": map[string]any{"e": map[string]any{"f": 2.5}},
+				"g": 3.0,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			got, err := ToGo(v)
+			if err != nil {
+				t.Fatalf("Could not convert value: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("ToGo() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// Converting a value to Go and encoding that as JSON must yield
+// the same result as encoding the value directly.
+func TestToGoJsonRoundTrip(t *testing.T) {
+	const input = `{
+		name: 'konfi'
+		ports: [80, 443]
+		limits: {cpu: 0.5 mem: {soft: 1 hard: 2}}
+		owner: nil
+		enabled: true
+	}`
+	e, err := parse(input)
+	if err != nil {
+		t.Fatalf("Could not parse expression: %s", err)
+	}
+	v, err := Eval(e, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Could not evaluate expression: %s", err)
+	}
+	g, err := ToGo(v)
+	if err != nil {
+		t.Fatalf("Could not convert value: %s", err)
+	}
+	// encoding/json sorts map keys.
+	want, err := EncodeAsJsonWith(v, JsonOptions{SortKeys: true, EscapeHTML: true})
+	if err != nil {
+		t.Fatalf("Could not encode value as JSON: %s", err)
+	}
+	bs, err := json.Marshal(g)
+	if err != nil {
+		t.Fatalf("Could not encode Go value as JSON: %s", err)
+	}
+	if got := string(bs); got != want {
+		t.Errorf("Got: %s, want: %s", got, want)
+	}
+}
+
+func TestToGoError(t *testing.T) {
+	tests := []string{
+		"func (x) { x }",
+		"len",
+		"{f: func (x) { x }}",
+		"[1, len]",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Could not parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Could not evaluate expression: %s", err)
+			}
+			if got, err := ToGo(v); err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestFromGo(t *testing.T) {
+	tests := []struct {
+		name  string
+		input any
+		want  Val
+	}{
+		{name: "nil", input: nil, want: NilVal{}},
+		{name: "int", input: 1, want: IntVal(1)},
+		{name: "int64", input: int64(-2), want: IntVal(-2)},
+		{name: "uint8", input: uint8(3), want: IntVal(3)},
+		{name: "uint", input: uint(4), want: IntVal(4)},
+		{name: "uint64", input: uint64(math.MaxInt64), want: IntVal(math.MaxInt64)},
+		{name: "uintptr", input: uintptr(5), want: IntVal(5)},
+		{name: "float32", input: float32(0.5), want: DoubleVal(0.5)},
+		{name: "float64", input: 1.5, want: DoubleVal(1.5)},
+		{name: "string", input: "a", want: StringVal("a")},
+		{name: "bool", input: true, want: BoolVal(true)},
+		{name: "val", input: IntVal(7), want: IntVal(7)},
+		{name: "list", input: []any{1, "x", nil}, want: ListVal{[]Val{IntVal(1), StringVal("x"), NilVal{}}}},
+		{
+			name:  "nested",
+			input: map[string]any{"a": 1, "b": map[string]any{"c": []any{true, map[string]any{}}}},
+			want: NewRecWithFields(map[string]Val{
+				"a": IntVal(1),
+				"b": NewRecWithFields(map[string]Val{
+					"c": ListVal{[]Val{BoolVal(true), NewRec()}},
+				}),
+			}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FromGo(test.input)
+			if err != nil {
+				t.Fatalf("Could not convert value: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestFromGoInCtx(t *testing.T) {
+	env, err := FromGo(map[string]any{
+		"region": "eu-west-1",
+		"replicas": []any{
+			map[string]any{"name": "a", "port": 8080},
+			map[string]any{"name": "b", "port": 8081},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not convert value: %s", err)
+	}
+	ctx := GlobalCtx()
+	ctx.Store("env", env)
+	e, err := parse("{region: env.region port: fold(func (acc, r) { acc + r.port }, 0, env.replicas)}")
+	if err != nil {
+		t.Fatalf("Could not parse expression: %s", err)
+	}
+	got, err := Eval(e, ctx)
+	if err != nil {
+		t.Fatalf("Could not evaluate expression: %s", err)
+	}
+	want := NewRecWithFields(map[string]Val{
+		"region": StringVal("eu-west-1"),
+		"port":   IntVal(16161),
+	})
+	if !got.Equal(want) {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+}
+
+// Values converted to Go and back must be equal to the original.
+func TestFromGoToGoRoundTrip(t *testing.T) {
+	e, err := parse("{a: 1 b: [1.5, 'x', nil, {c: true}] d: {e: {}}}")
+	if err != nil {
+		t.Fatalf("Could not parse expression: %s", err)
+	}
+	v, err := Eval(e, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Could not evaluate expression: %s", err)
+	}
+	g, err := ToGo(v)
+	if err != nil {
+		t.Fatalf("Could not convert value to Go: %s", err)
+	}
+	got, err := FromGo(g)
+	if err != nil {
+		t.Fatalf("Could not convert value from Go: %s", err)
+	}
+	if !got.Equal(v) {
+		t.Errorf("Want %v, got %v", v, got)
+	}
+}
+
+func TestFromGoError(t *testing.T) {
+	tests := []struct {
+		name  string
+		input any
+	}{
+		{name: "struct", input: struct{}{}},
+		{name: "uint64", input: uint64(math.MaxInt64 + 1)},
+		{name: "uint", input: uint(math.MaxUint64)},
+		{name: "stringMap", input: map[string]string{"a": "b"}},
+		{name: "nested", input: map[string]any{"a": []any{func() {}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := FromGo(test.input); err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
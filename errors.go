@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+
+	"github.com/dnswlt/gokonfi/token"
 )
 
 // The most generic error type returned by Konfi functions.
@@ -38,10 +40,85 @@ func (e *KonfiError) Unwrap() error {
 	return e.cause
 }
 
+// rootErrorMessage returns the message of the innermost error in err's chain.
+func rootErrorMessage(err error) string {
+	for {
+		cause := errors.Unwrap(err)
+		if cause == nil {
+			break
+		}
+		err = cause
+	}
+	if e, ok := err.(*EvalError); ok {
+		return e.msg
+	}
+	return err.Error()
+}
+
+// ErrorKind categorizes errors reported by the scanner, parser, and evaluator.
+// The values of ErrorKind are stable and can be used by tools such as
+// editor integrations.
+type ErrorKind int
+
+const (
+	KindUnspecified      ErrorKind = iota
+	KindSyntax                     // Invalid input, reported by the scanner or parser.
+	KindUnboundVariable            // Reference to an undefined variable.
+	KindCyclicDependency           // Variables that depend on each other.
+	KindNoSuchField                // Access to a non-existent field.
+	KindNotCallable                // Call of a value that is not a function.
+	KindCallFailed                 // Error raised by a called function.
+	KindTypeError                  // Operands or values of the wrong type.
+	KindUnknownType                // Reference to an undefined type.
+	KindInternal                   // Interpreter bug or unimplemented feature.
+	KindDivisionByZero             // Integer division or modulo by zero.
+	KindNoMatch                    // No arm of a match expression matched.
+	KindUnusedVariable             // let binding that is never referenced (only in strict mode).
+	KindMaxDepthExceeded           // Evaluation nested deeper than the context's maximum depth.
+	KindCanceled                   // Evaluation canceled or timed out (see EvalWithContext).
+)
+
+var errorKindNames = map[ErrorKind]string{
+	KindUnspecified:      "unspecified",
+	KindSyntax:           "syntax",
+	KindUnboundVariable:  "unbound-variable",
+	KindCyclicDependency: "cyclic-dependency",
+	KindNoSuchField:      "no-such-field",
+	KindNotCallable:      "not-callable",
+	KindCallFailed:       "call-failed",
+	KindTypeError:        "type-error",
+	KindUnknownType:      "unknown-type",
+	KindInternal:         "internal",
+	KindDivisionByZero:   "division-by-zero",
+	KindNoMatch:          "no-match",
+	KindUnusedVariable:   "unused-variable",
+	KindMaxDepthExceeded: "max-depth-exceeded",
+	KindCanceled:         "canceled",
+}
+
+func (k ErrorKind) String() string {
+	if n, ok := errorKindNames[k]; ok {
+		return n
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
 func chainError(cause error, format string, a ...any) error {
 	return &KonfiError{msg: fmt.Sprintf(format, a...), cause: cause}
 }
 
+// ErrorFormat controls the output of FormattedErrorWith.
+type ErrorFormat struct {
+	Color bool // Use ANSI escape sequences to highlight positions and messages.
+}
+
+// ANSI escape sequences used for colorized error output.
+const (
+	ansiBold  = "\x1b[1m"
+	ansiRed   = "\x1b[31m"
+	ansiReset = "\x1b[0m"
+)
+
 // FormattedError turns a (possible chain of) gokonfi errors
 // such as EvalError or ParseError into a simple Go error
 // with a nicely formatted (potentially multi-line) error message.
@@ -50,36 +127,93 @@ func chainError(cause error, format string, a ...any) error {
 // In particular, the error message has human-readable indicators
 // for the position at which the error(s) occurred, whenever possible.
 func FormattedError(err error, ctx *Ctx) error {
+	return FormattedErrorWith(err, ctx, ErrorFormat{})
+}
+
+// FormattedError is a convenience method for calling FormattedError(err, ctx).
+func (ctx *Ctx) FormattedError(err error) error {
+	return FormattedError(err, ctx)
+}
+
+// FormattedErrorWith is like FormattedError, but allows to customize
+// the output format.
+func FormattedErrorWith(err error, ctx *Ctx, format ErrorFormat) error {
 	fs := ctx.FileSet()
 	msgs := []string{}
+	msgAt := func(pos token.Pos, msg string) string {
+		p, ok := fs.Position(pos)
+		if !ok {
+			// Positions from a different FileSet or synthesized ones can't be
+			// translated. The message is still useful without them.
+			return msg
+		}
+		var sb strings.Builder
+		if format.Color {
+			fmt.Fprintf(&sb, "%s%s:%s %s%s%s", ansiBold, p.String(), ansiReset, ansiRed, msg, ansiReset)
+		} else {
+			fmt.Fprintf(&sb, "%s: %s", p.String(), msg)
+		}
+		if line, ok := fs.LineText(pos); ok {
+			caret := "^"
+			if format.Color {
+				caret = ansiBold + ansiRed + caret + ansiReset
+			}
+			fmt.Fprintf(&sb, "\n    %s\n    %s%s", line, caretIndent(line, p.Column()), caret)
+		}
+		return sb.String()
+	}
+	// Identical consecutive messages, as produced by deep recursion, are
+	// only shown once, followed by the number of repetitions.
+	repeated := 0
+	flushRepeated := func() {
+		if repeated > 0 {
+			msgs = append(msgs, fmt.Sprintf("(previous error repeated %d more times)", repeated))
+			repeated = 0
+		}
+	}
+	add := func(msg string) {
+		if len(msgs) > 0 && msgs[len(msgs)-1] == msg {
+			repeated++
+			return
+		}
+		flushRepeated()
+		msgs = append(msgs, msg)
+	}
 Loop:
 	for err != nil {
 		switch e := err.(type) {
 		case *KonfiError:
-			msgs = append(msgs, e.msg)
+			add(e.msg)
 		case *EvalError:
-			p, ok := fs.Position(e.Pos())
-			if !ok {
-				panic(fmt.Sprintf("cannot translate position %d", e.Pos()))
-			}
-			msgs = append(msgs, fmt.Sprintf("%s: %s", p.String(), e.msg))
+			add(msgAt(e.Pos(), e.msg))
 		case *ParseError:
-			p, ok := fs.Position(e.Pos())
-			if !ok {
-				panic(fmt.Sprintf("cannot translate position %d", e.Pos()))
-			}
-			msgs = append(msgs, fmt.Sprintf("%s: %s", p.String(), e.msg))
+			add(msgAt(e.Pos(), e.msg))
 		case *ScanError:
-			p, ok := fs.Position(e.Pos())
-			if !ok {
-				panic(fmt.Sprintf("cannot translate position %d", e.Pos()))
-			}
-			msgs = append(msgs, fmt.Sprintf("%s: %s", p.String(), e.msg))
+			add(msgAt(e.Pos(), e.msg))
 		default:
-			msgs = append(msgs, err.Error())
+			add(err.Error())
 			break Loop // Don't unwrap external errors.
 		}
 		err = errors.Unwrap(err)
 	}
-	return fmt.Errorf(strings.Join(msgs, "\n"))
+	flushRepeated()
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// caretIndent returns the whitespace that precedes a caret pointing at
+// the given (1-based, byte) column of line. Tabs are preserved so that
+// the caret aligns with the line regardless of the tab width.
+func caretIndent(line string, col int) string {
+	if col-1 > len(line) {
+		col = len(line) + 1
+	}
+	var sb strings.Builder
+	for _, r := range line[:col-1] {
+		if r == '\t' {
+			sb.WriteRune('\t')
+		} else {
+			sb.WriteRune(' ')
+		}
+	}
+	return sb.String()
 }
@@ -0,0 +1,118 @@
+package gokonfi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormattedError(t *testing.T) {
+	tests := []struct {
+		name   string
+		format ErrorFormat
+		want   string
+	}{
+		{
+			name:   "plain",
+			format: ErrorFormat{},
+			want:   "test:1:7: incompatible types for +: gokonfi.IntVal and gokonfi.StringVal\n    {x: 1 + 'a'}\n          ^",
+		},
+		{
+			name:   "color",
+			format: ErrorFormat{Color: true},
+			want:   "\x1b[1mtest:1:7:\x1b[0m \x1b[31mincompatible types for +: gokonfi.IntVal and gokonfi.StringVal\x1b[0m\n    {x: 1 + 'a'}\n          \x1b[1m\x1b[31m^\x1b[0m",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := GlobalCtx()
+			_, err := evalSelfContainedModule("{x: 1 + 'a'}", ctx)
+			if err == nil {
+				t.Fatalf("Wanted error, got none")
+			}
+			got := FormattedErrorWith(err, ctx, test.format).Error()
+			if got != test.want {
+				t.Errorf("Got:\n%q\nwant:\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormattedErrorChain(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "parse",
+			input: "{x: 1\n  y: }",
+			want:  "LoadModuleReader: failed to parse module\nin:2:6: unexpected token type RightBrace for operand\n      y: }\n         ^",
+		},
+		{
+			name:  "eval",
+			input: "let f(x): x + 'a'\n{y: f(1)}",
+			want: "LoadModuleReader: failed to evaluate module\n" +
+				"in:2:5: call failed\n    {y: f(1)}\n        ^\n" +
+				"in:1:13: incompatible types for +: gokonfi.IntVal and gokonfi.StringVal\n    let f(x): x + 'a'\n                ^",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := GlobalCtx()
+			_, err := LoadModuleReader("in", strings.NewReader(test.input), ctx)
+			if err == nil {
+				t.Fatalf("Wanted error, got none")
+			}
+			got := ctx.FormattedError(err).Error()
+			if got != test.want {
+				t.Errorf("Got:\n%q\nwant:\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormattedErrorUnknownPos(t *testing.T) {
+	err := chainError(&EvalError{pos: 12345, msg: "100% broken"}, "outer")
+	got := FormattedError(err, GlobalCtx()).Error()
+	if want := "outer\n100% broken"; got != want {
+		t.Errorf("Got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestFormattedErrorCaretWithTabs(t *testing.T) {
+	ctx := GlobalCtx()
+	_, err := LoadModuleReader("in", strings.NewReader("{\n\tx: 1 + 'a'\n}"), ctx)
+	if err == nil {
+		t.Fatalf("Wanted error, got none")
+	}
+	lines := strings.Split(ctx.FormattedError(err).Error(), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Wanted 4 lines, got %q", lines)
+	}
+	if want := "    \tx: 1 + 'a'"; lines[2] != want {
+		t.Errorf("Got source line %q, want %q", lines[2], want)
+	}
+	// The caret must be under the '+' (column 7 of the source line).
+	if want := "    \t     ^"; lines[3] != want {
+		t.Errorf("Got caret line %q, want %q", lines[3], want)
+	}
+}
+
+func TestFormattedErrorRepeated(t *testing.T) {
+	ctx := GlobalCtx()
+	ctx.SetMaxDepth(50)
+	_, err := LoadModuleReader("in", strings.NewReader("let f(x): f(x + 1)\n{y: f(0)}"), ctx)
+	if err == nil {
+		t.Fatalf("Wanted error, got none")
+	}
+	lines := strings.Split(ctx.FormattedError(err).Error(), "\n")
+	if len(lines) != 11 {
+		t.Fatalf("Wanted 11 lines, got %q", lines)
+	}
+	if !strings.HasPrefix(lines[7], "(previous error repeated ") {
+		t.Errorf("Wanted repetition note, got %q", lines[7])
+	}
+	if want := "in:1:13: maximum evaluation depth of 50 exceeded"; lines[8] != want {
+		t.Errorf("Got %q, want %q", lines[8], want)
+	}
+}
@@ -1,10 +1,15 @@
 package gokonfi
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dnswlt/gokonfi/token"
 )
@@ -13,6 +18,12 @@ type Val interface {
 	fmt.Stringer
 	Bool() bool
 	Typ() *Typ
+	// Equal reports whether the value is deeply equal to other.
+	// Values of different types are never equal.
+	Equal(other Val) bool
+	// Clone returns a deep copy of the value. Immutable values,
+	// such as scalars and functions, return themselves.
+	Clone() Val
 	valImpl()
 }
 
@@ -42,12 +53,38 @@ type globalCtx struct {
 	types     map[string]*Typ          // Known types
 	modules   map[string]*loadedModule // Already loaded modules, keyed by File.Name().
 	filestack []string                 // Stack of current working directories.
+	profile   *Profile                 // Evaluation statistics. Only non-nil if profiling is enabled.
+	comments  bool                     // If true, leading comments of record fields are kept.
+	strict    bool                     // If true, unused let bindings are an error.
+	now       func() time.Time         // Clock used by the now builtin.
+	depth     int                      // Current nesting depth of Eval calls.
+	maxDepth  int                      // Maximum nesting depth of Eval calls. No limit if <= 0.
+	cancel    context.Context          // If non-nil, evaluation is aborted once it is done.
+	evals     int                      // Number of Eval calls, used to check cancel periodically.
+}
+
+// Number of Eval calls between two checks for cancellation.
+const cancelCheckInterval = 1024
+
+// canceled returns the error of the context passed to EvalWithContext,
+// or nil if evaluation has not been canceled.
+func (g *globalCtx) canceled() error {
+	if g.cancel == nil {
+		return nil
+	}
+	return g.cancel.Err()
 }
 
+// DefaultMaxDepth is the default maximum nesting depth of expression evaluation.
+// It bounds the recursion depth of konfi functions and avoids Go stack overflows.
+const DefaultMaxDepth = 100000
+
 type loadedModule struct {
 	name    string         // Name of this module. In practice, always its file path.
 	pubVars map[string]Val // Declared pub(lic) variables of the module.
 	body    Val            // The final (optional) module body. Set to NilVal{} if not present.
+	types   []*Typ         // Unit, record, and alias types declared by the module, sorted by name.
+	ctx     *Ctx           // Context in which the module was evaluated.
 }
 
 func (m *loadedModule) Body() Val {
@@ -56,8 +93,13 @@ func (m *loadedModule) Body() Val {
 
 func (m *loadedModule) AsRec() *RecVal {
 	r := NewRec()
-	for v, val := range m.pubVars {
-		r.setField(v, val, nil) // Module-level vars have no FieldAnnotation.
+	names := make([]string, 0, len(m.pubVars))
+	for v := range m.pubVars {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	for _, v := range names {
+		r.setField(v, m.pubVars[v], nil) // Module-level vars have no FieldAnnotation.
 	}
 	const bodyField = "body"
 	if _, ok := r.Fields[bodyField]; !ok {
@@ -68,6 +110,40 @@ func (m *loadedModule) AsRec() *RecVal {
 	return r
 }
 
+// asRecSubset is like AsRec, but only returns the fields with the given names.
+// It returns an error if the module has no field of any of the given names.
+func (m *loadedModule) asRecSubset(names []string) (*RecVal, error) {
+	all := m.AsRec()
+	r := NewRec()
+	for _, n := range names {
+		v, ok := all.Fields[n]
+		if !ok {
+			return nil, fmt.Errorf("module %s has no public declaration %q", m.name, n)
+		}
+		r.setField(n, v, nil)
+	}
+	return r, nil
+}
+
+// Call calls the public function name of the module with the given args.
+// It returns an error if the module has no public declaration of that name
+// or if it is not callable.
+func (m *loadedModule) Call(name string, args ...Val) (Val, error) {
+	v, ok := m.pubVars[name]
+	if !ok {
+		return nil, fmt.Errorf("Call: module %s has no public declaration %q", m.name, name)
+	}
+	f, ok := v.(CallableVal)
+	if !ok {
+		return nil, fmt.Errorf("Call: %q in module %s is not callable, got %s", name, m.name, v.Typ().Id)
+	}
+	res, err := f.Call(args, m.ctx)
+	if err != nil {
+		return nil, chainError(err, "Call: %s failed", name)
+	}
+	return res, nil
+}
+
 func EmptyCtx() *Ctx {
 	return &Ctx{
 		vars: &varCtx{
@@ -76,9 +152,11 @@ func EmptyCtx() *Ctx {
 			parent: nil,
 		},
 		global: &globalCtx{
-			fileset: token.NewFileSet(),
-			types:   make(map[string]*Typ),
-			modules: make(map[string]*loadedModule),
+			fileset:  token.NewFileSet(),
+			types:    make(map[string]*Typ),
+			modules:  make(map[string]*loadedModule),
+			now:      time.Now,
+			maxDepth: DefaultMaxDepth,
 		},
 	}
 }
@@ -141,6 +219,55 @@ func (ctx *Ctx) LookupType(typeId string) *Typ {
 	return nil // Not found
 }
 
+// lookupAnnotatedType returns the type denoted by the non-list type annotation ta,
+// or nil if ta refers to an unknown type.
+func (ctx *Ctx) lookupAnnotatedType(ta TypeAnnotation) *Typ {
+	switch t := ta.(type) {
+	case *OptionalType:
+		elem := ctx.lookupAnnotatedType(t.Elem)
+		if elem == nil {
+			return nil
+		}
+		return NewOptionalType(elem)
+	case *UnionType:
+		members := make([]*Typ, len(t.Members))
+		for i, m := range t.Members {
+			members[i] = ctx.lookupAnnotatedType(m)
+			if members[i] == nil {
+				return nil
+			}
+		}
+		return NewUnionType(t.TypeId(), members)
+	}
+	return ctx.LookupType(ta.TypeId())
+}
+
+// EnableComments makes modules loaded in ctx and all contexts sharing its global state
+// keep the leading comments of record fields, so that they are included in YAML output.
+func (ctx *Ctx) EnableComments() {
+	ctx.global.comments = true
+}
+
+// EnableStrict enables strict mode in ctx and all contexts sharing its global state.
+// In strict mode, let bindings of records and modules that are never referenced
+// are reported as errors.
+func (ctx *Ctx) EnableStrict() {
+	ctx.global.strict = true
+}
+
+// SetClock sets the clock used by the now builtin in ctx and all contexts sharing
+// its global state. By default, the clock is time.Now.
+func (ctx *Ctx) SetClock(now func() time.Time) {
+	ctx.global.now = now
+}
+
+// SetMaxDepth sets the maximum nesting depth of expression evaluation in ctx and
+// all contexts sharing its global state. Exceeding it is an EvalError of kind
+// KindMaxDepthExceeded. A value <= 0 removes the limit.
+func (ctx *Ctx) SetMaxDepth(maxDepth int) {
+	ctx.global.maxDepth = maxDepth
+}
+
 func (ctx *Ctx) LookupModule(name string) *loadedModule {
 	if mod, ok := ctx.global.modules[name]; ok {
 		return mod
@@ -173,6 +300,13 @@ func (ctx *Ctx) store(v string, val Val) {
 	delete(ctx.vars.active, v)
 }
 
+// Store binds the variable v to val in ctx. Expressions and modules evaluated in ctx
+// (or in child contexts of ctx) can refer to val as a free variable. If ctx is the
+// top-level context, val is also visible to all modules loaded from it.
+func (ctx *Ctx) Store(v string, val Val) {
+	ctx.store(v, val)
+}
+
 func (ctx *Ctx) storeExpr(v string, expr Expr) {
 	ctx.vars.env[v] = lazyVal{expr: expr}
 }
@@ -188,8 +322,11 @@ func (ctx *Ctx) defineType(typ *Typ) {
 	}
 }
 
-func (ctx *Ctx) addFile(name string, size int) *token.File {
-	return ctx.global.fileset.AddFile(name, size)
+// addFile adds a file with the given source code to ctx's FileSet.
+func (ctx *Ctx) addFile(name string, src string) *token.File {
+	f := ctx.global.fileset.AddFile(name, len(src))
+	f.SetSource(src)
+	return f
 }
 
 // isActiveFile checks if a file with the given name is currently on the
@@ -220,7 +357,7 @@ func (ctx *Ctx) cwd() string {
 	if len(ctx.global.filestack) == 0 {
 		return "."
 	}
-	return path.Dir(ctx.global.filestack[len(ctx.global.filestack)-1])
+	return filepath.Dir(ctx.global.filestack[len(ctx.global.filestack)-1])
 }
 
 func (ctx *Ctx) FileSet() *token.FileSet {
@@ -230,6 +367,8 @@ func (ctx *Ctx) FileSet() *token.FileSet {
 // EvalError is the error type commonly returned if evaluation of an expression or module fails.
 type EvalError struct {
 	pos   token.Pos // Position at which evaluation failed.
+	end   token.Pos // Optional end position of the failed expression.
+	kind  ErrorKind // Category of the error.
 	msg   string    // Error message.
 	cause error     // Optional root cause error.
 }
@@ -245,6 +384,19 @@ func (e *EvalError) Pos() token.Pos {
 	return e.pos
 }
 
+// Returns the end position of the expression whose evaluation failed.
+// If the end position is unknown, End returns Pos.
+func (e *EvalError) End() token.Pos {
+	if e.end < e.pos {
+		return e.pos
+	}
+	return e.end
+}
+
+func (e *EvalError) Kind() ErrorKind {
+	return e.kind
+}
+
 func (e *EvalError) Unwrap() error {
 	return e.cause
 }
@@ -253,13 +405,15 @@ func (e *EvalError) Unwrap() error {
 type RecVal struct {
 	Fields           map[string]Val
 	FieldAnnotations map[string]*FieldAnnotation // Optional type annotations per field.
+	order            []string                    // Field names in insertion order.
 }
 
 // Information about the type annotation attached to a record field,
-// e.g. the minutes in `{ x::minutes }`.
+// e.g. the minutes in `{ x::minutes }`, and about its leading comment.
 type FieldAnnotation struct {
-	T *Typ
-	M float64 // optional, only nonzero for unit types (for which T.IsUnit() is true).
+	T       *Typ    // nil for untyped fields that only have a comment.
+	M       float64 // optional, only nonzero for unit types (for which T.IsUnit() is true).
+	Comment string  // Leading comment of the field. Only set if comments are enabled.
 }
 
 // NewRec returns a new record with no fields.
@@ -267,17 +421,56 @@ func NewRec() *RecVal {
 	return &RecVal{Fields: make(map[string]Val), FieldAnnotations: make(map[string]*FieldAnnotation)}
 }
 
+// NewRecWithFields returns a new record with the given fields.
+// Since maps are unordered, the fields are ordered by name.
 func NewRecWithFields(fields map[string]Val) *RecVal {
-	return &RecVal{Fields: fields, FieldAnnotations: make(map[string]*FieldAnnotation)}
+	return &RecVal{Fields: fields, FieldAnnotations: make(map[string]*FieldAnnotation), order: sortedKeys(fields)}
 }
 
 func (r *RecVal) setField(field string, val Val, anno *FieldAnnotation) {
+	if _, ok := r.Fields[field]; !ok {
+		r.order = append(r.order, field)
+	}
 	r.Fields[field] = val
 	if anno != nil {
 		r.FieldAnnotations[field] = anno
 	}
 }
 
+// FieldNames returns the names of all fields of r in insertion order.
+// Fields that were added to r.Fields directly come last, ordered by name.
+func (r *RecVal) FieldNames() []string {
+	if len(r.order) == len(r.Fields) {
+		// Fast path: all fields were added via setField.
+		return r.order
+	}
+	names := make([]string, 0, len(r.Fields))
+	seen := make(map[string]bool, len(r.Fields))
+	for _, f := range r.order {
+		if _, ok := r.Fields[f]; ok && !seen[f] {
+			names = append(names, f)
+			seen[f] = true
+		}
+	}
+	var rest []string
+	for f := range r.Fields {
+		if !seen[f] {
+			rest = append(rest, f)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 type ListVal struct {
 	Elements []Val
 }
@@ -330,15 +523,97 @@ func (f *NativeFuncVal) Call(args []Val, ctx *Ctx) (Val, error) {
 }
 
 func (f *FuncExprVal) Call(args []Val, _ *Ctx) (Val, error) {
-	arity := len(f.F.Params)
-	if len(args) != arity {
-		return nil, fmt.Errorf("wrong number of arguments for %s: got %d want %d", f.String(), len(args), arity)
+	params := f.F.Params
+	variadic := f.F.Variadic()
+	if variadic {
+		params = params[:len(params)-1]
+	}
+	arity := len(params)
+	minArity := arity
+	for minArity > 0 && params[minArity-1].Default != nil {
+		minArity--
+	}
+	if len(args) < minArity || !variadic && len(args) > arity {
+		want := fmt.Sprintf("%d", arity)
+		if variadic {
+			want = fmt.Sprintf("at least %d", minArity)
+		} else if minArity < arity {
+			want = fmt.Sprintf("%d to %d", minArity, arity)
+		}
+		return nil, fmt.Errorf("wrong number of arguments for %s: got %d want %s", f.String(), len(args), want)
 	}
 	fctx := ChildCtx(f.ctx)
-	for i, p := range f.F.Params {
-		fctx.store(p.Name, args[i])
+	for i, p := range params {
+		var v Val
+		if i < len(args) {
+			v = args[i]
+		} else {
+			// Default values are evaluated in the closure context on each call.
+			var err error
+			v, err = Eval(p.Default, f.ctx)
+			if err != nil {
+				return nil, chainError(err, "default value for parameter %s failed", p.Name)
+			}
+		}
+		v, err := checkAnnotatedType(p.T, v, "parameter "+p.Name, f.ctx)
+		if err != nil {
+			return nil, err
+		}
+		fctx.store(p.Name, v)
+	}
+	if variadic {
+		p := f.F.Params[arity]
+		rest := []Val{}
+		if len(args) > arity {
+			for _, arg := range args[arity:] {
+				// The type annotation of a variadic parameter applies to each argument.
+				v, err := checkAnnotatedType(p.T, arg, "parameter "+p.Name, f.ctx)
+				if err != nil {
+					return nil, err
+				}
+				rest = append(rest, v)
+			}
+		}
+		fctx.store(p.Name, ListVal{Elements: rest})
 	}
-	return Eval(f.F.Body, fctx)
+	res, err := Eval(f.F.Body, fctx)
+	if err != nil {
+		return nil, err
+	}
+	return checkAnnotatedType(f.F.Result, res, "result of "+f.String(), f.ctx)
+}
+
+// checkAnnotatedType checks that v has the annotated type ta, if it is not nil.
+// Like for record fields, unit values are converted to the multiple of the annotation,
+// e.g. seconds to minutes for a parameter d::minutes. The description what is used
+// in error messages, e.g. "parameter x".
+func checkAnnotatedType(ta TypeAnnotation, v Val, what string, ctx *Ctx) (Val, error) {
+	if ta == nil {
+		return v, nil
+	}
+	if lt, ok := ta.(*ListType); ok {
+		if et := elemType(lt); ctx.lookupAnnotatedType(et) == nil {
+			return nil, &EvalError{pos: et.Pos(), end: et.End(), kind: KindUnknownType, msg: fmt.Sprintf("unknown type %s for %s", et.TypeId(), what)}
+		}
+		if err := typeCheckList(v, lt, ctx); err != nil {
+			return nil, &EvalError{pos: ta.Pos(), end: ta.End(), kind: KindTypeError, msg: fmt.Sprintf("type error for %s: %s", what, err)}
+		}
+		return v, nil
+	}
+	t := ctx.lookupAnnotatedType(ta)
+	if t == nil {
+		return nil, &EvalError{pos: ta.Pos(), end: ta.End(), kind: KindUnknownType, msg: fmt.Sprintf("unknown type %s for %s", ta.TypeId(), what)}
+	}
+	if err := typeCheck(v, t, ctx); err != nil {
+		return nil, &EvalError{pos: ta.Pos(), end: ta.End(), kind: KindTypeError, msg: fmt.Sprintf("type error for %s: %s", what, err)}
+	}
+	if u, ok := v.(UnitVal); ok {
+		// ta may be the unit type itself (allowing any multiplier).
+		if m := unitMultiple(t, ta); m > 0 {
+			v = u.WithF(m)
+		}
+	}
+	return v, nil
 }
 
 type TypedVal struct {
@@ -422,10 +697,14 @@ func (s NilVal) String() string {
 	return "nil"
 }
 func (r *RecVal) String() string {
-	return "<rec>"
+	var sb strings.Builder
+	writeVal(&sb, r)
+	return sb.String()
 }
 func (r ListVal) String() string {
-	return "<list>"
+	var sb strings.Builder
+	writeVal(&sb, r)
+	return sb.String()
 }
 func (f *NativeFuncVal) String() string {
 	return fmt.Sprintf("<builtin %s>", f.Name)
@@ -434,10 +713,67 @@ func (f *FuncExprVal) String() string {
 	return fmt.Sprintf("<func @%d:%d>", f.F.Pos(), f.F.End())
 }
 func (v TypedVal) String() string {
-	// For now, user defined types cannot override the String() method.
+	// Types can only customize their string representation via their Encode
+	// function, which requires a context. See format.
 	return fmt.Sprintf("%s(%s)", v.T.Id, v.V.String())
 }
 
+// writeVal writes the string representation of v to sb. Records and lists are
+// written recursively, with record fields sorted by name for determinism.
+// Strings nested in records or lists are quoted.
+func writeVal(sb *strings.Builder, v Val) {
+	switch x := v.(type) {
+	case *RecVal:
+		sb.WriteByte('{')
+		for i, f := range sortedKeys(x.Fields) {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			if isIdentifier(f) {
+				sb.WriteString(f)
+			} else {
+				sb.WriteString(strconv.Quote(f))
+			}
+			sb.WriteString(": ")
+			writeVal(sb, x.Fields[f])
+		}
+		sb.WriteByte('}')
+	case ListVal:
+		sb.WriteByte('[')
+		for i, e := range x.Elements {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			writeVal(sb, e)
+		}
+		sb.WriteByte(']')
+	case StringVal:
+		sb.WriteString(strconv.Quote(string(x)))
+	case TypedVal:
+		fmt.Fprintf(sb, "%s(", x.T.Id)
+		writeVal(sb, x.V)
+		sb.WriteByte(')')
+	default:
+		sb.WriteString(v.String())
+	}
+}
+
+// format returns the string representation of v as defined by its type's
+// Encode function. Types without an Encode function use v.String().
+func (v TypedVal) format(ctx *Ctx) (string, error) {
+	if v.T.Encode == nil {
+		return v.String(), nil
+	}
+	e, err := v.T.Encode.Call([]Val{v}, ctx)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := e.(StringVal); ok {
+		return string(s), nil
+	}
+	return e.String(), nil
+}
+
 func (x IntVal) Typ() *Typ {
 	return builtinTypeInt
 }
@@ -472,6 +808,132 @@ func (v TypedVal) Typ() *Typ {
 	return v.T
 }
 
+func (x IntVal) Equal(other Val) bool {
+	y, ok := other.(IntVal)
+	return ok && x == y
+}
+func (v DoubleVal) Equal(other Val) bool {
+	w, ok := other.(DoubleVal)
+	return ok && v == w
+}
+func (v UnitVal) Equal(other Val) bool {
+	// Units with different multiples are not equal, even if they represent the same value:
+	// 1::days is not equal to 24::hours.
+	w, ok := other.(UnitVal)
+	return ok && v == w
+}
+func (b BoolVal) Equal(other Val) bool {
+	c, ok := other.(BoolVal)
+	return ok && b == c
+}
+func (s StringVal) Equal(other Val) bool {
+	t, ok := other.(StringVal)
+	return ok && s == t
+}
+func (s NilVal) Equal(other Val) bool {
+	_, ok := other.(NilVal)
+	return ok
+}
+func (r *RecVal) Equal(other Val) bool {
+	// Field annotations are not taken into account.
+	q, ok := other.(*RecVal)
+	if !ok {
+		return false
+	}
+	if r == q {
+		return true
+	}
+	if len(r.Fields) != len(q.Fields) {
+		return false
+	}
+	for k, v := range r.Fields {
+		w, ok := q.Fields[k]
+		if !ok || !v.Equal(w) {
+			return false
+		}
+	}
+	return true
+}
+func (r ListVal) Equal(other Val) bool {
+	q, ok := other.(ListVal)
+	if !ok || len(r.Elements) != len(q.Elements) {
+		return false
+	}
+	for i, v := range r.Elements {
+		if !v.Equal(q.Elements[i]) {
+			return false
+		}
+	}
+	return true
+}
+func (f *NativeFuncVal) Equal(other Val) bool {
+	// Functions are only equal to themselves.
+	g, ok := other.(*NativeFuncVal)
+	return ok && f == g
+}
+func (f *FuncExprVal) Equal(other Val) bool {
+	// Functions are only equal to themselves.
+	g, ok := other.(*FuncExprVal)
+	return ok && f == g
+}
+func (v TypedVal) Equal(other Val) bool {
+	w, ok := other.(TypedVal)
+	return ok && v.T == w.T && v.V.Equal(w.V)
+}
+
+func (x IntVal) Clone() Val {
+	return x
+}
+func (v DoubleVal) Clone() Val {
+	return v
+}
+func (v UnitVal) Clone() Val {
+	return v
+}
+func (b BoolVal) Clone() Val {
+	return b
+}
+func (s StringVal) Clone() Val {
+	return s
+}
+func (s NilVal) Clone() Val {
+	return s
+}
+func (r *RecVal) Clone() Val {
+	c := &RecVal{
+		Fields:           make(map[string]Val, len(r.Fields)),
+		FieldAnnotations: make(map[string]*FieldAnnotation, len(r.FieldAnnotations)),
+		order:            append([]string(nil), r.FieldNames()...),
+	}
+	for k, v := range r.Fields {
+		c.Fields[k] = v.Clone()
+	}
+	for k, a := range r.FieldAnnotations {
+		anno := *a
+		c.FieldAnnotations[k] = &anno
+	}
+	return c
+}
+func (r ListVal) Clone() Val {
+	if r.Elements == nil {
+		return r
+	}
+	elems := make([]Val, len(r.Elements))
+	for i, v := range r.Elements {
+		elems[i] = v.Clone()
+	}
+	return ListVal{Elements: elems}
+}
+func (f *NativeFuncVal) Clone() Val {
+	return f
+}
+func (f *FuncExprVal) Clone() Val {
+	return f
+}
+func (v TypedVal) Clone() Val {
+	return TypedVal{V: v.V.Clone(), T: v.T}
+}
+
 // Binary operations on Val.
 
 func plus(x, y Val) (Val, error) {
@@ -502,10 +964,31 @@ func plus(x, y Val) (Val, error) {
 			// u.F > v.F
 			return UnitVal{V: u.V*(u.F/v.F) + v.V, F: v.F, T: v.T}, nil
 		}
+		if v, ok := y.(TypedVal); ok {
+			if tm, ok := addDurationToTime(v, u, 1); ok {
+				return tm, nil
+			}
+		}
+	case TypedVal:
+		if v, ok := y.(UnitVal); ok {
+			if tm, ok := addDurationToTime(u, v, 1); ok {
+				return tm, nil
+			}
+		}
 	}
 	return nil, fmt.Errorf("incompatible types for +: %T and %T", x, y)
 }
 
+// addDurationToTime returns the time t shifted by sign * d. It returns false
+// if t is not a time or d is not a duration.
+func addDurationToTime(t TypedVal, d UnitVal, sign float64) (TypedVal, bool) {
+	if t.T != builtinTypeTime || d.T != builtinTypeDuration {
+		return TypedVal{}, false
+	}
+	tm := goTime(t.V.(*RecVal)).Add(time.Duration(sign * d.V * d.F))
+	return TypedVal{V: timeRec(tm), T: builtinTypeTime}, true
+}
+
 func minus(x, y Val) (Val, error) {
 	switch u := x.(type) {
 	case IntVal:
@@ -529,6 +1012,12 @@ func minus(x, y Val) (Val, error) {
 			// u.F > v.F
 			return UnitVal{V: u.V*(u.F/v.F) - v.V, F: v.F, T: v.T}, nil
 		}
+	case TypedVal:
+		if v, ok := y.(UnitVal); ok {
+			if tm, ok := addDurationToTime(u, v, -1); ok {
+				return tm, nil
+			}
+		}
 	}
 	return nil, fmt.Errorf("incompatible types for -: %T and %T", x, y)
 }
@@ -560,10 +1049,17 @@ func times(x, y Val) (Val, error) {
 	return nil, fmt.Errorf("incompatible types for *: %T and %T", x, y)
 }
 
+// errDivisionByZero is returned by integer division and modulo by zero.
+// Unlike most evaluation errors, it can be caught by pcall.
+var errDivisionByZero = errors.New("integer division by zero")
+
 func div(x, y Val) (Val, error) {
 	switch u := x.(type) {
 	case IntVal:
 		if v, ok := y.(IntVal); ok {
+			if v == 0 {
+				return nil, errDivisionByZero
+			}
 			return u / v, nil
 		}
 	case DoubleVal:
@@ -577,6 +1073,13 @@ func div(x, y Val) (Val, error) {
 		if v, ok := y.(DoubleVal); ok {
 			return UnitVal{V: u.V / float64(v), F: u.F, T: u.T}, nil
 		}
+		// Dividing units of the same type yields their (dimensionless) ratio.
+		if v, ok := y.(UnitVal); ok {
+			if u.T != v.T {
+				return nil, fmt.Errorf("incompatible unit types for /: %s and %s", u.TypeId(), v.TypeId())
+			}
+			return DoubleVal((u.V * u.F) / (v.V * v.F)), nil
+		}
 	}
 	return nil, fmt.Errorf("incompatible types for /: %T and %T", x, y)
 }
@@ -584,12 +1087,39 @@ func div(x, y Val) (Val, error) {
 func modulo(x, y Val) (Val, error) {
 	if u, ok := x.(IntVal); ok {
 		if v, ok := y.(IntVal); ok {
+			if v == 0 {
+				return nil, errDivisionByZero
+			}
 			return u % v, nil
 		}
 	}
 	return nil, fmt.Errorf("incompatible types for %%: %T and %T", x, y)
 }
 
+// in checks whether x is an element of the list y, a substring of the string y,
+// or the name of a field of the record y.
+func in(x, y Val) (Val, error) {
+	switch v := y.(type) {
+	case ListVal:
+		for _, e := range v.Elements {
+			if x.Equal(e) {
+				return BoolVal(true), nil
+			}
+		}
+		return BoolVal(false), nil
+	case StringVal:
+		if u, ok := x.(StringVal); ok {
+			return BoolVal(strings.Contains(string(v), string(u))), nil
+		}
+	case *RecVal:
+		if u, ok := x.(StringVal); ok {
+			_, found := v.Fields[string(u)]
+			return BoolVal(found), nil
+		}
+	}
+	return nil, fmt.Errorf("incompatible types for in: %T and %T", x, y)
+}
+
 func logicalAnd(x, y Val) (Val, error) {
 	return BoolVal(x.Bool() && y.Bool()), nil
 }
@@ -598,15 +1128,14 @@ func logicalOr(x, y Val) (Val, error) {
 	return BoolVal(x.Bool() || y.Bool()), nil
 }
 
-// Val equality is delegated to Go equality.
-// This works as expected for scalar types.
-// Records never compare equal.
+// Val equality is delegated to Val.Equal: values of different types are never equal,
+// records and lists are compared structurally, and functions are only equal to themselves.
 func equal(x, y Val) (Val, error) {
-	return BoolVal(x == y), nil
+	return BoolVal(x.Equal(y)), nil
 }
 
 func notEqual(x, y Val) (Val, error) {
-	return BoolVal(x != y), nil
+	return BoolVal(!x.Equal(y)), nil
 }
 
 func lessThan(x, y Val) (Val, error) {
@@ -730,7 +1259,7 @@ func unaryOp(x Val, op token.TokenType) (Val, error) {
 	return nil, fmt.Errorf("invalid unary operator '%v'", op)
 }
 
-func binaryOp(x, y Val, op token.TokenType) (Val, error) {
+func binaryOp(x, y Val, op token.TokenType, ctx *Ctx) (Val, error) {
 	switch op {
 	case token.Plus:
 		return plus(x, y)
@@ -759,12 +1288,63 @@ func binaryOp(x, y Val, op token.TokenType) (Val, error) {
 	case token.GreaterEq:
 		return greaterEq(x, y)
 	case token.Merge:
-		return mergeValues(x, y)
+		return mergeValues(x, y, ctx)
+	case token.In:
+		return in(x, y)
 	}
 	return nil, fmt.Errorf("invalid binary operator '%v'", op)
 }
 
+// EvalWithContext is like Eval, but aborts evaluation once goCtx is canceled or
+// its deadline is exceeded. The returned EvalError has kind KindCanceled and wraps
+// goCtx.Err(), so callers can test for it with errors.Is. To guarantee that
+// evaluation terminates, pcall and try do not catch this error.
+// ctx can be reused after EvalWithContext returns, even if evaluation was aborted.
+func EvalWithContext(goCtx context.Context, expr Expr, ctx *Ctx) (Val, error) {
+	if err := goCtx.Err(); err != nil {
+		return nil, canceledError(expr, err)
+	}
+	g := ctx.global
+	prevCancel, prevEvals := g.cancel, g.evals
+	g.cancel = goCtx
+	// Restore the cancellation state on every exit path, including panics of native functions.
+	// Eval itself restores the evaluation depth.
+	defer func() { g.cancel, g.evals = prevCancel, prevEvals }()
+	return Eval(expr, ctx)
+}
+
+func canceledError(expr Expr, cause error) error {
+	return &EvalError{pos: expr.Pos(), end: expr.End(), kind: KindCanceled,
+		msg: "evaluation canceled", cause: cause}
+}
+
 func Eval(expr Expr, ctx *Ctx) (Val, error) {
+	g := ctx.global
+	if g.maxDepth > 0 && g.depth >= g.maxDepth {
+		return nil, &EvalError{pos: expr.Pos(), end: expr.End(), kind: KindMaxDepthExceeded,
+			msg: fmt.Sprintf("maximum evaluation depth of %d exceeded", g.maxDepth)}
+	}
+	if g.cancel != nil {
+		g.evals++
+		if g.evals%cancelCheckInterval == 0 {
+			if err := g.cancel.Err(); err != nil {
+				return nil, canceledError(expr, err)
+			}
+		}
+	}
+	if p := g.profile; p != nil {
+		p.Nodes++
+		if e, ok := expr.(*CallExpr); ok {
+			defer p.start("func", callName(e))()
+		}
+	}
+	g.depth++
+	// Deferred, so that the depth is restored even if a native function panics.
+	defer func() { g.depth-- }()
+	return eval(expr, ctx)
+}
+
+func eval(expr Expr, ctx *Ctx) (Val, error) {
 	switch e := expr.(type) {
 	case *IntLiteral:
 		return IntVal(e.Val), nil
@@ -783,7 +1363,7 @@ func Eval(expr Expr, ctx *Ctx) (Val, error) {
 		}
 		r, err := unaryOp(x, e.Op)
 		if err != nil {
-			return nil, &EvalError{pos: e.OpPos, msg: err.Error()}
+			return nil, &EvalError{pos: e.OpPos, end: e.End(), kind: KindTypeError, msg: err.Error()}
 		}
 		return r, nil
 	case *BinaryExpr:
@@ -795,22 +1375,25 @@ func Eval(expr Expr, ctx *Ctx) (Val, error) {
 		if err != nil {
 			return nil, err
 		}
-		r, err := binaryOp(x, y, e.Op)
+		r, err := binaryOp(x, y, e.Op, ctx)
+		if errors.Is(err, errDivisionByZero) {
+			return nil, &EvalError{pos: e.OpPos, end: e.End(), kind: KindDivisionByZero, msg: err.Error(), cause: err}
+		}
 		if err != nil {
-			return nil, &EvalError{pos: e.OpPos, msg: err.Error()}
+			return nil, &EvalError{pos: e.OpPos, end: e.End(), kind: KindTypeError, msg: err.Error()}
 		}
 		return r, nil
 	case *VarExpr:
 		lv, vctx := ctx.Lookup(e.Name)
 		if vctx == nil {
-			return nil, &EvalError{pos: e.Pos(), msg: fmt.Sprintf("unbound variable %s", e.Name)}
+			return nil, &EvalError{pos: e.Pos(), end: e.End(), kind: KindUnboundVariable, msg: fmt.Sprintf("unbound variable %s", e.Name)}
 		}
 		switch {
 		case lv.val != nil:
 			return lv.val, nil
 		case lv.expr != nil:
 			if vctx.isActive(e.Name) {
-				return nil, &EvalError{pos: e.Pos(), msg: "cyclic variable dependencies detected"}
+				return nil, &EvalError{pos: e.Pos(), end: e.End(), kind: KindCyclicDependency, msg: "cyclic variable dependencies detected"}
 			}
 			vctx.setActive(e.Name)
 			v, err := Eval(lv.expr, vctx)
@@ -844,16 +1427,16 @@ func Eval(expr Expr, ctx *Ctx) (Val, error) {
 			if v, ok := r.Fields[e.Name]; ok {
 				return v, nil
 			}
-			return nil, &EvalError{pos: e.DotPos, msg: fmt.Sprintf("record has no field '%s'", e.Name)}
+			return nil, &EvalError{pos: e.DotPos, end: e.End(), kind: KindNoSuchField, msg: fmt.Sprintf("record has no field '%s'", e.Name)}
 		case TypedVal:
 			if rv, ok := r.V.(*RecVal); ok {
 				if v, ok := rv.Fields[e.Name]; ok {
 					return v, nil
 				}
 			}
-			return nil, &EvalError{pos: e.End(), msg: fmt.Sprintf("%s has no field '%s'", r.Typ().Id, e.Name)}
+			return nil, &EvalError{pos: e.End(), kind: KindNoSuchField, msg: fmt.Sprintf("%s has no field '%s'", r.Typ().Id, e.Name)}
 		default:
-			return nil, &EvalError{pos: e.End(), msg: fmt.Sprintf("cannot access .%s on type %s", e.Name, r.Typ().Id)}
+			return nil, &EvalError{pos: e.End(), kind: KindNoSuchField, msg: fmt.Sprintf("cannot access .%s on type %s", e.Name, r.Typ().Id)}
 		}
 	case *CallExpr:
 		fe, err := Eval(e.Func, ctx)
@@ -862,7 +1445,7 @@ func Eval(expr Expr, ctx *Ctx) (Val, error) {
 		}
 		f, ok := fe.(CallableVal)
 		if !ok {
-			return nil, &EvalError{pos: e.Func.Pos(), msg: fmt.Sprintf("type %T is not callable", fe)}
+			return nil, &EvalError{pos: e.Func.Pos(), end: e.Func.End(), kind: KindNotCallable, msg: fmt.Sprintf("type %T is not callable", fe)}
 		}
 		args := make([]Val, len(e.Args))
 		for i, arg := range e.Args {
@@ -874,11 +1457,35 @@ func Eval(expr Expr, ctx *Ctx) (Val, error) {
 		}
 		res, err := f.Call(args, ctx)
 		if err != nil {
-			return nil, &EvalError{pos: e.Func.Pos(), msg: "call failed", cause: err}
+			return nil, &EvalError{pos: e.Func.Pos(), end: e.End(), kind: KindCallFailed, msg: "call failed", cause: err}
 		}
 		return res, nil
 	case *FuncExpr:
 		return &FuncExprVal{F: e, ctx: ctx}, nil
+	case *LetExpr:
+		// Store the binding lazily, so that let functions can be recursive.
+		lctx := ChildCtx(ctx)
+		lctx.storeExpr(e.Var.Name, e.Var.X)
+		return Eval(e.X, lctx)
+	case *MatchExpr:
+		x, err := Eval(e.X, ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Arms are evaluated in order, the first matching one wins.
+		for _, arm := range e.Arms {
+			if arm.Pattern == nil {
+				return Eval(arm.X, ctx)
+			}
+			pat, err := Eval(arm.Pattern, ctx)
+			if err != nil {
+				return nil, err
+			}
+			if x.Equal(pat) {
+				return Eval(arm.X, ctx)
+			}
+		}
+		return nil, &EvalError{pos: e.Pos(), end: e.End(), kind: KindNoMatch, msg: fmt.Sprintf("no match for value %s", x)}
 	case *ConditionalExpr:
 		cond, err := Eval(e.Cond, ctx)
 		if err != nil {
@@ -894,12 +1501,27 @@ func Eval(expr Expr, ctx *Ctx) (Val, error) {
 		if err != nil {
 			return nil, err
 		}
-		return convertType(val, e.T.TypeId(), ctx, e.Pos())
+		if lt, ok := e.T.(*ListType); ok {
+			return convertListType(val, lt, ctx, e.Pos())
+		}
+		return convertAnnotatedType(val, e.T, ctx, e.Pos())
 	}
-	return nil, &EvalError{pos: expr.Pos(), msg: fmt.Sprintf("Eval: not implemented: %T", expr)}
+	return nil, &EvalError{pos: expr.Pos(), end: expr.End(), kind: KindInternal, msg: fmt.Sprintf("Eval: not implemented: %T", expr)}
 }
 
 func evalRec(e *RecExpr, ctx *Ctx) (Val, error) {
+	if ctx.global.strict {
+		var exprs []Expr
+		for _, lv := range e.LetVars {
+			exprs = append(exprs, lv.X)
+		}
+		for _, f := range e.Fields {
+			exprs = append(exprs, f.X)
+		}
+		if err := checkUnusedLetVars(e.LetVars, exprs); err != nil {
+			return nil, err
+		}
+	}
 	rctx := ChildCtx(ctx)
 	// Prepare context by storing lazy expressions of all fields.
 	for _, lv := range e.LetVars {
@@ -908,8 +1530,9 @@ func evalRec(e *RecExpr, ctx *Ctx) (Val, error) {
 	for _, f := range e.Fields {
 		rctx.storeExpr(f.Name, f.X)
 	}
-	// Evaluate all let vars and fields.
-	for _, lv := range e.LetVars {
+	// Evaluate all let vars and fields in declaration order,
+	// so that errors such as cyclic dependencies are reported consistently.
+	for _, lv := range letVarsInOrder(e.LetVars) {
 		if _, found := rctx.fullyEvaluated(lv.Name); found {
 			continue
 		}
@@ -921,19 +1544,23 @@ func evalRec(e *RecExpr, ctx *Ctx) (Val, error) {
 		rctx.store(lv.Name, v)
 	}
 	rec := NewRec()
-	for _, f := range e.Fields {
+	for _, name := range e.fieldNames() {
+		f := e.Fields[name]
 		var t *Typ
 		m := 0.
-		if f.T != nil {
-			t = rctx.LookupType(f.T.TypeId())
-			if t == nil {
-				return nil, &EvalError{pos: f.T.Pos(), msg: fmt.Sprintf("unknown type %s for field %s", f.T.TypeId(), f.Name)}
+		lt, isList := f.T.(*ListType)
+		if isList {
+			if et := elemType(lt); rctx.lookupAnnotatedType(et) == nil {
+				return nil, &EvalError{pos: et.Pos(), end: et.End(), kind: KindUnknownType, msg: fmt.Sprintf("unknown type %s for field %s", et.TypeId(), f.Name)}
 			}
-			if t.IsUnit() {
-				// f.T may be the unit type itself (allowing any multiplier),
-				// so UnitMults may return 0 here.
-				m = t.UnitMults[f.T.TypeId()]
+		} else if f.T != nil {
+			t = rctx.lookupAnnotatedType(f.T)
+			if t == nil {
+				return nil, &EvalError{pos: f.T.Pos(), end: f.T.End(), kind: KindUnknownType, msg: fmt.Sprintf("unknown type %s for field %s", f.T.TypeId(), f.Name)}
 			}
+			// f.T may be the unit type itself (allowing any multiplier),
+			// so m may be 0 here.
+			m = unitMultiple(t, f.T)
 		}
 		var v Val
 		cv, found := rctx.fullyEvaluated(f.Name)
@@ -943,33 +1570,215 @@ func evalRec(e *RecExpr, ctx *Ctx) (Val, error) {
 		} else {
 			var err error
 			rctx.setActive(f.Name)
+			stop := rctx.global.profile.start("field", f.Name)
 			v, err = Eval(f.X, rctx)
+			stop()
 			if err != nil {
 				return nil, err
 			}
 			rctx.store(f.Name, v)
 		}
-		if t != nil {
+		// Untyped fields only get an annotation if they have a comment.
+		var anno *FieldAnnotation
+		if f.Doc != "" {
+			anno = &FieldAnnotation{Comment: f.Doc}
+		}
+		if isList {
+			// List-typed fields are checked element-wise. They don't have a *Typ,
+			// so the field is stored without a type annotation.
+			if err := typeCheckList(v, lt, rctx); err != nil {
+				return nil, &EvalError{pos: f.T.Pos(), end: f.T.End(), kind: KindTypeError, msg: fmt.Sprintf("type error for field %s: %s", f.Name, err)}
+			}
+			rec.setField(f.Name, v, anno)
+		} else if t != nil {
 			// Typed field
-			if err := typeCheck(v, t); err != nil {
-				return nil, &EvalError{pos: f.T.Pos(), msg: fmt.Sprintf("type error for field %s: %s", f.Name, err)}
+			if err := typeCheck(v, t, rctx); err != nil {
+				return nil, &EvalError{pos: f.T.Pos(), end: f.T.End(), kind: KindTypeError, msg: fmt.Sprintf("type error for field %s: %s", f.Name, err)}
 			}
 			if u, ok := v.(UnitVal); ok && m > 0. {
 				v = u.WithF(m)
 			}
-			rec.setField(f.Name, v, &FieldAnnotation{T: t, M: m})
+			rec.setField(f.Name, v, &FieldAnnotation{T: t, M: m, Comment: f.Doc})
 		} else {
 			// t == nil => Untyped field
-			rec.setField(f.Name, v, nil)
+			rec.setField(f.Name, v, anno)
 		}
 	}
 	return rec, nil
 }
 
+// checkUnusedLetVars returns an error for the first (by position) of the let bindings
+// that is not referenced by any of the expressions exprs.
+// Shadowing is ignored, so any variable of the same name counts as a reference.
+func checkUnusedLetVars(letVars map[string]LetVar, exprs []Expr) error {
+	if len(letVars) == 0 {
+		return nil
+	}
+	refs := make(map[string]bool)
+	for _, x := range exprs {
+		varRefs(x, refs)
+	}
+	var unused *LetVar
+	for _, lv := range letVars {
+		if !refs[lv.Name] && (unused == nil || lv.NamePos < unused.NamePos) {
+			lv := lv
+			unused = &lv
+		}
+	}
+	if unused != nil {
+		return &EvalError{pos: unused.NamePos, end: unused.NamePos + token.Pos(len(unused.Name)), kind: KindUnusedVariable, msg: fmt.Sprintf("unused let binding %s", unused.Name)}
+	}
+	return nil
+}
+
+// varRefs adds the names of all variables referenced in e to refs.
+func varRefs(e Expr, refs map[string]bool) {
+	switch x := e.(type) {
+	case *VarExpr:
+		refs[x.Name] = true
+	case *BinaryExpr:
+		varRefs(x.X, refs)
+		varRefs(x.Y, refs)
+	case *UnaryExpr:
+		varRefs(x.X, refs)
+	case *FieldAcc:
+		varRefs(x.X, refs)
+	case *TypedExpr:
+		varRefs(x.X, refs)
+	case *ConditionalExpr:
+		varRefs(x.Cond, refs)
+		varRefs(x.X, refs)
+		varRefs(x.Y, refs)
+	case *LetExpr:
+		varRefs(x.Var.X, refs)
+		varRefs(x.X, refs)
+	case *MatchExpr:
+		varRefs(x.X, refs)
+		for _, arm := range x.Arms {
+			if arm.Pattern != nil {
+				varRefs(arm.Pattern, refs)
+			}
+			varRefs(arm.X, refs)
+		}
+	case *CallExpr:
+		varRefs(x.Func, refs)
+		for _, arg := range x.Args {
+			varRefs(arg, refs)
+		}
+	case *FuncExpr:
+		for _, p := range x.Params {
+			if p.Default != nil {
+				varRefs(p.Default, refs)
+			}
+		}
+		varRefs(x.Body, refs)
+	case *ListExpr:
+		for _, el := range x.Elements {
+			varRefs(el, refs)
+		}
+	case *RecExpr:
+		for _, lv := range x.LetVars {
+			varRefs(lv.X, refs)
+		}
+		for _, f := range x.Fields {
+			varRefs(f.X, refs)
+		}
+	}
+}
+
+// typeCheckList checks that v is a list whose elements all have the element type of lt.
+// All named types in lt must be known to ctx.
+func typeCheckList(v Val, lt *ListType, ctx *Ctx) error {
+	xs, ok := v.(ListVal)
+	if !ok {
+		return fmt.Errorf("incompatible types: %s <> %s", v.Typ().Id, lt.TypeId())
+	}
+	for i, x := range xs.Elements {
+		var err error
+		if et, ok := lt.Elem.(*ListType); ok {
+			err = typeCheckList(x, et, ctx)
+		} else {
+			err = typeCheck(x, ctx.lookupAnnotatedType(lt.Elem), ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("element %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// convertAnnotatedType converts val to the type of the non-list type annotation ta.
+// Values are not converted to union types, only checked against them.
+func convertAnnotatedType(val Val, ta TypeAnnotation, ctx *Ctx, pos token.Pos) (Val, error) {
+	switch t := ta.(type) {
+	case *OptionalType:
+		if _, isNil := val.(NilVal); isNil {
+			return val, nil
+		}
+		return convertAnnotatedType(val, t.Elem, ctx, pos)
+	case *UnionType:
+		typ := ctx.lookupAnnotatedType(t)
+		if typ == nil {
+			return nil, &EvalError{pos: pos, kind: KindUnknownType, msg: fmt.Sprintf("unknown type: %s", t.TypeId())}
+		}
+		if err := typeCheck(val, typ, ctx); err != nil {
+			return nil, &EvalError{pos: pos, kind: KindTypeError, msg: fmt.Sprintf("cannot convert value of type %s to %s", val.Typ().Id, typ.Id)}
+		}
+		return val, nil
+	}
+	return convertType(val, ta.TypeId(), ctx, pos)
+}
+
+// convertListType converts each element of the list val to the element type of lt.
+func convertListType(val Val, lt *ListType, ctx *Ctx, pos token.Pos) (Val, error) {
+	xs, ok := val.(ListVal)
+	if !ok {
+		return nil, &EvalError{pos: pos, kind: KindTypeError, msg: fmt.Sprintf("cannot convert value of type %s to %s", val.Typ().Id, lt.TypeId())}
+	}
+	ys := make([]Val, len(xs.Elements))
+	for i, x := range xs.Elements {
+		var err error
+		if et, ok := lt.Elem.(*ListType); ok {
+			ys[i], err = convertListType(x, et, ctx, pos)
+		} else {
+			ys[i], err = convertAnnotatedType(x, lt.Elem, ctx, pos)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ListVal{Elements: ys}, nil
+}
+
 // Evaluates the given module m.
 // If the module has type or unit declarations, those will be added to ctx.
 func EvalModule(m *Module, ctx *Ctx) (*loadedModule, error) {
+	if ctx.global.strict {
+		var exprs []Expr
+		for _, d := range m.LetVars {
+			exprs = append(exprs, d.X)
+		}
+		for _, d := range m.PubDecls {
+			exprs = append(exprs, d.X)
+		}
+		for _, d := range m.UnitDecls {
+			exprs = append(exprs, d.Multiples)
+		}
+		for _, d := range m.TypeDecls {
+			if d.Where != nil {
+				exprs = append(exprs, d.Where)
+			}
+		}
+		if m.Body != nil {
+			exprs = append(exprs, m.Body)
+		}
+		if err := checkUnusedLetVars(m.LetVars, exprs); err != nil {
+			return nil, err
+		}
+	}
 	mctx := ChildCtx(ctx)
+	// Store all declarations lazily before evaluating any of them,
+	// so that they can refer to each other independent of their order.
 	for _, d := range m.LetVars {
 		mctx.storeExpr(d.Name, d.X)
 	}
@@ -1000,14 +1809,38 @@ func EvalModule(m *Module, ctx *Ctx) (*loadedModule, error) {
 			case DoubleVal:
 				unitMults[f] = float64(u)
 			default:
-				return nil, &EvalError{pos: d.Multiples.Fields[f].X.Pos(), msg: fmt.Sprintf("Invalid type for multiplier %s: %s", f, v.Typ().Id)}
+				return nil, &EvalError{pos: d.Multiples.Fields[f].X.Pos(), end: d.Multiples.Fields[f].X.End(), kind: KindTypeError, msg: fmt.Sprintf("Invalid type for multiplier %s: %s", f, v.Typ().Id)}
 			}
 		}
 		t := NewUnitType(d.Name, unitMults)
 		ctx.defineType(t)
 	}
+	// Record types may refer to each other, so define all of them before
+	// resolving the types of their fields.
+	for _, d := range m.TypeDecls {
+		if d.Base == nil {
+			ctx.defineType(NewRecordType(d.Name, nil))
+		}
+	}
+	if err := defineAliasTypes(m, ctx, mctx); err != nil {
+		return nil, err
+	}
+	for _, d := range m.TypeDecls {
+		if d.Base != nil {
+			continue
+		}
+		t := ctx.LookupType(d.Name)
+		for f, rf := range d.Fields.Fields {
+			v := rf.X.(*VarExpr)
+			ft := ctx.LookupType(v.Name)
+			if ft == nil {
+				return nil, &EvalError{pos: v.Pos(), end: v.End(), kind: KindUnknownType, msg: fmt.Sprintf("unknown type %s for field %s of type %s", v.Name, f, d.Name)}
+			}
+			t.RecFields[f] = ft
+		}
+	}
 	// Evaluate module-level declarations. This is mostly analogous to how records are evaluated.
-	for _, d := range m.LetVars {
+	for _, d := range letVarsInOrder(m.LetVars) {
 		if _, found := mctx.fullyEvaluated(d.Name); found {
 			continue
 		}
@@ -1019,7 +1852,7 @@ func EvalModule(m *Module, ctx *Ctx) (*loadedModule, error) {
 		mctx.store(d.Name, v)
 	}
 	pubVars := make(map[string]Val)
-	for _, d := range m.PubDecls {
+	for _, d := range pubDeclsInOrder(m.PubDecls) {
 		if v, found := mctx.fullyEvaluated(d.Name); found {
 			pubVars[d.Name] = v
 			continue
@@ -1041,26 +1874,161 @@ func EvalModule(m *Module, ctx *Ctx) (*loadedModule, error) {
 		}
 		body = v
 	}
-	return &loadedModule{name: m.Name, pubVars: pubVars, body: body}, nil
+	var types []*Typ
+	for _, name := range sortedKeys(m.UnitDecls) {
+		types = append(types, ctx.LookupType(name))
+	}
+	for _, name := range sortedKeys(m.TypeDecls) {
+		types = append(types, ctx.LookupType(name))
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Id < types[j].Id })
+	return &loadedModule{name: m.Name, pubVars: pubVars, body: body, types: types, ctx: mctx}, nil
+}
+
+// defineAliasTypes defines all alias types declared in m in ctx. Alias types can
+// have other alias types of the same module as their base type, so these are
+// defined in dependency order. Where predicates are evaluated in mctx.
+func defineAliasTypes(m *Module, ctx *Ctx, mctx *Ctx) error {
+	const (
+		active = 1
+		done   = 2
+	)
+	state := make(map[string]int)
+	var define func(d TypeDecl) error
+	define = func(d TypeDecl) error {
+		switch state[d.Name] {
+		case done:
+			return nil
+		case active:
+			return &EvalError{pos: d.Base.Pos(), end: d.Base.End(), kind: KindCyclicDependency, msg: fmt.Sprintf("cyclic alias type declaration %s", d.Name)}
+		}
+		state[d.Name] = active
+		if bd, ok := m.TypeDecls[d.Base.Name]; ok && bd.Base != nil {
+			if err := define(bd); err != nil {
+				return err
+			}
+		}
+		base := ctx.LookupType(d.Base.Name)
+		if base == nil {
+			return &EvalError{pos: d.Base.Pos(), end: d.Base.End(), kind: KindUnknownType, msg: fmt.Sprintf("unknown base type %s of type %s", d.Base.Name, d.Name)}
+		}
+		var where CallableVal
+		if d.Where != nil {
+			v, err := Eval(d.Where, mctx)
+			if err != nil {
+				return err
+			}
+			f, ok := v.(CallableVal)
+			if !ok {
+				return &EvalError{pos: d.Where.Pos(), end: d.Where.End(), kind: KindTypeError, msg: fmt.Sprintf("where clause of type %s must be a function, got %s", d.Name, v.Typ().Id)}
+			}
+			where = f
+		}
+		ctx.defineType(NewAliasType(d.Name, base, where))
+		state[d.Name] = done
+		return nil
+	}
+	for _, name := range sortedKeys(m.TypeDecls) {
+		if d := m.TypeDecls[name]; d.Base != nil {
+			if err := define(d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MergeValues merges the records x and y, like the @ operator does:
+// fields of y override those of x. It returns an error if x or y is not a record.
+// Typed results are validated in ctx.
+func MergeValues(x, y Val, ctx *Ctx) (Val, error) {
+	return mergeValues(x, y, ctx)
+}
+
+// mergeOptions control how records are merged.
+type mergeOptions struct {
+	// If true, lists in common fields are concatenated instead of
+	// the list of the rhs replacing the one of the lhs.
+	concatLists bool
+}
+
+func mergeValues(x, y Val, ctx *Ctx) (Val, error) {
+	return mergeValuesWith(x, y, mergeOptions{}, ctx)
 }
 
-func mergeValues(x, y Val) (Val, error) {
-	u, ok := x.(*RecVal)
+func mergeValuesWith(x, y Val, opts mergeOptions, ctx *Ctx) (Val, error) {
+	u, tu, ok := asRec(x)
 	if !ok {
 		return nil, fmt.Errorf("cannot merge lhs of type %T", x)
 	}
-	v, ok := y.(*RecVal)
+	v, tv, ok := asRec(y)
 	if !ok {
 		return nil, fmt.Errorf("cannot merge rhs of type %T", y)
 	}
 	r := NewRec()
-	if err := mergeRecVal(u, v, r); err != nil {
+	if err := mergeRecVal(u, v, r, "", opts, ctx); err != nil {
 		return nil, err
 	}
-	return r, nil
+	return wrapMergedRec(r, tu, tv, ctx)
+}
+
+// asRec returns the record of v if v is a record or a typed record.
+// The returned type is nil for untyped records.
+func asRec(v Val) (*RecVal, *Typ, bool) {
+	switch x := v.(type) {
+	case *RecVal:
+		return x, nil, true
+	case TypedVal:
+		if r, ok := x.V.(*RecVal); ok {
+			return r, x.T, true
+		}
+	}
+	return nil, nil, false
 }
 
-func mergeRecVal(x, y, r *RecVal) error {
+// mergeAnnotations returns the annotation of a field that the merged records x and y
+// have in common, given their annotations ax and ay. The type annotation of y
+// overrides that of x. Comments of y take precedence over those of x.
+func mergeAnnotations(ax, ay *FieldAnnotation) *FieldAnnotation {
+	if ax == nil {
+		return ay
+	}
+	if ay == nil {
+		return ax
+	}
+	a := *ay
+	if a.T == nil {
+		a.T, a.M = ax.T, ax.M
+	}
+	if a.Comment == "" {
+		a.Comment = ax.Comment
+	}
+	return &a
+}
+
+// wrapMergedRec returns the merged record r as a typed record if either of the types
+// tx and ty of the merged records is not nil. It returns an error if both are
+// non-nil and differ, or if r is not a valid value of the resulting type in ctx.
+func wrapMergedRec(r *RecVal, tx, ty *Typ, ctx *Ctx) (Val, error) {
+	t := tx
+	if t == nil {
+		t = ty
+	} else if ty != nil && ty != tx {
+		return nil, fmt.Errorf("cannot merge records of types %s and %s", tx.Id, ty.Id)
+	}
+	if t == nil {
+		return r, nil
+	}
+	v := TypedVal{V: r, T: t}
+	if err := validate(v, t, ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// mergeRecVal merges the records x and y into r. The dotted path of x and y
+// relative to the top-level merged records (e.g. "db.pool") is used in error messages.
+func mergeRecVal(x, y, r *RecVal, path string, opts mergeOptions, ctx *Ctx) error {
 	// Copy fields only in x.
 	for f, vx := range x.Fields {
 		if _, ok := y.Fields[f]; !ok {
@@ -1074,13 +2042,22 @@ func mergeRecVal(x, y, r *RecVal) error {
 			r.setField(f, vy, y.FieldAnnotations[f])
 		} else {
 			// Common field.
+			fieldPath := f
+			if path != "" {
+				fieldPath = path + "." + f
+			}
 			// If only x has a type annotation, only allow merging if y's value has the same type
 			// OR y has an explicit type annotation (i.e. interpret y's annotation as an explicit override).
-			ax, xHasType := x.FieldAnnotations[f]
-			ay, yHasType := y.FieldAnnotations[f]
-			if xHasType && !yHasType {
-				if err := typeCheck(vy, ax.T); err != nil {
-					return fmt.Errorf("type error merging record field '%s': %w", f, err)
+			ax := x.FieldAnnotations[f]
+			ay := y.FieldAnnotations[f]
+			xHasType := ax != nil && ax.T != nil
+			yHasType := ay != nil && ay.T != nil
+			_, yIsRec := vy.(*RecVal)
+			if xHasType && !yHasType && !(ax.T.IsRecord() && yIsRec) {
+				// Untyped records can be merged into fields of record types.
+				// The merged record gets validated below.
+				if err := typeCheck(vy, ax.T, ctx); err != nil {
+					return fmt.Errorf("type error merging record field '%s': %w", fieldPath, err)
 				}
 				if ax.T.IsUnit() {
 					if uy, ok := vy.(UnitVal); ok {
@@ -1092,27 +2069,32 @@ func mergeRecVal(x, y, r *RecVal) error {
 						// it must be a UnitVal.
 						log.Fatalf("%v passes type check for type %s but is not a unit", vy, ax.T.Id)
 					}
+				} else if uy, ok := vy.(UnitVal); ok && ax.M > 0 {
+					// Optional unit types.
+					vy = uy.WithF(ax.M)
 				}
 			}
-			targetType := ax
-			if yHasType {
-				targetType = ay
-			}
-			// TODO: TypedVal is not properly supported here: we wouldn't recurse into a typed rec.
-			if _, ok := vx.(TypedVal); ok {
-				return fmt.Errorf("merging TypedVal is not implemented")
-			}
-			if _, ok := vy.(TypedVal); ok {
-				return fmt.Errorf("merging TypedVal is not implemented")
-			}
-			if ry, ok := vy.(*RecVal); ok {
-				if rx, ok := vx.(*RecVal); ok {
-					// x and y are records: recurse
+			targetType := mergeAnnotations(ax, ay)
+			if ry, ty, ok := asRec(vy); ok {
+				if rx, tx, ok := asRec(vx); ok {
+					// x and y are (possibly typed) records: recurse
 					cr := NewRec()
-					r.setField(f, cr, targetType)
-					if err := mergeRecVal(rx, ry, cr); err != nil {
+					if err := mergeRecVal(rx, ry, cr, fieldPath, opts, ctx); err != nil {
 						return err
 					}
+					v, err := wrapMergedRec(cr, tx, ty, ctx)
+					if err != nil {
+						return fmt.Errorf("cannot merge record field '%s': %w", fieldPath, err)
+					}
+					r.setField(f, v, targetType)
+					continue
+				}
+			}
+			if ly, ok := vy.(ListVal); ok && opts.concatLists {
+				if lx, ok := vx.(ListVal); ok {
+					elems := make([]Val, 0, len(lx.Elements)+len(ly.Elements))
+					elems = append(append(elems, lx.Elements...), ly.Elements...)
+					r.setField(f, ListVal{Elements: elems}, targetType)
 					continue
 				}
 			}
@@ -1120,5 +2102,14 @@ func mergeRecVal(x, y, r *RecVal) error {
 			r.setField(f, vy, targetType)
 		}
 	}
+	// Fields of x keep their position, new fields of y are appended.
+	order := make([]string, 0, len(r.Fields))
+	order = append(order, x.FieldNames()...)
+	for _, f := range y.FieldNames() {
+		if _, ok := x.Fields[f]; !ok {
+			order = append(order, f)
+		}
+	}
+	r.order = order
 	return nil
 }
@@ -1,9 +1,12 @@
 package gokonfi
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/google/go-cmp/cmp"
@@ -56,6 +59,11 @@ func TestEvalFormatString(t *testing.T) {
 		{input: `"${'a' + 'b'}"`, want: "ab"},
 		{input: `"$foo ${'bar'}"`, want: "$foo bar"},
 		{input: `"${ {a: {b: 3} }.a.b }"`, want: "3"},
+		{input: `"${1.0/3.0:%.3f}"`, want: "0.333"},
+		{input: `"[${42:%5d}]"`, want: "[   42]"},
+		{input: `"${'a':%q} ${1:%03d}"`, want: `"a" 001`},
+		{input: `"${2::minutes:%v}"`, want: "2"},
+		{input: `"${ {a: 1}.a :%x}"`, want: "1"},
 	}
 	for i, test := range tests {
 		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
@@ -108,6 +116,177 @@ func TestEvalComparisonExpr(t *testing.T) {
 	}
 }
 
+func TestValEqual(t *testing.T) {
+	tests := []struct {
+		x    string
+		y    string
+		want bool
+	}{
+		{x: "1", y: "1", want: true},
+		{x: "1", y: "2", want: false},
+		{x: "1", y: "1.0", want: false},
+		{x: "1.5", y: "1.5", want: true},
+		{x: "'a'", y: "'a'", want: true},
+		{x: "'a'", y: "'b'", want: false},
+		{x: "'1'", y: "1", want: false},
+		{x: "true", y: "true", want: true},
+		{x: "true", y: "1", want: false},
+		{x: "nil", y: "nil", want: true},
+		{x: "nil", y: "false", want: false},
+		{x: "[]", y: "[]", want: true},
+		{x: "[1, 'a']", y: "[1, 'a']", want: true},
+		{x: "[1, 2]", y: "[2, 1]", want: false},
+		{x: "[1, 2]", y: "[1, 2, 3]", want: false},
+		{x: "[[1], [2]]", y: "[[1], [2]]", want: true},
+		{x: "{}", y: "{}", want: true},
+		{x: "{a: 1 b: 2}", y: "{b: 2 a: 1}", want: true},
+		{x: "{a: 1}", y: "{a: 2}", want: false},
+		{x: "{a: 1}", y: "{b: 1}", want: false},
+		{x: "{a: 1}", y: "{a: 1 b: 2}", want: false},
+		{x: "{a: {b: [1, {c: 'd'}]}}", y: "{a: {b: [1, {c: 'd'}]}}", want: true},
+		{x: "{a: {b: [1, {c: 'd'}]}}", y: "{a: {b: [1, {c: 'e'}]}}", want: false},
+		{x: "{a::int: 1}", y: "{a: 1}", want: true},
+		{x: "{}", y: "[]", want: false},
+		{x: "7::minutes", y: "7::minutes", want: true},
+		{x: "7::minutes", y: "7::hours", want: false},
+		{x: "1::days", y: "24::hours", want: false},
+		{x: "7::minutes", y: "7", want: false},
+		{x: "'2023-01-02T03:04:05Z'::time", y: "'2023-01-02T03:04:05Z'::time", want: true},
+		{x: "'2023-01-02T03:04:05Z'::time", y: "'2023-01-02T03:04:06Z'::time", want: false},
+		{x: "len", y: "len", want: true},
+		{x: "len", y: "str", want: false},
+		{x: "func(x) {x}", y: "func(x) {x}", want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.x+"=="+test.y, func(t *testing.T) {
+			ctx := GlobalCtx()
+			var vals []Val
+			for _, input := range []string{test.x, test.y} {
+				e, err := parse(input)
+				if err != nil {
+					t.Fatalf("Cannot parse expression: %s", err)
+				}
+				v, err := Eval(e, ctx)
+				if err != nil {
+					t.Fatalf("Failed to evaluate: %s", err)
+				}
+				vals = append(vals, v)
+			}
+			x, y := vals[0], vals[1]
+			if got := x.Equal(y); got != test.want {
+				t.Errorf("%s.Equal(%s): got %t, want %t", test.x, test.y, got, test.want)
+			}
+			if got := y.Equal(x); got != test.want {
+				t.Errorf("%s.Equal(%s): got %t, want %t", test.y, test.x, got, test.want)
+			}
+			if !x.Equal(x) {
+				t.Errorf("%s is not equal to itself", test.x)
+			}
+		})
+	}
+}
+
+func TestValClone(t *testing.T) {
+	tests := []string{
+		"1",
+		"'a'",
+		"nil",
+		"7::minutes",
+		"'2023-01-02T03:04:05Z'::time",
+		"len",
+		"[1, [2, 3], {a: 4}]",
+		"{a: 1 b: {c: [1, 2]} d::minutes: 3::minutes}",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if c := v.Clone(); !c.Equal(v) {
+				t.Errorf("Clone %v is not equal to original %v", c, v)
+			}
+		})
+	}
+}
+
+func TestValCloneIndependent(t *testing.T) {
+	e, err := parse("{a: 1 b: {c: [1, {d: 2}]} e::minutes: 3::minutes}")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	v, err := Eval(e, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	orig := v.(*RecVal)
+	clone := orig.Clone().(*RecVal)
+	origM := orig.FieldAnnotations["e"].M
+	// Modify the clone at all levels.
+	clone.Fields["a"] = IntVal(100)
+	b := clone.Fields["b"].(*RecVal)
+	b.Fields["x"] = StringVal("new")
+	c := b.Fields["c"].(ListVal)
+	c.Elements[0] = IntVal(100)
+	c.Elements[1].(*RecVal).Fields["d"] = IntVal(100)
+	clone.FieldAnnotations["e"].M = 1
+	delete(clone.FieldAnnotations, "e")
+
+	if got := orig.Fields["a"]; got != IntVal(1) {
+		t.Errorf("Original field a changed: %v", got)
+	}
+	origB := orig.Fields["b"].(*RecVal)
+	if _, ok := origB.Fields["x"]; ok {
+		t.Errorf("Original nested record got new field x")
+	}
+	origC := origB.Fields["c"].(ListVal)
+	if got := origC.Elements[0]; got != IntVal(1) {
+		t.Errorf("Original list element changed: %v", got)
+	}
+	if got := origC.Elements[1].(*RecVal).Fields["d"]; got != IntVal(2) {
+		t.Errorf("Original record in list changed: %v", got)
+	}
+	anno, ok := orig.FieldAnnotations["e"]
+	if !ok {
+		t.Fatalf("Original field annotation was deleted")
+	}
+	if anno.M != origM {
+		t.Errorf("Original field annotation changed: %v", anno.M)
+	}
+}
+
+func TestEvalEqualityExpr(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "[1, [2, 3]] == [1, [2, 3]]", want: BoolVal(true)},
+		{input: "{a: 1 b: [2]} == {b: [2] a: 1}", want: BoolVal(true)},
+		{input: "{a: 1} != {a: 1}", want: BoolVal(false)},
+		{input: "{a: 1} != {a: '1'}", want: BoolVal(true)},
+		{input: "{let f: len g: f} == {g: len}", want: BoolVal(true)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
 func TestEvalLogicalExpr(t *testing.T) {
 	tests := []struct {
 		input string
@@ -376,6 +555,58 @@ func TestEvalBuiltins(t *testing.T) {
 
 // Almost an integration test (or a functional programming competition?):
 // Tests higher-order functions using list builtins (flatmap, fold).
+
+func TestValString(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "{}", want: "{}"},
+		{input: "[]", want: "[]"},
+		{input: "{a: 1 b: [2, 3]}", want: "{a: 1, b: [2, 3]}"},
+		// Fields are sorted by name.
+		{input: "{b: 1 a: 2}", want: "{a: 2, b: 1}"},
+		{input: "{z: {y: nil x: true} a: [{c: 1.5}, []]}", want: "{a: [{c: 1.5}, []], z: {x: true, y: nil}}"},
+		// Nested strings are quoted, field names only if necessary.
+		{input: `{s: 'a"b'}`, want: `{s: "a\"b"}`},
+		{input: `map_keys(func (k) { if k == 'x' then 'x y' else 'if' }, {x: 1 y: 2})`, want: `{"if": 2, "x y": 1}`},
+		{input: "['a', 1]", want: `["a", 1]`},
+		{input: "[2::minutes]", want: "[2::minutes]"},
+		// Functions are not traversed.
+		{input: "{f: len}", want: "{f: <builtin len>}"},
+		{input: "str({a: [1, 'x']})", want: `{a: [1, "x"]}`},
+		{input: `"r=${{a: 1}}"`, want: "r={a: 1}"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if got := v.String(); got != test.want {
+				t.Errorf("Got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValStringFunc(t *testing.T) {
+	e, err := parse("{f: func (x) { x }}")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	v, err := Eval(e, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	if got := v.String(); !strings.HasPrefix(got, "{f: <func") {
+		t.Errorf("Got %s, want function to be rendered as <func ...>", got)
+	}
+}
 func TestEvalFunctional(t *testing.T) {
 	const input = `{
 		let map(f, xs): flatmap(func (x) { [f(x)] }, xs)
@@ -485,76 +716,70 @@ func TestEvalFunc(t *testing.T) {
 	}
 }
 
-func TestEvalErrors(t *testing.T) {
+func TestEvalFuncDefaultParams(t *testing.T) {
 	tests := []struct {
 		input string
-		want  string
+		want  Val
 	}{
-		{input: "len(1)", want: "invalid type"},
-		{input: "len('a', 'b')", want: "wrong number of arguments"},
-		{input: "{x: 1}.y", want: "no field"},
-		{input: "'a'.y", want: "cannot access"},
-		{input: "{let f: 'a' y: f(0) }", want: "not callable"},
-		{input: "{x: y y: x}", want: "cyclic"},
-		{input: "{x: { a: b b: y.c } y: { c: x.a } }", want: "cyclic"},
-		{input: "'a' + 3", want: "incompatible types"},
-		{input: "1 + 1.0", want: "incompatible types"},
-		{input: "(func (x) {x}) + 3", want: "incompatible types"},
-		{input: "-'a'", want: "incompatible type"},
-		// Using the error function also yields an error
-		{input: "{x: error('foobar')}", want: "foobar"},
+		{input: "func (x, y: 10) { x + y }(1)", want: IntVal(11)},
+		{input: "func (x, y: 10) { x + y }(1, 2)", want: IntVal(3)},
+		{input: "func (x: 'a', y: 'b') { x + y }()", want: StringVal("ab")},
+		{input: "func (x: 'a', y: 'b') { x + y }('c')", want: StringVal("cb")},
+		{input: `{
+			let f(x, y: 10): x * y
+			a: f(2)
+			b: f(2, 3)
+			}`, want: &RecVal{Fields: map[string]Val{"a": IntVal(20), "b": IntVal(6)}}},
+		// Defaults are evaluated in the closure context, not in the caller's context.
+		{input: `{
+			let n: 1
+			let f(x: n): x
+			y: { let n: 2 a: f() }
+			}.y.a`, want: IntVal(1)},
+		// Defaults are only evaluated if needed.
+		{input: "func (x: error('boom')) { x }(1)", want: IntVal(1)},
+		{input: `{
+			let template t(x, y: 'b') { a: x b: y }
+			r: t('a')
+			}.r`, want: &RecVal{Fields: map[string]Val{"a": StringVal("a"), "b": StringVal("b")}}},
 	}
-	for i, test := range tests {
-		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
 			e, err := parse(test.input)
 			if err != nil {
 				t.Fatalf("Cannot parse expression: %s", err)
 			}
 			got, err := Eval(e, GlobalCtx())
-			if err == nil {
-				t.Errorf("Want error, got: %s", got)
-			} else if evalErr, ok := err.(*EvalError); !ok {
-				t.Errorf("Want EvalError, got %T", err)
-			} else if !strings.Contains(evalErr.Error(), test.want) {
-				t.Errorf("Got '%s', wanted it to contain '%v'", err, test.want)
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
-func TestSizeofVal(t *testing.T) {
-	// Some tests showing that RecVal, UnitVal, ListVal are small enough
-	// to be passed by value.
-	if unsafe.Sizeof((*int)(nil)) != 8 {
-		t.Skip("Skipping Sizeof tests on non-64bit architecture")
-	}
-	if got := unsafe.Sizeof(ListVal{}); got != 24 {
-		t.Errorf("Unexpected size for ListVal, got %d", got)
-	}
-	if got := unsafe.Sizeof(RecVal{}); got != 16 {
-		t.Errorf("Unexpected size for RecVal: %d", got)
-	}
-	if got := unsafe.Sizeof(UnitVal{}); got != 24 {
-		t.Errorf("Unexpected size for UnitVal, got %d", got)
-	}
-}
-
-func TestEvalTypedExpr(t *testing.T) {
+func TestEvalFuncVariadic(t *testing.T) {
 	tests := []struct {
-		name  string
 		input string
 		want  Val
 	}{
-		{name: "int", input: "1::int", want: IntVal(1)},
-		{name: "intfield", input: "{x::int: 1}.x", want: IntVal(1)},
-		// Casting truncates
-		{name: "d2i-trunc", input: "1.9 :: int", want: IntVal(1)},
-		{name: "d2i-neg", input: "(-1.9) :: int", want: IntVal(-1)},
-		{name: "i2d", input: "1::double", want: DoubleVal(1)},
-		{name: "rec", input: "{x: 1.::int y: 2::double r: x::double/y}.r :: string", want: StringVal("0.5")},
+		{input: "func (first, rest...) { rest }(1)", want: ListVal{Elements: []Val{}}},
+		{input: "func (first, rest...) { rest }(1, 2, 3)", want: ListVal{Elements: []Val{IntVal(2), IntVal(3)}}},
+		{input: "func (xs...) { len(xs) }()", want: IntVal(0)},
+		{input: "func (xs...) { len(xs) }('a', 'b')", want: IntVal(2)},
+		{input: "func (x: 10, rest...) { x }()", want: IntVal(10)},
+		{input: "func (x: 10, rest...) { [x, rest] }(1, 2)", want: ListVal{Elements: []Val{
+			IntVal(1), ListVal{Elements: []Val{IntVal(2)}}}}},
+		{input: `{
+			let sum_all(xs...): fold(func (acc, x) { acc + x }, 0, xs)
+			a: sum_all()
+			b: sum_all(1, 2, 3)
+			}`, want: &RecVal{Fields: map[string]Val{"a": IntVal(0), "b": IntVal(6)}}},
 	}
 	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
+		t.Run(test.input, func(t *testing.T) {
 			e, err := parse(test.input)
 			if err != nil {
 				t.Fatalf("Cannot parse expression: %s", err)
@@ -570,49 +795,24 @@ func TestEvalTypedExpr(t *testing.T) {
 	}
 }
 
-func TestDurationUnit(t *testing.T) {
-	u := func(x float64, name string) UnitVal {
-		if f, found := builtinTypeDuration.UnitMults[name]; found {
-			return UnitVal{V: x, F: f, T: builtinTypeDuration}
-		}
-		t.Fatalf("invalid unit multiple name: %s", name)
-		return UnitVal{}
-	}
+func TestEvalFuncParamTypes(t *testing.T) {
 	tests := []struct {
-		name  string
 		input string
-		want  Val
+		want  string // Expression that evaluates to the expected value.
 	}{
-		{name: "minPlusSec", input: "(7::minutes + 3::seconds)", want: u(7*60+3, "seconds")},
-		{name: "hourMinusMin", input: "(1::hours - 30::minutes)", want: u(30, "minutes")},
-		{name: "dayMinusDay", input: "(365::days - 30::days)", want: u(335, "days")},
-		{name: "dayMinusDay", input: "(365::days - (24 * 30)::hours)", want: u(335*24, "hours")},
-		{name: "dayTimesN", input: "3 * 10::days", want: u(30, "days")},
-		{name: "nTimesDay", input: "10::days * 3", want: u(30, "days")},
-		// Division does not change the unit multiplier:
-		{name: "millisDivN", input: "10::millis / 100", want: u(0.1, "millis")},
-		{name: "millisDivN", input: "str(10::millis)", want: StringVal("10::millis")},
-		// Casting to int yields the value in the given unit multiple:
-		{name: "millisDivN", input: "(10::minutes)::int", want: IntVal(10)},
-		{name: "plusd", input: "(7::minutes + 3::seconds)::double", want: DoubleVal(7*60 + 3)},
-		{name: "plusb", input: "7::minutes + 3::seconds == (7*60+3)::seconds", want: BoolVal(true)},
-		// Comparisons
-		{name: "cmp.lt", input: "7::minutes < 7::hours", want: BoolVal(true)},
-		{name: "cmp.lt2", input: "1::minutes < 61::seconds", want: BoolVal(true)},
-		{name: "cmp.gt", input: "7::minutes > 8::seconds", want: BoolVal(true)},
-		{name: "cmp.le", input: "1::minutes <= 60::seconds", want: BoolVal(true)},
-		{name: "cmp.ge", input: "1::days >= 1::nanos", want: BoolVal(true)},
-		{name: "cmp.eq", input: "1::days == (24::hours)::days", want: BoolVal(true)},
-		// 1 day is not the same as 24 hours -- the multiples are different!
-		{name: "cmp.neq", input: "1::days != 24::hours", want: BoolVal(true)},
-	}
-	opts := []cmp.Option{
-		cmpopts.IgnoreFields(Typ{}, "Convert"),
-		cmpopts.IgnoreFields(Typ{}, "Encode"),
-		cmpopts.IgnoreFields(Typ{}, "Validate"),
+		{input: "func (n::int) { n * 2 }(3)", want: "6"},
+		{input: "func (s::string, n::int) { s + str(n) }('a', 1)", want: "'a1'"},
+		{input: "func (xs::[int]) { len(xs) }([1, 2])", want: "2"},
+		// Unit multipliers are normalized.
+		{input: "str(func (d::minutes) { d }(90::seconds))", want: "'1.5::minutes'"},
+		{input: "str(func (d::duration) { d }(90::seconds))", want: "'90::seconds'"},
+		{input: "str(func (d::minutes: 30::seconds) { d }())", want: "'0.5::minutes'"},
+		// Annotations of variadic parameters apply to each argument.
+		{input: "func (xs::int...) { xs }(1, 2)", want: "[1, 2]"},
+		{input: "{let f(n::int): n + 1 r: f(1)}.r", want: "2"},
 	}
 	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
+		t.Run(test.input, func(t *testing.T) {
 			e, err := parse(test.input)
 			if err != nil {
 				t.Fatalf("Cannot parse expression: %s", err)
@@ -621,74 +821,1032 @@ func TestDurationUnit(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Failed to evaluate: %s", err)
 			}
-			if diff := cmp.Diff(test.want, got, opts...); diff != "" {
+			w, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse expected expression: %s", err)
+			}
+			want, err := Eval(w, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate expected expression: %s", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
 				t.Errorf("Value mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
-func TestEvalTypedExprError(t *testing.T) {
+func TestEvalOptionalType(t *testing.T) {
 	tests := []struct {
-		name  string
 		input string
-		want  string
+		want  string // Expression that evaluates to the expected value.
 	}{
-		{name: "s2i", input: `"foo"::int`, want: "cannot convert"},
-		{name: "s2i-prefix", input: `"3i"::int`, want: "cannot convert"},
-		{name: "nil-int", input: `nil::int`, want: "cannot convert"},
-		{name: "rec-int", input: `{x: 0}::int`, want: "cannot convert"},
-		{name: "invalid", input: `1::doesnotexist`, want: "unknown type"},
-		{name: "duration", input: `1::seconds + 3`, want: "incompatible types"},
-		{name: "daySquared", input: "3::days * 10::days", want: "incompatible types"},
-		{name: "dayDivided", input: "3::days / 10::days", want: "incompatible types"},
+		{input: "{name::string?: 'a'}.name", want: "'a'"},
+		{input: "{name::string?: nil}.name", want: "nil"},
+		{input: "{n::int?: nil} @ {n: 1}", want: "{n: 1}"},
+		{input: "{n::int?: 1} @ {n: nil}", want: "{n: nil}"},
+		{input: "str({d::minutes?: 90::seconds}.d)", want: "'1.5::minutes'"},
+		{input: "str({d::minutes?: nil} @ {d: 90::seconds})", want: "'{d: 1.5::minutes}'"},
+		{input: "{xs::[int?]: [1, nil]}.xs", want: "[1, nil]"},
+		{input: "nil::int?", want: "nil"},
+		{input: "'1'::int?", want: "1"},
+		{input: "func (x::int?) { x }(nil)", want: "nil"},
+		{input: "func (x) -> string? { x }('a')", want: "'a'"},
 	}
 	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
+		t.Run(test.input, func(t *testing.T) {
 			e, err := parse(test.input)
 			if err != nil {
 				t.Fatalf("Cannot parse expression: %s", err)
 			}
 			got, err := Eval(e, GlobalCtx())
-			if err == nil {
-				t.Fatalf("Expected error, got %s", got)
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
 			}
-			if !strings.Contains(err.Error(), test.want) {
-				t.Errorf("Wanted error message containing %q, got: %q", test.want, err)
+			w, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse expected expression: %s", err)
+			}
+			want, err := Eval(w, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate expected expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want: %s, got: %s", want, got)
 			}
 		})
 	}
 }
 
-// evalSelfContainedModule is a test helper that loads a module from a string
-// (instead of from a file). The module must not load any other modules or data.
-func evalSelfContainedModule(input string, ctx *Ctx) (*loadedModule, error) {
-	const dummyFilename = "test"
-	file := ctx.addFile(dummyFilename, len(input))
-	mod, err := ParseModule(input, file)
-	if err != nil {
-		return nil, err
+func TestEvalOptionalTypeError(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{input: "{name::string?: 1}", wantErr: "type error for field name: incompatible types: int <> string"},
+		{input: "{n::int?: nil} @ {n: 'a'}", wantErr: "type error merging record field 'n'"},
+		{input: "{xs::[int?]: [1, 'a']}", wantErr: "type error for field xs: element 1"},
+		{input: "{n::integer?: nil}", wantErr: "unknown type integer? for field n"},
+		{input: "func (x::int?) { x }('a')", wantErr: "type error for parameter x"},
+		{input: "'a'::int?", wantErr: "cannot convert string"},
 	}
-	// Evaluate module and store it in context.
-	m, err := EvalModule(mod, ctx)
-	if err != nil {
-		return nil, err
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			_, err = Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
 	}
-	ctx.storeModule(m)
-	return m, nil
 }
 
-func TestUnitDecl(t *testing.T) {
-	input := `
-		pub unit foo {
-			multiples: {
-				bar: dbl(1)
-				baz: dbl(10)
+func TestEvalUnionType(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // Expression that evaluates to the expected value.
+	}{
+		{input: "{value::(int | string): 1}.value", want: "1"},
+		{input: "{value::(int | string): 'a'}.value", want: "'a'"},
+		{input: "{value::(int | string)?: nil}.value", want: "nil"},
+		{input: "{value::(int | string): 1} @ {value: 'a'}", want: "{value: 'a'}"},
+		{input: "{xs::[(int | string)]: [1, 'a']}.xs", want: "[1, 'a']"},
+		// Values are only checked, not converted.
+		{input: "1::(string | int)", want: "1"},
+		{input: "'1'::(int | string)", want: "'1'"},
+		{input: "['a', 2]::[(int | string)]", want: "['a', 2]"},
+		{input: "func (x::(int | string)) { x }('a')", want: "'a'"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
 			}
-		}
-		let dbl(x): 2 * x
-		{
-			x::bar: 10::baz
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			w, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse expected expression: %s", err)
+			}
+			want, err := Eval(w, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate expected expression: %s", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Want: %s, got: %s", want, got)
+			}
+		})
+	}
+}
+
+func TestEvalUnionTypeError(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{input: "{value::(int | string): true}", wantErr: "type error for field value: incompatible types: bool <> (int | string)"},
+		{input: "{value::(int | string): nil}", wantErr: "type error for field value"},
+		{input: "{value::(int | string): 1} @ {value: 1.5}", wantErr: "type error merging record field 'value'"},
+		{input: "{value::(int | integer): 1}", wantErr: "unknown type (int | integer) for field value"},
+		{input: "1.5::(int | string)", wantErr: "cannot convert value of type double to (int | string)"},
+		{input: "func (x::(int | string)) { x }(true)", wantErr: "type error for parameter x"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			_, err = Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestEvalFuncParamTypesError(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{input: "func (n::int) { n }('a')", wantErr: "type error for parameter n: incompatible types: string <> int"},
+		{input: "func (d::minutes) { d }(1)", wantErr: "type error for parameter d"},
+		{input: "func (d::minutes) { d }(1::percent)", wantErr: "type error for parameter d"},
+		{input: "func (xs::[int]) { xs }([1, 'a'])", wantErr: "type error for parameter xs: element 1"},
+		{input: "func (xs::int...) { xs }(1, 'a')", wantErr: "type error for parameter xs"},
+		{input: "func (n::int: 'x') { n }()", wantErr: "type error for parameter n"},
+		{input: "func (n::integer) { n }(1)", wantErr: "unknown type integer for parameter n"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			_, err = Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+			var evalErr *EvalError
+			if !errors.As(err, &evalErr) {
+				t.Errorf("wanted EvalError, got %T", err)
+			}
+		})
+	}
+}
+
+func TestEvalFuncResultType(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // Expression that evaluates to the expected value.
+	}{
+		{input: "func (n) -> int { n * 2 }(3)", want: "6"},
+		{input: "func () -> [string] { ['a'] }()", want: "['a']"},
+		{input: "let f(x) -> string: x + 'b' in f('a')", want: "'ab'"},
+		{input: "{let f(x) -> int: x r: f(1)}.r", want: "1"},
+		// Unit multipliers are normalized.
+		{input: "str(func (s) -> minutes { s::seconds }(90))", want: "'1.5::minutes'"},
+		{input: "str(func (s) -> duration { s::seconds }(90))", want: "'90::seconds'"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			w, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse expected expression: %s", err)
+			}
+			want, err := Eval(w, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate expected expression: %s", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvalFuncResultTypeError(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{input: "func (n) -> int { str(n) }(1)", wantErr: "type error for result of <func"},
+		{input: "func () -> minutes { 1 }()", wantErr: "incompatible types: int <> duration"},
+		{input: "func () -> [int] { [1, 'a'] }()", wantErr: "element 1"},
+		{input: "let f(x) -> bool: x in f(1)", wantErr: "incompatible types: int <> bool"},
+		{input: "func () -> integer { 1 }()", wantErr: "unknown type integer"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			_, err = Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestEvalLetExpr(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "let x: 2 in x * x", want: IntVal(4)},
+		{input: "let x: 2 in let y: x + 1 in x * y", want: IntVal(6)},
+		{input: "let x: 1 in let x: 2 in x", want: IntVal(2)},
+		{input: "let xs: [1, 2] in 2 in xs", want: BoolVal(true)},
+		{input: "let f(x): x + 1 in f(f(1))", want: IntVal(3)},
+		{input: "let fac(n): if n == 0 then 1 else n * fac(n-1) in fac(10)", want: IntVal(3628800)},
+		// Bindings are lazy.
+		{input: "let x: error('boom') in 1", want: IntVal(1)},
+		{input: "{a: 1 b: let x: a in x + 1}.b", want: IntVal(2)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvalMatchExpr(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "match 1 { 1 => 'one', 2 => 'two', _ => 'many' }", want: StringVal("one")},
+		{input: "match 2 { 1 => 'one', 2 => 'two', _ => 'many' }", want: StringVal("two")},
+		{input: "match 3 { 1 => 'one', 2 => 'two', _ => 'many' }", want: StringVal("many")},
+		// Arms are evaluated in order.
+		{input: "match 'a' { 'a' => 1, 'a' => 2 }", want: IntVal(1)},
+		// Structural equality, without implicit conversions.
+		{input: "match [1, {x: 2}] { [1, {x: 2}] => true, _ => false }", want: BoolVal(true)},
+		{input: "match 1.0 { 1 => 'int', 1.0 => 'double' }", want: StringVal("double")},
+		// Patterns are expressions.
+		{input: "{a: 2 b: match 4 { a * 2 => 'yes', _ => 'no' }}.b", want: StringVal("yes")},
+		// Only the matching arm is evaluated.
+		{input: "match 2 { 1 => error('boom'), 2 => 'ok', _ => error('boom') }", want: StringVal("ok")},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvalMatchExprNoMatch(t *testing.T) {
+	e, err := parse("match 3 { 1 => 'one', 2 => 'two' }")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	got, err := Eval(e, GlobalCtx())
+	if err == nil {
+		t.Fatalf("Expected error, got %v", got)
+	}
+	var evalErr *EvalError
+	if !errors.As(err, &evalErr) || evalErr.Kind() != KindNoMatch {
+		t.Errorf("Want EvalError of kind %s, got %v", KindNoMatch, err)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "len(1)", want: "invalid type"},
+		{input: "len('a', 'b')", want: "wrong number of arguments"},
+		{input: "func (x, y: 1) { x }()", want: "wrong number of arguments"},
+		{input: "func (x, y: 1) { x }(1, 2, 3)", want: "wrong number of arguments"},
+		{input: "func (x: error('boom')) { x }()", want: "boom"},
+		{input: "func (x, rest...) { x }()", want: "wrong number of arguments"},
+		{input: "let x: x + 1 in x", want: "cyclic"},
+		{input: "(let x: 1 in x) + y", want: "unbound variable"},
+		{input: "{x: 1}.y", want: "no field"},
+		{input: "'a'.y", want: "cannot access"},
+		{input: "{let f: 'a' y: f(0) }", want: "not callable"},
+		{input: "{x: y y: x}", want: "cyclic"},
+		{input: "{x: { a: b b: y.c } y: { c: x.a } }", want: "cyclic"},
+		{input: "'a' + 3", want: "incompatible types"},
+		{input: "1 + 1.0", want: "incompatible types"},
+		{input: "(func (x) {x}) + 3", want: "incompatible types"},
+		{input: "-'a'", want: "incompatible type"},
+		// Using the error function also yields an error
+		{input: "{x: error('foobar')}", want: "foobar"},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Errorf("Want error, got: %s", got)
+			} else if evalErr, ok := err.(*EvalError); !ok {
+				t.Errorf("Want EvalError, got %T", err)
+			} else if !strings.Contains(evalErr.Error(), test.want) {
+				t.Errorf("Got '%s', wanted it to contain '%v'", err, test.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrorKindAndSpan(t *testing.T) {
+	tests := []struct {
+		input    string
+		wantKind ErrorKind
+		wantSpan string // The input between the error's Pos and End.
+	}{
+		{input: "1 + foo", wantKind: KindUnboundVariable, wantSpan: "foo"},
+		{input: "{x: 1}.y", wantKind: KindNoSuchField, wantSpan: ".y"},
+		{input: "{let f: 'a' y: f(0) }", wantKind: KindNotCallable, wantSpan: "f"},
+		{input: "len(1, 2)", wantKind: KindCallFailed, wantSpan: "len(1, 2)"},
+		{input: "{x: x}", wantKind: KindCyclicDependency, wantSpan: "x"},
+		{input: "{x: y y: x}", wantKind: KindCyclicDependency, wantSpan: "x"},
+		{input: "{let a: b let b: a x: 1}", wantKind: KindCyclicDependency, wantSpan: "a"},
+		{input: "'a' + 3", wantKind: KindTypeError, wantSpan: "+ 3"},
+		{input: "-'a'", wantKind: KindTypeError, wantSpan: "-'a'"},
+		{input: "{x::foo: 1}", wantKind: KindUnknownType, wantSpan: "foo"},
+		{input: "{x::int: 'a'}", wantKind: KindTypeError, wantSpan: "int"},
+		{input: "'a'::int", wantKind: KindTypeError, wantSpan: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("Want error, got: %s", got)
+			}
+			evalErr, ok := err.(*EvalError)
+			if !ok {
+				t.Fatalf("Want EvalError, got %T", err)
+			}
+			if evalErr.Kind() != test.wantKind {
+				t.Errorf("Got kind %s, want %s", evalErr.Kind(), test.wantKind)
+			}
+			if span := test.input[evalErr.Pos():evalErr.End()]; span != test.wantSpan {
+				t.Errorf("Got span %q, want %q", span, test.wantSpan)
+			}
+		})
+	}
+}
+
+func TestStrictUnusedLetVar(t *testing.T) {
+	tests := []struct {
+		input    string
+		wantSpan string // The input between the error's Pos and End.
+	}{
+		{input: "{let x: 1 a: 2}", wantSpan: "x"},
+		{input: "{let y: 1 let x: 2 a: y}", wantSpan: "x"},
+		// The first unused binding is reported.
+		{input: "{let b: 1 let a: 2 c: 3}", wantSpan: "b"},
+		{input: "{a: {let inner: 1 b: 2}}", wantSpan: "inner"},
+		{input: "{let f(x): x a: 1}", wantSpan: "f"},
+		// References by name from other fields' records don't count.
+		{input: "{r: {let x: 1} s: {a: r.x}}", wantSpan: "x"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			ctx := GlobalCtx()
+			ctx.EnableStrict()
+			_, err = Eval(e, ctx)
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			evalErr, ok := err.(*EvalError)
+			if !ok {
+				t.Fatalf("Want EvalError, got %T", err)
+			}
+			if evalErr.Kind() != KindUnusedVariable {
+				t.Errorf("Got kind %s, want %s", evalErr.Kind(), KindUnusedVariable)
+			}
+			if span := test.input[evalErr.Pos():evalErr.End()]; span != test.wantSpan {
+				t.Errorf("Got span %q, want %q", span, test.wantSpan)
+			}
+		})
+	}
+}
+
+// rootEvalError returns the innermost EvalError in err's chain, or nil if there is none.
+func rootEvalError(err error) *EvalError {
+	var root *EvalError
+	for ; err != nil; err = errors.Unwrap(err) {
+		if e, ok := err.(*EvalError); ok {
+			root = e
+		}
+	}
+	return root
+}
+
+func TestMaxDepthExceeded(t *testing.T) {
+	tests := []string{
+		"{let f(x): f(x + 1) r: f(0)}.r",
+		"{let f(x): g(x) let g(x): f(x) r: f(0)}.r",
+		"{let f(x): [f(x)] r: f(0)}.r",
+		"{let f(x): fold(func (a, b) { f(a) }, x, [1]) r: f(0)}.r",
+		"{let f(x): {a: f(x)}.a r: f(0)}.r",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			ctx := GlobalCtx()
+			ctx.SetMaxDepth(100)
+			_, err = Eval(e, ctx)
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if root := rootEvalError(err); root == nil || root.Kind() != KindMaxDepthExceeded {
+				t.Errorf("Want root EvalError of kind %s, got %v", KindMaxDepthExceeded, root)
+			}
+		})
+	}
+}
+
+func TestMaxDepthDefault(t *testing.T) {
+	e, err := parse("{let f(x): f(x + 1) r: f(0)}.r")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	_, err = Eval(e, GlobalCtx())
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	// Don't call err.Error(): the message of the deeply chained error is huge.
+	if root := rootEvalError(err); root == nil || root.Kind() != KindMaxDepthExceeded {
+		t.Errorf("Want root EvalError of kind %s", KindMaxDepthExceeded)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	tests := []struct {
+		input    string
+		maxDepth int
+		want     Val
+	}{
+		{input: "{let f(n): if n == 0 then 0 else 1 + f(n - 1) r: f(1000)}.r", maxDepth: DefaultMaxDepth, want: IntVal(1000)},
+		{input: "{let f(n): if n == 0 then 0 else 1 + f(n - 1) r: f(1000)}.r", maxDepth: 0, want: IntVal(1000)},
+		// Exceeding the maximum depth can be handled by pcall.
+		{input: "{let f(x): f(x + 1) r: pcall(f, 0).err}.r", maxDepth: 100, want: BoolVal(true)},
+		// After pcall returns, the full depth is available again.
+		{input: "{let f(x): f(x + 1) let g(n): if n == 0 then 0 else 1 + g(n - 1) r: if pcall(f, 0).err then g(20) else -1}.r",
+			maxDepth: 100, want: IntVal(20)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			ctx := GlobalCtx()
+			ctx.SetMaxDepth(test.maxDepth)
+			got, err := Eval(e, ctx)
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+// The depth is restored when a panic unwinds past Eval.
+func TestMaxDepthAfterPanic(t *testing.T) {
+	ctx := GlobalCtx()
+	ctx.Store("boom", &NativeFuncVal{
+		Name:  "boom",
+		F:     func(args []Val, ctx *Ctx) (Val, error) { panic("boom") },
+		Arity: 0,
+	})
+	e, err := parse("{let f(n): if n == 0 then boom() else f(n - 1) r: f(10)}.r")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic")
+			}
+		}()
+		Eval(e, ctx)
+	}()
+	if ctx.global.depth != 0 {
+		t.Errorf("Want depth 0 after panic, got %d", ctx.global.depth)
+	}
+}
+
+func TestEvalWithContextTimeout(t *testing.T) {
+	tests := []string{
+		// Doesn't exceed the maximum depth, but takes forever.
+		"{let f(n): if n == 0 then 0 else f(n - 1) + f(n - 1) r: f(100)}.r",
+		// Cancellation cannot be caught.
+		"{let f(n): if n == 0 then 0 else f(n - 1) + f(n - 1) r: try(func () { f(100) }, 0)}.r",
+		"{let f(n): if n == 0 then 0 else f(n - 1) + f(n - 1) r: pcall(f, 100)}.r",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			goCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			started := time.Now()
+			_, err = EvalWithContext(goCtx, e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if elapsed := time.Since(started); elapsed > 5*time.Second {
+				t.Errorf("Evaluation took %v after the deadline", elapsed)
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Want error wrapping context.DeadlineExceeded, got %v", err)
+			}
+			if root := rootEvalError(err); root == nil || root.Kind() != KindCanceled {
+				t.Errorf("Want root EvalError of kind %s, got %v", KindCanceled, root)
+			}
+		})
+	}
+}
+
+func TestEvalWithContext(t *testing.T) {
+	e, err := parse("{let f(n): if n == 0 then 0 else n + f(n - 1) r: f(100)}.r")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	ctx := GlobalCtx()
+	got, err := EvalWithContext(context.Background(), e, ctx)
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	if got != IntVal(5050) {
+		t.Errorf("Want 5050, got %v", got)
+	}
+	// An already canceled context fails immediately.
+	goCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = EvalWithContext(goCtx, e, ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Want error wrapping context.Canceled, got %v", err)
+	}
+	// The context is not used by subsequent calls of Eval.
+	got, err = Eval(e, ctx)
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	if got != IntVal(5050) {
+		t.Errorf("Want 5050, got %v", got)
+	}
+}
+
+func TestEvalWithContextReuseCtx(t *testing.T) {
+	e, err := parse("{let f(n): if n == 0 then 0 else n + f(n - 1) r: f(100)}.r")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	ctx := GlobalCtx()
+	ctx.Store("boom", &NativeFuncVal{
+		Name:  "boom",
+		F:     func(args []Val, ctx *Ctx) (Val, error) { panic("boom") },
+		Arity: 0,
+	})
+	// Abort evaluations deep inside recursions by cancellation and by a panic.
+	slow, err := parse("{let f(n): if n == 0 then 0 else f(n - 1) + f(n - 1) r: f(100)}.r")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	goCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := EvalWithContext(goCtx, slow, ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Want error wrapping context.DeadlineExceeded, got %v", err)
+	}
+	if ctx.global.depth != 0 {
+		t.Errorf("Want depth 0 after cancellation, got %d", ctx.global.depth)
+	}
+	panicky, err := parse("{let f(n): if n == 0 then boom() else f(n - 1) r: f(10)}.r")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic")
+			}
+		}()
+		EvalWithContext(context.Background(), panicky, ctx)
+	}()
+	if ctx.global.depth != 0 {
+		t.Errorf("Want depth 0 after panic, got %d", ctx.global.depth)
+	}
+	got, err := EvalWithContext(context.Background(), e, ctx)
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	if got != IntVal(5050) {
+		t.Errorf("Want 5050, got %v", got)
+	}
+}
+
+func TestStrictUsedLetVar(t *testing.T) {
+	tests := []string{
+		"{let x: 1 a: x}",
+		"{let x: 1 let y: x a: y}",
+		"{let x: 1 a: {b: x}}",
+		"{let x: 1 a: [1, x + 1]}",
+		"{let x: 1 a: 'v${x}'}",
+		"{let x: 1 a: if true then 0 else x}",
+		"{let x: 1 a: match 1 { 1 => x, _ => 0 }}",
+		"{let x: 1 a: let y: x in y}",
+		// References from function bodies count, even if the function is never called.
+		"{let x: 1 f: func (y) { x + y }}",
+		"{let x: 1 f: func (y: x) { y }}",
+		"{let f(x): x a: f(1)}",
+		// Unused fields are fine.
+		"{a: 1 b: 2}",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			ctx := GlobalCtx()
+			ctx.EnableStrict()
+			if _, err := Eval(e, ctx); err != nil {
+				t.Errorf("Failed to evaluate: %s", err)
+			}
+		})
+	}
+}
+
+func TestStrictModule(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: "let x: 1\n{a: x}", wantErr: false},
+		{input: "let x: 1\npub func f(y) { x + y }", wantErr: false},
+		{input: "let x: 1\npub type small: int where func (i) { i < x }", wantErr: false},
+		{input: "let x: 1\n{a: 2}", wantErr: true},
+		{input: "let x: 1\nlet y: 2\n{a: y}", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			ctx := GlobalCtx()
+			ctx.EnableStrict()
+			_, err := evalSelfContainedModule(test.input, ctx)
+			if test.wantErr {
+				var evalErr *EvalError
+				if !errors.As(err, &evalErr) || evalErr.Kind() != KindUnusedVariable {
+					t.Errorf("Want unused variable error, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Failed to evaluate module: %s", err)
+			}
+		})
+	}
+	// Unused let bindings are not an error in non-strict mode.
+	if _, err := evalSelfContainedModule("let x: {let y: 1 a: 2}\n{}", GlobalCtx()); err != nil {
+		t.Errorf("Failed to evaluate module in non-strict mode: %s", err)
+	}
+}
+
+func TestSizeofVal(t *testing.T) {
+	// Some tests showing that RecVal, UnitVal, ListVal are small enough
+	// to be passed by value.
+	if unsafe.Sizeof((*int)(nil)) != 8 {
+		t.Skip("Skipping Sizeof tests on non-64bit architecture")
+	}
+	if got := unsafe.Sizeof(ListVal{}); got != 24 {
+		t.Errorf("Unexpected size for ListVal, got %d", got)
+	}
+	if got := unsafe.Sizeof(RecVal{}); got != 40 {
+		t.Errorf("Unexpected size for RecVal: %d", got)
+	}
+	if got := unsafe.Sizeof(UnitVal{}); got != 24 {
+		t.Errorf("Unexpected size for UnitVal, got %d", got)
+	}
+}
+
+func TestEvalTypedExpr(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{name: "int", input: "1::int", want: IntVal(1)},
+		{name: "intfield", input: "{x::int: 1}.x", want: IntVal(1)},
+		// Casting truncates
+		{name: "d2i-trunc", input: "1.9 :: int", want: IntVal(1)},
+		{name: "d2i-neg", input: "(-1.9) :: int", want: IntVal(-1)},
+		{name: "i2d", input: "1::double", want: DoubleVal(1)},
+		{name: "rec", input: "{x: 1.::int y: 2::double r: x::double/y}.r :: string", want: StringVal("0.5")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDurationUnit(t *testing.T) {
+	u := func(x float64, name string) UnitVal {
+		if f, found := builtinTypeDuration.UnitMults[name]; found {
+			return UnitVal{V: x, F: f, T: builtinTypeDuration}
+		}
+		t.Fatalf("invalid unit multiple name: %s", name)
+		return UnitVal{}
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{name: "minPlusSec", input: "(7::minutes + 3::seconds)", want: u(7*60+3, "seconds")},
+		{name: "hourMinusMin", input: "(1::hours - 30::minutes)", want: u(30, "minutes")},
+		{name: "dayMinusDay", input: "(365::days - 30::days)", want: u(335, "days")},
+		{name: "dayMinusDay", input: "(365::days - (24 * 30)::hours)", want: u(335*24, "hours")},
+		{name: "dayTimesN", input: "3 * 10::days", want: u(30, "days")},
+		{name: "nTimesDay", input: "10::days * 3", want: u(30, "days")},
+		// Division does not change the unit multiplier:
+		{name: "millisDivN", input: "10::millis / 100", want: u(0.1, "millis")},
+		{name: "millisDivN", input: "str(10::millis)", want: StringVal("10::millis")},
+		// Dividing units of the same type yields their ratio:
+		{name: "dayDivDay", input: "10::days / 2::days", want: DoubleVal(5)},
+		{name: "hourDivMin", input: "1::hours / 15::minutes", want: DoubleVal(4)},
+		{name: "secDivMin", input: "30::seconds / 1::minutes", want: DoubleVal(0.5)},
+		// Casting to int yields the value in the given unit multiple:
+		{name: "millisDivN", input: "(10::minutes)::int", want: IntVal(10)},
+		{name: "plusd", input: "(7::minutes + 3::seconds)::double", want: DoubleVal(7*60 + 3)},
+		{name: "plusb", input: "7::minutes + 3::seconds == (7*60+3)::seconds", want: BoolVal(true)},
+		// Comparisons
+		{name: "cmp.lt", input: "7::minutes < 7::hours", want: BoolVal(true)},
+		{name: "cmp.lt2", input: "1::minutes < 61::seconds", want: BoolVal(true)},
+		{name: "cmp.gt", input: "7::minutes > 8::seconds", want: BoolVal(true)},
+		{name: "cmp.le", input: "1::minutes <= 60::seconds", want: BoolVal(true)},
+		{name: "cmp.ge", input: "1::days >= 1::nanos", want: BoolVal(true)},
+		{name: "cmp.eq", input: "1::days == (24::hours)::days", want: BoolVal(true)},
+		// 1 day is not the same as 24 hours -- the multiples are different!
+		{name: "cmp.neq", input: "1::days != 24::hours", want: BoolVal(true)},
+	}
+	opts := []cmp.Option{
+		cmpopts.IgnoreFields(Typ{}, "Convert"),
+		cmpopts.IgnoreFields(Typ{}, "Encode"),
+		cmpopts.IgnoreFields(Typ{}, "Validate"),
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got, opts...); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPortType(t *testing.T) {
+	port := func(i int64) Val {
+		return TypedVal{V: IntVal(i), T: builtinTypePort}
+	}
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "0::port", want: port(0)},
+		{input: "8080::port", want: port(8080)},
+		{input: "65535::port", want: port(65535)},
+		{input: "'443'::port", want: port(443)},
+		{input: "(80::port)::port", want: port(80)},
+		{input: "{p::port: 80::port}.p", want: port(80)},
+		{input: "typeof(80::port)", want: StringVal("port")},
+	}
+	// Only compare types by identity.
+	opts := cmp.Comparer(func(x, y *Typ) bool { return x == y })
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got, opts); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUnitDivisionError(t *testing.T) {
+	tests := []string{
+		"10::days / 80::percent",
+		"10 / 2::days",
+		"10.0 / 2::days",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			if got, err := Eval(e, GlobalCtx()); err == nil {
+				t.Errorf("Expected error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestPercentUnit(t *testing.T) {
+	u := func(x float64, name string) UnitVal {
+		if f, found := builtinTypePercent.UnitMults[name]; found {
+			return UnitVal{V: x, F: f, T: builtinTypePercent}
+		}
+		t.Fatalf("invalid unit multiple name: %s", name)
+		return UnitVal{}
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{name: "percent", input: "80::percent", want: u(80, "percent")},
+		{name: "toFraction", input: "(80::percent)::fraction", want: u(0.8, "fraction")},
+		{name: "toPercent", input: "(0.25::fraction)::percent", want: u(25, "percent")},
+		{name: "toSelf", input: "(80::percent)::percent", want: u(80, "percent")},
+		{name: "plus", input: "80::percent + 10::percent", want: u(90, "percent")},
+		{name: "double", input: "((80::percent)::fraction)::double", want: DoubleVal(0.8)},
+		{name: "field", input: "{x::percent: 0.5::fraction}.x", want: u(50, "percent")},
+		{name: "cmp.gt", input: "80::percent > 0.5::fraction", want: BoolVal(true)},
+		{name: "cmp.lt", input: "80::percent < 1::fraction", want: BoolVal(true)},
+	}
+	opts := []cmp.Option{
+		cmpopts.IgnoreFields(Typ{}, "Convert"),
+		cmpopts.IgnoreFields(Typ{}, "Encode"),
+		cmpopts.IgnoreFields(Typ{}, "Validate"),
+		cmpopts.EquateApprox(0, 1e-9),
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got, opts...); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvalTypedExprError(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "s2i", input: `"foo"::int`, want: "cannot convert"},
+		{name: "s2i-prefix", input: `"3i"::int`, want: "cannot convert"},
+		{name: "nil-int", input: `nil::int`, want: "cannot convert"},
+		{name: "rec-int", input: `{x: 0}::int`, want: "cannot convert"},
+		{name: "invalid", input: `1::doesnotexist`, want: "unknown type"},
+		{name: "duration", input: `1::seconds + 3`, want: "incompatible types"},
+		{name: "daySquared", input: "3::days * 10::days", want: "incompatible types"},
+		{name: "dayDividedPercent", input: "3::days / 10::percent", want: "incompatible unit types"},
+		{name: "portTooLarge", input: "65536::port", want: "invalid value for type port"},
+		{name: "portNegative", input: "(-1)::port", want: "invalid value for type port"},
+		{name: "portString", input: "'99999'::port", want: "invalid value for type port"},
+		{name: "portDouble", input: "80.0::port", want: "invalid argument type"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("Expected error, got %s", got)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Wanted error message containing %q, got: %q", test.want, err)
+			}
+		})
+	}
+}
+
+// evalSelfContainedModule is a test helper that loads a module from a string
+// (instead of from a file). The module must not load any other modules or data.
+func evalSelfContainedModule(input string, ctx *Ctx) (*loadedModule, error) {
+	const dummyFilename = "test"
+	file := ctx.addFile(dummyFilename, input)
+	mod, err := ParseModule(input, file)
+	if err != nil {
+		return nil, err
+	}
+	// Evaluate module and store it in context.
+	m, err := EvalModule(mod, ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx.storeModule(m)
+	return m, nil
+}
+
+func TestUnitDecl(t *testing.T) {
+	input := `
+		pub unit foo {
+			multiples: {
+				bar: dbl(1)
+				baz: dbl(10)
+			}
+		}
+		let dbl(x): 2 * x
+		{
+			x::bar: 10::baz
 		}.x`
 	// Load module and check result.
 	ctx := GlobalCtx()
@@ -696,32 +1854,534 @@ func TestUnitDecl(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to load module: %s", err)
 	}
-	got, ok := m.body.(UnitVal)
-	if !ok {
-		t.Fatalf("expected IntVal, got %T", m.body)
+	got, ok := m.body.(UnitVal)
+	if !ok {
+		t.Fatalf("expected IntVal, got %T", m.body)
+	}
+	typ := ctx.LookupType("foo")
+	if typ == nil {
+		t.Fatalf("type foo not defined in ctx")
+	}
+	want := UnitVal{V: 100., F: 2., T: typ}
+	// Ignore function fields in Typ.
+	opts := cmpopts.IgnoreInterfaces(struct{ CallableVal }{})
+	if diff := cmp.Diff(got, want, opts); diff != "" {
+		t.Fatalf("UnitVal mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestEvalModuleForwardRefs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]Val
+	}{
+		{name: "pub", input: `
+			pub let a: b + 1
+			pub let b: 2`,
+			want: map[string]Val{"a": IntVal(3), "b": IntVal(2)}},
+		{name: "mixed", input: `
+			pub let a: b + c
+			let b: c * 2
+			pub let c: 3`,
+			want: map[string]Val{"a": IntVal(9), "c": IntVal(3)}},
+		{name: "func", input: `
+			pub let a: f(1)
+			pub func f(x) { g(x) + 1 }
+			pub func g(x) { x * 10 }`,
+			want: map[string]Val{"a": IntVal(11)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := evalSelfContainedModule(test.input, GlobalCtx())
+			if err != nil {
+				t.Fatalf("failed to load module: %s", err)
+			}
+			for name, want := range test.want {
+				if got := m.pubVars[name]; got == nil || !got.Equal(want) {
+					t.Errorf("pub %s: want %v, got %v", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestEvalModuleCycle(t *testing.T) {
+	tests := []string{
+		"pub let a: a",
+		`pub let a: b + 1
+		pub let b: a`,
+		`pub let a: b
+		let b: c
+		pub let c: a`,
+		`pub let a: 1
+		let b: c
+		let c: b
+		b`,
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			_, err := evalSelfContainedModule(input, GlobalCtx())
+			var evalErr *EvalError
+			if !errors.As(err, &evalErr) || evalErr.Kind() != KindCyclicDependency {
+				t.Errorf("Want EvalError of kind %s, got %v", KindCyclicDependency, err)
+			}
+		})
+	}
+}
+
+func TestEvalTime(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{name: "time", input: `("2022-01-31"::time).year`, want: IntVal(2022)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			// Ignore function fields in Typ.
+			opts := cmpopts.IgnoreInterfaces(struct{ CallableVal }{})
+			if diff := cmp.Diff(test.want, got, opts); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvalErrorPcall(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{
+			name: "pcall-error",
+			input: `
+				{
+					let f(): error(1)
+					let p: pcall(f)
+					r: if p.err then p.value else error('expected p.err to be true')
+				}.r
+			`,
+			want: IntVal(1),
+		},
+		{
+			name: "pcall-noerror",
+			input: `
+				{
+					let f(x): x + 1
+					let p: pcall(f, 1)
+					r: if p.err then error('no error expected') else p.value
+				}.r
+			`,
+			want: IntVal(2),
+		},
+		{
+			name: "pcall-error-propagate",
+			input: `
+				{
+					let f(x): if x < 0 then error('negative') else x * x
+					let g(x): f(x) + 2
+					let p: pcall(g, -1)
+					r: if p.err then p.value else error('expected p.err to be true')
+				}.r
+			`,
+			want: StringVal("negative"),
+		},
+		{
+			name: "pcall-division-by-zero",
+			input: `
+				{
+					let f(x): 10 / x
+					let p: pcall(f, 0)
+					r: if p.err then p.value else error('expected p.err to be true')
+				}.r
+			`,
+			want: StringVal("integer division by zero"),
+		},
+		{
+			name: "pcall-modulo-by-zero",
+			input: `
+				{
+					let f(x): 10 % x
+					let g(x): f(x) + 1
+					r: pcall(g, 0).err
+				}.r
+			`,
+			want: BoolVal(true),
+		},
+		{
+			name: "pcall-error-message",
+			input: `
+				{
+					let f(): error('boom')
+					r: pcall(f).message
+				}.r
+			`,
+			want: StringVal("boom"),
+		},
+		{
+			name: "pcall-error-message-nonstring",
+			input: `
+				{
+					let f(): error({code: 3})
+					let p: pcall(f)
+					r: [p.value.code, p.message]
+				}.r
+			`,
+			want: ListVal{Elements: []Val{IntVal(3), StringVal("{code: 3}")}},
+		},
+		{
+			name: "pcall-builtin-error",
+			input: `
+				{
+					let f(s): substr(s, 0, 10)
+					let p: pcall(f, 'abc')
+					r: if p.err then p.message else error('expected p.err to be true')
+				}.r
+			`,
+			want: StringVal("substr: invalid start(0)/end(10) arguments for string of length 3"),
+		},
+		{
+			name:  "pcall-builtin-direct",
+			input: `pcall(substr, 'abc', 2, 1).err`,
+			want:  BoolVal(true),
+		},
+		{
+			name: "pcall-eval-error",
+			input: `
+				{
+					let f(): undefined_var + 1
+					r: pcall(f).message
+				}.r
+			`,
+			want: StringVal("unbound variable undefined_var"),
+		},
+		{
+			name:  "pcall-noerror-no-message",
+			input: `has(pcall(len, 'a'), 'message')`,
+			want:  BoolVal(false),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRecordTypeDecl(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{name: "field", input: `({host: 'a' port: 80}::Server).port`, want: IntVal(80)},
+		{name: "extra", input: `({host: 'a' port: 80 debug: true}::Server).debug`, want: BoolVal(true)},
+		{name: "typed", input: `typeof({host: 'a' port: 80}::Server)`, want: StringVal("Server")},
+		{name: "idempotent", input: `typeof(({host: 'a' port: 80}::Server)::Server)`, want: StringVal("Server")},
+		{name: "nested", input: `({name: 'x' server: {host: 'a' port: 80} timeout: 3::seconds}::Service).server.host`, want: StringVal("a")},
+		{name: "typedField", input: `{s::Server: {host: 'a' port: 80}::Server}.s.host`, want: StringVal("a")},
 	}
-	typ := ctx.LookupType("foo")
-	if typ == nil {
-		t.Fatalf("type foo not defined in ctx")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := `
+				pub type Server { host: string port: int }
+				pub type Service { name: string server: Server timeout: duration }
+			` + test.input
+			got, err := evalSelfContainedModule(input, GlobalCtx())
+			if err != nil {
+				t.Fatalf("failed to load module: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got.body); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
 	}
-	want := UnitVal{V: 100., F: 2., T: typ}
-	// Ignore function fields in Typ.
-	opts := cmpopts.IgnoreInterfaces(struct{ CallableVal }{})
-	if diff := cmp.Diff(got, want, opts); diff != "" {
-		t.Fatalf("UnitVal mismatch (-want +got):\n%s", diff)
+}
+
+func TestRecordTypeDeclError(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "missing", input: `{host: 'a'}::Server`, wantErr: "missing field port"},
+		{name: "type", input: `{host: 'a' port: '80'}::Server`, wantErr: "field port: incompatible types"},
+		{name: "nested", input: `{name: 'x' server: {host: 'a'} timeout: 3::seconds}::Service`, wantErr: "field server: missing field port"},
+		{name: "unit", input: `{name: 'x' server: {host: 'a' port: 1} timeout: 3}::Service`, wantErr: "field timeout: incompatible types"},
+		{name: "notrec", input: `1::Server`, wantErr: "cannot convert value of type int to Server"},
+		{name: "typedField", input: `{s::Server: {host: 'a' port: 80}}`, wantErr: "type error for field s"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := `
+				pub type Server { host: string port: int }
+				pub type Service { name: string server: Server timeout: duration }
+			` + test.input
+			_, err := evalSelfContainedModule(input, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
 	}
 }
 
-func TestEvalTime(t *testing.T) {
+func TestMergeTypedRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		want     string // Expected value of the merged record's field s, evaluated in the same module.
+		wantType string // Expected type of the merged record's field s.
+	}{
+		{name: "typed", input: `{s: {host: 'a' port: 80}::Server} @ {s: {host: 'b' port: 81}::Server}`,
+			want: `{host: 'b' port: 81}`, wantType: "Server"},
+		{name: "typedUntyped", input: `{s: {host: 'a' port: 80}::Server} @ {s: {port: 81}}`,
+			want: `{host: 'a' port: 81}`, wantType: "Server"},
+		{name: "untypedTyped", input: `{s: {debug: true}} @ {s: {host: 'b' port: 81}::Server}`,
+			want: `{debug: true host: 'b' port: 81}`, wantType: "Server"},
+		{name: "annotated", input: `{s::Server: {host: 'a' port: 80}::Server} @ {s: {host: 'b'}}`,
+			want: `{host: 'b' port: 80}`, wantType: "Server"},
+		{name: "toplevel", input: `{s: {host: 'a' port: 80}::Server @ {port: 81}}`,
+			want: `{host: 'a' port: 81}`, wantType: "Server"},
+		{name: "builtin", input: `merge({s: {host: 'a' port: 80}::Server}, {s: {port: 81}}, {s: {port: 82}})`,
+			want: `{host: 'a' port: 82}`, wantType: "Server"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := `
+				pub type Server { host: string port: int }
+				let m: ` + test.input + `
+				[typeof(m.s), m.s == (` + test.want + `)::` + test.wantType + `]`
+			m, err := evalSelfContainedModule(input, GlobalCtx())
+			if err != nil {
+				t.Fatalf("failed to load module: %s", err)
+			}
+			want := ListVal{Elements: []Val{StringVal(test.wantType), BoolVal(true)}}
+			if diff := cmp.Diff(want, m.body); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMergeTypedRecordsError(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "conflict", input: `{s: {host: 'a' port: 80}::Server} @ {s: {name: 'x'}::Client}`,
+			wantErr: "cannot merge records of types Server and Client"},
+		{name: "invalid", input: `{s: {host: 'a' port: 80}::Server} @ {s: {port: 'x'}}`,
+			wantErr: "field port: incompatible types"},
+		{name: "toplevel", input: `{host: 'a' port: 80}::Server @ {name: 'x'}::Client`,
+			wantErr: "cannot merge records of types Server and Client"},
+		{name: "nested", input: `{a: {s: {host: 'a' port: 80}::Server}} @ {a: {s: {name: 'x'}::Client}}`,
+			wantErr: "cannot merge record field 'a.s': cannot merge records of types Server and Client"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := `
+				pub type Server { host: string port: int }
+				pub type Client { name: string }
+			` + test.input
+			_, err := evalSelfContainedModule(input, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestMergeErrorPath(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{input: "{size::int: 1} @ {size: 'x'}",
+			wantErr: "type error merging record field 'size': incompatible types: string <> int"},
+		{input: "{db: {pool: {size::int: 1}}} @ {db: {pool: {size: 'x'}}}",
+			wantErr: "type error merging record field 'db.pool.size': incompatible types: string <> int"},
+		{input: "merge({a: {d::duration: 1::seconds}}, {a: {d: true}})",
+			wantErr: "type error merging record field 'a.d': incompatible types: bool <> duration"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			_, err = Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRecordTypeDeclUnknownFieldType(t *testing.T) {
+	_, err := evalSelfContainedModule(`pub type Server { host: hostname } 1`, GlobalCtx())
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	if evalErr, ok := err.(*EvalError); !ok || evalErr.Kind() != KindUnknownType {
+		t.Errorf("wanted EvalError of kind %s, got %v", KindUnknownType, err)
+	}
+}
+
+func TestAliasTypeDecl(t *testing.T) {
 	tests := []struct {
 		name  string
 		input string
 		want  Val
 	}{
-		{name: "time", input: `("2022-01-31"::time).year`, want: IntVal(2022)},
+		{name: "fieldAnnotation", input: "{p::Port: 8080}.p", want: IntVal(8080)},
+		{name: "conversion", input: "'443'::Port", want: IntVal(443)},
+		{name: "valuesHaveBaseType", input: "typeof(80::Port)", want: StringVal("int")},
+		{name: "where", input: "{p::ValidPort: 443}.p", want: IntVal(443)},
+		{name: "whereConversion", input: "'65535'::ValidPort", want: IntVal(65535)},
+		{name: "aliasOfAlias", input: "{p::HttpPort: 80}.p", want: IntVal(80)},
+		{name: "listElements", input: "{ps::[ValidPort]: [1, 2]}.ps", want: ListVal{[]Val{IntVal(1), IntVal(2)}}},
+		{name: "unitBase", input: "{t::Timeout: 5::minutes}.t == 5::minutes", want: BoolVal(true)},
+		{name: "recordBase", input: "({host: 'a'}::Host).host", want: StringVal("a")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := `
+				pub type Port: int
+				pub type ValidPort: int where func (x) { x > 0 && x < 65536 }
+				pub type HttpPort: ValidPort where func (x) { x == 80 || x == 8080 }
+				pub type Timeout: duration where func (d) { d <= max_timeout }
+				pub type Server { host: string }
+				pub type Host: Server
+				let max_timeout: 1::hours
+			` + test.input
+			m, err := evalSelfContainedModule(input, GlobalCtx())
+			if err != nil {
+				t.Fatalf("failed to load module: %s", err)
+			}
+			if diff := cmp.Diff(test.want, m.body); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateWithCtx(t *testing.T) {
+	// Native predicates such as builtins get the evaluating ctx.
+	pred := &NativeFuncVal{
+		Name: "checked",
+		F: func(args []Val, ctx *Ctx) (Val, error) {
+			if ctx == nil {
+				return nil, fmt.Errorf("checked: called without ctx")
+			}
+			return BoolVal(ctx.LookupType("int") == args[0].Typ()), nil
+		},
+		Arity: 1,
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{name: "field", input: "{c::Checked: 1}.c", want: IntVal(1)},
+		{name: "param", input: "(func (c::Checked) { c })(2)", want: IntVal(2)},
+		{name: "recordField", input: "({c: 3}::Box).c", want: IntVal(3)},
+		{name: "merge", input: "(({c: 1}::Box) @ {c: 4}).c", want: IntVal(4)},
+		{name: "mergeBuiltin", input: "merge({c: 1}::Box, {c: 5}).c", want: IntVal(5)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := GlobalCtx()
+			ctx.defineType(NewAliasType("Checked", builtinTypeInt, pred))
+			m, err := evalSelfContainedModule("pub type Box { c: Checked } "+test.input, ctx)
+			if err != nil {
+				t.Fatalf("failed to load module: %s", err)
+			}
+			if diff := cmp.Diff(test.want, m.body); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAliasTypeDeclError(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "wrongBaseType", input: "pub type Port: int {p::Port: '80'}", wantErr: "incompatible types: string <> int"},
+		{name: "whereField", input: "pub type Port: int where func (x) { x < 65536 } {p::Port: 70000}", wantErr: "validation failed for type Port"},
+		{name: "whereConversion", input: "pub type Port: int where func (x) { x < 65536 } 70000::Port", wantErr: "invalid value for type Port"},
+		{name: "whereBase", input: "pub type A: int where func (x) { x > 0 } pub type B: A {b::B: -1}", wantErr: "validation failed for type A"},
+		{name: "unknownBase", input: "pub type Port: integer 1", wantErr: "unknown base type integer"},
+		{name: "cycle", input: "pub type A: B pub type B: A 1", wantErr: "cyclic alias type declaration"},
+		{name: "whereNotCallable", input: "pub type Port: int where 1 1", wantErr: "must be a function"},
+		{name: "listBase", input: "pub type Ports: [int] 1", wantErr: "base type of Ports must be a type name"},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
+			_, err := evalSelfContainedModule(test.input, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestEvalListTypeAnnotation(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "{ports::[int]: [80, 443]}.ports", want: ListVal{Elements: []Val{IntVal(80), IntVal(443)}}},
+		{input: "{ports::[int]: []}.ports", want: ListVal{Elements: []Val{}}},
+		{input: "{xs::[[string]]: [['a'], [], ['b', 'c']]}.xs", want: ListVal{Elements: []Val{
+			ListVal{Elements: []Val{StringVal("a")}},
+			ListVal{Elements: []Val{}},
+			ListVal{Elements: []Val{StringVal("b"), StringVal("c")}},
+		}}},
+		{input: "['1', '2']::[int]", want: ListVal{Elements: []Val{IntVal(1), IntVal(2)}}},
+		{input: "[[1], [2.5]]::[[string]]", want: ListVal{Elements: []Val{
+			ListVal{Elements: []Val{StringVal("1")}},
+			ListVal{Elements: []Val{StringVal("2.5")}},
+		}}},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
 			e, err := parse(test.input)
 			if err != nil {
 				t.Fatalf("Cannot parse expression: %s", err)
@@ -730,58 +2390,116 @@ func TestEvalTime(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Failed to evaluate: %s", err)
 			}
-			// Ignore function fields in Typ.
-			opts := cmpopts.IgnoreInterfaces(struct{ CallableVal }{})
-			if diff := cmp.Diff(test.want, got, opts); diff != "" {
+			if diff := cmp.Diff(test.want, got); diff != "" {
 				t.Errorf("Value mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
-func TestEvalErrorPcall(t *testing.T) {
+func TestEvalListTypeAnnotationError(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{input: "{ports::[int]: [80, '443']}", wantErr: "element 1: incompatible types: string <> int"},
+		{input: "{ports::[int]: 80}", wantErr: "incompatible types: int <> [int]"},
+		{input: "{xs::[[string]]: [['a'], ['b', 1]]}", wantErr: "element 1: element 1: incompatible types"},
+		{input: "{xs::[[string]]: ['a']}", wantErr: "element 0: incompatible types: string <> [string]"},
+		{input: "{xs::[foo]: []}", wantErr: "unknown type foo"},
+		{input: "1::[int]", wantErr: "cannot convert value of type int to [int]"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			_, err = Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wanted error containing %q, got %q", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestEvalDivisionByZero(t *testing.T) {
+	tests := []string{
+		"1 / 0",
+		"1 % 0",
+		"{x: 0 y: 7 % x}",
+		"{let f(x): 1 / x  y: f(0)}",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err == nil {
+				t.Fatalf("Expected error, got %v", got)
+			}
+			if !errors.Is(err, errDivisionByZero) {
+				t.Errorf("Expected division by zero error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestEvalModulo(t *testing.T) {
 	tests := []struct {
-		name  string
 		input string
 		want  Val
 	}{
-		{
-			name: "pcall-error",
-			input: `
-				{
-					let f(): error(1)
-					let p: pcall(f)
-					r: if p.err then p.value else error('expected p.err to be true')
-				}.r
-			`,
-			want: IntVal(1),
-		},
-		{
-			name: "pcall-noerror",
-			input: `
-				{
-					let f(x): x + 1
-					let p: pcall(f, 1)
-					r: if p.err then error('no error expected') else p.value
-				}.r
-			`,
-			want: IntVal(2),
-		},
-		{
-			name: "pcall-error-propagate",
-			input: `
-				{
-					let f(x): if x < 0 then error('negative') else x * x
-					let g(x): f(x) + 2
-					let p: pcall(g, -1)
-					r: if p.err then p.value else error('expected p.err to be true')
-				}.r
-			`,
-			want: StringVal("negative"),
-		},
+		{input: "7 % 3", want: IntVal(1)},
+		{input: "-7 % 3", want: IntVal(-1)},
+		{input: "1 + 7 % 4 * 2", want: IntVal(7)},
+		// Division by zero is only an error for ints.
+		{input: "1.0 / 0.0 > 1e300", want: BoolVal(true)},
 	}
 	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvalIn(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "2 in [1, 2, 3]", want: BoolVal(true)},
+		{input: "4 in [1, 2, 3]", want: BoolVal(false)},
+		{input: "1 in []", want: BoolVal(false)},
+		{input: "'a' in ['a', 'b']", want: BoolVal(true)},
+		// Uses structural equality.
+		{input: "{x: 1} in [{x: 2}, {x: 1}]", want: BoolVal(true)},
+		{input: "[1, 2] in [[1], [1, 2]]", want: BoolVal(true)},
+		{input: "1.0 in [1]", want: BoolVal(false)},
+		{input: "'ell' in 'hello'", want: BoolVal(true)},
+		{input: "'' in 'hello'", want: BoolVal(true)},
+		{input: "'xyz' in 'hello'", want: BoolVal(false)},
+		{input: "'x' in {x: 1}", want: BoolVal(true)},
+		{input: "'y' in {x: 1}", want: BoolVal(false)},
+		{input: "!('y' in {x: 1}) && 1 in [1]", want: BoolVal(true)},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
 			e, err := parse(test.input)
 			if err != nil {
 				t.Fatalf("Cannot parse expression: %s", err)
@@ -796,3 +2514,59 @@ func TestEvalErrorPcall(t *testing.T) {
 		})
 	}
 }
+
+func TestEvalPipe(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "'a,b' |> split(',')", want: "split('a,b', ',')"},
+		{input: "'a,b' |> split(',') |> len", want: "len(split('a,b', ','))"},
+		{input: "2 |> take([1, 2, 3]) |> len()", want: "len(take(2, [1, 2, 3]))"},
+		{input: "'abc' |> func(s) { s + s }", want: "'abcabc'"},
+		{input: "3 |> func(x, y) { x - y }(1)", want: "2"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			got, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			w, err := parse(test.want)
+			if err != nil {
+				t.Fatalf("Cannot parse expected expression: %s", err)
+			}
+			want, err := Eval(w, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate expected expression: %s", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Value mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvalInError(t *testing.T) {
+	tests := []string{
+		"1 in 'abc'",
+		"1 in {x: 1}",
+		"1 in 2",
+		"'a' in nil",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			if got, err := Eval(e, GlobalCtx()); err == nil {
+				t.Errorf("Expected error, got %v", got)
+			}
+		})
+	}
+}
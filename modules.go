@@ -1,30 +1,50 @@
 package gokonfi
 
 import (
+	"embed"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
 )
 
 const (
 	konfiFileExtension = ".konfi"
 	konfiPathEnv       = "KONFIPATH"
+	// Prefix of the (pseudo) filenames of standard library modules.
+	stdlibPrefix = "<stdlib>/"
 )
 
+// Standard library modules, embedded in the binary.
+//
+//go:embed stdlib/*.konfi
+var stdlibFS embed.FS
+
 // LoadModule loads a module specified by a file path or module name.
 //
 // A module name gets resolved to a filename by checking for files of the
 // given name (with konfiFileExtension appended) in ctx's current working directory
-// and directories specified in konfiPathEnv.
+// and directories specified in konfiPathEnv, separated by [os.PathListSeparator].
+//
+// Standard library modules such as "std" are embedded in the binary
+// and take precedence over files of the same name.
 //
 // The module gets evaluated in the given ctx.
 //
 // If the module is loaded successfully, it is stored in ctx.
 func LoadModule(name string, ctx *Ctx) (*loadedModule, error) {
-	filename, ok := fileForModule(name, ctx.cwd())
+	filename, ok := stdlibModule(name)
+	var searched []string
 	if !ok {
-		return nil, fmt.Errorf("LoadModule: module %q not found in %q or %s", name, ctx.cwd(), konfiPathEnv)
+		filename, searched, ok = fileForModule(name, ctx.cwd())
+	}
+	if !ok {
+		if len(searched) == 0 {
+			return nil, fmt.Errorf("LoadModule: module %q not found", name)
+		}
+		return nil, fmt.Errorf("LoadModule: module %q not found, searched directories: %s", name, strings.Join(searched, ", "))
 	}
 	// Check if module has already been loaded.
 	if m := ctx.LookupModule(filename); m != nil {
@@ -32,16 +52,17 @@ func LoadModule(name string, ctx *Ctx) (*loadedModule, error) {
 	}
 	// Check for load dependency cycle.
 	if ctx.isActiveFile(filename) {
-		return nil, fmt.Errorf("LoadModule: load cycle detected while loading %q", filename)
+		chain := append(append([]string(nil), ctx.global.filestack...), filename)
+		return nil, fmt.Errorf("LoadModule: load cycle detected: %s", strings.Join(chain, " -> "))
 	}
 	// Read and parse file.
-	data, err := os.ReadFile(filename)
+	data, err := readModuleFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("LoadModule: error reading module file: %w", err)
 	}
 	input := string(data)
-	file := ctx.addFile(filename, len(input))
-	mod, err := ParseModule(input, file)
+	file := ctx.addFile(filename, input)
+	mod, err := parseModuleWith(input, file, ctx.global.comments)
 	if err != nil {
 		return nil, chainError(err, "LoadModule: failed to parse module")
 	}
@@ -56,30 +77,106 @@ func LoadModule(name string, ctx *Ctx) (*loadedModule, error) {
 	return m, nil
 }
 
+// LoadModuleReader loads a module whose source code is read from r.
+//
+// The given name identifies the module in error messages, e.g. "<stdin>".
+// It is not used to locate files, so modules loaded by this module are
+// resolved relative to the current working directory.
+//
+// The module gets evaluated in the given ctx.
+func LoadModuleReader(name string, r io.Reader, ctx *Ctx) (*loadedModule, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("LoadModuleReader: error reading module: %w", err)
+	}
+	input := string(data)
+	file := ctx.addFile(name, input)
+	mod, err := parseModuleWith(input, file, ctx.global.comments)
+	if err != nil {
+		return nil, chainError(err, "LoadModuleReader: failed to parse module")
+	}
+	m, err := EvalModule(mod, ctx)
+	if err != nil {
+		return nil, chainError(err, "LoadModuleReader: failed to evaluate module")
+	}
+	ctx.storeModule(m)
+	return m, nil
+}
+
+// EvalString parses src as a module, evaluates it in a new global context,
+// and returns the module's body. Modules without a body evaluate to nil.
+func EvalString(src string) (Val, error) {
+	return EvalStringCtx(src, GlobalCtx())
+}
+
+// EvalStringCtx is like EvalString, but evaluates the module in the given ctx.
+// Variables stored in ctx can be used as free variables in src.
+func EvalStringCtx(src string, ctx *Ctx) (Val, error) {
+	const name = "<string>"
+	file := ctx.addFile(name, src)
+	mod, err := parseModuleWith(src, file, ctx.global.comments)
+	if err != nil {
+		return nil, chainError(err, "EvalString: failed to parse module")
+	}
+	m, err := EvalModule(mod, ctx)
+	if err != nil {
+		return nil, chainError(err, "EvalString: failed to evaluate module")
+	}
+	return m.Body(), nil
+}
+
+// stdlibModule returns the (pseudo) filename of the standard library module
+// of the given name. It returns false if there is no such module.
+func stdlibModule(name string) (string, bool) {
+	if strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+	filename := name
+	if !strings.HasSuffix(filename, konfiFileExtension) {
+		filename = filename + konfiFileExtension
+	}
+	if _, err := fs.Stat(stdlibFS, "stdlib/"+filename); err != nil {
+		return "", false
+	}
+	return stdlibPrefix + filename, true
+}
+
+// readModuleFile reads the contents of the given module file,
+// which can be a file on disk or a standard library module.
+func readModuleFile(filename string) ([]byte, error) {
+	if strings.HasPrefix(filename, stdlibPrefix) {
+		return stdlibFS.ReadFile("stdlib/" + strings.TrimPrefix(filename, stdlibPrefix))
+	}
+	return os.ReadFile(filename)
+}
+
 // fileForModule translates a module name as specified in e.g. load('mymodule')
 // to its file path. Looks for a matching file in cwd and [konfiPathEnv].
-func fileForModule(name string, cwd string) (string, bool) {
+// It also returns the directories that were searched, in search order.
+func fileForModule(name string, cwd string) (string, []string, bool) {
 	filename := name
 	if !strings.HasSuffix(filename, konfiFileExtension) {
 		filename = filename + konfiFileExtension
 	}
-	if path.IsAbs(filename) {
+	if filepath.IsAbs(filename) {
 		if s, err := os.Stat(name); err == nil && !s.IsDir() {
-			return name, true
+			return name, nil, true
 		}
-		return "", false
+		return "", nil, false
 	}
 	// Relative path or module name: check in all configured directories.
 	kpath, ok := os.LookupEnv(konfiPathEnv)
 	dirs := []string{cwd}
 	if ok {
-		dirs = append(strings.Split(kpath, ":"), dirs...)
+		dirs = append(filepath.SplitList(kpath), dirs...)
 	}
+	var searched []string
 	for i := len(dirs) - 1; i >= 0; i-- {
-		p := path.Join(dirs[i], filename)
+		searched = append(searched, dirs[i])
+		p := filepath.Join(dirs[i], filename)
 		if s, err := os.Stat(p); err == nil && !s.IsDir() {
-			return p, true
+			return p, searched, true
 		}
 	}
-	return "", false
+	return "", searched, false
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -52,7 +53,7 @@ func TestLoadModuleKonfipath(t *testing.T) {
 	d1 := t.TempDir()
 	d2 := t.TempDir() // Contains the loaded module.
 	d3 := t.TempDir() // Empty, but added to KONFIPATH.
-	os.Setenv(konfiPathEnv, fmt.Sprintf("%s:%s", d2, d3))
+	os.Setenv(konfiPathEnv, strings.Join([]string{d2, d3}, string(os.PathListSeparator)))
 	// Write modules to disk.
 	rootPath := path.Join(d1, "root.konfi")
 	rootModule := []byte(`
@@ -80,6 +81,28 @@ func TestLoadModuleKonfipath(t *testing.T) {
 	}
 }
 
+func TestLoadModuleKonfipathSecondEntry(t *testing.T) {
+	// load('util') should find modules in any KONFIPATH entry, separated by the OS path list separator.
+	if testing.Short() {
+		// Don't run tests writing to disk in -short mode.
+		return
+	}
+	d1 := t.TempDir()
+	d2 := t.TempDir() // Empty, but added to KONFIPATH.
+	d3 := t.TempDir() // Contains the loaded module.
+	t.Setenv(konfiPathEnv, strings.Join([]string{d2, d3}, string(os.PathListSeparator)))
+	rootPath := filepath.Join(d1, "root.konfi")
+	os.WriteFile(rootPath, []byte("load('util').body.one"), 0644)
+	os.WriteFile(filepath.Join(d3, "util.konfi"), []byte("{ one: 1 }"), 0644)
+	m, err := LoadModule(rootPath, GlobalCtx())
+	if err != nil {
+		t.Fatalf("failed to load module: %s", err)
+	}
+	if m.body != IntVal(1) {
+		t.Errorf("want 1, got: %v", m.body)
+	}
+}
+
 func TestLoadModuleSubdir(t *testing.T) {
 	// load('sub/util') should work.
 	if testing.Short() {
@@ -116,6 +139,112 @@ func TestLoadModuleSubdir(t *testing.T) {
 	}
 }
 
+func TestLoadModuleSelective(t *testing.T) {
+	if testing.Short() {
+		// Don't run tests writing to disk in -short mode.
+		return
+	}
+	d := t.TempDir()
+	rootPath := path.Join(d, "root.konfi")
+	rootModule := []byte(`
+	{
+		let u: load('util', ['foo', 'bar'])
+		x: u.foo + u.bar
+		y: has(u, 'baz')
+	}
+	`)
+	os.WriteFile(rootPath, rootModule, 0644)
+	utilPath := path.Join(d, "util.konfi")
+	utilModule := []byte(`
+		pub let foo: 1
+		pub let bar: 2
+		pub let baz: 3
+	`)
+	os.WriteFile(utilPath, utilModule, 0644)
+	m, err := LoadModule(rootPath, GlobalCtx())
+	if err != nil {
+		t.Fatalf("failed to load module: %s", err)
+	}
+	r, ok := m.body.(*RecVal)
+	if !ok {
+		t.Fatalf("expected *RecVal, got %T", m.body)
+	}
+	if got := r.Fields["x"]; got != IntVal(3) {
+		t.Errorf("want 3, got: %v", got)
+	}
+	if got := r.Fields["y"]; got != BoolVal(false) {
+		t.Errorf("want false, got: %v", got)
+	}
+}
+
+func TestLoadModuleSelectiveError(t *testing.T) {
+	if testing.Short() {
+		// Don't run tests writing to disk in -short mode.
+		return
+	}
+	d := t.TempDir()
+	utilPath := path.Join(d, "util.konfi")
+	os.WriteFile(utilPath, []byte("pub let foo: 1"), 0644)
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "load('util', ['foo', 'missing'])", want: `no public declaration "missing"`},
+		{input: "load('util', 'foo')", want: "must be a list"},
+		{input: "load('util', [1])", want: "list of strings"},
+		{input: "load('util', ['foo'], 1)", want: "expected 1 or 2 arguments"},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			rootPath := path.Join(d, fmt.Sprintf("root%d.konfi", i))
+			os.WriteFile(rootPath, []byte(test.input), 0644)
+			_, err := LoadModule(rootPath, GlobalCtx())
+			if err == nil {
+				t.Fatal("Expected error, got none")
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Expected error containing %q, got %q", test.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadStdlib(t *testing.T) {
+	t.Setenv(konfiPathEnv, "")
+	tests := []struct {
+		input string
+		want  Val
+	}{
+		{input: "load('std').capitalize('hello')", want: StringVal("Hello")},
+		{input: "load('std').capitalize('éa')", want: StringVal("Éa")},
+		{input: "load('std').capitalize('')", want: StringVal("")},
+		{input: "load('std').repeat_str('ab', 3)", want: StringVal("ababab")},
+		{input: "load('std').repeat_str('ab', 0)", want: StringVal("")},
+		{input: "load('std').is_blank(' \\t')", want: BoolVal(true)},
+		{input: "load('std').map(func (x) { x * 2 }, [1, 2])", want: ListVal{Elements: []Val{IntVal(2), IntVal(4)}}},
+		{input: "load('std').filter(func (x) { x > 1 }, [1, 2, 3])", want: ListVal{Elements: []Val{IntVal(2), IntVal(3)}}},
+		{input: "load('std').reverse([1, 2, 3])", want: ListVal{Elements: []Val{IntVal(3), IntVal(2), IntVal(1)}}},
+		{input: "load('std').first([1, 2, 3])", want: IntVal(1)},
+		{input: "load('std').last([1, 2, 3])", want: IntVal(3)},
+		{input: "load('std').first([])", want: NilVal{}},
+		{input: "load('std').range(3)", want: ListVal{Elements: []Val{IntVal(0), IntVal(1), IntVal(2)}}},
+		// Builtins are not duplicated by std.
+		{input: "flatmap(func (f) { [has(load('std'), f)] }, ['lines', 'concat', 'all', 'any', 'repeat'])", want: ListVal{Elements: []Val{BoolVal(false), BoolVal(false), BoolVal(false), BoolVal(false), BoolVal(false)}}},
+		{input: "load('std', ['range']).range(0)", want: ListVal{Elements: []Val{}}},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			m, err := evalSelfContainedModule(test.input, GlobalCtx())
+			if err != nil {
+				t.Fatalf("failed to load module: %s", err)
+			}
+			if !m.body.Equal(test.want) {
+				t.Errorf("want %v, got %v", test.want, m.body)
+			}
+		})
+	}
+}
+
 func TestLoadModuleNotFound(t *testing.T) {
 	if testing.Short() {
 		// Don't run tests writing to disk in -short mode.
@@ -141,6 +270,28 @@ func TestLoadModuleNotFound(t *testing.T) {
 	}
 }
 
+func TestLoadModuleNotFoundSearchedDirs(t *testing.T) {
+	if testing.Short() {
+		// Don't run tests writing to disk in -short mode.
+		return
+	}
+	d1 := t.TempDir()
+	d2 := t.TempDir()
+	d3 := t.TempDir()
+	t.Setenv(konfiPathEnv, strings.Join([]string{d2, d3}, string(os.PathListSeparator)))
+	rootPath := filepath.Join(d1, "root.konfi")
+	os.WriteFile(rootPath, []byte("load('doesnotexist')"), 0644)
+	m, err := LoadModule(rootPath, GlobalCtx())
+	if err == nil {
+		t.Fatalf("wanted error, got: %v", m)
+	}
+	// The module's own directory is searched first, then KONFIPATH entries.
+	want := fmt.Sprintf("searched directories: %s, %s, %s", d1, d3, d2)
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("wanted error containing %q, got: %s", want, err)
+	}
+}
+
 func TestLoadModuleCycle(t *testing.T) {
 	// Cycle detection for three modules trying to load each other.
 	if testing.Short() {
@@ -166,6 +317,10 @@ func TestLoadModuleCycle(t *testing.T) {
 	if !strings.Contains(err.Error(), "cycle") {
 		t.Errorf("expected 'cycle' error, got: %s", err)
 	}
+	wantChain := strings.Join([]string{m1Path, m2Path, m3Path, m1Path}, " -> ")
+	if !strings.Contains(err.Error(), wantChain) {
+		t.Errorf("expected error containing load chain %q, got: %s", wantChain, err)
+	}
 }
 
 func TestLoadModuleSyntaxError(t *testing.T) {
@@ -236,3 +391,152 @@ func TestLoadModuleNoBody(t *testing.T) {
 		t.Errorf("type foo not declared")
 	}
 }
+
+func TestLoadedModuleCall(t *testing.T) {
+	input := `
+		let greeting: 'Hello'
+		pub func greet(name) { greeting + ', ' + name }
+		pub func add(x, y) { x + y }
+		pub let strlen: len
+		pub let answer: 42
+	`
+	m, err := evalSelfContainedModule(input, GlobalCtx())
+	if err != nil {
+		t.Fatalf("failed to load module: %s", err)
+	}
+	tests := []struct {
+		name string
+		args []Val
+		want Val
+	}{
+		{name: "greet", args: []Val{StringVal("konfi")}, want: StringVal("Hello, konfi")},
+		{name: "add", args: []Val{IntVal(1), IntVal(2)}, want: IntVal(3)},
+		{name: "strlen", args: []Val{StringVal("abc")}, want: IntVal(3)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := m.Call(test.name, test.args...)
+			if err != nil {
+				t.Fatalf("Call failed: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadedModuleCallError(t *testing.T) {
+	input := `
+		pub func add(x, y) { x + y }
+		pub let answer: 42
+		let hidden(x): x
+	`
+	m, err := evalSelfContainedModule(input, GlobalCtx())
+	if err != nil {
+		t.Fatalf("failed to load module: %s", err)
+	}
+	tests := []struct {
+		name string
+		args []Val
+		want string
+	}{
+		{name: "unknown", want: "no public declaration"},
+		{name: "hidden", args: []Val{IntVal(1)}, want: "no public declaration"},
+		{name: "answer", want: "not callable"},
+		{name: "add", args: []Val{IntVal(1)}, want: "wrong number of arguments"},
+		{name: "add", args: []Val{IntVal(1), StringVal("a")}, want: "incompatible types"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := m.Call(test.name, test.args...)
+			if err == nil {
+				t.Fatalf("Wanted error, got %v", got)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Wanted error containing %q, got %q", test.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadModuleReader(t *testing.T) {
+	ctx := GlobalCtx()
+	m, err := LoadModuleReader("<stdin>", strings.NewReader(`pub let x: 7 {y: x + 1}`), ctx)
+	if err != nil {
+		t.Fatalf("failed to load module: %s", err)
+	}
+	r, ok := m.Body().(*RecVal)
+	if !ok {
+		t.Fatalf("expected *RecVal body, got %T", m.Body())
+	}
+	if got := r.Fields["y"]; got != IntVal(8) {
+		t.Errorf("want y == 8, got %v", got)
+	}
+	if ctx.LookupModule("<stdin>") != m {
+		t.Errorf("module was not stored in ctx")
+	}
+}
+
+func TestEvalString(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Val
+	}{
+		{name: "expr", input: "1 + 2", want: IntVal(3)},
+		{name: "rec", input: "{a: 'x' + 'y'}", want: NewRecWithFields(map[string]Val{"a": StringVal("xy")})},
+		{
+			name: "module",
+			input: `
+				pub let x: 7
+				let f(y): y * 2
+				pub type point {x: int y: int}
+				{y: f(x) z: x}`,
+			want: NewRecWithFields(map[string]Val{"y": IntVal(14), "z": IntVal(7)}),
+		},
+		{name: "noBody", input: "pub let x: 7", want: NilVal{}},
+		{name: "empty", input: "", want: NilVal{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := EvalString(test.input)
+			if err != nil {
+				t.Fatalf("EvalString failed: %s", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestEvalStringCtx(t *testing.T) {
+	ctx := GlobalCtx()
+	ctx.Store("env", StringVal("prod"))
+	got, err := EvalStringCtx("let suffix: '-1' {host: env + suffix}", ctx)
+	if err != nil {
+		t.Fatalf("EvalStringCtx failed: %s", err)
+	}
+	want := NewRecWithFields(map[string]Val{"host": StringVal("prod-1")})
+	if !got.Equal(want) {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+}
+
+func TestEvalStringError(t *testing.T) {
+	tests := []string{
+		"1 +",
+		"{a: 1",
+		"x",
+		"pub let x: 1 pub let x: 2",
+		"1 + 'a'",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if got, err := EvalString(input); err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
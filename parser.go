@@ -3,6 +3,7 @@ package gokonfi
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -12,12 +13,36 @@ import (
 type Parser struct {
 	tokens  []token.Token
 	current int
+	// Leading comments of tokens, keyed by their index in tokens.
+	// Consecutive comment lines are joined by newlines.
+	comments map[int]string
+	// noIn disables "in" as a binary operator while parsing the value
+	// of a let expression, so that "let x: y in z" is not parsed as "let x: (y in z)".
+	noIn bool
 }
 
 // Returns a new Parser that will process tokens, which will typically
-// have been generated using a [Scanner].
+// have been generated using a [Scanner]. Comment tokens are not parsed,
+// but attached to the record fields that they precede.
 func NewParser(tokens []token.Token) Parser {
-	return Parser{tokens: tokens, current: 0}
+	var ts []token.Token
+	var comments map[int]string
+	var pending []string
+	for _, t := range tokens {
+		if t.Typ == token.Comment {
+			pending = append(pending, t.Val)
+			continue
+		}
+		if len(pending) > 0 {
+			if comments == nil {
+				comments = make(map[int]string)
+			}
+			comments[len(ts)] = strings.Join(pending, "\n")
+			pending = nil
+		}
+		ts = append(ts, t)
+	}
+	return Parser{tokens: ts, current: 0, comments: comments}
 }
 
 // ParseError is the error type returned by [Parser] methods.
@@ -34,11 +59,21 @@ func (e *ParseError) Pos() token.Pos {
 	return e.tok.Pos
 }
 
+// Returns the end position of the token at which the ParseError occurred.
+func (e *ParseError) End() token.Pos {
+	return e.tok.End
+}
+
+func (e *ParseError) Kind() ErrorKind {
+	return KindSyntax
+}
+
 // Modules and module-level declarations.
 
 type Module struct {
 	Name      string              // Name of this module. Outside of tests this is always its file path.
 	UnitDecls map[string]UnitDecl // Exported unit type declarations.
+	TypeDecls map[string]TypeDecl // Exported record and alias type declarations.
 	PubDecls  map[string]PubDecl  // Exported functions and templates (which are just functions).
 	LetVars   map[string]LetVar   // Local declarations.
 	Body      Expr                // Optional module body.
@@ -56,15 +91,35 @@ type UnitDecl struct {
 	DeclPos   token.Pos // Start of the declaration.
 }
 
+// TypeDecl declares a record type. Each field of Fields names the type that
+// the corresponding field of a record must have, e.g.
+//
+//	pub type Server { host: string port: int }
+type TypeDecl struct {
+	Name    string
+	Fields  *RecExpr   // Fields of record types. Nil for alias types.
+	Base    *NamedType // Base type of alias types, e.g. int in "type port: int".
+	Where   Expr       // Optional predicate of alias types that values must satisfy.
+	DeclPos token.Pos  // Start of the declaration.
+}
+
 func NewModule(name string) *Module {
 	return &Module{
 		Name:      name,
 		PubDecls:  make(map[string]PubDecl),
 		LetVars:   make(map[string]LetVar),
 		UnitDecls: make(map[string]UnitDecl),
+		TypeDecls: make(map[string]TypeDecl),
 	}
 }
 
+// hasTypeDecl reports whether m declares a unit or record type of the given name.
+func (m *Module) hasTypeDecl(name string) bool {
+	_, isUnit := m.UnitDecls[name]
+	_, isType := m.TypeDecls[name]
+	return isUnit || isType
+}
+
 // Expression nodes.
 
 type Node interface {
@@ -90,6 +145,28 @@ type UnaryExpr struct {
 	Op    token.TokenType
 }
 
+// let x: expr in body
+type LetExpr struct {
+	Var    LetVar
+	X      Expr
+	LetPos token.Pos
+}
+
+// match x { 1 => "one", 2 => "two", _ => "many" }
+type MatchExpr struct {
+	X        Expr
+	Arms     []MatchArm
+	MatchPos token.Pos
+	MatchEnd token.Pos
+}
+
+// A single "pattern => expr" arm of a match expression.
+// Pattern is nil for the default arm "_".
+type MatchArm struct {
+	Pattern Expr
+	X       Expr
+}
+
 // if then else
 type ConditionalExpr struct {
 	Cond Expr
@@ -101,6 +178,7 @@ type ConditionalExpr struct {
 type FuncExpr struct {
 	Name    string // optional, "" if not defined.
 	Params  []AnnotatedIdent
+	Result  TypeAnnotation // optional, nil if not defined.
 	FuncPos token.Pos
 	FuncEnd token.Pos
 	Body    Expr
@@ -129,12 +207,17 @@ type AnnotatedIdent struct {
 	Name    string
 	NamePos token.Pos
 	T       TypeAnnotation
+	Default Expr // Optional default value. Only used for function parameters.
+	// Variadic is true for a final function parameter declared as "rest...",
+	// which binds to a list of all remaining arguments.
+	Variadic bool
 }
 
 // f: expr
 type RecField struct {
 	AnnotatedIdent
-	X Expr
+	X   Expr
+	Doc string // Leading comment lines, if comments were kept by the scanner.
 }
 
 // let x: expr
@@ -146,10 +229,11 @@ type LetVar struct {
 
 // { a: 1 b: "two" }
 type RecExpr struct {
-	LetVars map[string]LetVar
-	Fields  map[string]RecField
-	RecPos  token.Pos
-	RecEnd  token.Pos
+	LetVars    map[string]LetVar
+	Fields     map[string]RecField
+	FieldOrder []string // Names of Fields in declaration order.
+	RecPos     token.Pos
+	RecEnd     token.Pos
 }
 
 // [1, 2, 3]
@@ -236,6 +320,36 @@ func (e *RecExpr) Pos() token.Pos { return e.RecPos }
 func (e *RecExpr) End() token.Pos { return e.RecPos }
 func (e *RecExpr) exprNode()      {}
 
+// fieldNames returns the names of e's fields in declaration order.
+// If e has no FieldOrder (e.g. because it was not created by the parser),
+// the fields are ordered by name.
+func (e *RecExpr) fieldNames() []string {
+	if len(e.FieldOrder) == len(e.Fields) {
+		return e.FieldOrder
+	}
+	return sortedKeys(e.Fields)
+}
+
+// letVarsInOrder returns the let bindings in letVars in declaration order.
+func letVarsInOrder(letVars map[string]LetVar) []LetVar {
+	lvs := make([]LetVar, 0, len(letVars))
+	for _, lv := range letVars {
+		lvs = append(lvs, lv)
+	}
+	sort.Slice(lvs, func(i, j int) bool { return lvs[i].NamePos < lvs[j].NamePos })
+	return lvs
+}
+
+// pubDeclsInOrder returns the declarations in pubDecls in declaration order.
+func pubDeclsInOrder(pubDecls map[string]PubDecl) []PubDecl {
+	ds := make([]PubDecl, 0, len(pubDecls))
+	for _, d := range pubDecls {
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].DeclPos < ds[j].DeclPos })
+	return ds
+}
+
 func (e *ListExpr) Pos() token.Pos { return e.ListPos }
 func (e *ListExpr) End() token.Pos { return e.ListEnd }
 func (e *ListExpr) exprNode()      {}
@@ -244,6 +358,14 @@ func (e *TypedExpr) Pos() token.Pos { return e.X.Pos() }
 func (e *TypedExpr) End() token.Pos { return e.T.End() }
 func (e *TypedExpr) exprNode()      {}
 
+func (e *LetExpr) Pos() token.Pos { return e.LetPos }
+func (e *LetExpr) End() token.Pos { return e.X.End() }
+func (e *LetExpr) exprNode()      {}
+
+func (e *MatchExpr) Pos() token.Pos { return e.MatchPos }
+func (e *MatchExpr) End() token.Pos { return e.MatchEnd }
+func (e *MatchExpr) exprNode()      {}
+
 func (e *ConditionalExpr) Pos() token.Pos { return e.Cond.Pos() }
 func (e *ConditionalExpr) End() token.Pos { return e.Y.End() }
 func (e *ConditionalExpr) exprNode()      {}
@@ -256,6 +378,11 @@ func (e *FuncExpr) Pos() token.Pos { return e.FuncPos }
 func (e *FuncExpr) End() token.Pos { return e.FuncEnd }
 func (e *FuncExpr) exprNode()      {}
 
+// Variadic reports whether the last parameter of e collects all remaining arguments.
+func (e *FuncExpr) Variadic() bool {
+	return len(e.Params) > 0 && e.Params[len(e.Params)-1].Variadic
+}
+
 // Module-level declarations.
 func (d *PubDecl) Pos() token.Pos { return d.DeclPos }
 func (d *PubDecl) End() token.Pos { return d.X.End() }
@@ -274,6 +401,26 @@ type NamedType struct {
 	NameEnd token.Pos
 }
 
+// [int], [[string]]
+type ListType struct {
+	Elem    TypeAnnotation
+	ListPos token.Pos
+	ListEnd token.Pos
+}
+
+// string?
+type OptionalType struct {
+	Elem        TypeAnnotation
+	QuestionEnd token.Pos
+}
+
+// (int | string)
+type UnionType struct {
+	Members  []TypeAnnotation
+	UnionPos token.Pos
+	UnionEnd token.Pos
+}
+
 // Implementations of TypeAnnotation.
 
 func (t *NamedType) TypeId() string      { return t.Name }
@@ -281,6 +428,39 @@ func (t *NamedType) typeAnnotationImpl() {}
 func (t *NamedType) Pos() token.Pos      { return t.NamePos }
 func (t *NamedType) End() token.Pos      { return t.NameEnd }
 
+func (t *ListType) TypeId() string      { return "[" + t.Elem.TypeId() + "]" }
+func (t *ListType) typeAnnotationImpl() {}
+func (t *ListType) Pos() token.Pos      { return t.ListPos }
+func (t *ListType) End() token.Pos      { return t.ListEnd }
+
+func (t *OptionalType) TypeId() string      { return t.Elem.TypeId() + "?" }
+func (t *OptionalType) typeAnnotationImpl() {}
+func (t *OptionalType) Pos() token.Pos      { return t.Elem.Pos() }
+func (t *OptionalType) End() token.Pos      { return t.QuestionEnd }
+
+func (t *UnionType) TypeId() string {
+	ids := make([]string, len(t.Members))
+	for i, m := range t.Members {
+		ids[i] = m.TypeId()
+	}
+	return "(" + strings.Join(ids, " | ") + ")"
+}
+func (t *UnionType) typeAnnotationImpl() {}
+func (t *UnionType) Pos() token.Pos      { return t.UnionPos }
+func (t *UnionType) End() token.Pos      { return t.UnionEnd }
+
+// elemType returns the innermost element type of (possibly nested) list types,
+// or t itself if it is not a list type.
+func elemType(t TypeAnnotation) TypeAnnotation {
+	for {
+		lt, ok := t.(*ListType)
+		if !ok {
+			return t
+		}
+		t = lt.Elem
+	}
+}
+
 // Parser methods.
 
 func (p *Parser) advance() token.Token {
@@ -337,7 +517,17 @@ func (p *Parser) AtEnd() bool {
 }
 
 func ParseModule(input string, file *token.File) (*Module, error) {
-	ts, err := NewScanner(input, file).ScanAll()
+	return parseModuleWith(input, file, false)
+}
+
+// parseModuleWith is like ParseModule. If keepComments is true, leading comments
+// of record fields are retained in their RecField.Doc.
+func parseModuleWith(input string, file *token.File, keepComments bool) (*Module, error) {
+	s := NewScanner(input, file)
+	if keepComments {
+		s.KeepComments()
+	}
+	ts, err := s.ScanAll()
 	if err != nil {
 		return nil, err
 	}
@@ -360,10 +550,19 @@ Loop:
 				if err != nil {
 					return nil, err
 				}
-				if _, found := m.UnitDecls[ud.Name]; found {
+				if m.hasTypeDecl(ud.Name) {
 					return nil, p.failat(t, "duplicate unit declaration %q", ud.Name)
 				}
 				m.UnitDecls[ud.Name] = ud
+			} else if p.peek().Typ == token.Type {
+				td, err := p.typeDecl()
+				if err != nil {
+					return nil, err
+				}
+				if m.hasTypeDecl(td.Name) {
+					return nil, p.failat(t, "duplicate type declaration %q", td.Name)
+				}
+				m.TypeDecls[td.Name] = td
 			} else {
 				fd, err := p.pubDecl()
 				if err != nil {
@@ -437,6 +636,57 @@ func (p *Parser) unitDecl() (UnitDecl, error) {
 	return UnitDecl{Name: name, Multiples: mults, DeclPos: start}, nil
 }
 
+func (p *Parser) typeDecl() (TypeDecl, error) {
+	start := p.peek().Pos
+	if err := p.expect(token.Type, "typeDecl"); err != nil {
+		return TypeDecl{}, err
+	}
+	t := p.advance()
+	if t.Typ != token.Ident {
+		return TypeDecl{}, p.failat(t, "expected identifier (type name), got %s", t.Typ)
+	}
+	if p.match(token.Colon) {
+		return p.aliasTypeDecl(t, start)
+	}
+	r, err := p.record()
+	if err != nil {
+		return TypeDecl{}, err
+	}
+	if len(r.LetVars) > 0 {
+		return TypeDecl{}, p.failat(t, "type declaration must not have let bindings")
+	}
+	for _, f := range r.fieldNames() {
+		fd := r.Fields[f]
+		if fd.T != nil {
+			return TypeDecl{}, p.failat(t, "type declaration field %s must not have a type annotation", f)
+		}
+		if _, ok := fd.X.(*VarExpr); !ok {
+			return TypeDecl{}, p.failat(t, "type declaration field %s must be a type name", f)
+		}
+	}
+	return TypeDecl{Name: t.Val, Fields: r, DeclPos: start}, nil
+}
+
+// aliasTypeDecl parses the remainder of an alias type declaration
+// like "type port: int where func (x) { x >= 0 }" after the colon.
+func (p *Parser) aliasTypeDecl(name token.Token, start token.Pos) (TypeDecl, error) {
+	ta, err := p.typeAnnotation()
+	if err != nil {
+		return TypeDecl{}, err
+	}
+	base, ok := ta.(*NamedType)
+	if !ok {
+		return TypeDecl{}, p.failat(name, "base type of %s must be a type name, got %s", name.Val, ta.TypeId())
+	}
+	var where Expr
+	if p.match(token.Where) {
+		if where, err = p.Expression(); err != nil {
+			return TypeDecl{}, err
+		}
+	}
+	return TypeDecl{Name: name.Val, Base: base, Where: where, DeclPos: start}, nil
+}
+
 func (p *Parser) pubDecl() (PubDecl, error) {
 	pub := p.previous()
 	if pub.Typ != token.Public {
@@ -468,12 +718,71 @@ func (p *Parser) pubDecl() (PubDecl, error) {
 		}
 		return PubDecl{Name: lv.Name, DeclPos: pub.Pos, X: lv.X}, nil
 	}
-	return PubDecl{}, p.failat(p.peek(), "expected func or template")
+	return PubDecl{}, p.failat(p.peek(), "expected let, func, or template")
 }
 
 // Parses an expression.
 func (p *Parser) Expression() (Expr, error) {
-	return p.conditional()
+	// Expressions in delimited contexts, e.g. in parentheses, can use "in" freely.
+	noIn := p.noIn
+	p.noIn = false
+	defer func() { p.noIn = noIn }()
+	return p.expression()
+}
+
+// expression     -> let_expr | pipe ;
+func (p *Parser) expression() (Expr, error) {
+	if p.peek().Typ == token.Let {
+		return p.letExpr()
+	}
+	return p.pipe()
+}
+
+// let_expr       -> let_binding "in" expression ;
+//
+// The body of a let expression extends as far as possible.
+func (p *Parser) letExpr() (Expr, error) {
+	letPos := p.peek().Pos
+	lv, err := p.letBinding(func() (Expr, error) {
+		noIn := p.noIn
+		p.noIn = true
+		defer func() { p.noIn = noIn }()
+		return p.expression()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(token.In, "let expression"); err != nil {
+		return nil, err
+	}
+	body, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &LetExpr{Var: *lv, X: body, LetPos: letPos}, nil
+}
+
+// pipe           -> conditional ( "|>" primary )* ;
+//
+// Pipes are desugared in the AST: x |> f(a, b) ==> f(x, a, b), and x |> f ==> f(x).
+func (p *Parser) pipe() (Expr, error) {
+	x, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	for p.match(token.Pipe) {
+		y, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := y.(*CallExpr); ok {
+			args := append([]Expr{x}, c.Args...)
+			x = &CallExpr{Func: c.Func, Args: args, ArgsEnd: c.ArgsEnd}
+		} else {
+			x = &CallExpr{Func: y, Args: []Expr{x}, ArgsEnd: y.End()}
+		}
+	}
+	return x, nil
 }
 
 func (p *Parser) conditional() (Expr, error) {
@@ -492,7 +801,8 @@ func (p *Parser) conditional() (Expr, error) {
 		if err = p.expect(token.Else, "conditional"); err != nil {
 			return nil, err
 		}
-		y, err := p.Expression()
+		// The else branch is not delimited, so it must respect p.noIn.
+		y, err := p.expression()
 		if err != nil {
 			return nil, err
 		}
@@ -535,13 +845,14 @@ func (p *Parser) logicalAnd() (Expr, error) {
 	return x, nil
 }
 
-// comparison     -> term ( ( "!=" | "==" | ">" | ">=" | "<" | "<=" ) term )* ;
+// comparison     -> term ( ( "!=" | "==" | ">" | ">=" | "<" | "<=" | "in" ) term )* ;
 func (p *Parser) comparison() (Expr, error) {
 	x, err := p.term()
 	if err != nil {
 		return nil, err
 	}
-	for p.match(token.NotEqual, token.Equal, token.GreaterThan, token.GreaterEq, token.LessThan, token.LessEq) {
+	for p.match(token.NotEqual, token.Equal, token.GreaterThan, token.GreaterEq, token.LessThan, token.LessEq) ||
+		!p.noIn && p.match(token.In) {
 		t := p.previous()
 		y, err := p.term()
 		if err != nil {
@@ -552,13 +863,13 @@ func (p *Parser) comparison() (Expr, error) {
 	return x, nil
 }
 
-// term           -> factor ( ( "-" | "+" | "|" | "^" | "@" ) factor )* ;
+// term           -> factor ( ( "-" | "+" | "^" | "@" ) factor )* ;
 func (p *Parser) term() (Expr, error) {
 	x, err := p.factor()
 	if err != nil {
 		return nil, err
 	}
-	for p.match(token.Minus, token.Plus, token.BitwiseOr, token.BitwiseXor, token.Merge) {
+	for p.match(token.Minus, token.Plus, token.BitwiseXor, token.Merge) {
 		t := p.previous()
 		y, err := p.factor()
 		if err != nil {
@@ -566,6 +877,10 @@ func (p *Parser) term() (Expr, error) {
 		}
 		x = &BinaryExpr{X: x, OpPos: t.Pos, Op: t.Typ, Y: y}
 	}
+	if p.peek().Typ == token.BitwiseOr {
+		// The scanner emits "|" for union types, but it is not a binary operator.
+		return nil, p.fail("'|' is only allowed in union type annotations")
+	}
 	return x, nil
 }
 
@@ -668,6 +983,10 @@ func (p *Parser) exprList(sep token.TokenType, close token.TokenType) ([]Expr, e
 	return nil, &ParseError{tok: p.previous(), msg: "reached end of input while parsing expression list"}
 }
 
+// identList parses a list of (function parameter) identifiers.
+// Identifiers can have a default value, as in (x, y: 10). Once an identifier
+// has a default value, all subsequent ones must have one, too.
+// The last identifier can be variadic, as in (x, rest...).
 func (p *Parser) identList(sep token.TokenType, close token.TokenType) ([]AnnotatedIdent, error) {
 	idents := []AnnotatedIdent{}
 	seen := make(map[string]bool)
@@ -675,18 +994,33 @@ func (p *Parser) identList(sep token.TokenType, close token.TokenType) ([]Annota
 		return idents, nil
 	}
 	for !p.AtEnd() {
+		nameTok := p.peek()
 		ident, err := p.annotatedIdent()
 		if err != nil {
 			return nil, err
 		}
+		if p.match(token.Ellipsis) {
+			ident.Variadic = true
+		} else if p.match(token.Colon) {
+			def, err := p.Expression()
+			if err != nil {
+				return nil, err
+			}
+			ident.Default = def
+		} else if len(idents) > 0 && idents[len(idents)-1].Default != nil {
+			return nil, p.failat(nameTok, "identifier without default value follows one with default value: %s", ident.Name)
+		}
 		if seen[ident.Name] {
-			return nil, p.failat(p.previous(), "duplicate identifier in identifier list: %s", ident.Name)
+			return nil, p.failat(nameTok, "duplicate identifier in identifier list: %s", ident.Name)
 		}
 		seen[ident.Name] = true
 		idents = append(idents, ident)
 		if p.match(close) {
 			return idents, nil
 		}
+		if ident.Variadic {
+			return nil, p.failat(nameTok, "variadic identifier must be the last one: %s", ident.Name)
+		}
 		if err := p.expect(sep, "identifier list"); err != nil {
 			return nil, err
 		}
@@ -738,6 +1072,7 @@ func (p *Parser) operand() (Expr, error) {
 		}
 		// Format strings are explicitly desugared in the AST:
 		// "prefix${expr}suffix" ==> "prefix" + str(expr) + "suffix"
+		// "prefix${expr:spec}suffix" ==> "prefix" + format("spec", expr) + "suffix"
 		plusArgs := make([]Expr, len(t.Fmt.Values))
 		for i, fmtValue := range t.Fmt.Values {
 			switch v := fmtValue.(type) {
@@ -757,6 +1092,14 @@ func (p *Parser) operand() (Expr, error) {
 				if !cp.AtEnd() {
 					return nil, &ParseError{tok: cp.peek(), msg: "remaining tokens in interpolated expression"}
 				}
+				if v.Spec != "" {
+					spec := &StrLiteral{Val: v.Spec, LiteralPos: LiteralPos{v.End, v.End}}
+					plusArgs[i] =
+						&CallExpr{
+							Func: &VarExpr{Name: "format", NamePos: v.Pos, NameEnd: v.Pos},
+							Args: []Expr{spec, fe}, ArgsEnd: v.End}
+					continue
+				}
 				plusArgs[i] =
 					&CallExpr{
 						Func: &VarExpr{Name: "str", NamePos: v.Pos, NameEnd: v.Pos},
@@ -794,10 +1137,57 @@ func (p *Parser) operand() (Expr, error) {
 	case p.peek().Typ == token.Template:
 		// Templates are syntactic sugar for functions returning records.
 		return p.template()
+	case p.peek().Typ == token.Match:
+		return p.matchExpr()
 	}
 	return nil, p.fail("unexpected token type %s for operand", p.peek().Typ)
 }
 
+// match_expr     -> "match" expression "{" ( match_arm ( "," match_arm )* ","? )? "}" ;
+// match_arm      -> ( "_" | expression ) "=>" expression ;
+func (p *Parser) matchExpr() (*MatchExpr, error) {
+	if err := p.expect(token.Match, "match"); err != nil {
+		return nil, err
+	}
+	matchPos := p.previous().Pos
+	x, err := p.Expression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(token.LeftBrace, "match"); err != nil {
+		return nil, err
+	}
+	var arms []MatchArm
+	for !p.match(token.RightBrace) {
+		if p.AtEnd() {
+			return nil, p.fail("reached end of input while parsing match expression")
+		}
+		if len(arms) > 0 && arms[len(arms)-1].Pattern == nil {
+			return nil, p.fail("default arm '_' must be the last arm of a match expression")
+		}
+		var pattern Expr
+		if t := p.peek(); t.Typ == token.Ident && t.Val == "_" {
+			p.advance()
+		} else if pattern, err = p.Expression(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(token.Arrow, "match"); err != nil {
+			return nil, err
+		}
+		arm, err := p.Expression()
+		if err != nil {
+			return nil, err
+		}
+		arms = append(arms, MatchArm{Pattern: pattern, X: arm})
+		if p.peek().Typ != token.RightBrace {
+			if err := p.expect(token.Comma, "match"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &MatchExpr{X: x, Arms: arms, MatchPos: matchPos, MatchEnd: p.previous().End}, nil
+}
+
 func (p *Parser) funk() (*FuncExpr, error) {
 	if err := p.expect(token.Func, "func"); err != nil {
 		return nil, err
@@ -815,6 +1205,10 @@ func (p *Parser) funk() (*FuncExpr, error) {
 	if err != nil {
 		return nil, err
 	}
+	result, err := p.resultType()
+	if err != nil {
+		return nil, err
+	}
 	if err = p.expect(token.LeftBrace, "func"); err != nil {
 		return nil, err
 	}
@@ -825,7 +1219,15 @@ func (p *Parser) funk() (*FuncExpr, error) {
 	if err = p.expect(token.RightBrace, "func"); err != nil {
 		return nil, err
 	}
-	return &FuncExpr{Name: name, Params: params, FuncPos: funcPos, FuncEnd: p.previous().End, Body: body}, nil
+	return &FuncExpr{Name: name, Params: params, Result: result, FuncPos: funcPos, FuncEnd: p.previous().End, Body: body}, nil
+}
+
+// resultType parses the optional result type annotation "->" <type> of a function.
+func (p *Parser) resultType() (TypeAnnotation, error) {
+	if !p.match(token.ThinArrow) {
+		return nil, nil
+	}
+	return p.typeAnnotation()
 }
 
 func (p *Parser) template() (*FuncExpr, error) {
@@ -859,10 +1261,11 @@ func (p *Parser) record() (*RecExpr, error) {
 	recPos := p.previous().Pos
 	letVars := make(map[string]LetVar)
 	fields := make(map[string]RecField)
+	var fieldOrder []string
 	seen := make(map[string]bool)
 	for !p.AtEnd() {
 		if p.match(token.RightBrace) {
-			return &RecExpr{LetVars: letVars, Fields: fields, RecPos: recPos, RecEnd: p.previous().End}, nil
+			return &RecExpr{LetVars: letVars, Fields: fields, FieldOrder: fieldOrder, RecPos: recPos, RecEnd: p.previous().End}, nil
 		}
 		fTok := p.peek()
 		if fTok.Typ == token.Let {
@@ -885,6 +1288,7 @@ func (p *Parser) record() (*RecExpr, error) {
 			}
 			seen[f.Name] = true
 			fields[f.Name] = *f
+			fieldOrder = append(fieldOrder, f.Name)
 		}
 	}
 	return nil, p.fail("reached end of input while parsing record")
@@ -892,7 +1296,7 @@ func (p *Parser) record() (*RecExpr, error) {
 
 // Can be one of
 // "let" <ident> ":" <expr>
-// "let" <ident> "(" <id_list> ")" ":" <expr>
+// "let" <ident> "(" <id_list> ")" ["->" <type>] ":" <expr>
 // "let" "template" <ident> "(" <id_list> ")" <record>
 //
 // Examples:
@@ -908,6 +1312,12 @@ func (p *Parser) record() (*RecExpr, error) {
 // <==>
 // let f: func (x, y) { { x: 7 } }
 func (p *Parser) letVar() (*LetVar, error) {
+	return p.letBinding(p.Expression)
+}
+
+// letBinding parses a let binding as described for letVar,
+// using value to parse the bound expression.
+func (p *Parser) letBinding(value func() (Expr, error)) (*LetVar, error) {
 	if err := p.expect(token.Let, "let"); err != nil {
 		return nil, err
 	}
@@ -920,21 +1330,25 @@ func (p *Parser) letVar() (*LetVar, error) {
 			if err != nil {
 				return nil, err
 			}
+			result, err := p.resultType()
+			if err != nil {
+				return nil, err
+			}
 			if err = p.expect(token.Colon, "func"); err != nil {
 				return nil, err
 			}
-			body, err := p.Expression()
+			body, err := value()
 			if err != nil {
 				return nil, err
 			}
-			f := &FuncExpr{Params: params, FuncPos: v.Pos, FuncEnd: body.End(), Body: body}
+			f := &FuncExpr{Params: params, Result: result, FuncPos: v.Pos, FuncEnd: body.End(), Body: body}
 			return &LetVar{Name: v.Val, NamePos: v.Pos, X: f}, nil
 		}
 		// Regular variable binding
 		if err := p.expect(token.Colon, "let"); err != nil {
 			return nil, err
 		}
-		expr, err := p.Expression()
+		expr, err := value()
 		if err != nil {
 			return nil, err
 		}
@@ -962,6 +1376,7 @@ func (p *Parser) letVar() (*LetVar, error) {
 }
 
 func (p *Parser) recordField() (*RecField, error) {
+	doc := p.comments[p.current]
 	v, err := p.annotatedIdent()
 	if err != nil {
 		return nil, err
@@ -974,18 +1389,73 @@ func (p *Parser) recordField() (*RecField, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &RecField{AnnotatedIdent: v, X: expr}, nil
+	return &RecField{AnnotatedIdent: v, X: expr, Doc: doc}, nil
 }
 
 func (p *Parser) typeAnnotation() (TypeAnnotation, error) {
-	// For now, only type names, no complex expressions.
+	// For now, only (optional) type names, unions, and list types, no complex expressions.
+	var ta TypeAnnotation
 	if p.match(token.Ident) {
 		t := p.previous()
-		return &NamedType{Name: t.Val, NamePos: t.Pos, NameEnd: t.End}, nil
+		ta = &NamedType{Name: t.Val, NamePos: t.Pos, NameEnd: t.End}
+	} else if p.match(token.LeftParen) {
+		ut, err := p.unionType()
+		if err != nil {
+			return nil, err
+		}
+		ta = ut
+	}
+	if ta != nil {
+		if p.match(token.Question) {
+			return &OptionalType{Elem: ta, QuestionEnd: p.previous().End}, nil
+		}
+		return ta, nil
+	}
+	if p.match(token.LeftSquare) {
+		start := p.previous()
+		elem, err := p.typeAnnotation()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(token.RightSquare, "typeAnnotation"); err != nil {
+			return nil, err
+		}
+		lt := &ListType{Elem: elem, ListPos: start.Pos, ListEnd: p.previous().End}
+		if p.peek().Typ == token.Question {
+			return nil, p.fail("typeAnnotation: optional list types are not supported")
+		}
+		return lt, nil
 	}
 	return nil, p.fail("typeAnnotation: unexpected token")
 }
 
+// unionType parses the members of a union type. The opening '(' was already consumed.
+// A single parenthesized type is returned as is.
+func (p *Parser) unionType() (TypeAnnotation, error) {
+	start := p.previous()
+	var members []TypeAnnotation
+	for {
+		m, err := p.typeAnnotation()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m.(*ListType); ok {
+			return nil, p.fail("unionType: list types are not supported in unions")
+		}
+		members = append(members, m)
+		if !p.match(token.BitwiseOr) {
+			break
+		}
+	}
+	if err := p.expect(token.RightParen, "unionType"); err != nil {
+		return nil, err
+	}
+	if len(members) == 1 {
+		return members[0], nil
+	}
+	return &UnionType{Members: members, UnionPos: start.Pos, UnionEnd: p.previous().End}, nil
+}
+
 func (p *Parser) annotatedIdent() (AnnotatedIdent, error) {
 	if err := p.expect(token.Ident, "annotatedIdent"); err != nil {
 		return AnnotatedIdent{}, err
@@ -68,6 +68,15 @@ func (e *TypedExpr) sexpr() string {
 func (e *NamedType) sexpr() string {
 	return e.Name
 }
+func (e *ListType) sexpr() string {
+	return "[" + e.Elem.(sexpr).sexpr() + "]"
+}
+func (e *OptionalType) sexpr() string {
+	return e.Elem.(sexpr).sexpr() + "?"
+}
+func (e *UnionType) sexpr() string {
+	return e.TypeId()
+}
 func (e *ConditionalExpr) sexpr() string {
 	return fmt.Sprintf("(if %s %s %s)", e.Cond.(sexpr).sexpr(), e.X.(sexpr).sexpr(), e.Y.(sexpr).sexpr())
 }
@@ -82,6 +91,23 @@ func (e *CallExpr) sexpr() string {
 	b.WriteString(")")
 	return b.String()
 }
+func (e *LetExpr) sexpr() string {
+	return fmt.Sprintf("(let %s %s %s)", e.Var.Name, e.Var.X.(sexpr).sexpr(), e.X.(sexpr).sexpr())
+}
+func (e *MatchExpr) sexpr() string {
+	var b strings.Builder
+	b.WriteString("(match ")
+	b.WriteString(e.X.(sexpr).sexpr())
+	for _, arm := range e.Arms {
+		pat := "_"
+		if arm.Pattern != nil {
+			pat = arm.Pattern.(sexpr).sexpr()
+		}
+		fmt.Fprintf(&b, " (%s %s)", pat, arm.X.(sexpr).sexpr())
+	}
+	b.WriteString(")")
+	return b.String()
+}
 func (e *FuncExpr) sexpr() string {
 	var b strings.Builder
 	b.WriteString("(func (")
@@ -89,9 +115,18 @@ func (e *FuncExpr) sexpr() string {
 		if i > 0 {
 			b.WriteString(" ")
 		}
-		b.WriteString(p.Name)
+		if p.Default != nil {
+			b.WriteString("(" + p.Name + " " + p.Default.(sexpr).sexpr() + ")")
+		} else if p.Variadic {
+			b.WriteString(p.Name + "...")
+		} else {
+			b.WriteString(p.Name)
+		}
 	}
 	b.WriteString(")")
+	if e.Result != nil {
+		b.WriteString("->" + e.Result.TypeId() + " ")
+	}
 	b.WriteString(e.Body.(sexpr).sexpr())
 	return b.String()
 }
@@ -161,6 +196,9 @@ func TestParseTopLevelExpr(t *testing.T) {
 		// Format strings are desugared by the parser, so expect a str call:
 		{name: "fstr", input: `"${1 + 2}"`, want: (*CallExpr)(nil)},
 		{name: "type", input: "x::int", want: (*TypedExpr)(nil)},
+		{name: "in", input: "1 in [1]", want: (*BinaryExpr)(nil)},
+		{name: "let", input: "let x: 1 in x", want: (*LetExpr)(nil)},
+		{name: "match", input: "match x { 1 => 'a' }", want: (*MatchExpr)(nil)},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -175,6 +213,359 @@ func TestParseTopLevelExpr(t *testing.T) {
 	}
 }
 
+func TestParseInExpr(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "x in xs", want: "(In x xs)"},
+		// in has the same precedence as other comparisons.
+		{input: "1 + 2 in xs", want: "(In (Plus 1 2) xs)"},
+		{input: "'a' in s && b", want: `(LogicalAnd (In "a" s) b)`},
+		{input: "x in xs == y", want: "(Equal (In x xs) y)"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got := e.(sexpr).sexpr(); got != test.want {
+				t.Errorf("Want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParsePipe(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "x |> f", want: "(f x)"},
+		{input: "x |> f()", want: "(f x)"},
+		{input: "x |> f(1, 2)", want: "(f x 1 2)"},
+		{input: "x |> f |> g(1)", want: "(g (f x) 1)"},
+		{input: "x |> a.f", want: "((Dot a f) x)"},
+		// |> has lower precedence than all other binary operators.
+		{input: "1 + 2 |> f", want: "(f (Plus 1 2))"},
+		{input: "a || b |> f", want: "(f (LogicalOr a b))"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got := e.(sexpr).sexpr(); got != test.want {
+				t.Errorf("Want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseFuncDefaultParams(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "func (x, y: 10) { x }", want: "(func (x (y 10))x"},
+		{input: "func (x: 1 + 2) { x }", want: "(func ((x (Plus 1 2)))x"},
+		{input: "func (x::int: 1, y: x) { y }", want: "(func ((x 1) (y x))y"},
+		{input: "func (x, rest...) { x }", want: "(func (x rest...)x"},
+		{input: "func (x: 1, rest...) { x }", want: "(func ((x 1) rest...)x"},
+		{input: "func (xs...) { xs }", want: "(func (xs...)xs"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got := e.(sexpr).sexpr(); got != test.want {
+				t.Errorf("Want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseFuncResultType(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "func (x) -> int { x }", want: "(func (x)->int x"},
+		{input: "func () -> [string] { [] }", want: "(func ()->[string] (rec)"},
+		{input: "func f(x, y) -> minutes { x - y }", want: "(func (x y)->minutes (Minus x y)"},
+		{input: "let f(x) -> int: x in f(1)", want: "(let f (func (x)->int x (f 1))"},
+		// Without spaces, -> is still a single token.
+		{input: "func(x)->int{x}", want: "(func (x)->int x"},
+		{input: "x - -1", want: "(Minus x (Minus 1))"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got := e.(sexpr).sexpr(); got != test.want {
+				t.Errorf("Want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseFuncResultTypeError(t *testing.T) {
+	tests := []string{
+		"func (x) -> { x }",
+		"func (x) -> 1 { x }",
+		"func (x) int { x }",
+		"let f(x) ->: x in f",
+		"template t(x) -> int { x: x }",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := parse(input); err == nil {
+				t.Errorf("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestParseOptionalType(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "x::string?", want: "(OfType x string?)"},
+		{input: "x::[int?]", want: "(OfType x [int?])"},
+		{input: "func (x::int?) -> string? { x }", want: "(func (x)->string? x"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got := e.(sexpr).sexpr(); got != test.want {
+				t.Errorf("Want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseOptionalTypeError(t *testing.T) {
+	tests := []string{
+		"x::?",
+		"x::[int]?",
+		"x::int??",
+		"{a::int?: 1 ?}",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := parse(input); err == nil {
+				t.Errorf("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestParseUnionType(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "x::(int | string)", want: "(OfType x (int | string))"},
+		{input: "x::(int|string|bool)", want: "(OfType x (int | string | bool))"},
+		{input: "x::(int | string)?", want: "(OfType x (int | string)?)"},
+		{input: "x::(int | string?)", want: "(OfType x (int | string?))"},
+		{input: "x::[(int | string)]", want: "(OfType x [(int | string)])"},
+		// A single parenthesized type is not a union.
+		{input: "x::(int)", want: "(OfType x int)"},
+		{input: "func (x::(int | string)) { x }", want: "(func (x)x"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got := e.(sexpr).sexpr(); got != test.want {
+				t.Errorf("Want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseUnionTypeError(t *testing.T) {
+	tests := []string{
+		"x::()",
+		"x::(int |)",
+		"x::(int | string",
+		"x::(int | [string])",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := parse(input); err == nil {
+				t.Errorf("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestParseBarOutsideUnionType(t *testing.T) {
+	tests := []string{
+		"1 | 2",
+		"{a: 1 | 2}",
+		"f(x | y)",
+		"x::int | 1",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			_, err := parse(input)
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if want := "'|' is only allowed in union type annotations"; !strings.Contains(err.Error(), want) {
+				t.Errorf("wanted error containing %q, got %q", want, err)
+			}
+		})
+	}
+}
+
+func TestParseFieldComments(t *testing.T) {
+	const input = `{
+		// The host.
+		// Second line.
+		host: 'h' // not a leading comment
+		port: 80
+		// A let binding.
+		let x: 1
+		// Nested.
+		db::rec: {
+			// Inner.
+			name: x
+		}
+	}`
+	s := NewScanner(input, nil)
+	s.KeepComments()
+	ts, err := s.ScanAll()
+	if err != nil {
+		t.Fatalf("Error scanning: %s", err)
+	}
+	p := NewParser(ts)
+	e, err := p.Expression()
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	r := e.(*RecExpr)
+	got := map[string]string{}
+	for name, f := range r.Fields {
+		got[name] = f.Doc
+	}
+	got["db.name"] = r.Fields["db"].X.(*RecExpr).Fields["name"].Doc
+	want := map[string]string{
+		"host":    "The host.\nSecond line.",
+		"port":    "",
+		"db":      "Nested.",
+		"db.name": "Inner.",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Comments differ (-want +got): %s", diff)
+	}
+}
+
+func TestParseLetExpr(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "let x: 2 in x * x", want: "(let x 2 (Times x x))"},
+		{input: "let x: 1 in let y: 2 in x + y", want: "(let x 1 (let y 2 (Plus x y)))"},
+		// The body extends as far as possible.
+		{input: "let x: 1 in x |> f", want: "(let x 1 (f x))"},
+		// "in" as an operator is available in the body and in delimited contexts.
+		{input: "let xs: ys in 1 in xs", want: "(let xs ys (In 1 xs))"},
+		{input: "let b: (1 in xs) in b", want: "(let b (In 1 xs) b)"},
+		{input: "let b: f(1 in xs) in b", want: "(let b (f (In 1 xs)) b)"},
+		{input: "let x: if a then 1 in xs else 2 in x", want: "(let x (if a (In 1 xs) 2) x)"},
+		{input: "if a then let x: 1 in x else 2", want: "(if a (let x 1 x) 2)"},
+		{input: "1 + (let x: 1 in x)", want: "(Plus 1 (let x 1 x))"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got := e.(sexpr).sexpr(); got != test.want {
+				t.Errorf("Want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseLetExprError(t *testing.T) {
+	tests := []string{
+		"let x: 1",
+		"let x: 1 in",
+		"let x 1 in x",
+		"let: 1 in x",
+		"1 + let x: 1 in x",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if e, err := parse(input); err == nil {
+				t.Errorf("Expected error, got %s", e.(sexpr).sexpr())
+			}
+		})
+	}
+}
+
+func TestParseMatchExpr(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "match x { 1 => 'one', 2 => 'two', _ => 'many' }", want: `(match x (1 "one") (2 "two") (_ "many"))`},
+		{input: "match x {}", want: "(match x)"},
+		{input: "match x { _ => 0, }", want: "(match x (_ 0))"},
+		{input: "match x + 1 { y * 2 => a || b }", want: "(match (Plus x 1) ((Times y 2) (LogicalOr a b)))"},
+		{input: "match {a: 1}.a { 1 => 2 }", want: "(match (Dot (rec (a 1)) a) (1 2))"},
+		{input: "1 + match x { _ => 2 }", want: "(Plus 1 (match x (_ 2)))"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got := e.(sexpr).sexpr(); got != test.want {
+				t.Errorf("Want: %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParseMatchExprError(t *testing.T) {
+	tests := []string{
+		"match x",
+		"match x {",
+		"match x { 1 }",
+		"match x { 1 => }",
+		"match x { 1 => 2 3 => 4 }",
+		"match x { _ => 1, 2 => 3 }",
+		"match { 1 => 2 }",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if e, err := parse(input); err == nil {
+				t.Errorf("Expected error, got %s", e.(sexpr).sexpr())
+			}
+		})
+	}
+}
+
 func TestParseLetVar(t *testing.T) {
 	tests := []struct {
 		input   string
@@ -187,6 +578,12 @@ func TestParseLetVar(t *testing.T) {
 		{input: "let w(): { a: 1 }", wantErr: false},
 		{input: "let w: func() { { a: 1 } }", wantErr: false},
 		{input: "let w: func x() { a: 1 }", wantErr: true},
+		{input: "let f(x, y: 10): x + y", wantErr: false},
+		{input: "let f(x: 1, y): x + y", wantErr: true},
+		{input: "let template t(x: 'a') { a: x }", wantErr: false},
+		{input: "let f(x, rest...): rest", wantErr: false},
+		{input: "let f(rest..., x): rest", wantErr: true},
+		{input: "let f(rest...: 1): rest", wantErr: true},
 	}
 	for i, test := range tests {
 		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
@@ -235,10 +632,12 @@ func TestParseFieldAcc(t *testing.T) {
 // Test helpers to generate expressions.
 func rec(fields ...*RecField) *RecExpr {
 	fieldMap := make(map[string]RecField)
+	var fieldOrder []string
 	for _, f := range fields {
 		fieldMap[f.Name] = *f
+		fieldOrder = append(fieldOrder, f.Name)
 	}
-	return &RecExpr{LetVars: make(map[string]LetVar), Fields: fieldMap}
+	return &RecExpr{LetVars: make(map[string]LetVar), Fields: fieldMap, FieldOrder: fieldOrder}
 }
 func reclet(letvars []*LetVar, fields []*RecField) *RecExpr {
 	letvarMap := make(map[string]LetVar)
@@ -246,10 +645,12 @@ func reclet(letvars []*LetVar, fields []*RecField) *RecExpr {
 		letvarMap[lv.Name] = *lv
 	}
 	fieldMap := make(map[string]RecField)
+	var fieldOrder []string
 	for _, f := range fields {
 		fieldMap[f.Name] = *f
+		fieldOrder = append(fieldOrder, f.Name)
 	}
-	return &RecExpr{LetVars: letvarMap, Fields: fieldMap}
+	return &RecExpr{LetVars: letvarMap, Fields: fieldMap, FieldOrder: fieldOrder}
 }
 func fld(name string, val Expr) *RecField {
 	return &RecField{AnnotatedIdent: AnnotatedIdent{Name: name}, X: val}
@@ -411,6 +812,36 @@ func TestParseErrorPos(t *testing.T) {
 	}
 }
 
+func TestParseErrorSpan(t *testing.T) {
+	tests := []struct {
+		input    string
+		wantSpan string
+	}{
+		{input: "{z}", wantSpan: "}"},
+		{input: "{let x(7) { 7 }}", wantSpan: "7"},
+		{input: "{x: 1 x: 'abc'}", wantSpan: "x"},
+		{input: "[1, 2 foo]", wantSpan: "foo"},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := parse(test.input)
+			if err == nil {
+				t.Fatalf("Want error, got a successful parse: %T", got)
+			}
+			parseErr, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("Want ParseError, got %T", err)
+			}
+			if parseErr.Kind() != KindSyntax {
+				t.Errorf("Got kind %s, want %s", parseErr.Kind(), KindSyntax)
+			}
+			if span := test.input[parseErr.Pos():parseErr.End()]; span != test.wantSpan {
+				t.Errorf("Got span %q, want %q", span, test.wantSpan)
+			}
+		})
+	}
+}
+
 func TestParseTypedExpr(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -442,6 +873,16 @@ func TestParseTypedExpr(t *testing.T) {
 			input: "{x: 1::double y: 2::double r: x/y}",
 			want:  "(rec (r (Div x y)) (x (OfType 1 double)) (y (OfType 2 double)))",
 		},
+		{
+			name:  "list",
+			input: "xs::[int]",
+			want:  "(OfType xs [int])",
+		},
+		{
+			name:  "nestedlist",
+			input: "{xs::[[string]]: ys}",
+			want:  "(rec (([[string]] xs) ys))",
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -514,6 +955,63 @@ func TestParseModule(t *testing.T) {
 
 }
 
+func TestParseModulePubLet(t *testing.T) {
+	m, err := parseModule(`pub let x: 1 + 2 pub let f(y): y`)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "x", want: "(Plus 1 2)"},
+		{name: "f", want: "(func (y)y"},
+	}
+	for _, test := range tests {
+		d, ok := m.PubDecls[test.name]
+		if !ok {
+			t.Fatalf("missing pub decl %q", test.name)
+		}
+		if got := d.X.(sexpr).sexpr(); got != test.want {
+			t.Errorf("pub decl %s: want %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+// ParseModule is the entry point used when loading modules from files.
+func TestParseModuleFile(t *testing.T) {
+	const input = `
+		pub unit bytes { multiples: {kb: 1000} }
+		pub type point { x: int y: int }
+		pub let origin: {x: 0 y: 0}
+		pub template tmpl(x) { x: x }
+		pub func f(x) { x }
+		let g(x): x + 1
+		{p: origin}`
+	file := token.NewFileSet().AddFile("mod.konfi", len(input))
+	m, err := ParseModule(input, file)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if m.Name != "mod.konfi" {
+		t.Errorf("want module name %q, got %q", "mod.konfi", m.Name)
+	}
+	if len(m.UnitDecls) != 1 || len(m.TypeDecls) != 1 {
+		t.Errorf("want 1 unit and 1 type decl, got %d and %d", len(m.UnitDecls), len(m.TypeDecls))
+	}
+	for _, name := range []string{"origin", "tmpl", "f"} {
+		if _, ok := m.PubDecls[name]; !ok {
+			t.Errorf("missing pub decl %q", name)
+		}
+	}
+	if _, ok := m.LetVars["g"]; !ok {
+		t.Errorf("missing let decl %q", "g")
+	}
+	if m.Body == nil {
+		t.Errorf("want body, got none")
+	}
+}
+
 func TestParseModuleError(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -600,3 +1098,75 @@ pub unit bytes {
 		t.Errorf("Want %d multiples, got %d", wantLen, gotLen)
 	}
 }
+
+func TestParseTypeDecl(t *testing.T) {
+	input := `
+pub type Server {
+    host: string
+    port: int
+}`
+	m, err := parseModule(input)
+	if err != nil {
+		t.Fatalf("could not parse module: %s", err)
+	}
+	td, ok := m.TypeDecls["Server"]
+	if !ok {
+		t.Fatalf("no type declaration found for Server")
+	}
+	if diff := cmp.Diff([]string{"host", "port"}, td.Fields.FieldOrder); diff != "" {
+		t.Errorf("Fields mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseAliasTypeDecl(t *testing.T) {
+	m, err := parseModule(`pub type Port: int pub type ValidPort: Port where func (x) { x > 0 }`)
+	if err != nil {
+		t.Fatalf("could not parse module: %s", err)
+	}
+	tests := []struct {
+		name      string
+		wantBase  string
+		wantWhere string
+	}{
+		{name: "Port", wantBase: "int"},
+		{name: "ValidPort", wantBase: "Port", wantWhere: "(func (x)(GreaterThan x 0)"},
+	}
+	for _, test := range tests {
+		td, ok := m.TypeDecls[test.name]
+		if !ok {
+			t.Fatalf("no type declaration found for %s", test.name)
+		}
+		if td.Fields != nil || td.Base == nil || td.Base.Name != test.wantBase {
+			t.Errorf("%s: want alias of %s, got %+v", test.name, test.wantBase, td)
+		}
+		gotWhere := ""
+		if td.Where != nil {
+			gotWhere = td.Where.(sexpr).sexpr()
+		}
+		if gotWhere != test.wantWhere {
+			t.Errorf("%s: want where clause %q, got %q", test.name, test.wantWhere, gotWhere)
+		}
+	}
+}
+
+func TestParseTypeDeclError(t *testing.T) {
+	tests := []string{
+		`pub type Server { host: 'localhost' }`,
+		`pub type Server { host::string: string }`,
+		`pub type Server { let x: 1 host: string }`,
+		`pub type { host: string }`,
+		`pub type Server { host: string } pub type Server { port: int }`,
+		`pub unit Server { multiples: {a: 1} } pub type Server { port: int }`,
+		`pub type Port:`,
+		`pub type Port: [int]`,
+		`pub type Port: int where`,
+		`pub type Port: int pub type Port: string`,
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := parseModule(input); err == nil {
+				t.Errorf("expected error, got none")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package gokonfi
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Profile collects statistics about the evaluation of expressions.
+// Profiling is disabled by default and can be enabled with [Ctx.EnableProfiling].
+type Profile struct {
+	Nodes   int                      // Total number of evaluated expression nodes.
+	entries map[string]*ProfileEntry // Keyed by Kind and Name.
+	active  map[string]int           // Number of active evaluations per entry key.
+}
+
+// ProfileEntry contains the statistics of a single function or record field.
+type ProfileEntry struct {
+	Kind     string        // "func" or "field".
+	Name     string        // Name of the function or field.
+	Count    int           // Number of evaluations.
+	Duration time.Duration // Cumulative evaluation time.
+}
+
+func newProfile() *Profile {
+	return &Profile{
+		entries: make(map[string]*ProfileEntry),
+		active:  make(map[string]int),
+	}
+}
+
+// EnableProfiling enables the collection of evaluation statistics in ctx
+// and all contexts sharing its global state. It returns the profile
+// that gets populated during evaluation.
+func (ctx *Ctx) EnableProfiling() *Profile {
+	if ctx.global.profile == nil {
+		ctx.global.profile = newProfile()
+	}
+	return ctx.global.profile
+}
+
+// start records the start of an evaluation of the given function or field.
+// The returned function must be called when the evaluation is done.
+// It is safe to call start on a nil *Profile.
+func (p *Profile) start(kind, name string) func() {
+	if p == nil {
+		return func() {}
+	}
+	key := kind + " " + name
+	e, ok := p.entries[key]
+	if !ok {
+		e = &ProfileEntry{Kind: kind, Name: name}
+		p.entries[key] = e
+	}
+	e.Count++
+	p.active[key]++
+	t := time.Now()
+	return func() {
+		p.active[key]--
+		if p.active[key] == 0 {
+			// Only count the outermost evaluation of recursive functions,
+			// so that the cumulative time does not exceed the total time.
+			e.Duration += time.Since(t)
+		}
+	}
+}
+
+// Top returns the n entries with the highest cumulative evaluation time.
+func (p *Profile) Top(n int) []ProfileEntry {
+	es := make([]ProfileEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		es = append(es, *e)
+	}
+	sort.Slice(es, func(i, j int) bool {
+		if es[i].Duration != es[j].Duration {
+			return es[i].Duration > es[j].Duration
+		}
+		if es[i].Kind != es[j].Kind {
+			return es[i].Kind < es[j].Kind
+		}
+		return es[i].Name < es[j].Name
+	})
+	if n < len(es) {
+		es = es[:n]
+	}
+	return es
+}
+
+// WriteTop writes a human-readable report of the n most time-consuming
+// entries of p to w.
+func (p *Profile) WriteTop(w io.Writer, n int) error {
+	if _, err := fmt.Fprintf(w, "Evaluated %d expression nodes.\n", p.Nodes); err != nil {
+		return err
+	}
+	for _, e := range p.Top(n) {
+		_, err := fmt.Fprintf(w, "%12s %8d  %-5s %s\n", e.Duration.Round(time.Microsecond), e.Count, e.Kind, e.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// callName returns a name for the function called in e, for use in profiles.
+func callName(e *CallExpr) string {
+	switch f := e.Func.(type) {
+	case *VarExpr:
+		return f.Name
+	case *FieldAcc:
+		return "." + f.Name
+	}
+	return "<anonymous>"
+}
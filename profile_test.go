@@ -0,0 +1,66 @@
+package gokonfi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	input := `{
+		let fib(n): if n <= 1 then n else fib(n-1) + fib(n-2)
+		a: fib(10)
+		b: len('abc')
+	}`
+	e, err := parse(input)
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	ctx := GlobalCtx()
+	p := ctx.EnableProfiling()
+	if _, err := Eval(e, ctx); err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	if p.Nodes == 0 {
+		t.Errorf("Expected nonzero node count")
+	}
+	counts := make(map[string]int)
+	for _, e := range p.Top(100) {
+		counts[e.Kind+" "+e.Name] = e.Count
+	}
+	want := map[string]int{
+		"func fib": 177, // Number of calls to compute fib(10) recursively.
+		"func len": 1,
+		"field a":  1,
+		"field b":  1,
+	}
+	for k, n := range want {
+		if counts[k] != n {
+			t.Errorf("Got count %d for %q, want %d", counts[k], k, n)
+		}
+	}
+	if top := p.Top(1); len(top) != 1 {
+		t.Errorf("Top(1) returned %d entries", len(top))
+	}
+	var buf bytes.Buffer
+	if err := p.WriteTop(&buf, 2); err != nil {
+		t.Fatalf("WriteTop failed: %s", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 3 {
+		t.Errorf("Want 3 lines of output, got %d:\n%s", len(lines), buf.String())
+	}
+}
+
+func TestProfileDisabled(t *testing.T) {
+	ctx := GlobalCtx()
+	e, err := parse("{x: len('a')}")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	if _, err := Eval(e, ctx); err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	if ctx.global.profile != nil {
+		t.Errorf("Profiling should be disabled by default")
+	}
+}
@@ -17,7 +17,9 @@ var (
 		"false":    token.BoolLiteral,
 		"func":     token.Func,
 		"if":       token.If,
+		"in":       token.In,
 		"let":      token.Let,
+		"match":    token.Match,
 		"nil":      token.Nil,
 		"pub":      token.Public,
 		"template": token.Template,
@@ -25,6 +27,7 @@ var (
 		"true":     token.BoolLiteral,
 		"type":     token.Type,
 		"unit":     token.Unit,
+		"where":    token.Where,
 	}
 	// Used to extract integer and double literals.
 	numberRegexp = regexp.MustCompile(`^(?:\d+[eE][+-]?\d+|\d*\.\d+(?:[eE][+-]?\d+)?|\d+\.\d*(?:[eE][+-]?\d+)?|(\d+))`)
@@ -37,6 +40,8 @@ type Scanner struct {
 	pos   int         // Next position in input to be scanned.
 	off   int         // Offset of input[0] in a broader context. Nonzero only for child scanners.
 	file  *token.File // The file (part of a FileSet) that this scanner is processing.
+	// If true, comments that start a line are returned as [token.Comment] tokens.
+	keepComments bool
 }
 
 // Creates a new scanner from the given input.
@@ -48,6 +53,13 @@ func NewScanner(input string, file *token.File) *Scanner {
 	return &Scanner{input: input, file: file, off: off}
 }
 
+// KeepComments makes the scanner return comments that start a line (i.e. are
+// preceded only by whitespace) as [token.Comment] tokens, instead of discarding them.
+// Comments following other tokens on the same line are always discarded.
+func (s *Scanner) KeepComments() {
+	s.keepComments = true
+}
+
 // AtEnd returns true if the scanner has processed its input entirely.
 func (s *Scanner) AtEnd() bool {
 	return s.pos >= len(s.input)
@@ -127,12 +139,17 @@ func (s *Scanner) fail(format string, args ...any) error {
 }
 
 func (s *Scanner) failat(pos int, format string, args ...any) error {
-	return &ScanError{pos: token.Pos(pos), msg: fmt.Sprintf(format, args...)}
+	end := pos
+	if s.pos > end {
+		end = s.pos
+	}
+	return &ScanError{pos: token.Pos(pos), end: token.Pos(end), msg: fmt.Sprintf(format, args...)}
 }
 
 // ScanError is the error type typically returned by calls to Scanner methods.
 type ScanError struct {
 	pos token.Pos
+	end token.Pos
 	msg string
 }
 
@@ -141,6 +158,16 @@ func (s *ScanError) Pos() token.Pos {
 	return s.pos
 }
 
+// Returns the position immediately after the input that was scanned
+// when the ScanError occurred.
+func (s *ScanError) End() token.Pos {
+	return s.end
+}
+
+func (s *ScanError) Kind() ErrorKind {
+	return KindSyntax
+}
+
 func (e *ScanError) Error() string {
 	return fmt.Sprintf("scanError: %s at position %d", e.msg, e.pos)
 }
@@ -180,13 +207,23 @@ func (s *Scanner) NextToken() (token.Token, error) {
 		case '+':
 			return s.token(token.Plus)
 		case '-':
+			if s.match('>') {
+				return s.token(token.ThinArrow)
+			}
 			return s.token(token.Minus)
+		case '?':
+			return s.token(token.Question)
 		case '*':
 			return s.token(token.Times)
+		case '%':
+			return s.token(token.Modulo)
 		case '@':
 			return s.token(token.Merge)
 		case '/':
 			if s.match('/') {
+				if s.keepComments && s.startsLine() {
+					return s.comment()
+				}
 				s.eatline()
 				continue
 			}
@@ -196,6 +233,10 @@ func (s *Scanner) NextToken() (token.Token, error) {
 			if u >= '0' && u <= '9' {
 				return s.number()
 			}
+			if strings.HasPrefix(s.rem(), "..") {
+				s.pos += 2
+				return s.token(token.Ellipsis)
+			}
 			return s.token(token.Dot)
 		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 			return s.number()
@@ -218,6 +259,9 @@ func (s *Scanner) NextToken() (token.Token, error) {
 			if s.match('=') {
 				return s.token(token.Equal)
 			}
+			if s.match('>') {
+				return s.token(token.Arrow)
+			}
 		case '!':
 			if s.match('=') {
 				return s.token(token.NotEqual)
@@ -231,6 +275,10 @@ func (s *Scanner) NextToken() (token.Token, error) {
 			if s.match('|') {
 				return s.token(token.LogicalOr)
 			}
+			if s.match('>') {
+				return s.token(token.Pipe)
+			}
+			return s.token(token.BitwiseOr)
 		case '"', '\'':
 			return s.stringLiteral(r)
 		case '`':
@@ -263,6 +311,29 @@ func (s *Scanner) ScanAll() ([]token.Token, error) {
 	return r, nil
 }
 
+// startsLine reports whether the current token is preceded only by whitespace on its line.
+func (s *Scanner) startsLine() bool {
+	for i := s.mark - 1; i >= 0; i-- {
+		switch s.input[i] {
+		case '\n':
+			return true
+		case ' ', '\t', '\r':
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// comment scans a line comment whose leading "//" was already consumed.
+// The token's value is the comment's text without "//" and surrounding whitespace.
+func (s *Scanner) comment() (token.Token, error) {
+	for !s.AtEnd() && s.peek() != '\n' {
+		s.advance()
+	}
+	return s.tokenVal(token.Comment, strings.TrimSpace(s.val()[2:]))
+}
+
 func (s *Scanner) eatline() {
 	for !s.AtEnd() {
 		if s.advance() == '\n' {
@@ -294,6 +365,20 @@ func (s *Scanner) ident() (token.Token, error) {
 	return token.Token{}, s.fail("invalid identifier")
 }
 
+// isIdentifier reports whether s is a valid identifier that is not a keyword.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || i > 0 && unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	_, isKeyword := keywords[s]
+	return !isKeyword
+}
+
 // Parses IntLiterals and DoubleLiterals.
 func (s *Scanner) number() (token.Token, error) {
 	ix := numberRegexp.FindStringSubmatchIndex(s.input[s.mark:])
@@ -359,11 +444,19 @@ func (s *Scanner) stringLiteral(delim rune) (token.Token, error) {
 				b.Reset()
 			}
 			exprStart := s.pos // s.pos points at the first character inside the ${} (after '{').
-			err := s.skipFormatStringExpr(delim)
+			specStart, err := s.skipFormatStringExpr(delim)
 			if err != nil {
 				return token.Token{}, err
 			}
 			exprEnd := s.pos - 1 // s.pos points at the first character outside the ${} (after '}').
+			spec := ""
+			if specStart >= 0 {
+				spec = s.input[specStart+1 : exprEnd]
+				exprEnd = specStart
+				if strings.TrimSpace(s.input[exprStart:exprEnd]) == "" {
+					return token.Token{}, s.failat(specStart, "missing expression before format spec")
+				}
+			}
 			if exprStart == exprEnd {
 				// Ignore empty interpolation ${}.
 				continue
@@ -373,7 +466,7 @@ func (s *Scanner) stringLiteral(delim rune) (token.Token, error) {
 				return token.Token{}, err
 			}
 			partPos = s.tpos()
-			part := token.FormattedValue{Tokens: exprTokens, Pos: token.Pos(exprStart), End: token.Pos(exprEnd)}
+			part := token.FormattedValue{Tokens: exprTokens, Pos: token.Pos(exprStart), End: token.Pos(exprEnd), Spec: spec}
 			parts = append(parts, part)
 		} else if r == '\\' {
 			r = s.advance()
@@ -400,36 +493,47 @@ func (s *Scanner) stringLiteral(delim rune) (token.Token, error) {
 // Advances the scanner so it points at the character following the '}' that closes
 // the format string interpolated expression.
 //
+// If the expression is followed by a format spec, as in ${x:%.2f}, the position of
+// the ':' that starts the spec is returned, else -1. A format spec starts at the
+// first top-level ':' that is immediately followed by a '%' and extends to the closing '}'.
+//
 // When calling this method, s must point at the first character of the interpolated expression.
-func (s *Scanner) skipFormatStringExpr(delim rune) error {
+func (s *Scanner) skipFormatStringExpr(delim rune) (int, error) {
 	depth := 0
 	inString := false
+	specStart := -1
 	for !s.AtEnd() {
 		pos := s.pos
 		r := s.advance()
 		switch r {
 		case delim:
-			return s.failat(pos, "end of string in interpolated expression")
+			return -1, s.failat(pos, "end of string in interpolated expression")
 		case '\n', '\r':
-			return s.failat(pos, "newline in interpolated expression")
+			return -1, s.failat(pos, "newline in interpolated expression")
 		case '\\':
-			return s.failat(pos, "interpolated expression cannot contain a backslash")
+			return -1, s.failat(pos, "interpolated expression cannot contain a backslash")
 		case '\'', '"':
 			// One of these is delim, so we only end up here for the other string delimiter,
 			// which can be used to delimit string literals inside the interpolated expression.
-			inString = !inString
+			if specStart < 0 {
+				inString = !inString
+			}
+		case ':':
+			if depth == 0 && !inString && specStart < 0 && s.peek() == '%' {
+				specStart = pos
+			}
 		case '}':
-			if depth == 0 && !inString {
+			if (depth == 0 && !inString) || specStart >= 0 {
 				// Reached end of interpolated expression
-				return nil
+				return specStart, nil
 			} else if !inString {
 				depth--
 			}
 		case '{':
-			if !inString {
+			if !inString && specStart < 0 {
 				depth++
 			}
 		}
 	}
-	return s.fail("end of input")
+	return -1, s.fail("end of input")
 }
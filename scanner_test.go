@@ -51,6 +51,7 @@ func TestScanOperators(t *testing.T) {
 		{op: "-", want: token.Minus},
 		{op: "*", want: token.Times},
 		{op: "/", want: token.Div},
+		{op: "%", want: token.Modulo},
 		{op: "@", want: token.Merge},
 		{op: ".", want: token.Dot},
 		{op: "!", want: token.Not},
@@ -70,6 +71,12 @@ func TestScanOperators(t *testing.T) {
 		{op: ">=", want: token.GreaterEq},
 		{op: "&&", want: token.LogicalAnd},
 		{op: "||", want: token.LogicalOr},
+		{op: "|>", want: token.Pipe},
+		{op: "...", want: token.Ellipsis},
+		{op: "=>", want: token.Arrow},
+		{op: "->", want: token.ThinArrow},
+		{op: "?", want: token.Question},
+		{op: "|", want: token.BitwiseOr},
 	}
 	for _, test := range tests {
 		s := newTestScanner(test.op)
@@ -99,6 +106,37 @@ func TestScanExpr(t *testing.T) {
 	compareTokenTypes(t, tokenTypes, expected)
 }
 
+func TestScanKeepComments(t *testing.T) {
+	const input = "// first\n  //second  \n{a: 1 // trailing\n}\n// last"
+	s := newTestScanner(input)
+	s.KeepComments()
+	ts, err := s.ScanAll()
+	if err != nil {
+		t.Fatalf("Error scanning: %s", err)
+	}
+	var types []token.TokenType
+	var comments []string
+	for _, tok := range ts {
+		types = append(types, tok.Typ)
+		if tok.Typ == token.Comment {
+			comments = append(comments, tok.Val)
+		}
+	}
+	compareTokenTypes(t, types, []token.TokenType{token.Comment, token.Comment, token.LeftBrace,
+		token.Ident, token.Colon, token.IntLiteral, token.RightBrace, token.Comment, token.EndOfInput})
+	if diff := cmp.Diff([]string{"first", "second", "last"}, comments); diff != "" {
+		t.Errorf("Comments differ (-want +got): %s", diff)
+	}
+	// Comments are discarded by default.
+	ts, err = scanTokens(input)
+	if err != nil {
+		t.Fatalf("Error scanning: %s", err)
+	}
+	if len(ts) != 6 {
+		t.Errorf("Want 6 tokens, got %d", len(ts))
+	}
+}
+
 func TestScanSkipsWhitespace(t *testing.T) {
 	s := newTestScanner("     \t    \n   +\nx   \t\t\n   +")
 	tokenTypes := []token.TokenType{}
@@ -220,6 +258,12 @@ func TestScanKeywords(t *testing.T) {
 		{"then", token.Then},
 		{"else", token.Else},
 		{"nil", token.Nil},
+		{"in", token.In},
+		{"match", token.Match},
+		{"pub", token.Public},
+		{"type", token.Type},
+		{"unit", token.Unit},
+		{"where", token.Where},
 	} {
 		s := newTestScanner(td.input)
 		tok, err := s.NextToken()
@@ -343,11 +387,16 @@ func TestScanFormatStringValue(t *testing.T) {
 		tLb   = token.LeftBrace
 		tRb   = token.RightBrace
 		tCol  = token.Colon
+		tDbl  = token.DoubleLiteral
+		tDiv  = token.Div
+		tDot  = token.Dot
+		tOfT  = token.OfType
 	)
 	tests := []struct {
 		input     string
 		wantIndex int               // Index at which we expect the FormattedValue
 		wantTypes []token.TokenType // wanted token types, excluding the mandatory EndOfInput
+		wantSpec  string
 	}{
 		{input: `"alpha ${a+b}"`, wantIndex: 1, wantTypes: []token.TokenType{tId, tPlus, tId}},
 		{input: `"${'a'}"`, wantIndex: 0, wantTypes: []token.TokenType{tStr}},
@@ -357,6 +406,10 @@ func TestScanFormatStringValue(t *testing.T) {
 		{input: `"${{a: 1}}"`, wantIndex: 0, wantTypes: []token.TokenType{tLb, tId, tCol, tInt, tRb}},
 		{input: `"${'{'}"`, wantIndex: 0, wantTypes: []token.TokenType{tStr}},
 		{input: `"${ '}' }"`, wantIndex: 0, wantTypes: []token.TokenType{tStr}},
+		{input: `"${1.0/3.0:%.3f}"`, wantIndex: 0, wantTypes: []token.TokenType{tDbl, tDiv, tDbl}, wantSpec: "%.3f"},
+		{input: `"x=${a:%5d}!"`, wantIndex: 1, wantTypes: []token.TokenType{tId}, wantSpec: "%5d"},
+		{input: `"${{a: 1}.a:%d}"`, wantIndex: 0, wantTypes: []token.TokenType{tLb, tId, tCol, tInt, tRb, tDot, tId}, wantSpec: "%d"},
+		{input: `"${x::int}"`, wantIndex: 0, wantTypes: []token.TokenType{tId, tOfT, tId}},
 	}
 	for i, test := range tests {
 		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
@@ -388,6 +441,9 @@ func TestScanFormatStringValue(t *testing.T) {
 			if diff := cmp.Diff(test.wantTypes, gotTokenTypes); diff != "" {
 				t.Fatalf("FormattedValue.Token mismatch (-want +got):\n%s", diff)
 			}
+			if got.Spec != test.wantSpec {
+				t.Errorf("Want spec %q, got %q", test.wantSpec, got.Spec)
+			}
 		})
 	}
 }
@@ -410,6 +466,7 @@ func TestScanErrors(t *testing.T) {
 		// Format strings cannot contain newlines.
 		{input: "\"${ \n }\"", want: "newline", wantRune: '\n'},
 		{input: "\"${ \r }\"", want: "newline", wantRune: '\r'},
+		{input: `"${:%d}"`, want: "missing expression", wantRune: ':'},
 	}
 	for i, test := range tests {
 		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
@@ -435,3 +492,31 @@ func TestScanErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestScanErrorSpan(t *testing.T) {
+	tests := []struct {
+		input    string
+		wantSpan string
+	}{
+		{input: "a $", wantSpan: "$"},
+		{input: `"foo`, wantSpan: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			toks, err := newTestScanner(test.input).ScanAll()
+			if err == nil {
+				t.Fatalf("expected error, got %v", toks)
+			}
+			gotErr, ok := err.(*ScanError)
+			if !ok {
+				t.Fatalf("expected ScanError, got %v", err)
+			}
+			if gotErr.Kind() != KindSyntax {
+				t.Errorf("want kind %s, got %s", KindSyntax, gotErr.Kind())
+			}
+			if span := test.input[gotErr.Pos():gotErr.End()]; span != test.wantSpan {
+				t.Errorf("want span %q, got %q", test.wantSpan, span)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package gokonfi
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// The JSON Schema dialect of generated schemas.
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// SchemaOptions control the generation of JSON Schema documents.
+type SchemaOptions struct {
+	// Units is the encoding of unit values that the schema describes.
+	// It should match the JsonOptions.Units of the encoded values.
+	Units UnitEncoding
+}
+
+// SchemaFor returns a JSON Schema document for values of type typ, as
+// encoded by EncodeAsJson. The result can be marshalled with encoding/json.
+// Record types are defined in the document's "$defs" and referenced by name.
+func SchemaFor(typ *Typ) (any, error) {
+	return SchemaForWith(typ, SchemaOptions{})
+}
+
+// SchemaForWith is like SchemaFor, but uses the given options.
+func SchemaForWith(typ *Typ, opts SchemaOptions) (any, error) {
+	b := newSchemaBuilder(opts)
+	s, err := b.typeSchema(typ)
+	if err != nil {
+		return nil, err
+	}
+	return b.document(s), nil
+}
+
+// SchemaForVal returns a JSON Schema document inferred from the structure of v.
+// Annotated record fields use the schema of their annotated type. Fields
+// annotated with an optional type (e.g. x::string?) are not required.
+func SchemaForVal(v Val) (any, error) {
+	return SchemaForValWith(v, SchemaOptions{})
+}
+
+// SchemaForValWith is like SchemaForVal, but uses the given options.
+func SchemaForValWith(v Val, opts SchemaOptions) (any, error) {
+	b := newSchemaBuilder(opts)
+	s, err := b.valSchema(v)
+	if err != nil {
+		return nil, err
+	}
+	return b.document(s), nil
+}
+
+// Schema returns a JSON Schema document for the module's body, inferred from
+// its structure. All types declared by the module are defined in the document's
+// "$defs", even if the body does not use them.
+func (m *loadedModule) Schema() (any, error) {
+	return m.SchemaWith(SchemaOptions{})
+}
+
+// SchemaWith is like Schema, but uses the given options.
+func (m *loadedModule) SchemaWith(opts SchemaOptions) (any, error) {
+	b := newSchemaBuilder(opts)
+	for _, t := range m.types {
+		if err := b.define(t); err != nil {
+			return nil, err
+		}
+	}
+	s, err := b.valSchema(m.body)
+	if err != nil {
+		return nil, err
+	}
+	return b.document(s), nil
+}
+
+// schemaBuilder collects the definitions of a JSON Schema document.
+type schemaBuilder struct {
+	defs  map[string]any
+	units UnitEncoding
+}
+
+func newSchemaBuilder(opts SchemaOptions) *schemaBuilder {
+	return &schemaBuilder{defs: make(map[string]any), units: opts.Units}
+}
+
+// document returns the JSON Schema document with root schema s and all collected definitions.
+func (b *schemaBuilder) document(s map[string]any) map[string]any {
+	doc := map[string]any{"$schema": jsonSchemaDialect}
+	for k, v := range s {
+		doc[k] = v
+	}
+	if len(b.defs) > 0 {
+		doc["$defs"] = b.defs
+	}
+	return doc
+}
+
+// define adds the declared type t to the document's definitions.
+func (b *schemaBuilder) define(t *Typ) error {
+	if t.IsRecord() {
+		_, err := b.recordRef(t)
+		return err
+	}
+	s, err := b.typeSchema(t)
+	if err != nil {
+		return err
+	}
+	b.defs[t.Id] = s
+	return nil
+}
+
+func (b *schemaBuilder) typeSchema(t *Typ) (map[string]any, error) {
+	switch {
+	case t.Optional != nil:
+		s, err := b.typeSchema(t.Optional)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"anyOf": []any{s, map[string]any{"type": "null"}}}, nil
+	case t.Union != nil:
+		members := make([]any, len(t.Union))
+		for i, m := range t.Union {
+			s, err := b.typeSchema(m)
+			if err != nil {
+				return nil, err
+			}
+			members[i] = s
+		}
+		return map[string]any{"anyOf": members}, nil
+	case t.Base != nil:
+		// Where predicates of alias types cannot be expressed in JSON Schema.
+		return b.typeSchema(t.Base)
+	case t.IsRecord():
+		return b.recordRef(t)
+	case t.IsUnit():
+		if b.units == UnitEncodingString {
+			return map[string]any{"type": "string"}, nil
+		}
+		return map[string]any{"type": "number"}, nil
+	}
+	switch t {
+	case builtinTypeBool:
+		return map[string]any{"type": "boolean"}, nil
+	case builtinTypeInt:
+		return map[string]any{"type": "integer"}, nil
+	case builtinTypeDouble:
+		return map[string]any{"type": "number"}, nil
+	case builtinTypeString:
+		return map[string]any{"type": "string"}, nil
+	case builtinTypeNil:
+		return map[string]any{"type": "null"}, nil
+	case builtinTypeRec:
+		return map[string]any{"type": "object"}, nil
+	case builtinTypeList:
+		return map[string]any{"type": "array"}, nil
+	case builtinTypeTime:
+		return map[string]any{"type": "string", "format": "date-time"}, nil
+	case builtinTypePort:
+		return map[string]any{"type": "integer", "minimum": 0, "maximum": 65535}, nil
+	}
+	return nil, fmt.Errorf("no JSON schema for type %s", t.Id)
+}
+
+// recordRef returns a reference to the definition of the record type t,
+// defining it first if necessary.
+func (b *schemaBuilder) recordRef(t *Typ) (map[string]any, error) {
+	ref := map[string]any{"$ref": "#/$defs/" + t.Id}
+	if _, ok := b.defs[t.Id]; ok {
+		return ref, nil
+	}
+	// Record types may refer to themselves, so reserve the definition before
+	// building the schemas of its fields.
+	b.defs[t.Id] = nil
+	props := make(map[string]any)
+	required := make([]string, 0, len(t.RecFields))
+	for f, ft := range t.RecFields {
+		s, err := b.typeSchema(ft)
+		if err != nil {
+			return nil, fmt.Errorf("field %s of type %s: %w", f, t.Id, err)
+		}
+		props[f] = s
+		required = append(required, f)
+	}
+	sort.Strings(required)
+	b.defs[t.Id] = map[string]any{
+		"type":       "object",
+		"properties": props,
+		"required":   required,
+	}
+	return ref, nil
+}
+
+func (b *schemaBuilder) valSchema(v Val) (map[string]any, error) {
+	switch x := v.(type) {
+	case *RecVal:
+		props := make(map[string]any)
+		required := []string{}
+		for _, f := range x.FieldNames() {
+			var s map[string]any
+			var err error
+			a := x.FieldAnnotations[f]
+			if a != nil && a.T != nil {
+				s, err = b.typeSchema(a.T)
+			} else {
+				s, err = b.valSchema(x.Fields[f])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", f, err)
+			}
+			props[f] = s
+			if a == nil || a.T == nil || a.T.Optional == nil {
+				required = append(required, f)
+			}
+		}
+		return map[string]any{
+			"type":       "object",
+			"properties": props,
+			"required":   required,
+		}, nil
+	case ListVal:
+		s := map[string]any{"type": "array"}
+		// Only lists whose elements all have the same schema get an items schema.
+		var items map[string]any
+		for i, e := range x.Elements {
+			es, err := b.valSchema(e)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			if i == 0 {
+				items = es
+			} else if !reflect.DeepEqual(items, es) {
+				return s, nil
+			}
+		}
+		if items != nil {
+			s["items"] = items
+		}
+		return s, nil
+	}
+	return b.typeSchema(v.Typ())
+}
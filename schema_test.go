@@ -0,0 +1,275 @@
+package gokonfi
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// jsonDiff returns the difference between the JSON encoding of got and the JSON string want.
+func jsonDiff(t *testing.T, want string, got any) string {
+	t.Helper()
+	bs, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("Cannot marshal schema: %s", err)
+	}
+	var g, w any
+	if err := json.Unmarshal(bs, &g); err != nil {
+		t.Fatalf("Cannot unmarshal schema: %s", err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("Invalid expected JSON: %s", err)
+	}
+	return cmp.Diff(w, g)
+}
+
+func TestSchemaFor(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  *Typ
+		want string
+	}{
+		{name: "int", typ: builtinTypeInt,
+			want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "integer"}`},
+		{name: "optional", typ: NewOptionalType(builtinTypeString),
+			want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "anyOf": [{"type": "string"}, {"type": "null"}]}`},
+		{name: "union", typ: NewUnionType("(int | bool)", []*Typ{builtinTypeInt, builtinTypeBool}),
+			want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "anyOf": [{"type": "integer"}, {"type": "boolean"}]}`},
+		{name: "alias", typ: NewAliasType("name", builtinTypeString, nil),
+			want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "string"}`},
+		{name: "port", typ: builtinTypePort,
+			want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "integer", "minimum": 0, "maximum": 65535}`},
+		{name: "unit", typ: builtinTypeDuration,
+			want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "number"}`},
+		{name: "record", typ: NewRecordType("Server", map[string]*Typ{"host": builtinTypeString, "port": builtinTypePort}),
+			want: `{
+				"$schema": "https://json-schema.org/draft/2020-12/schema",
+				"$ref": "#/$defs/Server",
+				"$defs": {
+					"Server": {
+						"type": "object",
+						"properties": {
+							"host": {"type": "string"},
+							"port": {"type": "integer", "minimum": 0, "maximum": 65535}
+						},
+						"required": ["host", "port"]
+					}
+				}
+			}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SchemaFor(test.typ)
+			if err != nil {
+				t.Fatalf("SchemaFor failed: %s", err)
+			}
+			if diff := jsonDiff(t, test.want, got); diff != "" {
+				t.Errorf("Schema mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSchemaForRecursiveRecordType(t *testing.T) {
+	node := NewRecordType("Node", map[string]*Typ{"value": builtinTypeInt})
+	node.RecFields["next"] = NewOptionalType(node)
+	got, err := SchemaFor(node)
+	if err != nil {
+		t.Fatalf("SchemaFor failed: %s", err)
+	}
+	want := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$ref": "#/$defs/Node",
+		"$defs": {
+			"Node": {
+				"type": "object",
+				"properties": {
+					"value": {"type": "integer"},
+					"next": {"anyOf": [{"$ref": "#/$defs/Node"}, {"type": "null"}]}
+				},
+				"required": ["next", "value"]
+			}
+		}
+	}`
+	if diff := jsonDiff(t, want, got); diff != "" {
+		t.Errorf("Schema mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSchemaForVal(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "'a'", want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "string"}`},
+		{input: "[1, 2]", want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "array", "items": {"type": "integer"}}`},
+		{input: "[1, 'a']", want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "array"}`},
+		{input: "[]", want: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "type": "array"}`},
+		{
+			input: "{a: 1 b: {c: [true]} d: nil}",
+			want: `{
+				"$schema": "https://json-schema.org/draft/2020-12/schema",
+				"type": "object",
+				"properties": {
+					"a": {"type": "integer"},
+					"b": {
+						"type": "object",
+						"properties": {"c": {"type": "array", "items": {"type": "boolean"}}},
+						"required": ["c"]
+					},
+					"d": {"type": "null"}
+				},
+				"required": ["a", "b", "d"]
+			}`,
+		},
+		{
+			// Annotated fields use their type's schema. Optional fields are not required.
+			input: "{name::string?: nil n::double: 1.0 d::minutes: 1::minutes}",
+			want: `{
+				"$schema": "https://json-schema.org/draft/2020-12/schema",
+				"type": "object",
+				"properties": {
+					"name": {"anyOf": [{"type": "string"}, {"type": "null"}]},
+					"n": {"type": "number"},
+					"d": {"type": "number"}
+				},
+				"required": ["n", "d"]
+			}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			e, err := parse(test.input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			got, err := SchemaForVal(v)
+			if err != nil {
+				t.Fatalf("SchemaForVal failed: %s", err)
+			}
+			if diff := jsonDiff(t, test.want, got); diff != "" {
+				t.Errorf("Schema mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSchemaForValUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		units    UnitEncoding
+		wantType string
+	}{
+		{name: "value", units: UnitEncodingValue, wantType: "number"},
+		{name: "base", units: UnitEncodingBase, wantType: "number"},
+		{name: "string", units: UnitEncodingString, wantType: "string"},
+	}
+	e, err := parse("{d::minutes: 1::minutes p: 2::percent}")
+	if err != nil {
+		t.Fatalf("Cannot parse expression: %s", err)
+	}
+	v, err := Eval(e, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %s", err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SchemaForValWith(v, SchemaOptions{Units: test.units})
+			if err != nil {
+				t.Fatalf("SchemaForValWith failed: %s", err)
+			}
+			want := fmt.Sprintf(`{
+				"$schema": "https://json-schema.org/draft/2020-12/schema",
+				"type": "object",
+				"properties": {"d": {"type": %[1]q}, "p": {"type": %[1]q}},
+				"required": ["d", "p"]
+			}`, test.wantType)
+			if diff := jsonDiff(t, want, got); diff != "" {
+				t.Errorf("Schema mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSchemaForValError(t *testing.T) {
+	tests := []string{
+		"func (x) { x }",
+		"{f: len}",
+		"[1, func () { 2 }]",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			e, err := parse(input)
+			if err != nil {
+				t.Fatalf("Cannot parse expression: %s", err)
+			}
+			v, err := Eval(e, GlobalCtx())
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %s", err)
+			}
+			if got, err := SchemaForVal(v); err == nil {
+				t.Errorf("Wanted error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestModuleSchema(t *testing.T) {
+	const input = `
+	pub type Server {
+		host: string
+		port: int
+	}
+	pub type Unused {
+		x: bool
+	}
+	pub type hostname: string
+	{
+		server::Server: {host: 'localhost' port: 8080}::Server
+		name::string?: nil
+		timeout: 10::seconds
+	}`
+	m, err := evalSelfContainedModule(input, GlobalCtx())
+	if err != nil {
+		t.Fatalf("Failed to evaluate module: %s", err)
+	}
+	got, err := m.Schema()
+	if err != nil {
+		t.Fatalf("Schema failed: %s", err)
+	}
+	want := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"properties": {
+			"server": {"$ref": "#/$defs/Server"},
+			"name": {"anyOf": [{"type": "string"}, {"type": "null"}]},
+			"timeout": {"type": "number"}
+		},
+		"required": ["server", "timeout"],
+		"$defs": {
+			"Server": {
+				"type": "object",
+				"properties": {
+					"host": {"type": "string"},
+					"port": {"type": "integer"}
+				},
+				"required": ["host", "port"]
+			},
+			"Unused": {
+				"type": "object",
+				"properties": {"x": {"type": "boolean"}},
+				"required": ["x"]
+			},
+			"hostname": {"type": "string"}
+		}
+	}`
+	if diff := jsonDiff(t, want, got); diff != "" {
+		t.Errorf("Schema mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -3,6 +3,7 @@ package token
 import (
 	"fmt"
 	"sort"
+	"strings"
 )
 
 //go:generate stringer -type=TokenType
@@ -40,6 +41,7 @@ const (
 	Not         // !
 	Complement  // ~
 	Merge       // @
+	Pipe        // |>
 	// Separators
 	Comma       // ,
 	LeftParen   // (
@@ -50,8 +52,14 @@ const (
 	RightSquare // ]
 	Colon       // :
 	OfType      // ::
+	Ellipsis    // ...
+	Arrow       // =>
+	ThinArrow   // ->
+	Question    // ?
 	// Identifiers
 	Ident
+	// Comments are only returned by scanners that keep them.
+	Comment // comment
 	// Keywords
 	Func     // func
 	Let      // let
@@ -62,6 +70,9 @@ const (
 	Public   // pub
 	Unit     // unit
 	Type     // type
+	In       // in
+	Match    // match
+	Where    // where
 	// Don't treat end of input as an error, but use a special token.
 	EndOfInput
 )
@@ -94,6 +105,9 @@ type FormattedValue struct {
 	Tokens []Token
 	Pos    Pos
 	End    Pos
+	// Spec is the optional format spec following the expression, as in ${x:%.2f}.
+	// It does not include the leading ':'.
+	Spec string
 }
 
 // FormatStrValue is a marker interface for types that can be part of a format string.
@@ -113,6 +127,7 @@ type File struct {
 	base  int    // offset of all positions (Pos) in this file in the FileSet that this File belongs to.
 	size  int    // size of the file, in bytes.
 	lines []int  // offsets of the first character in each line.
+	src   string // optional source code of the file, used for error messages.
 }
 
 func (f *File) Name() string { return f.name }
@@ -123,6 +138,11 @@ func (f *File) AddLine(offset int) {
 	f.lines = append(f.lines, offset)
 }
 
+// SetSource retains the source code of f, so that it can be retrieved by FileSet.LineText.
+func (f *File) SetSource(src string) {
+	f.src = src
+}
+
 type FileSet struct {
 	base  int // base for the next file
 	files []*File
@@ -153,33 +173,57 @@ func (p *Position) String() string {
 }
 
 func (fs *FileSet) Position(pos Pos) (Position, bool) {
-	if len(fs.files) == 0 {
+	f, line, q, ok := fs.lookup(pos)
+	if !ok {
 		return Position{}, false
 	}
+	// Lines and columns in Position are 1-based, not 0-based.
+	return Position{line: line + 1, col: q - f.lines[line] + 1, file: f.name}, true
+}
+
+// LineText returns the text of the line containing pos, without the trailing newline.
+// It returns false if pos cannot be translated or the file's source was not retained.
+func (fs *FileSet) LineText(pos Pos) (string, bool) {
+	f, line, _, ok := fs.lookup(pos)
+	if !ok || len(f.src) != f.size {
+		return "", false
+	}
+	end := f.size
+	if line+1 < len(f.lines) {
+		end = f.lines[line+1]
+	}
+	return strings.TrimRight(f.src[f.lines[line]:end], "\r\n"), true
+}
+
+// lookup returns the file containing pos, the (0-based) index of the line
+// containing pos, and the offset of pos within the file.
+func (fs *FileSet) lookup(pos Pos) (f *File, line int, offset int, ok bool) {
+	if len(fs.files) == 0 {
+		return nil, 0, 0, false
+	}
 	p := int(pos)
 	i := sort.Search(len(fs.files), func(i int) bool {
 		return fs.files[i].base > p
 	})
 	if i == 0 {
 		// No file has a base <= p.
-		return Position{}, false
+		return nil, 0, 0, false
 	}
 	i--
-	f := fs.files[i]
+	f = fs.files[i]
 	q := p - f.base
 	if q >= f.size {
 		// Offset within file too large. Can only happen at the end or if the difference
 		// of .base consecutive files is not equal to the size of the first file,
 		// which our API currently prevents, but better safe than sorry.
-		return Position{}, false
+		return nil, 0, 0, false
 	}
 	j := sort.Search(len(f.lines), func(i int) bool {
 		return f.lines[i] > q
 	})
 	if j == 0 {
 		// No line has an offset <= q.
-		return Position{}, false
+		return nil, 0, 0, false
 	}
-	// Lines and columns in Position are 1-based, not 0-based.
-	return Position{line: j, col: q - f.lines[j-1] + 1, file: f.name}, true
+	return f, j - 1, q, true
 }
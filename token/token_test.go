@@ -1,6 +1,7 @@
 package token
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -61,3 +62,72 @@ func TestPositionForError(t *testing.T) {
 	}
 
 }
+
+func TestLineText(t *testing.T) {
+	src := "first\nsecond line\r\n\nlast"
+	fs := NewFileSet()
+	fs.AddFile("other", 10)
+	f := fs.AddFile("foo", len(src))
+	f.SetSource(src)
+	for i, c := range src {
+		if c == '\n' {
+			f.AddLine(i + 1)
+		}
+	}
+	tests := []struct {
+		pos  Pos
+		want string
+	}{
+		{Pos(10), "first"},
+		{Pos(15), "first"},
+		{Pos(16), "second line"},
+		{Pos(29), ""},
+		{Pos(30), "last"},
+		{Pos(33), "last"},
+	}
+	for _, test := range tests {
+		got, ok := fs.LineText(test.pos)
+		if !ok {
+			t.Errorf("LineText(%d): wanted text, got none", test.pos)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("LineText(%d): got %q, want %q", test.pos, got, test.want)
+		}
+	}
+	// File without source.
+	if got, ok := fs.LineText(Pos(5)); ok {
+		t.Errorf("Wanted no text for file without source, got %q", got)
+	}
+	if got, ok := fs.LineText(Pos(100)); ok {
+		t.Errorf("Wanted no text for invalid position, got %q", got)
+	}
+}
+
+func TestTokenTypeString(t *testing.T) {
+	tests := []struct {
+		typ  TokenType
+		want string
+	}{
+		{typ: Unspecified, want: "Unspecified"},
+		{typ: Nil, want: "Nil"},
+		{typ: BoolLiteral, want: "BoolLiteral"},
+		{typ: Merge, want: "Merge"},
+		{typ: Pipe, want: "Pipe"},
+		{typ: OfType, want: "OfType"},
+		{typ: Ellipsis, want: "Ellipsis"},
+		{typ: Public, want: "Public"},
+		{typ: EndOfInput, want: "EndOfInput"},
+	}
+	for _, test := range tests {
+		if got := test.typ.String(); got != test.want {
+			t.Errorf("Want %q, got %q", test.want, got)
+		}
+	}
+	// Every token type must have a name, i.e. the generated code must be up to date.
+	for typ := Unspecified; typ <= EndOfInput; typ++ {
+		if s := typ.String(); strings.HasPrefix(s, "TokenType(") {
+			t.Errorf("Token type %d has no name: %s", typ, s)
+		}
+	}
+}
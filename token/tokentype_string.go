@@ -37,31 +37,40 @@ func _() {
 	_ = x[Not-26]
 	_ = x[Complement-27]
 	_ = x[Merge-28]
-	_ = x[Comma-29]
-	_ = x[LeftParen-30]
-	_ = x[RightParen-31]
-	_ = x[LeftBrace-32]
-	_ = x[RightBrace-33]
-	_ = x[LeftSquare-34]
-	_ = x[RightSquare-35]
-	_ = x[Colon-36]
-	_ = x[OfType-37]
-	_ = x[Ident-38]
-	_ = x[Func-39]
-	_ = x[Let-40]
-	_ = x[Template-41]
-	_ = x[If-42]
-	_ = x[Then-43]
-	_ = x[Else-44]
-	_ = x[Public-45]
-	_ = x[Unit-46]
-	_ = x[Type-47]
-	_ = x[EndOfInput-48]
+	_ = x[Pipe-29]
+	_ = x[Comma-30]
+	_ = x[LeftParen-31]
+	_ = x[RightParen-32]
+	_ = x[LeftBrace-33]
+	_ = x[RightBrace-34]
+	_ = x[LeftSquare-35]
+	_ = x[RightSquare-36]
+	_ = x[Colon-37]
+	_ = x[OfType-38]
+	_ = x[Ellipsis-39]
+	_ = x[Arrow-40]
+	_ = x[ThinArrow-41]
+	_ = x[Question-42]
+	_ = x[Ident-43]
+	_ = x[Comment-44]
+	_ = x[Func-45]
+	_ = x[Let-46]
+	_ = x[Template-47]
+	_ = x[If-48]
+	_ = x[Then-49]
+	_ = x[Else-50]
+	_ = x[Public-51]
+	_ = x[Unit-52]
+	_ = x[Type-53]
+	_ = x[In-54]
+	_ = x[Match-55]
+	_ = x[Where-56]
+	_ = x[EndOfInput-57]
 }
 
-const _TokenType_name = "UnspecifiedNilBoolLiteralIntLiteralDoubleLiteralStrLiteralFormatStrLiteralPlusMinusTimesDivModuloEqualNotEqualLessThanLessEqGreaterThanGreaterEqLogicalAndLogicalOrBitwiseAndBitwiseOrBitwiseXorShiftLeftShiftRightDotNotComplementMergeCommaLeftParenRightParenLeftBraceRightBraceLeftSquareRightSquareColonOfTypeIdentFuncLetTemplateIfThenElsePublicUnitTypeEndOfInput"
+const _TokenType_name = "UnspecifiedNilBoolLiteralIntLiteralDoubleLiteralStrLiteralFormatStrLiteralPlusMinusTimesDivModuloEqualNotEqualLessThanLessEqGreaterThanGreaterEqLogicalAndLogicalOrBitwiseAndBitwiseOrBitwiseXorShiftLeftShiftRightDotNotComplementMergePipeCommaLeftParenRightParenLeftBraceRightBraceLeftSquareRightSquareColonOfTypeEllipsisArrowThinArrowQuestionIdentCommentFuncLetTemplateIfThenElsePublicUnitTypeInMatchWhereEndOfInput"
 
-var _TokenType_index = [...]uint16{0, 11, 14, 25, 35, 48, 58, 74, 78, 83, 88, 91, 97, 102, 110, 118, 124, 135, 144, 154, 163, 173, 182, 192, 201, 211, 214, 217, 227, 232, 237, 246, 256, 265, 275, 285, 296, 301, 307, 312, 316, 319, 327, 329, 333, 337, 343, 347, 351, 361}
+var _TokenType_index = [...]uint16{0, 11, 14, 25, 35, 48, 58, 74, 78, 83, 88, 91, 97, 102, 110, 118, 124, 135, 144, 154, 163, 173, 182, 192, 201, 211, 214, 217, 227, 232, 236, 241, 250, 260, 269, 279, 289, 300, 305, 311, 319, 324, 333, 341, 346, 353, 357, 360, 368, 370, 374, 378, 384, 388, 392, 394, 399, 404, 414}
 
 func (i TokenType) String() string {
 	if i < 0 || i >= TokenType(len(_TokenType_index)-1) {
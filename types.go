@@ -3,6 +3,7 @@ package gokonfi
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dnswlt/gokonfi/token"
@@ -14,12 +15,20 @@ type Typ struct {
 	Encode    CallableVal        // (Self) -> Val
 	Validate  CallableVal        // (Self) -> bool
 	UnitMults map[string]float64 // Non-nil only for unit types.
+	RecFields map[string]*Typ    // Non-nil only for record types.
+	Base      *Typ               // Non-nil only for alias types.
+	Optional  *Typ               // Non-nil only for optional types: the type of non-nil values.
+	Union     []*Typ             // Non-nil only for union types: the member types.
 }
 
 func (t *Typ) IsUnit() bool {
 	return len(t.UnitMults) > 0
 }
 
+func (t *Typ) IsRecord() bool {
+	return t.RecFields != nil
+}
+
 func (t *Typ) unitMultiplierName(factor float64) (name string, found bool) {
 	for n, f := range t.UnitMults {
 		if f == factor {
@@ -57,6 +66,64 @@ func NewUnitType(name string, unitMults map[string]float64) *Typ {
 	return t
 }
 
+// NewRecordType returns a new record type. Records of this type must have
+// (at least) the given fields, and each field must have the given type.
+func NewRecordType(name string, fields map[string]*Typ) *Typ {
+	t := &Typ{
+		Id: name,
+	}
+	t.Validate = &NativeFuncVal{
+		Name: name + ".Validate",
+		F: func(args []Val, ctx *Ctx) (Val, error) {
+			return builtinRecordTypeValidate(t, args, ctx)
+		},
+		Arity: 1,
+	}
+	// Copy fields so callers don't accidentally modify them.
+	fs := make(map[string]*Typ)
+	for k, v := range fields {
+		fs[k] = v
+	}
+	t.RecFields = fs
+	return t
+}
+
+// NewAliasType returns a new alias type of the base type. Values of an alias type
+// are values of its base type. If where is not nil, they must also satisfy the
+// predicate where.
+func NewAliasType(name string, base *Typ, where CallableVal) *Typ {
+	return &Typ{
+		Id:       name,
+		Validate: where,
+		Base:     base,
+	}
+}
+
+// NewOptionalType returns a new type whose values are either nil or values of type t.
+func NewOptionalType(t *Typ) *Typ {
+	return &Typ{
+		Id:       t.Id + "?",
+		Optional: t,
+	}
+}
+
+// NewUnionType returns a new type whose values are values of any of the given member types.
+func NewUnionType(name string, members []*Typ) *Typ {
+	return &Typ{
+		Id:    name,
+		Union: members,
+	}
+}
+
+// unitMultiple returns the multiple of the unit type t named by the annotation ta,
+// or 0 if t is not a unit type or ta names the unit type itself.
+func unitMultiple(t *Typ, ta TypeAnnotation) float64 {
+	if ot, ok := ta.(*OptionalType); ok && t.Optional != nil {
+		return unitMultiple(t.Optional, ot.Elem)
+	}
+	return t.UnitMults[ta.TypeId()]
+}
+
 var (
 	// Predefine built-in types. Type comparisons generally use pointer equality (==), so don't duplicate these types.
 	builtinTypeBool       = &Typ{Id: "bool"}
@@ -77,7 +144,14 @@ var (
 		"hours":   1000 * 1000 * 1000 * 60 * 60,
 		"days":    1000 * 1000 * 1000 * 60 * 60 * 24,
 	})
+	// Percentages are stored as fractions, so 80::percent can be used as 0.8 in computations
+	// by converting it to a fraction: (80::percent)::fraction.
+	builtinTypePercent = NewUnitType("percent", map[string]float64{
+		"fraction": 1,
+		"percent":  0.01,
+	})
 	builtinTypeTime = makeBuiltinTypeTime()
+	builtinTypePort = makeBuiltinTypePort()
 
 	// This slice contains all predefined (builtin) types. Add new types here to make them
 	// available in konfi.
@@ -92,7 +166,9 @@ var (
 		builtinTypeNativeFunc,
 		builtinTypeFuncExpr,
 		builtinTypeDuration,
+		builtinTypePercent,
 		builtinTypeTime,
+		builtinTypePort,
 	}
 )
 
@@ -121,18 +197,9 @@ func makeBuiltinTypeTime() *Typ {
 				if a.T != t {
 					break
 				}
-				r := a.V.(*RecVal)
-				intf := func(f string) int {
-					i, ok := r.Fields[f].(IntVal)
-					if !ok {
-						return 0
-					}
-					return int(i)
-				}
-				loc := time.FixedZone("A51", intf("offset"))
-				tm := time.Date(intf("year"), time.Month(intf("month")), intf("day"),
-					intf("hour"), intf("minute"), intf("second"), intf("nanosecond"), loc)
-				return StringVal(tm.Format("2006-01-02T15:04:05Z07:00")), nil
+				tm := goTime(a.V.(*RecVal))
+				// Use nanosecond precision, so that encoded times can be converted back losslessly.
+				return StringVal(tm.Format(time.RFC3339Nano)), nil
 			}
 			return nil, fmt.Errorf("time.Encode: invalid argument type %s", args[0].Typ().Id)
 		},
@@ -141,6 +208,96 @@ func makeBuiltinTypeTime() *Typ {
 	return t
 }
 
+// timeRec returns the record representation of tm used by values of the time type.
+func timeRec(tm time.Time) *RecVal {
+	r := NewRec()
+	r.setField("year", IntVal(tm.Year()), nil)
+	r.setField("month", IntVal(tm.Month()), nil)
+	r.setField("day", IntVal(tm.Day()), nil)
+	r.setField("hour", IntVal(tm.Hour()), nil)
+	r.setField("minute", IntVal(tm.Minute()), nil)
+	r.setField("second", IntVal(tm.Second()), nil)
+	r.setField("nanosecond", IntVal(tm.Nanosecond()), nil)
+	_, offset := tm.Zone()
+	r.setField("offset", IntVal(offset), nil)
+	return r
+}
+
+// goTime is the inverse of timeRec. Missing or non-int fields are treated as 0.
+func goTime(r *RecVal) time.Time {
+	intf := func(f string) int {
+		i, ok := r.Fields[f].(IntVal)
+		if !ok {
+			return 0
+		}
+		return int(i)
+	}
+	// Times only store their offset, not their zone name. The unnamed zone
+	// formats as a numeric offset (e.g. "+0200") in layouts that ask for a name.
+	loc := time.UTC
+	if offset := intf("offset"); offset != 0 {
+		loc = time.FixedZone("", offset)
+	}
+	return time.Date(intf("year"), time.Month(intf("month")), intf("day"),
+		intf("hour"), intf("minute"), intf("second"), intf("nanosecond"), loc)
+}
+
+// makeBuiltinTypePort returns the type of TCP/UDP port numbers, i.e. ints between 0 and 65535.
+func makeBuiltinTypePort() *Typ {
+	t := &Typ{Id: "port"}
+	t.Convert = &NativeFuncVal{
+		Name: "port.Convert",
+		F: func(args []Val, ctx *Ctx) (Val, error) {
+			switch a := args[1].(type) {
+			case IntVal:
+				return TypedVal{V: a, T: t}, nil
+			case StringVal:
+				i, err := strconv.ParseInt(string(a), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("port.Convert: cannot convert string %q to port", string(a))
+				}
+				return TypedVal{V: IntVal(i), T: t}, nil
+			case TypedVal:
+				if a.T == t {
+					return a, nil
+				}
+			}
+			return nil, fmt.Errorf("port.Convert: invalid argument type %s", args[1].Typ().Id)
+		},
+		Arity: 2,
+	}
+	t.Validate = &NativeFuncVal{
+		Name: "port.Validate",
+		F: func(args []Val, ctx *Ctx) (Val, error) {
+			if a, ok := args[0].(TypedVal); ok && a.T == t {
+				if i, ok := a.V.(IntVal); ok {
+					return BoolVal(i >= 0 && i <= 65535), nil
+				}
+			}
+			return nil, fmt.Errorf("port.Validate: invalid argument type %s", args[0].Typ().Id)
+		},
+		Arity: 1,
+	}
+	return t
+}
+
+// UnitEncoding determines how UnitVals are represented in encoded output.
+// It is set per call in the options of the encoding functions, e.g. JsonOptions.
+type UnitEncoding int
+
+const (
+	// UnitEncodingValue encodes a UnitVal as a number in its unit multiple,
+	// e.g. 7::minutes is encoded as 7.
+	UnitEncodingValue UnitEncoding = iota
+	// UnitEncodingString encodes a UnitVal as a string including its unit multiple,
+	// e.g. 7::minutes is encoded as "7::minutes". Such strings can be converted back
+	// to the unit type, e.g. "7::minutes"::duration.
+	UnitEncodingString
+	// UnitEncodingBase encodes a UnitVal as a number in the base unit of its type
+	// (the unit with multiple 1), e.g. 80::percent is encoded as 0.8.
+	UnitEncodingBase
+)
+
 func builtinUnitTypeConvert(typ *Typ, args []Val, _ *Ctx) (Val, error) {
 	if len(args) != 2 {
 		return nil, fmt.Errorf("%s.Convert: want 2 arguments, got %d", typ.Id, len(args))
@@ -149,8 +306,22 @@ func builtinUnitTypeConvert(typ *Typ, args []Val, _ *Ctx) (Val, error) {
 	if !ok {
 		return nil, fmt.Errorf("%s.Convert: want 1st argument as StringVal, got %T", typ.Id, args[0])
 	}
-	f, ok := typ.UnitMults[string(unit)]
-	if !ok {
+	f, isMult := typ.UnitMults[string(unit)]
+	// Conversion to the unit type itself (e.g. x::duration) keeps the multiple,
+	// unless the type has a multiple of the same name (e.g. x::percent).
+	toSelf := string(unit) == typ.Id && !isMult
+	if s, ok := args[1].(StringVal); ok {
+		// Strings like "7::minutes", as produced by UnitEncodingString.
+		u, err := parseUnitVal(typ, string(s))
+		if err != nil {
+			return nil, fmt.Errorf("%s.Convert: %w", typ.Id, err)
+		}
+		args = []Val{unit, u}
+	}
+	if v, ok := args[1].(UnitVal); ok && v.T == typ && toSelf {
+		return v, nil
+	}
+	if !isMult {
 		return nil, fmt.Errorf("%s.Convert: invalid unit %s", typ.Id, unit)
 	}
 	switch v := args[1].(type) {
@@ -181,13 +352,114 @@ func builtinUnitTypeEncode(typ *Typ, args []Val, _ *Ctx) (Val, error) {
 	if uval.TypeId() != typ.Id {
 		return nil, fmt.Errorf("%s.Encode: called on invalid type: %s", typ.Id, uval.TypeId())
 	}
+	// Other unit encodings are handled by the encoders (see UnitVal.encode).
 	return DoubleVal(uval.V), nil
 }
 
+func builtinRecordTypeValidate(typ *Typ, args []Val, ctx *Ctx) (Val, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s.Validate: want 1 argument, got %d", typ.Id, len(args))
+	}
+	tv, ok := args[0].(TypedVal)
+	if !ok || tv.T != typ {
+		return nil, fmt.Errorf("%s.Validate: called on invalid type: %s", typ.Id, args[0].Typ().Id)
+	}
+	r, ok := tv.V.(*RecVal)
+	if !ok {
+		return nil, fmt.Errorf("%s.Validate: want record value, got %s", typ.Id, tv.V.Typ().Id)
+	}
+	if err := checkRecFields(r, typ, ctx); err != nil {
+		return nil, err
+	}
+	return BoolVal(true), nil
+}
+
+// checkRecFields checks that r has all fields of record type t with the right types.
+// Fields of t that are themselves record types are checked structurally if the
+// corresponding field of r is an untyped record.
+func checkRecFields(r *RecVal, t *Typ, ctx *Ctx) error {
+	for _, f := range sortedKeys(t.RecFields) {
+		v, ok := r.Fields[f]
+		if !ok {
+			return fmt.Errorf("missing field %s", f)
+		}
+		ft := t.RecFields[f]
+		if rv, ok := v.(*RecVal); ok && ft.IsRecord() {
+			if err := checkRecFields(rv, ft, ctx); err != nil {
+				return fmt.Errorf("field %s: %w", f, err)
+			}
+			continue
+		}
+		if err := typeCheck(v, ft, ctx); err != nil {
+			return fmt.Errorf("field %s: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// validate calls t's Validate function, if it has one, on val.
+func validate(val Val, t *Typ, ctx *Ctx) error {
+	if t.Validate == nil {
+		return nil
+	}
+	ok, err := t.Validate.Call([]Val{val}, ctx)
+	if err != nil {
+		return err
+	}
+	if !ok.Bool() {
+		return fmt.Errorf("validation failed for type %s", t.Id)
+	}
+	return nil
+}
+
+// parseUnitVal parses strings of the form "<number>::<multiple>", e.g. "7::minutes",
+// into a UnitVal of the given type.
+func parseUnitVal(typ *Typ, s string) (UnitVal, error) {
+	num, name, found := strings.Cut(s, "::")
+	if !found {
+		return UnitVal{}, fmt.Errorf("invalid unit value %q", s)
+	}
+	f, ok := typ.UnitMults[strings.TrimSpace(name)]
+	if !ok {
+		return UnitVal{}, fmt.Errorf("invalid unit in %q", s)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil {
+		return UnitVal{}, fmt.Errorf("invalid number in %q", s)
+	}
+	return UnitVal{V: v, F: f, T: typ}, nil
+}
+
 func convertType(val Val, typeName string, ctx *Ctx, pos token.Pos) (Val, error) {
 	typ := ctx.LookupType(typeName)
 	if typ == nil {
-		return nil, &EvalError{pos: pos, msg: fmt.Sprintf("unknown type: %s", typeName)}
+		return nil, &EvalError{pos: pos, kind: KindUnknownType, msg: fmt.Sprintf("unknown type: %s", typeName)}
+	}
+	v, err := convertToType(val, typ, typeName, ctx, pos)
+	if err != nil {
+		return nil, err
+	}
+	// Converted values must satisfy the type's invariants, if it has any.
+	if err := validate(v, typ, ctx); err != nil {
+		return nil, &EvalError{pos: pos, kind: KindTypeError, msg: fmt.Sprintf("invalid value for type %s: %s", typ.Id, err)}
+	}
+	return v, nil
+}
+
+func convertToType(val Val, typ *Typ, typeName string, ctx *Ctx, pos token.Pos) (Val, error) {
+	if typ.Base != nil {
+		// Alias types convert to their base type, which must validate as usual.
+		v, err := convertToType(val, typ.Base, typ.Base.Id, ctx, pos)
+		if err != nil {
+			return nil, err
+		}
+		if err := validate(v, typ.Base, ctx); err != nil {
+			return nil, &EvalError{pos: pos, kind: KindTypeError, msg: fmt.Sprintf("invalid value for type %s: %s", typ.Base.Id, err)}
+		}
+		return v, nil
+	}
+	if typ.IsRecord() {
+		return convertRecordType(val, typ, ctx, pos)
 	}
 	if typ.Convert != nil {
 		// Types with custom conversion functions convert themselves:
@@ -239,13 +511,13 @@ func convertType(val Val, typeName string, ctx *Ctx, pos token.Pos) (Val, error)
 		case builtinTypeInt:
 			i, err := strconv.ParseInt(string(v), 10, 64)
 			if err != nil {
-				return nil, &EvalError{pos: pos, msg: fmt.Sprintf("cannot convert string %q to int", string(v))}
+				return nil, &EvalError{pos: pos, kind: KindTypeError, msg: fmt.Sprintf("cannot convert string %q to int", string(v))}
 			}
 			return IntVal(i), nil
 		case builtinTypeDouble:
 			d, err := strconv.ParseFloat(string(v), 64)
 			if err != nil {
-				return nil, &EvalError{pos: pos, msg: fmt.Sprintf("cannot convert string %q to double", string(v))}
+				return nil, &EvalError{pos: pos, kind: KindTypeError, msg: fmt.Sprintf("cannot convert string %q to double", string(v))}
 			}
 			return DoubleVal(d), nil
 		case builtinTypeString:
@@ -261,16 +533,51 @@ func convertType(val Val, typeName string, ctx *Ctx, pos token.Pos) (Val, error)
 			return DoubleVal(v.V), nil
 		}
 	}
-	return nil, &EvalError{pos: pos, msg: fmt.Sprintf("cannot convert value of type %T to %s", val, typ.Id)}
+	return nil, &EvalError{pos: pos, kind: KindTypeError, msg: fmt.Sprintf("cannot convert value of type %T to %s", val, typ.Id)}
 }
 
-func typeCheck(val Val, t *Typ) error {
+// convertRecordType converts an untyped record to the record type typ.
+// The caller is responsible for validating that it has all fields required by typ.
+func convertRecordType(val Val, typ *Typ, ctx *Ctx, pos token.Pos) (Val, error) {
+	switch v := val.(type) {
+	case TypedVal:
+		if v.T == typ {
+			return v, nil
+		}
+	case *RecVal:
+		return TypedVal{V: v, T: typ}, nil
+	}
+	return nil, &EvalError{pos: pos, kind: KindTypeError, msg: fmt.Sprintf("cannot convert value of type %s to %s", val.Typ().Id, typ.Id)}
+}
+
+func typeCheck(val Val, t *Typ, ctx *Ctx) error {
 	if t == nil {
 		// Type check against no type succeeds.
 		return nil
 	}
 	if t == val.Typ() {
-		return nil
+		return validate(val, t, ctx)
+	}
+	if t.Optional != nil {
+		if _, ok := val.(NilVal); ok {
+			return nil
+		}
+		return typeCheck(val, t.Optional, ctx)
+	}
+	if t.Union != nil {
+		for _, m := range t.Union {
+			if typeCheck(val, m, ctx) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("incompatible types: %s <> %s", val.Typ().Id, t.Id)
+	}
+	if t.Base != nil {
+		// Values of alias types are values of their base type.
+		if err := typeCheck(val, t.Base, ctx); err != nil {
+			return err
+		}
+		return validate(val, t, ctx)
 	}
 	return fmt.Errorf("incompatible types: %s <> %s", val.Typ().Id, t.Id)
 }